@@ -20,10 +20,12 @@ var deleteCmd = &cobra.Command{
 
 		dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
 		if err != nil {
-			return fmt.Errorf("failed to connect to dagger: %w", err)
+			return fmt.Errorf("failed to connect to dagger: %w: %w", environment.ErrEngineUnavailable, err)
 		}
 		defer dag.Close()
-		environment.Initialize(dag)
+		if err := environment.Initialize(ctx, dag); err != nil {
+			return err
+		}
 
 		env := environment.Get(envName)
 		if env == nil {
@@ -45,11 +45,13 @@ var (
 			dag, err = dagger.Connect(ctx, dagger.WithLogOutput(logWriter))
 			if err != nil {
 				slog.Error("Error starting dagger", "error", err)
-				os.Exit(1)
+				return fmt.Errorf("%w: %w", environment.ErrEngineUnavailable, err)
 			}
 			defer dag.Close()
 
-			environment.Initialize(dag)
+			if err := environment.Initialize(ctx, dag); err != nil {
+				return err
+			}
 			return mcpserver.RunStdioServer(ctx)
 		},
 	}
@@ -84,6 +86,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	environment.SetToolVersion(version)
+
 	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
@@ -37,10 +37,12 @@ var terminalCmd = &cobra.Command{
 		dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
 		if err != nil {
 			slog.Error("Error starting dagger", "error", err)
-			os.Exit(1)
+			return fmt.Errorf("%w: %w", environment.ErrEngineUnavailable, err)
 		}
 		defer dag.Close()
-		environment.Initialize(dag)
+		if err := environment.Initialize(ctx, dag); err != nil {
+			return err
+		}
 
 		env, err := environment.Open(ctx, "opening terminal", ".", args[0])
 		if err != nil {
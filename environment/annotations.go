@@ -0,0 +1,40 @@
+package environment
+
+import (
+	"context"
+	"maps"
+)
+
+// Annotate sets an environment-level annotation, e.g. the id of the last agent
+// session or the number of the associated pull request. An empty value removes
+// the annotation.
+//
+// Annotations don't affect the build. They are recorded on the revisions
+// created from then on, so they are persisted and restored along with the
+// history; revisions already recorded are left as they were. History exports
+// carry the current annotations, recorded on a revision or not.
+func (env *Environment) Annotate(ctx context.Context, key, value string) {
+	env.mu.Lock()
+	if value == "" {
+		delete(env.annotations, key)
+	} else {
+		if env.annotations == nil {
+			env.annotations = map[string]string{}
+		}
+		env.annotations[key] = value
+	}
+	env.mu.Unlock()
+	env.audit(ctx, "annotate", key)
+}
+
+// Annotations returns a copy of the annotations of the environment.
+func (env *Environment) Annotations() map[string]string {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	annotations := maps.Clone(env.annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	return annotations
+}
@@ -0,0 +1,73 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"testing"
+)
+
+func TestAnnotationsApplyToFutureRevisions(t *testing.T) {
+	env := &Environment{}
+	env.mu.Lock()
+	before := env.appendRevision(nil, "before", "", "", nil, "")
+	env.mu.Unlock()
+
+	env.Annotate(context.Background(), "pr", "42")
+	env.Annotate(context.Background(), "session", "abc")
+	if len(before.Annotations) != 0 {
+		t.Errorf("Annotate() rewrote an existing revision: %v", before.Annotations)
+	}
+
+	env.mu.Lock()
+	after := env.appendRevision(nil, "after", "", "", nil, "")
+	env.mu.Unlock()
+	want := map[string]string{"pr": "42", "session": "abc"}
+	if !maps.Equal(after.Annotations, want) {
+		t.Errorf("new revision annotations = %v, want %v", after.Annotations, want)
+	}
+
+	env.Annotate(context.Background(), "session", "")
+	env.Annotate(context.Background(), "pr", "43")
+	if !maps.Equal(after.Annotations, want) {
+		t.Errorf("Annotate() rewrote a recorded revision: %v", after.Annotations)
+	}
+	if got := env.Annotations(); !maps.Equal(got, map[string]string{"pr": "43"}) {
+		t.Errorf("Annotations() = %v", got)
+	}
+
+	// The returned map is a copy.
+	env.Annotations()["pr"] = "mutated"
+	if env.Annotations()["pr"] != "43" {
+		t.Error("Annotations() returned the live map")
+	}
+}
+
+func TestAnnotationsSurviveHistoryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := &Environment{Config: DefaultConfig()}
+	src.mu.Lock()
+	src.appendRevision(nil, "create", "", "", nil, "")
+	src.mu.Unlock()
+	// Not recorded on any revision yet.
+	src.Annotate(ctx, "pr", "42")
+
+	var archive bytes.Buffer
+	if err := src.ExportHistory(&archive); err != nil {
+		t.Fatal(err)
+	}
+	dst := &Environment{Config: DefaultConfig()}
+	if err := dst.ImportHistory(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"pr": "42"}
+	if got := dst.Annotations(); !maps.Equal(got, want) {
+		t.Errorf("annotations after a round trip = %v, want %v", got, want)
+	}
+	dst.mu.Lock()
+	next := dst.appendRevision(nil, "next", "", "", nil, "")
+	dst.mu.Unlock()
+	if !maps.Equal(next.Annotations, want) {
+		t.Errorf("next revision annotations = %v, want %v", next.Annotations, want)
+	}
+}
@@ -0,0 +1,101 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a single mutating operation. Summary never contains
+// values of environment variables or secrets.
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	EnvironmentID string    `json:"environment_id"`
+	Action        string    `json:"action"`
+	Actor         string    `json:"actor,omitempty"`
+	Summary       string    `json:"summary,omitempty"`
+}
+
+type AuditLogger interface {
+	Log(entry AuditEntry)
+}
+
+var (
+	auditMu     sync.RWMutex
+	auditLogger AuditLogger
+)
+
+// SetAuditLogger sets the logger receiving an entry for every mutating
+// operation. A nil logger disables auditing.
+func SetAuditLogger(logger AuditLogger) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditLogger = logger
+}
+
+type actorKey struct{}
+
+// WithActor returns a context attributing the operations it is used for to
+// actor in the audit log.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+func (env *Environment) audit(ctx context.Context, action, summary string) {
+	auditMu.RLock()
+	logger := auditLogger
+	auditMu.RUnlock()
+	if logger == nil {
+		return
+	}
+
+	logger.Log(AuditEntry{
+		Time:          time.Now(),
+		EnvironmentID: env.ID,
+		Action:        action,
+		Actor:         ActorFromContext(ctx),
+		Summary:       summary,
+	})
+}
+
+// JSONAuditLogger writes audit entries as JSON lines. Every line carries the
+// hash of the previous one, so editing or removing a line breaks the chain.
+type JSONAuditLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	prev string
+}
+
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{w: w}
+}
+
+func (l *JSONAuditLogger) Log(entry AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line, err := json.Marshal(struct {
+		AuditEntry
+		PrevHash string `json:"prev_hash"`
+	}{entry, l.prev})
+	if err != nil {
+		slog.Error("failed to encode audit entry", "err", err)
+		return
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write audit entry", "err", err)
+		return
+	}
+	sum := sha256.Sum256(line)
+	l.prev = hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,167 @@
+package environment
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+// recordingAuditLogger keeps the entries it's given.
+type recordingAuditLogger struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (l *recordingAuditLogger) Log(entry AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func (l *recordingAuditLogger) Entries() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditEntry(nil), l.entries...)
+}
+
+func setTestAuditLogger(t *testing.T) *recordingAuditLogger {
+	logger := &recordingAuditLogger{}
+	SetAuditLogger(logger)
+	t.Cleanup(func() { SetAuditLogger(nil) })
+	return logger
+}
+
+func TestAudit(t *testing.T) {
+	logger := setTestAuditLogger(t)
+	env := &Environment{ID: "audited"}
+
+	env.audit(WithActor(context.Background(), "agent-1"), "run", "make test")
+	env.audit(context.Background(), "close", "")
+
+	entries := logger.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("%d audit entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.EnvironmentID != "audited" || e.Action != "run" || e.Actor != "agent-1" || e.Summary != "make test" || e.Time.IsZero() {
+		t.Errorf("first entry = %+v", e)
+	}
+	if e := entries[1]; e.Actor != "" {
+		t.Errorf("entry without an actor = %+v", e)
+	}
+}
+
+func TestJSONAuditLoggerChain(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONAuditLogger(&buf)
+	for _, action := range []string{"create", "run", "set_env"} {
+		logger.Log(AuditEntry{EnvironmentID: "chained", Action: action})
+	}
+
+	prev := ""
+	scanner := bufio.NewScanner(&buf)
+	lines := 0
+	for scanner.Scan() {
+		var entry struct {
+			Action   string `json:"action"`
+			PrevHash string `json:"prev_hash"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.PrevHash != prev {
+			t.Errorf("%s: prev_hash = %q, want %q", entry.Action, entry.PrevHash, prev)
+		}
+		sum := sha256.Sum256(scanner.Bytes())
+		prev = hex.EncodeToString(sum[:])
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("%d lines, want 3", lines)
+	}
+}
+
+func TestAuditSetEnvOmitsValues(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	logger := setTestAuditLogger(t)
+
+	if err := env.SetEnv(context.Background(), "set", []string{"API_TOKEN=hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range logger.Entries() {
+		if strings.Contains(entry.Summary, "hunter2") {
+			t.Errorf("audit entry leaks a value: %+v", entry)
+		}
+	}
+}
+
+func TestAuditRunOmitsValues(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	logger := setTestAuditLogger(t)
+
+	if _, err := env.Run(context.Background(), "run", "API_TOKEN=hunter2 env", "", false); err != nil {
+		t.Fatal(err)
+	}
+	entries := logger.Entries()
+	if len(entries) == 0 {
+		t.Fatal("Run() wrote no audit entry")
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Summary, "hunter2") {
+			t.Errorf("audit entry leaks a value: %+v", entry)
+		}
+	}
+}
+
+func TestAuditMutations(t *testing.T) {
+	ctx := WithActor(context.Background(), "agent-1")
+	env := &Environment{ID: "audit/mutations", Name: "audit", Config: DefaultConfig()}
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", &dagger.Container{}, "")
+	env.mu.Unlock()
+	var archive bytes.Buffer
+	if err := env.ExportHistory(&archive); err != nil {
+		t.Fatal(err)
+	}
+	logger := setTestAuditLogger(t)
+
+	env.Annotate(ctx, "ticket", "42")
+	env.SetInstructions(ctx, "Fix the build.")
+	if err := env.ImportHistory(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Freeze(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.Thaw(ctx)
+	mirror, err := env.Mirror(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterEnvironment(mirror.ID) })
+
+	want := []AuditEntry{
+		{Action: "annotate", Summary: "ticket"},
+		{Action: "set_instructions"},
+		{Action: "import_history", Summary: "1 revisions"},
+		{Action: "freeze"},
+		{Action: "thaw"},
+		{Action: "mirror", Summary: mirror.ID},
+	}
+	entries := logger.Entries()
+	if len(entries) != len(want) {
+		t.Fatalf("audit entries = %+v, want %d", entries, len(want))
+	}
+	for i, entry := range entries {
+		if entry.Action != want[i].Action || entry.Summary != want[i].Summary || entry.Actor != "agent-1" || entry.EnvironmentID != env.ID {
+			t.Errorf("entry %d = %+v, want %s %q", i, entry, want[i].Action, want[i].Summary)
+		}
+	}
+}
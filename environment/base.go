@@ -0,0 +1,160 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// baseFields are the config fields a child environment must share with its
+// base, as they can't be changed without rebuilding from scratch.
+var baseFields = []string{"base_image", "base_build", "workdir_policy", "pull_policy", "ca_certs", "proxy", "setup_layering", "shell", "run_as_user", "packages", "runtime"}
+
+// NewFromBase creates an ephemeral environment that starts from the built
+// state of baseEnv instead of building cfg from scratch. Only what cfg adds on
+// top of the base config is applied: extra setup commands, env, secrets, files
+// and services. The base is left untouched.
+func NewFromBase(ctx context.Context, baseEnv *Environment, cfg *EnvironmentConfig) (_ *Environment, rerr error) {
+	baseEnv.mu.Lock()
+	root := baseEnv.History.Root()
+	baseConfig := baseEnv.Config.Copy()
+	baseImage := baseEnv.baseImage
+	baseEnv.mu.Unlock()
+	if root == nil || root.container == nil {
+		return nil, fmt.Errorf("base environment %s has not been built", baseEnv.ID)
+	}
+
+	if cfg == nil {
+		cfg = baseConfig.Copy()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	setupCommands, err := deltaFromBase(baseConfig, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Environment{
+		ID:        NewEnvironmentID(baseEnv.Name),
+		Name:      baseEnv.Name,
+		Source:    baseEnv.Source,
+		Config:    cfg,
+		Ephemeral: true,
+		profiles:  baseEnv.Profiles(),
+		baseImage: baseImage,
+	}
+	defer releaseIDOnError(env.ID, &rerr)
+
+	container := root.container.WithWorkdir(cfg.Workdir)
+	container, err = containerWithEnvAndSecrets(container, cfg.Env, cfg.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	container, err = env.withFiles(container)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ScratchDir != "" {
+		container = container.WithMountedCache(cfg.ScratchDir, dag.CacheVolume("container-use-scratch-"+env.ID))
+	}
+	container, err = env.runSetupCommands(ctx, env.withSetupUser(container), setupCommands)
+	if err != nil {
+		return nil, err
+	}
+	container = env.withRunAsUser(container)
+	if err := env.checkRequiredTools(ctx, container); err != nil {
+		return nil, err
+	}
+	container, err = env.withServices(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	defer env.abortBuildOnError(ctx, &rerr)
+
+	slog.Info("Creating environment from base", "id", env.ID, "base", baseEnv.ID)
+
+	if err := env.apply(ctx, "Create from "+baseEnv.ID, "Create the environment from a base environment", "", container); err != nil {
+		return nil, err
+	}
+	env.audit(ctx, "create", "from base "+baseEnv.ID)
+	registerEnvironment(env)
+
+	return env, nil
+}
+
+// deltaFromBase checks that cfg only adds to baseConfig and returns the setup
+// commands that remain to be run.
+func deltaFromBase(baseConfig, cfg *EnvironmentConfig) ([]string, error) {
+	for _, change := range DiffConfigs(baseConfig, cfg).Changes {
+		if slices.Contains(baseFields, change.Field) {
+			return nil, fmt.Errorf("%s differs from the base environment", change.Field)
+		}
+		if change.New == "" && (strings.HasPrefix(change.Field, "env.") || strings.HasPrefix(change.Field, "secrets.")) {
+			return nil, fmt.Errorf("%s of the base environment can't be removed", change.Field)
+		}
+	}
+
+	n := len(baseConfig.SetupCommands)
+	if len(cfg.SetupCommands) < n || !slices.Equal(baseConfig.SetupCommands, cfg.SetupCommands[:n]) {
+		return nil, errors.New("setup commands must start with the setup commands of the base environment")
+	}
+	return cfg.SetupCommands[n:], nil
+}
+
+// Spawn creates n ephemeral environments from the root revision of env. They
+// share its built base (image and setup) and start with the workdir as it was
+// when env was created, but each gets its own history: changes made in one
+// never show up in env or in the others.
+//
+// Services are the exception: they are bound to the base, and dagger can't
+// unbind them to start new ones, so every spawn would talk to the same live
+// services. Environments running services can't be spawned.
+func (env *Environment) Spawn(ctx context.Context, n int) (_ []*Environment, rerr error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of environments to spawn: %d", n)
+	}
+	env.mu.Lock()
+	root := env.History.Root()
+	config := env.Config.Copy()
+	profiles := env.profiles
+	baseImage := env.baseImage
+	env.mu.Unlock()
+	if root == nil || root.container == nil {
+		return nil, fmt.Errorf("environment %s has not been built", env.ID)
+	}
+	if len(config.Services.Active(profiles...)) > 0 {
+		return nil, fmt.Errorf("environment %s runs services, which spawns would share", env.ID)
+	}
+
+	spawns := make([]*Environment, 0, n)
+	defer func() {
+		if rerr != nil {
+			for _, spawn := range spawns {
+				unregisterEnvironment(spawn.ID)
+			}
+		}
+	}()
+	for range n {
+		spawn := &Environment{
+			ID:        NewEnvironmentID(env.Name),
+			Name:      env.Name,
+			Source:    env.Source,
+			Config:    config.Copy(),
+			Ephemeral: true,
+			profiles:  slices.Clone(profiles),
+			baseImage: baseImage,
+		}
+		if err := spawn.apply(ctx, "Spawn from "+env.ID, "Spawn from a shared base", "", root.container); err != nil {
+			releaseEnvironmentID(spawn.ID)
+			return nil, fmt.Errorf("failed to spawn from %s: %w", env.ID, err)
+		}
+		registerEnvironment(spawn)
+		spawns = append(spawns, spawn)
+	}
+	env.audit(ctx, "spawn", fmt.Sprintf("%d environments", n))
+	return spawns, nil
+}
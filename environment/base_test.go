@@ -0,0 +1,130 @@
+package environment
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestDeltaFromBase(t *testing.T) {
+	base := DefaultConfig()
+	base.Env = []string{"GOFLAGS=-mod=mod"}
+	base.SetupCommands = []string{"apt-get update", "apt-get install -y git"}
+
+	child := base.Copy()
+	child.Env = []string{"GOFLAGS=-mod=mod", "CGO_ENABLED=0"}
+	child.SetupCommands = []string{"apt-get update", "apt-get install -y git", "go mod download"}
+	commands, err := deltaFromBase(base, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(commands, []string{"go mod download"}) {
+		t.Errorf("deltaFromBase() = %q, want the extra command", commands)
+	}
+
+	for name, mutate := range map[string]func(*EnvironmentConfig){
+		"base image":      func(c *EnvironmentConfig) { c.BaseImage = "debian:12" },
+		"removed env":     func(c *EnvironmentConfig) { c.Env = nil },
+		"edited setup":    func(c *EnvironmentConfig) { c.SetupCommands = []string{"apt-get update", "apt-get install -y curl"} },
+		"dropped setup":   func(c *EnvironmentConfig) { c.SetupCommands = c.SetupCommands[:1] },
+		"reordered setup": func(c *EnvironmentConfig) { c.SetupCommands = []string{"apt-get install -y git", "apt-get update"} },
+	} {
+		child := base.Copy()
+		mutate(child)
+		if _, err := deltaFromBase(base, child); err == nil {
+			t.Errorf("deltaFromBase() accepted a child with a changed %s", name)
+		}
+	}
+}
+
+func TestNewFromBase(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupCommands = []string{"echo base > /base"}
+	base := newEngineEnvironment(t, config)
+
+	child := config.Copy()
+	child.Env = []string{"CHILD=1"}
+	child.SetupCommands = []string{"echo base > /base", "echo child > /child"}
+	env, err := NewFromBase(ctx, base, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = env.Close(context.Background()) })
+
+	out, err := env.Run(ctx, "check", "cat /base /child; echo $CHILD", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "base\nchild\n1"; strings.TrimSpace(out) != want {
+		t.Errorf("child environment = %q, want %q", out, want)
+	}
+	if out, _ := base.Run(ctx, "check", "if test -e /child; then echo leaked; fi", "", false); out != "" {
+		t.Error("the child setup ran in the base environment")
+	}
+}
+
+func TestSpawnErrors(t *testing.T) {
+	ctx := context.Background()
+	env := &Environment{ID: "spawn/test", Config: DefaultConfig()}
+	if _, err := env.Spawn(ctx, 0); err == nil {
+		t.Error("Spawn(0) succeeded")
+	}
+	if _, err := env.Spawn(ctx, 2); err == nil {
+		t.Error("Spawn() of an unbuilt environment succeeded")
+	}
+
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", &dagger.Container{}, "")
+	env.mu.Unlock()
+	env.Config.Services = ServiceConfigs{{Name: "db", Image: "postgres:16"}}
+	if _, err := env.Spawn(ctx, 2); err == nil || !strings.Contains(err.Error(), "services") {
+		t.Errorf("Spawn() of an environment running services = %v, want it refused", err)
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupCommands = []string{"mkdir -p /workdir && echo base > /workdir/shared"}
+	env := newEngineEnvironment(t, config)
+	// Changes made after the spawned root don't show up in the spawns.
+	if _, err := env.Run(ctx, "after", "echo later > later", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	spawns, err := env.Spawn(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spawn := range spawns {
+		t.Cleanup(func() { _ = spawn.Close(context.Background()) })
+	}
+	if len(spawns) != 3 || spawns[0].ID == spawns[1].ID {
+		t.Fatalf("Spawn() = %v, want 3 distinct environments", spawns)
+	}
+
+	if _, err := spawns[0].Run(ctx, "mutate", "echo first > shared; echo first > own", "", false); err != nil {
+		t.Fatal(err)
+	}
+	for i, spawn := range spawns[1:] {
+		out, err := spawn.Run(ctx, "check", "cat shared; if test -e own || test -e later; then echo leaked; fi", "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(out) != "base" {
+			t.Errorf("spawn %d workdir = %q, want the untouched base", i+1, out)
+		}
+		if got := spawn.History.LatestVersion(); got != 1 {
+			t.Errorf("spawn %d latest version = %d, want its own history", i+1, got)
+		}
+	}
+	if out, _ := env.Run(ctx, "check", "cat shared", "", false); strings.TrimSpace(out) != "base" {
+		t.Errorf("spawned-from workdir = %q, want it untouched by spawns", out)
+	}
+}
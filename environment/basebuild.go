@@ -0,0 +1,78 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// BaseBuild builds the base image of the environment from a Dockerfile
+// instead of pulling a published image.
+type BaseBuild struct {
+	// Context is a host path or a git URL (https:// or git://).
+	Context string `json:"context"`
+	// Dockerfile is the path of the Dockerfile within the context, "Dockerfile"
+	// by default.
+	Dockerfile string `json:"dockerfile,omitempty"`
+}
+
+func (b *BaseBuild) Validate() error {
+	if b.Context == "" {
+		return errors.New("base build context cannot be empty")
+	}
+	if strings.HasPrefix(b.Dockerfile, "/") {
+		return fmt.Errorf("base build dockerfile must be relative to the context: %q", b.Dockerfile)
+	}
+	return nil
+}
+
+var (
+	baseBuildsMu sync.Mutex
+	// baseBuilds caches built base images by the digest of their context and
+	// Dockerfile path, so environments sharing a base don't rebuild it.
+	baseBuilds = map[string]*dagger.Container{}
+)
+
+// buildBaseImage builds the base image of build. It also returns the digest of
+// the build context, which identifies the image in provenance.
+func buildBaseImage(ctx context.Context, build *BaseBuild) (*dagger.Container, string, error) {
+	contextDir := urlToDirectory(build.Context)
+	digest, err := contextDir.Digest(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load base build context %s: %w", build.Context, err)
+	}
+	key := digest + ":" + build.Dockerfile
+
+	baseBuildsMu.Lock()
+	defer baseBuildsMu.Unlock()
+	if container, ok := baseBuilds[key]; ok {
+		return container, digest, nil
+	}
+	if container := loadCachedContainer("base-builds", key); container != nil {
+		if _, err := container.Sync(ctx); err == nil {
+			baseBuilds[key] = container
+			return container, digest, nil
+		}
+	}
+
+	container := contextDir.DockerBuild(dagger.DirectoryDockerBuildOpts{
+		Dockerfile: build.Dockerfile,
+	})
+	id, err := container.ID(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to build base image from %s: %w", build.Context, err)
+	}
+	if _, err := container.Sync(ctx); err != nil {
+		return nil, "", fmt.Errorf("failed to build base image from %s: %w", build.Context, err)
+	}
+	if err := storeCachedContainer("base-builds", key, id); err != nil {
+		slog.Warn("Failed to cache base image", "context", build.Context, "error", err)
+	}
+	baseBuilds[key] = container
+	return container, digest, nil
+}
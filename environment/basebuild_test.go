@@ -0,0 +1,79 @@
+package environment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBaseBuildValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		baseImage string
+		build     *BaseBuild
+		ok        bool
+	}{
+		{"image", "alpine:3.20", nil, true},
+		{"build", "", &BaseBuild{Context: "https://github.com/org/images", Dockerfile: "go/Dockerfile"}, true},
+		{"neither", "", nil, false},
+		{"both", "alpine:3.20", &BaseBuild{Context: "."}, false},
+		{"empty context", "", &BaseBuild{}, false},
+		{"absolute dockerfile", "", &BaseBuild{Context: ".", Dockerfile: "/Dockerfile"}, false},
+	} {
+		config := DefaultConfig()
+		config.BaseImage = tt.baseImage
+		config.BaseBuild = tt.build
+		if err := config.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadBaseBuildReplacesDefaultImage(t *testing.T) {
+	config := DefaultConfig()
+	err := config.load("environment.json", "", mapReader(map[string]string{
+		"environment.json": `{"base_build": {"context": "https://github.com/org/images"}}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "" || config.BaseBuild == nil {
+		t.Fatalf("loaded config = %+v, want only the base build", config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildBaseImage(t *testing.T) {
+	requireEngine(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"images/Dockerfile": "FROM " + alpineImage + "\nRUN echo built > /marker\n",
+	})
+	build := &BaseBuild{Context: dir, Dockerfile: "images/Dockerfile"}
+
+	container, digest, err := buildBaseImage(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest == "" {
+		t.Error("buildBaseImage() returned no digest")
+	}
+	out, err := container.WithExec([]string{"cat", "/marker"}).Stdout(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "built\n" {
+		t.Errorf("/marker = %q", out)
+	}
+
+	// The same context is built once.
+	again, againDigest, err := buildBaseImage(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != container || againDigest != digest {
+		t.Error("buildBaseImage() rebuilt an unchanged context")
+	}
+}
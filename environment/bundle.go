@@ -0,0 +1,42 @@
+package environment
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// configBundleVersion is bumped whenever the bundle layout changes in a way
+// older readers can't understand.
+const configBundleVersion = 1
+
+type configBundle struct {
+	Version      int                `json:"version"`
+	Instructions string             `json:"instructions"`
+	Config       *EnvironmentConfig `json:"config"`
+}
+
+// Bundle returns a single JSON document holding both the config and its
+// instructions, which are otherwise stored in separate files.
+func (config *EnvironmentConfig) Bundle() ([]byte, error) {
+	return json.MarshalIndent(&configBundle{
+		Version:      configBundleVersion,
+		Instructions: config.Instructions,
+		Config:       config,
+	}, "", "  ")
+}
+
+// UnbundleConfig parses a document produced by Bundle.
+func UnbundleConfig(data []byte) (*EnvironmentConfig, error) {
+	var bundle configBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid config bundle: %w", err)
+	}
+	if bundle.Version < 1 || bundle.Version > configBundleVersion {
+		return nil, fmt.Errorf("unsupported config bundle version %d (supported: %d)", bundle.Version, configBundleVersion)
+	}
+	if bundle.Config == nil {
+		return nil, fmt.Errorf("invalid config bundle: missing config")
+	}
+	bundle.Config.Instructions = bundle.Instructions
+	return bundle.Config, nil
+}
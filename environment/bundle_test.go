@@ -0,0 +1,42 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	config := DefaultConfig()
+	config.Instructions = "Run `make test` before committing.\n\nUse \"quotes\" freely."
+	config.SetupCommands = []string{"apk add make"}
+	config.Env = []string{"FOO=bar"}
+	config.Services = ServiceConfigs{{Name: "db", Image: "postgres:16", ExposedPorts: []int{5432}}}
+	config.Ulimits = map[string]Ulimit{"nofile": {Soft: 1024, Hard: 4096}}
+
+	data, err := config.Bundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnbundleConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, config) {
+		t.Errorf("UnbundleConfig(Bundle()) = %+v, want %+v", got, config)
+	}
+}
+
+func TestUnbundleConfigErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"not json":        `config`,
+		"future version":  `{"version": 99, "config": {}}`,
+		"missing version": `{"config": {}}`,
+		"missing config":  `{"version": 1, "instructions": "hi"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := UnbundleConfig([]byte(data)); err == nil {
+				t.Errorf("UnbundleConfig(%s) succeeded", data)
+			}
+		})
+	}
+}
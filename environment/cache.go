@@ -0,0 +1,86 @@
+package environment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+var (
+	cacheDirMu sync.RWMutex
+	cacheDir   string
+)
+
+// SetCacheDir sets the directory holding the container-use build cache. An
+// empty path disables it, which is the default.
+//
+// It covers the caches container-use keeps itself: base images built from a
+// Dockerfile are recorded there by the digest of their context, so a later
+// process reuses them instead of building again. The dagger engine owns its
+// layer cache and the cache volumes mounted in environments (runtime caches,
+// scratch directories), and a client can't choose where they are stored: to
+// persist them across CI jobs, mount the persistent directory as the state
+// directory of the engine (/var/lib/dagger). Cache volume names are unaffected
+// and stay scoped as before (per environment for scratch, shared for
+// runtimes), so they keep matching whatever the engine has stored.
+func SetCacheDir(path string) error {
+	if path != "" {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("cache directory must be an absolute path: %q", path)
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+
+	cacheDirMu.Lock()
+	defer cacheDirMu.Unlock()
+	cacheDir = path
+	return nil
+}
+
+func cachePath(kind, key string) string {
+	cacheDirMu.RLock()
+	defer cacheDirMu.RUnlock()
+	if cacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheDir, kind, hex.EncodeToString(sum[:]))
+}
+
+// loadCachedContainer returns the container stored under key in the cache
+// directory, if any.
+func loadCachedContainer(kind, key string) *dagger.Container {
+	p := cachePath(kind, key)
+	if p == "" {
+		return nil
+	}
+	id, err := os.ReadFile(p)
+	if err != nil || strings.TrimSpace(string(id)) == "" {
+		return nil
+	}
+	return dag.LoadContainerFromID(dagger.ContainerID(strings.TrimSpace(string(id))))
+}
+
+// storeCachedContainer records the container ID under key in the cache
+// directory. It's a no-op when no cache directory is set.
+func storeCachedContainer(kind, key string, id dagger.ContainerID) error {
+	p := cachePath(kind, key)
+	if p == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".tmp", []byte(id), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
@@ -0,0 +1,54 @@
+package environment
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestSetCacheDir(t *testing.T) {
+	t.Cleanup(func() { _ = SetCacheDir("") })
+
+	if err := SetCacheDir("relative/cache"); err == nil {
+		t.Error("SetCacheDir() accepted a relative path")
+	}
+	if p := cachePath("base-builds", "key"); p != "" {
+		t.Errorf("cachePath() without a cache directory = %q", p)
+	}
+	if err := storeCachedContainer("base-builds", "key", "id"); err != nil {
+		t.Errorf("storeCachedContainer() without a cache directory = %v, want a no-op", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "ci", "cache")
+	if err := SetCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("SetCacheDir() didn't create the directory: %v", err)
+	}
+
+	p := cachePath("base-builds", "context digest")
+	if !strings.HasPrefix(p, filepath.Join(dir, "base-builds")+string(filepath.Separator)) {
+		t.Errorf("cachePath() = %q, want it under %s", p, dir)
+	}
+	if p == cachePath("base-builds", "other digest") || p == cachePath("other", "context digest") {
+		t.Error("cachePath() collides for different keys or kinds")
+	}
+
+	if err := storeCachedContainer("base-builds", "context digest", dagger.ContainerID("container-id")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(p); err != nil || string(data) != "container-id" {
+		t.Errorf("cached container = %q, %v, want its ID in the cache directory", data, err)
+	}
+
+	if err := SetCacheDir(""); err != nil {
+		t.Fatal(err)
+	}
+	if loadCachedContainer("base-builds", "context digest") != nil {
+		t.Error("loadCachedContainer() read the cache after disabling it")
+	}
+}
@@ -0,0 +1,45 @@
+package environment
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const caCertsDir = "/usr/local/share/ca-certificates"
+
+// installCACertsScript registers the certificates copied into caCertsDir with
+// the system trust store. Debian/Ubuntu and Alpine (with the ca-certificates
+// package) ship update-ca-certificates; on other images the certificates are
+// appended to the bundle most TLS libraries read by default.
+const installCACertsScript = `if command -v update-ca-certificates >/dev/null 2>&1; then
+	update-ca-certificates
+else
+	mkdir -p /etc/ssl/certs && cat ` + caCertsDir + `/container-use-*.crt >> /etc/ssl/certs/ca-certificates.crt
+fi`
+
+// withCACerts installs the PEM bundles listed in certs into the container
+// trust store. Entries are host paths (optionally prefixed with file://) or
+// secret references (e.g. env://CORP_CA). The scripts run with shell.
+func withCACerts(container *dagger.Container, shell []string, certs []string) *dagger.Container {
+	if len(certs) == 0 {
+		return container
+	}
+
+	for i, cert := range certs {
+		target := path.Join(caCertsDir, fmt.Sprintf("container-use-%d.crt", i))
+		if strings.Contains(cert, "://") && !strings.HasPrefix(cert, "file://") {
+			mountPath := path.Join("/run/container-use", path.Base(target))
+			container = container.
+				WithMountedSecret(mountPath, resolveSecret(cert)).
+				WithExec(append(shell, "-c", `mkdir -p "$(dirname "$2")" && cp "$1" "$2"`, "sh", mountPath, target)).
+				WithoutMount(mountPath)
+			continue
+		}
+		container = container.WithFile(target, dag.Host().File(strings.TrimPrefix(cert, "file://")))
+	}
+
+	return container.WithExec(append(shell, "-c", installCACertsScript))
+}
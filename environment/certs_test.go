@@ -0,0 +1,46 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCert = `-----BEGIN CERTIFICATE-----
+Y29udGFpbmVyLXVzZSB0ZXN0IGNlcnRpZmljYXRl
+-----END CERTIFICATE-----
+`
+
+func TestCACerts(t *testing.T) {
+	ctx := context.Background()
+	certFile := filepath.Join(t.TempDir(), "corp.pem")
+	if err := os.WriteFile(certFile, []byte(testCert), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONTAINER_USE_TEST_CA", testCert)
+
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.CACerts = []string{certFile, "env://CONTAINER_USE_TEST_CA"}
+	env := newEngineEnvironment(t, config)
+
+	for _, name := range []string{"container-use-0.crt", "container-use-1.crt"} {
+		contents, err := env.container.File(caCertsDir + "/" + name).Contents(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if contents != testCert {
+			t.Errorf("%s = %q, want the certificate", name, contents)
+		}
+	}
+
+	bundle, err := env.container.File("/etc/ssl/certs/ca-certificates.crt").Contents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bundle, strings.TrimSpace(testCert)) {
+		t.Error("the certificate isn't in the trust store bundle")
+	}
+}
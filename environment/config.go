@@ -1,9 +1,21 @@
 package environment
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
 )
 
 const (
@@ -20,30 +32,402 @@ func DefaultConfig() *EnvironmentConfig {
 		BaseImage:    defaultImage,
 		Instructions: "No instructions found. Please look around the filesystem and update me",
 		Workdir:      "/workdir",
+		ScratchDir:   "/tmp/scratch",
 	}
 }
 
 type EnvironmentConfig struct {
-	Instructions  string         `json:"-"`
-	Workdir       string         `json:"workdir,omitempty"`
-	BaseImage     string         `json:"base_image,omitempty"`
-	SetupCommands []string       `json:"setup_commands,omitempty"`
-	Env           []string       `json:"env,omitempty"`
-	Secrets       []string       `json:"secrets,omitempty"`
-	Services      ServiceConfigs `json:"services,omitempty"`
+	Instructions       string            `json:"-"`
+	InstructionSources []string          `json:"instruction_sources,omitempty"`
+	Workdir            string            `json:"workdir,omitempty"`
+	WorkdirPolicy      WorkdirPolicy     `json:"workdir_policy,omitempty"`
+	ScratchDir         string            `json:"scratch_dir,omitempty"`
+	BaseImage          string            `json:"base_image,omitempty"`
+	BaseBuild          *BaseBuild        `json:"base_build,omitempty"`
+	Runtime            *RuntimeConfig    `json:"runtime,omitempty"`
+	Packages           []string          `json:"packages,omitempty"`
+	RequiredTools      []string          `json:"required_tools,omitempty"`
+	SetupCommands      []string          `json:"setup_commands,omitempty"`
+	SetupLayering      SetupLayering     `json:"setup_layering,omitempty"`
+	SetupLogMode       SetupLogMode      `json:"setup_log_mode,omitempty"`
+	Shell              string            `json:"shell,omitempty"`
+	Env                []string          `json:"env,omitempty"`
+	Secrets            []string          `json:"secrets,omitempty"`
+	EnvRules           EnvRules          `json:"env_rules,omitempty"`
+	Services           ServiceConfigs    `json:"services,omitempty"`
+	TTL                Duration          `json:"ttl,omitempty"`
+	ReadOnlyRoot       bool              `json:"read_only_root,omitempty"`
+	WritablePaths      []string          `json:"writable_paths,omitempty"`
+	CACerts            []string          `json:"ca_certs,omitempty"`
+	Proxy              *ProxyConfig      `json:"proxy,omitempty"`
+	PullPolicy         PullPolicy        `json:"pull_policy,omitempty"`
+	Files              []FileProvision   `json:"files,omitempty"`
+	Ulimits            map[string]Ulimit `json:"ulimits,omitempty"`
+	SecurityProfile    string            `json:"security_profile,omitempty"`
+	NoNewPrivileges    bool              `json:"no_new_privileges,omitempty"`
+	DropCapabilities   []string          `json:"drop_capabilities,omitempty"`
+
+	// RunAsUser is the user the environment runs as once built. Setup
+	// (packages, runtime and setup commands) runs as root before the
+	// container switches to it, and the workdir is handed over to it.
+	RunAsUser string `json:"run_as_user,omitempty"`
+
+	// SetupExitCodes lists, by setup command, exit codes treated as success
+	// on top of 0. A command exiting with any other code fails the build with
+	// a SetupError, and in combined layers stops the commands following it.
+	SetupExitCodes map[string][]int `json:"setup_exit_codes,omitempty"`
+
+	// SetupUsers lists, by setup command, users running them instead of the
+	// setup user, e.g. to build as RunAsUser what must belong to it.
+	SetupUsers map[string]string `json:"setup_users,omitempty"`
+
+	// HealthCheck gates WaitReady. Like any command, it runs in a fresh exec
+	// of the environment, so it only probes what outlives a command: the
+	// files left by setup and the services of the config. No process keeps
+	// running in the environment container; a server to wait for must be
+	// declared as a service.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	// OnStart commands run once the environment is ready, and OnStop ones
+	// before it closes. Each runs in its own throwaway exec and records no
+	// revision, so anything it starts in the environment container stops
+	// with it: a background process must be declared as a service instead.
+	OnStart        []string       `json:"on_start,omitempty"`
+	OnStartFailure OnStartFailure `json:"on_start_failure,omitempty"`
+	OnStop         []string       `json:"on_stop,omitempty"`
+}
+
+// ProxyConfig sets the standard proxy variables, in both upper and lower case,
+// in the environment and all of its services. Explicit Env entries take
+// precedence.
+type ProxyConfig struct {
+	HTTP    string `json:"http,omitempty"`
+	HTTPS   string `json:"https,omitempty"`
+	NoProxy string `json:"no_proxy,omitempty"`
+}
+
+func (p *ProxyConfig) Validate() error {
+	for name, value := range map[string]string{"http": p.HTTP, "https": p.HTTPS} {
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s proxy: %w", name, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid %s proxy %q: expected a URL such as http://proxy:3128", name, value)
+		}
+	}
+	return nil
+}
+
+// Env returns the proxy variables as KEY=VALUE entries.
+func (p *ProxyConfig) Env() []string {
+	if p == nil {
+		return nil
+	}
+	envs := []string{}
+	for _, v := range []struct{ key, value string }{
+		{"HTTP_PROXY", p.HTTP},
+		{"HTTPS_PROXY", p.HTTPS},
+		{"NO_PROXY", p.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		envs = append(envs, v.key+"="+v.value, strings.ToLower(v.key)+"="+v.value)
+	}
+	return envs
+}
+
+// Duration is a time.Duration that is stored in JSON in its string form (e.g.
+// "1h30m").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
 }
 
 type ServiceConfig struct {
 	Name         string   `json:"name,omitempty"`
 	Image        string   `json:"image,omitempty"`
 	Command      string   `json:"command,omitempty"`
+	CommandArgs  []string `json:"command_args,omitempty"`
 	ExposedPorts []int    `json:"exposed_ports,omitempty"`
 	Env          []string `json:"env,omitempty"`
 	Secrets      []string `json:"secrets,omitempty"`
+	DependsOn    []string `json:"depends_on,omitempty"`
+
+	Ulimits map[string]Ulimit `json:"ulimits,omitempty"`
+
+	Logs *LogConfig `json:"logs,omitempty"`
+
+	// Profiles restrict the service to bring-ups activating one of them. A
+	// service without profiles always starts.
+	Profiles []string `json:"profiles,omitempty"`
+
+	// EnvFiles are dotenv files, relative to the source directory, loaded
+	// before Env. Env entries take precedence.
+	EnvFiles []string `json:"env_files,omitempty"`
+
+	// Optional services don't fail the environment when they can't start.
+	Optional bool `json:"optional,omitempty"`
+
+	// Replicas starts that many copies of the service. See Expand.
+	Replicas   int `json:"replicas,omitempty"`
+	PortStride int `json:"port_stride,omitempty"`
+
+	PullPolicy PullPolicy `json:"pull_policy,omitempty"`
+
+	// Exports are variables injected into the environment and into services
+	// depending on this one. Values are expanded with ${host}, ${port} (the
+	// first exposed port), ${port_<n>} (exposed port n, e.g. ${port_5432}) and
+	// ${endpoint} (${host}:${port}).
+	Exports map[string]string `json:"exports,omitempty"`
+}
+
+func (config *EnvironmentConfig) Validate() error {
+	switch {
+	case config.BaseImage == "" && config.BaseBuild == nil:
+		return errors.New("base image cannot be empty")
+	case config.BaseImage != "" && config.BaseBuild != nil:
+		return errors.New("only one of base_image and base_build can be set")
+	case config.BaseImage != "":
+		if err := ValidateImageRef(config.BaseImage); err != nil {
+			return err
+		}
+	case config.BaseBuild != nil:
+		if err := config.BaseBuild.Validate(); err != nil {
+			return err
+		}
+	}
+	if !path.IsAbs(config.Workdir) {
+		return fmt.Errorf("workdir must be an absolute path: %q", config.Workdir)
+	}
+
+	for _, p := range config.WritablePaths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("writable path must be absolute: %q", p)
+		}
+	}
+	if config.ReadOnlyRoot && !config.Writable(config.Workdir) {
+		return fmt.Errorf("workdir %s must be in writable_paths when read_only_root is set", config.Workdir)
+	}
+
+	if err := config.PullPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := config.WorkdirPolicy.Validate(); err != nil {
+		return err
+	}
+
+	for _, secret := range config.Secrets {
+		// The main container has no notion of a missing secret.
+		if k, _, optional, ok := parseSecretEntry(secret); ok && optional {
+			return fmt.Errorf("secret %s: only services support optional secrets (KEY?=ref)", k)
+		}
+	}
+
+	if err := validateEnvRules(config); err != nil {
+		return err
+	}
+
+	if err := validateUser(config.RunAsUser); err != nil {
+		return err
+	}
+
+	if err := config.SetupLayering.Validate(); err != nil {
+		return err
+	}
+
+	if err := config.SetupLogMode.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateSetupExitCodes(config.SetupExitCodes, config.SetupCommands); err != nil {
+		return err
+	}
+
+	if err := validateSetupUsers(config.SetupUsers, config.SetupCommands); err != nil {
+		return err
+	}
+
+	if err := validateUlimits(config.Ulimits); err != nil {
+		return err
+	}
+
+	if config.Runtime != nil {
+		if err := config.Runtime.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, pkg := range config.Packages {
+		if err := validatePackage(pkg); err != nil {
+			return err
+		}
+	}
+
+	for _, tool := range config.RequiredTools {
+		if err := validateTool(tool); err != nil {
+			return err
+		}
+	}
+
+	if config.HealthCheck != nil {
+		if err := config.HealthCheck.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := config.OnStartFailure.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateSecurityProfile(config.SecurityProfile); err != nil {
+		return err
+	}
+	for _, capability := range config.DropCapabilities {
+		if err := validateCapability(capability); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range config.Files {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.Proxy != nil {
+		if err := config.Proxy.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, svc := range config.Services {
+		if err := svc.Validate(); err != nil {
+			return err
+		}
+	}
+	return runConfigValidators(config)
+}
+
+func (cfg *ServiceConfig) Validate() error {
+	if cfg.Name == "" {
+		return errors.New("service name cannot be empty")
+	}
+	if cfg.Image == "" {
+		return fmt.Errorf("service %s: image cannot be empty", cfg.Name)
+	}
+	if err := ValidateImageRef(cfg.Image); err != nil {
+		return fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	if cfg.Command != "" && len(cfg.CommandArgs) > 0 {
+		return fmt.Errorf("service %s: only one of command and command_args can be set", cfg.Name)
+	}
+	if err := cfg.PullPolicy.Validate(); err != nil {
+		return fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	if cfg.Replicas < 0 || cfg.PortStride < 0 {
+		return fmt.Errorf("service %s: replicas and port_stride cannot be negative", cfg.Name)
+	}
+	if _, err := cfg.Expand(); err != nil {
+		return err
+	}
+	for _, secret := range cfg.Secrets {
+		if _, _, _, ok := parseSecretEntry(secret); !ok {
+			return fmt.Errorf("service %s: invalid secret %q, expected KEY=REF or KEY?=REF", cfg.Name, secret)
+		}
+	}
+	if err := validateUlimits(cfg.Ulimits); err != nil {
+		return fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	if cfg.Logs != nil {
+		if err := cfg.Logs.Validate(); err != nil {
+			return fmt.Errorf("service %s: %w", cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// Args returns the argv used to start the service. CommandArgs is executed
+// as-is, while Command is interpreted by shell. If neither is set, the image
+// default command is used.
+func (cfg *ServiceConfig) Args(shell []string) []string {
+	switch {
+	case len(cfg.CommandArgs) > 0:
+		return cfg.CommandArgs
+	case cfg.Command != "":
+		return append(slices.Clone(shell), "-c", cfg.Command)
+	default:
+		return []string{}
+	}
+}
+
+// SemanticEqual reports whether both services run the same way. The order of
+// ExposedPorts, Env and Secrets doesn't matter, except that the last Env or
+// Secrets entry of a key wins; everything else is compared exactly.
+func (cfg ServiceConfig) SemanticEqual(other ServiceConfig) bool {
+	return marshalString(cfg.normalized()) == marshalString(other.normalized())
+}
+
+// normalized returns a copy of the service with its unordered fields sorted.
+func (cfg ServiceConfig) normalized() ServiceConfig {
+	cfg.ExposedPorts = slices.Sorted(slices.Values(cfg.ExposedPorts))
+	cfg.Env = lastByKey(cfg.Env, func(entry string) (string, bool) {
+		key, _, ok := parseKV(entry)
+		return key, ok
+	})
+	cfg.Secrets = lastByKey(cfg.Secrets, func(entry string) (string, bool) {
+		key, _, _, ok := parseSecretEntry(entry)
+		return key, ok
+	})
+	return cfg
+}
+
+// lastByKey returns the last entry of each key, sorted. Entries keyOf can't
+// parse are kept as-is.
+func lastByKey(entries []string, keyOf func(string) (string, bool)) []string {
+	byKey := map[string]string{}
+	for _, entry := range entries {
+		key, ok := keyOf(entry)
+		if !ok {
+			key = entry
+		}
+		byKey[key] = entry
+	}
+	return slices.Sorted(maps.Values(byKey))
 }
 
 type ServiceConfigs []*ServiceConfig
 
+// Active returns the services started when the given profiles are active:
+// services without profiles and services with at least one of the profiles.
+func (sc ServiceConfigs) Active(profiles ...string) ServiceConfigs {
+	active := ServiceConfigs{}
+	for _, cfg := range sc {
+		if len(cfg.Profiles) == 0 || slices.ContainsFunc(cfg.Profiles, func(p string) bool { return slices.Contains(profiles, p) }) {
+			active = append(active, cfg)
+		}
+	}
+	return active
+}
+
 func (sc ServiceConfigs) Get(name string) *ServiceConfig {
 	for _, cfg := range sc {
 		if cfg.Name == name {
@@ -53,32 +437,131 @@ func (sc ServiceConfigs) Get(name string) *ServiceConfig {
 	return nil
 }
 
+// TopoSort orders the services so that each one comes after its
+// dependencies, keeping the declaration order otherwise. Dependencies outside
+// of sc are ignored. It fails if some services depend on each other in a
+// cycle.
+func (sc ServiceConfigs) TopoSort() (ServiceConfigs, error) {
+	sorted := make(ServiceConfigs, 0, len(sc))
+	placed := map[string]bool{}
+	remaining := slices.Clone(sc)
+	for len(remaining) > 0 {
+		idx := slices.IndexFunc(remaining, func(cfg *ServiceConfig) bool {
+			return !slices.ContainsFunc(cfg.DependsOn, func(dep string) bool {
+				return sc.Get(dep) != nil && !placed[dep]
+			})
+		})
+		if idx == -1 {
+			names := make([]string, len(remaining))
+			for i, cfg := range remaining {
+				names[i] = cfg.Name
+			}
+			return nil, fmt.Errorf("dependency cycle between services %s", strings.Join(names, ", "))
+		}
+		placed[remaining[idx].Name] = true
+		sorted = append(sorted, remaining[idx])
+		remaining = slices.Delete(remaining, idx, idx+1)
+	}
+	return sorted, nil
+}
+
+// Copy returns a deep copy of the config: changing the copy, even in place,
+// never changes the original.
 func (config *EnvironmentConfig) Copy() *EnvironmentConfig {
 	copy := *config
+	copy.InstructionSources = slices.Clone(config.InstructionSources)
+	copy.Packages = slices.Clone(config.Packages)
+	copy.RequiredTools = slices.Clone(config.RequiredTools)
+	copy.OnStart = slices.Clone(config.OnStart)
+	copy.OnStop = slices.Clone(config.OnStop)
+	copy.SetupCommands = slices.Clone(config.SetupCommands)
+	copy.Env = slices.Clone(config.Env)
+	copy.Secrets = slices.Clone(config.Secrets)
+	copy.WritablePaths = slices.Clone(config.WritablePaths)
+	copy.CACerts = slices.Clone(config.CACerts)
+	copy.Files = slices.Clone(config.Files)
+	copy.DropCapabilities = slices.Clone(config.DropCapabilities)
+	copy.Ulimits = maps.Clone(config.Ulimits)
+	copy.SetupUsers = maps.Clone(config.SetupUsers)
+	if config.SetupExitCodes != nil {
+		copy.SetupExitCodes = make(map[string][]int, len(config.SetupExitCodes))
+		for command, codes := range config.SetupExitCodes {
+			copy.SetupExitCodes[command] = slices.Clone(codes)
+		}
+	}
+	if config.EnvRules != nil {
+		copy.EnvRules = make(EnvRules, len(config.EnvRules))
+		for key, rule := range config.EnvRules {
+			rule.OneOf = slices.Clone(rule.OneOf)
+			copy.EnvRules[key] = rule
+		}
+	}
 	copy.Services = make(ServiceConfigs, len(config.Services))
 	for i, svc := range config.Services {
-		svcCopy := *svc
-		copy.Services[i] = &svcCopy
+		copy.Services[i] = svc.Copy()
 	}
+	copy.Proxy = copyPtr(config.Proxy)
+	copy.Runtime = copyPtr(config.Runtime)
+	copy.BaseBuild = copyPtr(config.BaseBuild)
+	copy.HealthCheck = copyPtr(config.HealthCheck)
+	return &copy
+}
+
+// Copy returns a deep copy of the service config.
+func (cfg *ServiceConfig) Copy() *ServiceConfig {
+	copy := *cfg
+	copy.CommandArgs = slices.Clone(cfg.CommandArgs)
+	copy.ExposedPorts = slices.Clone(cfg.ExposedPorts)
+	copy.Env = slices.Clone(cfg.Env)
+	copy.Secrets = slices.Clone(cfg.Secrets)
+	copy.DependsOn = slices.Clone(cfg.DependsOn)
+	copy.Profiles = slices.Clone(cfg.Profiles)
+	copy.EnvFiles = slices.Clone(cfg.EnvFiles)
+	copy.Ulimits = maps.Clone(cfg.Ulimits)
+	copy.Exports = maps.Clone(cfg.Exports)
+	copy.Logs = copyPtr(cfg.Logs)
 	return &copy
 }
 
+// copyPtr returns a pointer to a copy of *p, or nil if p is nil.
+func copyPtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
 func (config *EnvironmentConfig) Save(baseDir string) error {
 	configPath := path.Join(baseDir, configDir)
-	if err := os.MkdirAll(configPath, 0755); err != nil {
-		return err
-	}
+	return SaveConfigFile(config, path.Join(configPath, environmentFile), path.Join(configPath, instructionsFile))
+}
 
-	if err := os.WriteFile(path.Join(configPath, instructionsFile), []byte(config.Instructions), 0644); err != nil {
-		return err
+// SaveConfigFile writes the config to envPath and its instructions to
+// instructionsPath, creating missing directories. An empty instructionsPath
+// skips the instructions.
+func SaveConfigFile(config *EnvironmentConfig, envPath, instructionsPath string) error {
+	if instructionsPath != "" {
+		if err := os.MkdirAll(filepath.Dir(instructionsPath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(instructionsPath, []byte(config.Instructions), 0644); err != nil {
+			return err
+		}
 	}
 
-	data, err := json.MarshalIndent(config, "", "  ")
+	data, err := json.MarshalIndent(struct {
+		SchemaVersion int `json:"schema_version"`
+		*EnvironmentConfig
+	}{configSchemaVersion, config}, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	if err := os.WriteFile(path.Join(configPath, environmentFile), data, 0644); err != nil {
+	if err := os.MkdirAll(filepath.Dir(envPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(envPath, data, 0644); err != nil {
 		return err
 	}
 
@@ -86,22 +569,171 @@ func (config *EnvironmentConfig) Save(baseDir string) error {
 }
 
 func (config *EnvironmentConfig) Load(baseDir string) error {
-	configPath := path.Join(baseDir, configDir)
+	return config.load(path.Join(configDir, environmentFile), path.Join(configDir, instructionsFile), func(name string) ([]byte, error) {
+		return os.ReadFile(path.Join(baseDir, name))
+	})
+}
 
-	instructions, err := os.ReadFile(path.Join(configPath, instructionsFile))
+// LoadConfigFile loads the config from envPath and its instructions from
+// instructionsPath, which may be empty when there are none. Instruction
+// sources are relative to the directory of envPath.
+func LoadConfigFile(envPath, instructionsPath string) (*EnvironmentConfig, error) {
+	envPath, err := filepath.Abs(envPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if instructionsPath != "" {
+		if instructionsPath, err = filepath.Abs(instructionsPath); err != nil {
+			return nil, err
+		}
+	}
+	baseDir := filepath.Dir(envPath)
+	config := &EnvironmentConfig{}
+	err = config.load(envPath, instructionsPath, func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(baseDir, name)
+		}
+		return os.ReadFile(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadWithDefaults loads the config from baseDir and fills the base image,
+// workdir and instructions from DefaultConfig when the files leave them empty.
+// Use Load to get exactly what's on disk.
+func LoadWithDefaults(baseDir string) (*EnvironmentConfig, error) {
+	config := &EnvironmentConfig{}
+	if err := config.Load(baseDir); err != nil {
+		return nil, err
 	}
-	config.Instructions = string(instructions)
 
-	data, err := os.ReadFile(path.Join(configPath, environmentFile))
+	defaults := DefaultConfig()
+	// A config building its base image doesn't take the default one.
+	if config.BaseImage == "" && config.BaseBuild == nil {
+		config.BaseImage = defaults.BaseImage
+	}
+	if config.Workdir == "" {
+		config.Workdir = defaults.Workdir
+	}
+	if config.Instructions == "" {
+		config.Instructions = defaults.Instructions
+	}
+	return config, nil
+}
+
+// LoadFromGit loads the config stored in subdir of the git repository at ref
+// (defaults to HEAD). authSecret is an optional secret reference (e.g.
+// env://GITHUB_TOKEN) used as the HTTP auth token for private repositories.
+func LoadFromGit(ctx context.Context, repoURL, ref, subdir, authSecret string) (*EnvironmentConfig, error) {
+	opts := dagger.GitOpts{}
+	if authSecret != "" {
+		opts.HTTPAuthToken = resolveSecret(authSecret)
+	}
+	repo := dag.Git(repoURL, opts)
+	gitRef := repo.Head()
+	if ref != "" {
+		gitRef = repo.Ref(ref)
+	}
+	tree := gitRef.Tree()
+	if subdir != "" {
+		tree = tree.Directory(subdir)
+	}
+
+	found, err := pathExists(ctx, tree, configDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s (ref %q, subdir %q): %w", repoURL, ref, subdir, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("no %s directory found in %s (ref %q, subdir %q)", configDir, repoURL, ref, subdir)
+	}
+
+	config := DefaultConfig()
+	err = config.load(path.Join(configDir, environmentFile), path.Join(configDir, instructionsFile), func(name string) ([]byte, error) {
+		found, err := pathExists(ctx, tree, name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		contents, err := tree.File(name).Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(contents), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config from %s: %w", repoURL, err)
+	}
+	return config, nil
+}
+
+// load reads the config from envFile and instructionsPath, if set, using
+// readFile, which resolves paths relative to the base directory.
+func (config *EnvironmentConfig) load(envFile, instructionsPath string, readFile func(name string) ([]byte, error)) error {
+	data, err := readFile(envFile)
+	if err != nil {
+		return err
+	}
+	data, err = migrateConfigJSON(data)
 	if err != nil {
 		return err
 	}
 	if err := json.Unmarshal(data, config); err != nil {
 		return err
 	}
+	// A base_build replaces the default base image instead of conflicting
+	// with it.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err == nil && fields["base_build"] != nil && fields["base_image"] == nil {
+		config.BaseImage = ""
+	}
+
+	if len(config.InstructionSources) == 0 {
+		if instructionsPath == "" {
+			return nil
+		}
+		// Instructions are documentation, not build input: a config without
+		// them is still usable and keeps whatever instructions it had.
+		instructions, err := readFile(instructionsPath)
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("No instructions file found", "file", instructionsPath)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		config.Instructions = string(instructions)
+		return nil
+	}
 
+	return config.loadInstructionSources(readFile)
+}
+
+// loadInstructionSources concatenates the configured instruction files
+// (relative to the base directory), in order, skipping the ones that don't
+// exist.
+func (config *EnvironmentConfig) loadInstructionSources(readFile func(name string) ([]byte, error)) error {
+	parts := []string{}
+	for _, source := range config.InstructionSources {
+		instructions, err := readFile(source)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		parts = append(parts, strings.TrimSpace(string(instructions)))
+	}
+
+	if len(parts) == 0 {
+		config.Instructions = DefaultConfig().Instructions
+		return nil
+	}
+	config.Instructions = strings.Join(parts, "\n\n")
 	return nil
 }
 
@@ -0,0 +1,465 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under dir, keyed by their slash-separated path.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadInstructionSources(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".container-use/environment.json": `{"instruction_sources": ["AGENTS.md", "missing.md", "docs/CLAUDE.md"]}`,
+		".container-use/AGENT.md":         "canonical",
+		"AGENTS.md":                       "agents\n",
+		"docs/CLAUDE.md":                  "claude\n",
+	})
+
+	config := DefaultConfig()
+	if err := config.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if want := "agents\n\nclaude"; config.Instructions != want {
+		t.Errorf("Instructions = %q, want %q", config.Instructions, want)
+	}
+
+	if err := config.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	canonical, err := os.ReadFile(filepath.Join(dir, ".container-use", "AGENT.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(canonical) != config.Instructions {
+		t.Errorf("saved instructions = %q, want %q", canonical, config.Instructions)
+	}
+}
+
+func TestLoadInstructionSourcesFallback(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".container-use/environment.json": `{"instruction_sources": ["AGENTS.md"]}`,
+	})
+
+	config := &EnvironmentConfig{}
+	if err := config.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if want := DefaultConfig().Instructions; config.Instructions != want {
+		t.Errorf("Instructions = %q, want the placeholder %q", config.Instructions, want)
+	}
+}
+
+// mapReader reads files from a map, like a git tree would, reporting missing
+// ones as os.ErrNotExist.
+func mapReader(files map[string]string) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		contents, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		return []byte(contents), nil
+	}
+}
+
+func TestLoadThroughReader(t *testing.T) {
+	config := DefaultConfig()
+	err := config.load(".container-use/environment.json", ".container-use/AGENT.md", mapReader(map[string]string{
+		".container-use/environment.json": `{"base_image": "golang:1.24", "setup_commands": ["go mod download"]}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "golang:1.24" || len(config.SetupCommands) != 1 {
+		t.Errorf("loaded config = %+v", config)
+	}
+	// The instructions are optional and keep their default.
+	if config.Instructions != DefaultConfig().Instructions {
+		t.Errorf("Instructions = %q, want the default", config.Instructions)
+	}
+
+	err = DefaultConfig().load(".container-use/environment.json", "", mapReader(nil))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("load() without a config = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestLoadMissingInstructions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".container-use/environment.json": `{"base_image": "golang:1.24"}`,
+	})
+
+	config := &EnvironmentConfig{Instructions: "kept"}
+	if err := config.Load(dir); err != nil {
+		t.Fatalf("Load() without instructions = %v", err)
+	}
+	if config.BaseImage != "golang:1.24" || config.Instructions != "kept" {
+		t.Errorf("loaded config = %+v, want the instructions left alone", config)
+	}
+
+	loaded, err := LoadConfigFile(filepath.Join(dir, ".container-use", "environment.json"), filepath.Join(dir, "missing.md"))
+	if err != nil {
+		t.Fatalf("LoadConfigFile() without instructions = %v", err)
+	}
+	if loaded.Instructions != "" {
+		t.Errorf("Instructions = %q, want them empty", loaded.Instructions)
+	}
+
+	// Only a missing file is tolerated, not an unreadable one.
+	writeFiles(t, dir, map[string]string{".container-use/AGENT.md/README": "not a file"})
+	if err := DefaultConfig().Load(dir); err == nil {
+		t.Error("Load() with an unreadable instructions file succeeded")
+	}
+
+	// The environment itself stays mandatory.
+	if err := DefaultConfig().Load(t.TempDir()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load() without environment.json = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestProxyConfigEnv(t *testing.T) {
+	proxy := &ProxyConfig{HTTP: "http://proxy:3128", HTTPS: "http://proxy:3129", NoProxy: "localhost,.internal"}
+	want := []string{
+		"HTTP_PROXY=http://proxy:3128", "http_proxy=http://proxy:3128",
+		"HTTPS_PROXY=http://proxy:3129", "https_proxy=http://proxy:3129",
+		"NO_PROXY=localhost,.internal", "no_proxy=localhost,.internal",
+	}
+	if got := proxy.Env(); !slices.Equal(got, want) {
+		t.Errorf("Env() = %q, want %q", got, want)
+	}
+	if got := (&ProxyConfig{HTTPS: "http://proxy:3129"}).Env(); len(got) != 2 {
+		t.Errorf("Env() with only https = %q", got)
+	}
+	if got := (*ProxyConfig)(nil).Env(); got != nil {
+		t.Errorf("Env() of a nil proxy = %q", got)
+	}
+}
+
+func TestProxyConfigValidate(t *testing.T) {
+	for value, ok := range map[string]bool{
+		"":                       true,
+		"http://proxy:3128":      true,
+		"http://user:pw@proxy:1": true,
+		"proxy:3128":             false,
+		"http://":                false,
+		"://proxy":               false,
+	} {
+		if err := (&ProxyConfig{HTTP: value}).Validate(); (err == nil) != ok {
+			t.Errorf("Validate() of %q = %v, want ok %v", value, err, ok)
+		}
+	}
+}
+
+func TestProxyEnvInContainer(t *testing.T) {
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Proxy = &ProxyConfig{HTTP: "http://proxy:3128", NoProxy: "localhost"}
+	config.Env = []string{"no_proxy=localhost,db"}
+	env := newEngineEnvironment(t, config)
+
+	out, err := env.Run(context.Background(), "env", `echo "$HTTP_PROXY $http_proxy $NO_PROXY $no_proxy"`, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://proxy:3128 http://proxy:3128 localhost localhost,db"; strings.TrimSpace(out) != want {
+		t.Errorf("proxy variables = %q, want %q", out, want)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	if err := config.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Environment{Config: config.Copy()}
+	diff, err := env.Drift(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("Drift() of an unchanged environment = %v", diff)
+	}
+
+	env.runtimeEnv = []string{"FOO=bar"}
+	diff, err = env.Drift(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(diff.Fields(), []string{"env.FOO"}) {
+		t.Errorf("Drift() after SetEnv = %v, want env.FOO", diff)
+	}
+
+	diff, err = env.Drift(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(diff.Fields(), "base_image") || !slices.Contains(diff.Fields(), "env.FOO") {
+		t.Errorf("Drift() without a config = %v, want every field", diff)
+	}
+}
+
+func TestLoadWithDefaults(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".container-use/environment.json": `{"setup_commands": ["make deps"]}`,
+	})
+
+	config, err := LoadWithDefaults(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultConfig()
+	if config.BaseImage != defaults.BaseImage || config.Workdir != defaults.Workdir || config.Instructions != defaults.Instructions {
+		t.Errorf("LoadWithDefaults() = %+v, want the defaults filled in", config)
+	}
+	if len(config.SetupCommands) != 1 {
+		t.Errorf("LoadWithDefaults() lost the setup commands: %v", config.SetupCommands)
+	}
+
+	// Load leaves what's missing empty.
+	raw := &EnvironmentConfig{}
+	if err := raw.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if raw.BaseImage != "" || raw.Workdir != "" {
+		t.Errorf("Load() = %+v, want the fields left empty", raw)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		".container-use/environment.json": `{"base_image": "golang:1.24", "workdir": "/src"}`,
+	})
+	if config, err = LoadWithDefaults(dir); err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "golang:1.24" || config.Workdir != "/src" {
+		t.Errorf("LoadWithDefaults() overrode the config: %+v", config)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		".container-use/environment.json": `{"base_build": {"context": "https://github.com/org/images"}}`,
+	})
+	if config, err = LoadWithDefaults(dir); err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "" {
+		t.Errorf("LoadWithDefaults() set base image %q on a config with a base build", config.BaseImage)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() of a defaulted config with a base build = %v", err)
+	}
+}
+
+func TestServiceConfigSemanticEqual(t *testing.T) {
+	base := ServiceConfig{
+		Name:         "db",
+		Image:        "postgres:16",
+		CommandArgs:  []string{"postgres", "-c", "fsync=off"},
+		ExposedPorts: []int{5432, 9187},
+		Env:          []string{"POSTGRES_USER=app", "POSTGRES_DB=app"},
+		Secrets:      []string{"POSTGRES_PASSWORD=env://PGPASS", "TLS_KEY=file:///tls.key"},
+	}
+	for name, tt := range map[string]struct {
+		change func(*ServiceConfig)
+		equal  bool
+	}{
+		"unchanged":         {func(*ServiceConfig) {}, true},
+		"reordered ports":   {func(s *ServiceConfig) { s.ExposedPorts = []int{9187, 5432} }, true},
+		"reordered env":     {func(s *ServiceConfig) { s.Env = []string{"POSTGRES_DB=app", "POSTGRES_USER=app"} }, true},
+		"reordered secrets": {func(s *ServiceConfig) { slices.Reverse(s.Secrets) }, true},
+		"overridden env":    {func(s *ServiceConfig) { s.Env = append([]string{"POSTGRES_DB=old"}, s.Env...) }, true},
+		"other port":        {func(s *ServiceConfig) { s.ExposedPorts = []int{5433, 9187} }, false},
+		"missing port":      {func(s *ServiceConfig) { s.ExposedPorts = s.ExposedPorts[:1] }, false},
+		"other env value":   {func(s *ServiceConfig) { s.Env = []string{"POSTGRES_USER=root", "POSTGRES_DB=app"} }, false},
+		"env overridden":    {func(s *ServiceConfig) { s.Env = append(slices.Clone(s.Env), "POSTGRES_DB=other") }, false},
+		"other secret":      {func(s *ServiceConfig) { s.Secrets = s.Secrets[:1] }, false},
+		"overridden secret": {func(s *ServiceConfig) { s.Secrets = append([]string{"TLS_KEY=env://OLD"}, s.Secrets...) }, true},
+		"secret overridden": {func(s *ServiceConfig) { s.Secrets = append(slices.Clone(s.Secrets), "TLS_KEY?=env://TLS") }, false},
+		"other image":       {func(s *ServiceConfig) { s.Image = "postgres:17" }, false},
+		"reordered args":    {func(s *ServiceConfig) { s.CommandArgs = []string{"postgres", "fsync=off", "-c"} }, false},
+	} {
+		other := base
+		other.ExposedPorts = slices.Clone(base.ExposedPorts)
+		other.Env = slices.Clone(base.Env)
+		other.Secrets = slices.Clone(base.Secrets)
+		tt.change(&other)
+		if got := base.SemanticEqual(other); got != tt.equal {
+			t.Errorf("%s: SemanticEqual() = %v, want %v", name, got, tt.equal)
+		}
+		if got := other.SemanticEqual(base); got != tt.equal {
+			t.Errorf("%s: SemanticEqual() reversed = %v, want %v", name, got, tt.equal)
+		}
+	}
+	if !slices.Equal(base.ExposedPorts, []int{5432, 9187}) || base.Env[0] != "POSTGRES_USER=app" {
+		t.Error("SemanticEqual() reordered the service it was called on")
+	}
+}
+
+func TestConfigFileExplicitPaths(t *testing.T) {
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, "deploy", "envs", "ci.json")
+	instructionsPath := filepath.Join(dir, "docs", "agents", "CI.md")
+
+	config := DefaultConfig()
+	config.BaseImage = "golang:1.24"
+	config.Instructions = "Run make ci."
+	config.SetupCommands = []string{"go mod download"}
+	if err := SaveConfigFile(config, envPath, instructionsPath); err != nil {
+		t.Fatal(err)
+	}
+	if instructions, err := os.ReadFile(instructionsPath); err != nil || string(instructions) != config.Instructions {
+		t.Errorf("instructions file = %q, %v", instructions, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, configDir)); !os.IsNotExist(err) {
+		t.Errorf("SaveConfigFile() wrote to the conventional layout: %v", err)
+	}
+
+	loaded, err := LoadConfigFile(envPath, instructionsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Errorf("LoadConfigFile() = %+v, want %+v", loaded, config)
+	}
+
+	// Relative paths are relative to the working directory.
+	t.Chdir(dir)
+	loaded, err = LoadConfigFile(filepath.Join("deploy", "envs", "ci.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.BaseImage != "golang:1.24" || loaded.Instructions != "" {
+		t.Errorf("LoadConfigFile() without instructions = %+v", loaded)
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(dir, "missing.json"), instructionsPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadConfigFile() of a missing file = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestConfigFileInstructionSourcesAreRelativeToEnvPath(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"deploy/ci.json":   `{"instruction_sources": ["AGENTS.md", "../README.md"]}`,
+		"deploy/AGENTS.md": "deploy agents",
+		"README.md":        "readme",
+		"AGENTS.md":        "root agents",
+	})
+	t.Chdir(t.TempDir())
+
+	config, err := LoadConfigFile(filepath.Join(dir, "deploy", "ci.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "deploy agents\n\nreadme"; config.Instructions != want {
+		t.Errorf("Instructions = %q, want %q", config.Instructions, want)
+	}
+}
+
+// fillValue sets every field reachable from v, following slices, maps and
+// pointers, to a value derived from seed.
+func fillValue(v reflect.Value, seed string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(seed)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		v.SetInt(int64(len(seed)))
+	case reflect.Uint32:
+		v.SetUint(uint64(len(seed)))
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem(), seed)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0), seed)
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key, value := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fillValue(key, "key")
+		fillValue(value, seed)
+		v.SetMapIndex(key, value)
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				fillValue(v.Field(i), seed)
+			}
+		}
+	}
+}
+
+// mutateInPlace changes, without reallocating them, the elements of every
+// slice, map and pointer reachable from v.
+func mutateInPlace(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			fillValue(v.Elem(), "mutated")
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			fillValue(v.Index(i), "mutated")
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			fillValue(value, "mutated")
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				mutateInPlace(v.Field(i))
+			}
+		}
+	}
+}
+
+func TestConfigCopyIsDeep(t *testing.T) {
+	var config, want EnvironmentConfig
+	fillValue(reflect.ValueOf(&config).Elem(), "original")
+	fillValue(reflect.ValueOf(&want).Elem(), "original")
+
+	copy := config.Copy()
+	if !reflect.DeepEqual(copy, &want) {
+		t.Fatalf("Copy() = %+v, want %+v", copy, &want)
+	}
+	// Slices, maps and pointers nested in services, rules and exit codes
+	// included.
+	for _, svc := range copy.Services {
+		mutateInPlace(reflect.ValueOf(svc).Elem())
+	}
+	for _, codes := range copy.SetupExitCodes {
+		codes[0] = 255
+	}
+	for _, rule := range copy.EnvRules {
+		rule.OneOf[0] = "mutated"
+	}
+	mutateInPlace(reflect.ValueOf(copy).Elem())
+	if !reflect.DeepEqual(&config, &want) {
+		t.Errorf("changing the copy changed the original: %+v", &config)
+	}
+}
@@ -0,0 +1,185 @@
+package environment
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ConfigChange is a single difference between two configs. Field identifies
+// what changed, e.g. "base_image", "env.FOO", "setup_commands[2]" or
+// "services.redis". Old is empty for additions and New is empty for removals.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+func (c ConfigChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("added %s: %s", c.Field, c.New)
+	case c.New == "":
+		return fmt.Sprintf("removed %s: %s", c.Field, c.Old)
+	default:
+		return fmt.Sprintf("%s changed from %s to %s", c.Field, c.Old, c.New)
+	}
+}
+
+type ConfigDiff struct {
+	Changes []ConfigChange `json:"changes"`
+}
+
+// configDiffSchemaVersion is bumped whenever the JSON shape of ConfigDiff
+// changes in a way consumers need to know about.
+const configDiffSchemaVersion = 1
+
+// MarshalJSON encodes the diff with a schema version. Changes keep the stable
+// order produced by DiffConfigs and an empty diff has an empty list.
+func (d ConfigDiff) MarshalJSON() ([]byte, error) {
+	changes := d.Changes
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+	return json.Marshal(struct {
+		Schema  int            `json:"schema"`
+		Changes []ConfigChange `json:"changes"`
+	}{configDiffSchemaVersion, changes})
+}
+
+func (d ConfigDiff) Empty() bool {
+	return len(d.Changes) == 0
+}
+
+func (d ConfigDiff) Copy() ConfigDiff {
+	return ConfigDiff{Changes: slices.Clone(d.Changes)}
+}
+
+// Fields returns the fields that changed, in order.
+func (d ConfigDiff) Fields() []string {
+	fields := make([]string, 0, len(d.Changes))
+	for _, change := range d.Changes {
+		fields = append(fields, change.Field)
+	}
+	return fields
+}
+
+func (d ConfigDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	lines := make([]string, 0, len(d.Changes))
+	for _, change := range d.Changes {
+		lines = append(lines, change.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffConfigs returns the changes needed to go from oldConfig to newConfig.
+// Changes are ordered by field so the result is stable.
+func DiffConfigs(oldConfig, newConfig *EnvironmentConfig) ConfigDiff {
+	if oldConfig == nil {
+		oldConfig = &EnvironmentConfig{}
+	}
+	if newConfig == nil {
+		newConfig = &EnvironmentConfig{}
+	}
+
+	diff := ConfigDiff{}
+	add := func(field, oldValue, newValue string) {
+		if oldValue != newValue {
+			diff.Changes = append(diff.Changes, ConfigChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+
+	add("instructions", oldConfig.Instructions, newConfig.Instructions)
+
+	// Every other scalar field is compared through its JSON form so that new
+	// config fields are picked up without touching this function.
+	oldFields, newFields := configFields(oldConfig), configFields(newConfig)
+	for _, field := range slices.Sorted(maps.Keys(merge(oldFields, newFields))) {
+		add(field, oldFields[field], newFields[field])
+	}
+
+	for i := range max(len(oldConfig.SetupCommands), len(newConfig.SetupCommands)) {
+		add(fmt.Sprintf("setup_commands[%d]", i), at(oldConfig.SetupCommands, i), at(newConfig.SetupCommands, i))
+	}
+
+	diffKV(add, "env", oldConfig.Env, newConfig.Env)
+	diffKV(add, "secrets", oldConfig.Secrets, newConfig.Secrets)
+
+	oldServices, newServices := map[string]string{}, map[string]string{}
+	for _, svc := range oldConfig.Services {
+		oldServices[svc.Name] = marshalString(svc.normalized())
+	}
+	for _, svc := range newConfig.Services {
+		newServices[svc.Name] = marshalString(svc.normalized())
+	}
+	for _, name := range slices.Sorted(maps.Keys(merge(oldServices, newServices))) {
+		add("services."+name, oldServices[name], newServices[name])
+	}
+
+	return diff
+}
+
+// configFields returns the JSON encoding of each top-level config field that
+// isn't diffed explicitly by DiffConfigs.
+func configFields(config *EnvironmentConfig) map[string]string {
+	raw := map[string]json.RawMessage{}
+	_ = json.Unmarshal([]byte(marshalString(config)), &raw)
+
+	fields := map[string]string{}
+	for key, value := range raw {
+		switch key {
+		case "setup_commands", "env", "secrets", "services":
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			fields[key] = s
+			continue
+		}
+		fields[key] = string(value)
+	}
+	return fields
+}
+
+func diffKV(add func(field, oldValue, newValue string), prefix string, oldEntries, newEntries []string) {
+	oldValues, newValues := kvMap(oldEntries), kvMap(newEntries)
+	for _, key := range slices.Sorted(maps.Keys(merge(oldValues, newValues))) {
+		add(prefix+"."+key, oldValues[key], newValues[key])
+	}
+}
+
+func kvMap(entries []string) map[string]string {
+	values := map[string]string{}
+	for _, entry := range entries {
+		if k, v, ok := parseKV(entry); ok {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+func merge(a, b map[string]string) map[string]string {
+	merged := maps.Clone(a)
+	maps.Copy(merged, b)
+	return merged
+}
+
+func at(s []string, i int) string {
+	if i < len(s) {
+		return s[i]
+	}
+	return ""
+}
+
+func marshalString(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
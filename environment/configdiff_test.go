@@ -0,0 +1,62 @@
+package environment
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestConfigDiffJSONIsStable(t *testing.T) {
+	oldConfig, newConfig := DefaultConfig(), DefaultConfig()
+	for i := range 50 {
+		oldConfig.Env = append(oldConfig.Env, fmt.Sprintf("VAR_%02d=old", i))
+		newConfig.Env = append([]string{fmt.Sprintf("VAR_%02d=new", i)}, newConfig.Env...)
+	}
+	newConfig.BaseImage = "golang:1.24"
+	newConfig.Services = ServiceConfigs{{Name: "redis", Image: "redis:7"}, {Name: "db", Image: "postgres:16"}}
+
+	first, err := json.Marshal(DiffConfigs(oldConfig, newConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		data, err := json.Marshal(DiffConfigs(oldConfig, newConfig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(first) {
+			t.Fatalf("JSON changed between runs:\n%s\n%s", first, data)
+		}
+	}
+
+	for _, tt := range []struct {
+		diff ConfigDiff
+		want string
+	}{
+		{ConfigDiff{}, `{"schema":1,"changes":[]}`},
+		{ConfigDiff{Changes: []ConfigChange{{Field: "env.FOO", New: "bar"}}}, `{"schema":1,"changes":[{"field":"env.FOO","new":"bar"}]}`},
+	} {
+		data, err := json.Marshal(tt.diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("json.Marshal() = %s, want %s", data, tt.want)
+		}
+	}
+}
+
+func TestConfigDiffString(t *testing.T) {
+	diff := ConfigDiff{Changes: []ConfigChange{
+		{Field: "env.FOO", New: "bar"},
+		{Field: "env.OLD", Old: "1"},
+		{Field: "base_image", Old: "alpine", New: "ubuntu"},
+	}}
+	want := "added env.FOO: bar\nremoved env.OLD: 1\nbase_image changed from alpine to ubuntu"
+	if got := diff.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := (ConfigDiff{}).String(); got != "no changes" {
+		t.Errorf("String() of an empty diff = %q", got)
+	}
+}
@@ -0,0 +1,30 @@
+package environment
+
+// SnapshotConfig returns a copy of the config, to be handed back to
+// RestoreConfig.
+func (env *Environment) SnapshotConfig() *EnvironmentConfig {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.Config.Copy()
+}
+
+// RestoreConfig swaps the config of the environment for a copy of cfg without
+// touching the container or recording a revision. If the container was built
+// from a different config, RebuildReason and the next rebuild compare against
+// the config the container was built from.
+func (env *Environment) RestoreConfig(cfg *EnvironmentConfig) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.appliedConfig == nil {
+		env.appliedConfig = env.Config
+	}
+	env.Config = cfg.Copy()
+}
+
+// builtConfig returns the config the container was built from.
+func (env *Environment) builtConfig() *EnvironmentConfig {
+	if env.appliedConfig != nil {
+		return env.appliedConfig
+	}
+	return env.Config
+}
@@ -0,0 +1,85 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestSnapshotRestoreConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.SetupCommands = []string{"apt-get update"}
+	container := &dagger.Container{}
+	env := &Environment{ID: "config-snapshot/test", Config: config, container: container}
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", container, "")
+	env.mu.Unlock()
+
+	snapshot := env.SnapshotConfig()
+	if snapshot == env.Config || !DiffConfigs(env.Config, snapshot).Empty() {
+		t.Fatal("SnapshotConfig() isn't a copy of the config")
+	}
+
+	// Experiment with the config, without rebuilding.
+	experiment := snapshot.Copy()
+	experiment.SetupCommands = append(experiment.SetupCommands, "apt-get install -y git")
+	experiment.Env = []string{"DEBUG=1"}
+	env.RestoreConfig(experiment)
+	if len(snapshot.SetupCommands) != 1 || snapshot.Env != nil {
+		t.Errorf("changing the config changed the snapshot: %+v", snapshot)
+	}
+	if env.Config == experiment || !DiffConfigs(experiment, env.Config).Empty() {
+		t.Errorf("config = %+v, want a copy of %+v", env.Config, experiment)
+	}
+	// The container is still the one built from the snapshot.
+	if rebuild, _ := env.RebuildReason(env.Config); !rebuild {
+		t.Error("RebuildReason() of the experiment = no rebuild")
+	}
+	if rebuild, reason := env.RebuildReason(snapshot); rebuild {
+		t.Errorf("RebuildReason() of the built config = %s", reason)
+	}
+
+	// Revert the experiment.
+	env.RestoreConfig(snapshot)
+	if env.Config == snapshot || !DiffConfigs(snapshot, env.Config).Empty() {
+		t.Errorf("restored config = %+v, want a copy of %+v", env.Config, snapshot)
+	}
+	if rebuild, reason := env.RebuildReason(env.Config); rebuild {
+		t.Errorf("RebuildReason() of the restored config = %s", reason)
+	}
+	if env.container != container || env.History.LatestVersion() != 1 {
+		t.Error("RestoreConfig() touched the container or the history")
+	}
+}
+
+func TestSnapshotConfigIsDeep(t *testing.T) {
+	config := DefaultConfig()
+	config.Env = []string{"A=1"}
+	config.SetupCommands = []string{"make deps"}
+	config.SetupUsers = map[string]string{"make deps": "root"}
+	config.SetupExitCodes = map[string][]int{"make deps": {2}}
+	config.Services = ServiceConfigs{{Name: "db", Image: "postgres:16", Env: []string{"POSTGRES_DB=app"}, Exports: map[string]string{"DB_HOST": "${host}"}}}
+	env := &Environment{ID: "config-snapshot/deep", Config: config}
+	want := config.Copy()
+
+	snapshot := env.SnapshotConfig()
+	snapshot.Env[0] = "A=2"
+	snapshot.SetupCommands[0] = "make other"
+	snapshot.SetupUsers["a"] = "bob"
+	snapshot.SetupExitCodes["make deps"][0] = 3
+	snapshot.Services[0].Env[0] = "POSTGRES_DB=other"
+	snapshot.Services[0].Exports["DB_HOST"] = "elsewhere"
+	if !reflect.DeepEqual(env.Config, want) {
+		t.Errorf("changing the snapshot in place changed the config: %+v", env.Config)
+	}
+
+	// Nor does changing the config in place change a restored snapshot.
+	env.RestoreConfig(snapshot)
+	restored := snapshot.Copy()
+	env.Config.Env[0] = "A=3"
+	env.Config.Services[0].Exports["DB_HOST"] = "moved"
+	if !reflect.DeepEqual(snapshot, restored) {
+		t.Errorf("changing the config in place changed the restored snapshot: %+v", snapshot)
+	}
+}
@@ -0,0 +1,96 @@
+package environment
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UnsupportedFeature is a config feature the target engine can't run. An
+// empty MinVersion means no engine version supports it.
+type UnsupportedFeature struct {
+	Feature    string `json:"feature"`
+	MinVersion string `json:"min_version,omitempty"`
+}
+
+func (f UnsupportedFeature) String() string {
+	if f.MinVersion == "" {
+		return fmt.Sprintf("%s isn't supported by any dagger engine", f.Feature)
+	}
+	return fmt.Sprintf("%s requires dagger engine %s or later", f.Feature, f.MinVersion)
+}
+
+// engineFeature is a config feature along with the first engine version
+// providing the APIs it relies on, or none if no version does.
+type engineFeature struct {
+	name       string
+	minVersion string
+	used       func(c *EnvironmentConfig) bool
+}
+
+// clientEngineVersion is the engine version the dagger client is generated
+// for. Every API the environment relies on (services, cache volumes, secret
+// mounts, Dockerfile builds, users) predates it, so it is the floor of every
+// config.
+const clientEngineVersion = "v0.18.0"
+
+// engineFeatures is the capability table checked by CheckEngineSupport. A
+// feature only gets an entry when it needs more than clientEngineVersion, or
+// when no engine supports it: dagger doesn't let clients pick a security
+// profile, set no_new_privs or drop capabilities. Ulimits don't need engine
+// support since they are applied by a shell in the container.
+var engineFeatures = []engineFeature{
+	{"environments", clientEngineVersion, func(c *EnvironmentConfig) bool { return true }},
+	{"security_profile", "", func(c *EnvironmentConfig) bool { return c.SecurityProfile != "" }},
+	{"no_new_privileges", "", func(c *EnvironmentConfig) bool { return c.NoNewPrivileges }},
+	{"drop_capabilities", "", func(c *EnvironmentConfig) bool { return len(c.DropCapabilities) > 0 }},
+}
+
+// CheckEngineSupport returns the features of the config that engineVersion
+// (e.g. v0.18.10) doesn't support. An unparseable version is reported as not
+// supporting anything.
+func (c *EnvironmentConfig) CheckEngineSupport(engineVersion string) []UnsupportedFeature {
+	version, ok := parseEngineVersion(engineVersion)
+	unsupported := []UnsupportedFeature{}
+	for _, feature := range engineFeatures {
+		if !feature.used(c) {
+			continue
+		}
+		minVersion, supported := parseEngineVersion(feature.minVersion)
+		if !ok || !supported || compareEngineVersions(version, minVersion) < 0 {
+			unsupported = append(unsupported, UnsupportedFeature{Feature: feature.name, MinVersion: feature.minVersion})
+		}
+	}
+	return unsupported
+}
+
+// parseEngineVersion parses versions of the form [v]major.minor.patch,
+// ignoring any pre-release or build suffix.
+func parseEngineVersion(s string) ([3]int, bool) {
+	var version [3]int
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return version, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version, false
+		}
+		version[i] = n
+	}
+	return version, true
+}
+
+func compareEngineVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEngineVersion(t *testing.T) {
+	for s, want := range map[string][3]int{
+		"v0.18.10":       {0, 18, 10},
+		"0.19.2":         {0, 19, 2},
+		"v0.18.0-rc.1":   {0, 18, 0},
+		"v1.2.3+build.5": {1, 2, 3},
+	} {
+		if got, ok := parseEngineVersion(s); !ok || got != want {
+			t.Errorf("parseEngineVersion(%q) = %v, %v, want %v", s, got, ok, want)
+		}
+	}
+	for _, s := range []string{"", "v0.18", "latest", "v0.x.1", "v0.18.-1", "v0.18.0.1"} {
+		if _, ok := parseEngineVersion(s); ok {
+			t.Errorf("parseEngineVersion(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCheckEngineSupport(t *testing.T) {
+	config := DefaultConfig()
+	environments := UnsupportedFeature{Feature: "environments", MinVersion: clientEngineVersion}
+	for version, want := range map[string][]UnsupportedFeature{
+		"v0.18.0":  {},
+		"v0.18.10": {},
+		"v1.0.0":   {},
+		"v0.17.9":  {environments},
+		"v0.9.99":  {environments},
+		"unknown":  {environments},
+	} {
+		if got := config.CheckEngineSupport(version); !reflect.DeepEqual(got, want) {
+			t.Errorf("CheckEngineSupport(%q) = %v, want %v", version, got, want)
+		}
+	}
+
+	// Features dagger doesn't expose are reported whatever the version.
+	config.SecurityProfile = "restricted"
+	config.DropCapabilities = []string{"NET_RAW"}
+	want := []UnsupportedFeature{{Feature: "security_profile"}, {Feature: "drop_capabilities"}}
+	if got := config.CheckEngineSupport("v0.19.0"); !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckEngineSupport() with a security profile = %v, want %v", got, want)
+	}
+	if got := want[0].String(); got != "security_profile isn't supported by any dagger engine" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := environments.String(); got != "environments requires dagger engine "+clientEngineVersion+" or later" {
+		t.Errorf("String() = %q", got)
+	}
+}
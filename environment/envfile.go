@@ -0,0 +1,76 @@
+package environment
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadEnvFiles reads the dotenv files in order and returns their entries as
+// KEY=VALUE. Relative paths are resolved against the source directory.
+func (env *Environment) loadEnvFiles(files []string) ([]string, error) {
+	entries := []string{}
+	for _, name := range files {
+		p := name
+		if !filepath.IsAbs(p) {
+			if env.Source == "" {
+				return nil, fmt.Errorf("relative env file %s requires a source directory", name)
+			}
+			p = filepath.Join(env.Source, p)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env file: %w", err)
+		}
+		fileEntries, err := parseEnvFile(name, data)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil
+}
+
+// parseEnvFile parses dotenv syntax: KEY=VALUE lines with an optional
+// "export " prefix, blank lines and # comments. Values may be wrapped in
+// single quotes, taken literally, or double quotes, where \n, \" and \\ are
+// unescaped.
+func parseEnvFile(name string, data []byte) ([]string, error) {
+	entries := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", name, lineno)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		case strings.HasPrefix(value, "'") || strings.HasPrefix(value, `"`):
+			return nil, fmt.Errorf("%s:%d: unterminated quoted value for %s", name, lineno, key)
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		entries = append(entries, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return entries, nil
+}
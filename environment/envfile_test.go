@@ -0,0 +1,78 @@
+package environment
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	data := `# database
+DB_HOST=db
+export DB_PORT=5432
+  DB_USER = app  
+DB_PASSWORD='p@ss # not a comment'
+GREETING="hello\n\"world\""
+URL=http://example.com/#anchor
+DEBUG=true # trailing comment
+
+EMPTY=
+`
+	got, err := parseEnvFile(".env", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DB_HOST=db",
+		"DB_PORT=5432",
+		"DB_USER=app",
+		"DB_PASSWORD=p@ss # not a comment",
+		"GREETING=hello\n\"world\"",
+		"URL=http://example.com/#anchor",
+		"DEBUG=true",
+		"EMPTY=",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseEnvFile() = %q, want %q", got, want)
+	}
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	for _, data := range []string{
+		"NOT_AN_ASSIGNMENT",
+		"=value",
+		"MY KEY=value",
+		`QUOTED="unterminated`,
+		"QUOTED='unterminated",
+	} {
+		if _, err := parseEnvFile(".env", []byte(data)); err == nil {
+			t.Errorf("parseEnvFile(%q) succeeded", data)
+		}
+	}
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{
+		".env":       "A=1\nB=1\n",
+		".env.local": "B=2\n",
+	})
+	env := &Environment{Source: source}
+
+	got, err := env.loadEnvFiles([]string{".env", filepath.Join(source, ".env.local")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A=1", "B=1", "B=2"}; !slices.Equal(got, want) {
+		t.Errorf("loadEnvFiles() = %q, want %q", got, want)
+	}
+
+	if _, err := env.loadEnvFiles([]string{"missing.env"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loadEnvFiles() of a missing file = %v", err)
+	}
+	if _, err := (&Environment{}).loadEnvFiles([]string{".env"}); err == nil {
+		t.Error("loadEnvFiles() resolved a relative file without a source directory")
+	}
+}
@@ -5,15 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"dagger.io/dagger"
-
-	petname "github.com/dustinkirkland/golang-petname"
 )
 
 var dag *dagger.Client
@@ -22,22 +23,37 @@ type Version int
 
 type Revision struct {
 	Version     Version   `json:"version"`
+	Parent      Version   `json:"parent,omitempty"`
 	Name        string    `json:"name"`
 	Explanation string    `json:"explanation"`
 	Output      string    `json:"output,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	State       string    `json:"state"`
 
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	SetupResults []SetupResult `json:"setup_results,omitempty"`
+
+	// RuntimeEnv holds the variables set with SetEnv as of this revision.
+	RuntimeEnv []string `json:"runtime_env,omitempty"`
+
 	container *dagger.Container `json:"-"`
 }
 
 type History []*Revision
 
+// Latest returns the revision with the highest version, whatever its position
+// in the history. Among revisions sharing that version, the most recently
+// created one wins.
 func (h History) Latest() *Revision {
-	if len(h) == 0 {
-		return nil
+	var latest *Revision
+	for _, revision := range h {
+		if latest == nil || revision.Version > latest.Version ||
+			(revision.Version == latest.Version && revision.CreatedAt.After(latest.CreatedAt)) {
+			latest = revision
+		}
 	}
-	return h[len(h)-1]
+	return latest
 }
 
 func (h History) LatestVersion() Version {
@@ -48,7 +64,24 @@ func (h History) LatestVersion() Version {
 	return latest.Version
 }
 
+// NextVersion returns the version following the highest version in the
+// history.
+func (h History) NextVersion() Version {
+	var highest Version
+	for _, revision := range h {
+		highest = max(highest, revision.Version)
+	}
+	return highest + 1
+}
+
+// Get returns the revision with the given version, or nil. Histories are
+// ordered by version unless reshaped by hand, so it searches them as such
+// first and only scans them on a miss.
 func (h History) Get(version Version) *Revision {
+	i := sort.Search(len(h), func(i int) bool { return h[i].Version >= version })
+	if i < len(h) && h[i].Version == version {
+		return h[i]
+	}
 	for _, revision := range h {
 		if revision.Version == version {
 			return revision
@@ -57,7 +90,15 @@ func (h History) Get(version Version) *Revision {
 	return nil
 }
 
-func Initialize(client *dagger.Client) error {
+var ErrEngineUnavailable = errors.New("dagger engine is unavailable (is the dagger engine running?)")
+
+func Initialize(ctx context.Context, client *dagger.Client) error {
+	if client == nil {
+		return ErrEngineUnavailable
+	}
+	if _, err := client.Version(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+	}
 	dag = client
 	return nil
 }
@@ -74,45 +115,197 @@ type Environment struct {
 
 	History History
 
+	// Ephemeral environments live only in memory: nothing is written to the
+	// worktree, git notes or the config directory.
+	Ephemeral bool
+
 	mu        sync.Mutex
+	opMu      sync.Mutex
 	container *dagger.Container
+
+	historyIndex historyIndex
+
+	// runtimeEnv holds the variables set with SetEnv on top of the config.
+	runtimeEnv []string
+
+	// runtimeInstructions override the config instructions when set with
+	// SetInstructions. They are never saved.
+	runtimeInstructions string
+
+	// lastVersion is the highest version ever handed out, so versions are
+	// never reused even if the history shrinks.
+	lastVersion Version
+
+	serviceFailures map[string]*ServiceFailure
+
+	// setupCheckpoints are the setup layers completed by the last build.
+	setupCheckpoints []setupCheckpoint
+
+	// setupResults are recorded by a build until the revision it produces is
+	// appended.
+	setupResults []SetupResult
+
+	annotations map[string]string
+
+	// profiles are the service profiles activated when the environment was
+	// brought up.
+	profiles []string
+
+	// shell is the probed shell of the base image, used when the config
+	// doesn't set one.
+	shell []string
+
+	// hasTimeout caches whether timeout(1) runs in the current build, nil
+	// until probed.
+	hasTimeout *bool
+
+	// baseImage is the base image of the current build, pinned to the digest
+	// it was built from.
+	baseImage PinnedImage
+
+	// started is set once the on_start commands ran for the current build.
+	// onStartMu serializes their runs.
+	started   bool
+	onStartMu sync.Mutex
+
+	// appliedConfig is the config the container was built from, when
+	// RestoreConfig swapped in another one.
+	appliedConfig *EnvironmentConfig
+
+	// dependencies must be ready before this environment starts.
+	dependencies []*Environment
+
+	defaultTimeout time.Duration
+
+	operations    map[string]*operation
+	lastOperation int
+
+	// mirrors follow the revisions of this environment; primary is set on
+	// mirrors until they are promoted.
+	mirrors []*Environment
+	primary *Environment
+
+	state            EnvironmentState
+	queueDuringBuild bool
+	buildDone        chan struct{}
 }
 
 func (env *Environment) apply(ctx context.Context, name, explanation, output string, newState *dagger.Container) error {
+	return env.applyFrom(ctx, nil, name, explanation, output, newState)
+}
+
+// applyFrom records newState as a revision derived from parent, or from the
+// latest revision if parent is nil.
+func (env *Environment) applyFrom(ctx context.Context, parent *Revision, name, explanation, output string, newState *dagger.Container) error {
 	if _, err := newState.Sync(ctx); err != nil {
 		return err
 	}
+	containerID, err := newState.ID(ctx)
+	if err != nil {
+		return err
+	}
+	env.commitRevision(parent, name, explanation, output, newState, string(containerID))
+	return nil
+}
+
+// commitRevision appends a revision of newState under env.mu and notifies
+// the hooks and subscribers of it.
+func (env *Environment) commitRevision(parent *Revision, name, explanation, output string, newState *dagger.Container, state string) *Revision {
+	env.mu.Lock()
+	if parent != nil {
+		// Going back to the state of parent, runtime variables included.
+		env.runtimeEnv = slices.Clone(parent.RuntimeEnv)
+	}
+	revision := env.appendRevision(parent, name, explanation, output, newState, state)
+	env.mu.Unlock()
 
+	fireRevision(env, revision)
+	env.emit(Event{Type: EventRevision, Version: revision.Version})
+	return revision
+}
+
+// NextVersion returns the version the next revision of the environment will
+// get. Versions are never reused, even once dropped from the history.
+func (env *Environment) NextVersion() Version {
 	env.mu.Lock()
 	defer env.mu.Unlock()
+	return max(env.History.NextVersion(), env.lastVersion+1)
+}
+
+// appendRevision is the only way revisions get added to the history. It must
+// be called with env.mu held, which makes version assignment atomic and
+// strictly increasing.
+func (env *Environment) appendRevision(parent *Revision, name, explanation, output string, newState *dagger.Container, state string) *Revision {
+	if parent == nil {
+		parent = env.History.Latest()
+	}
 	revision := &Revision{
-		Version:     env.History.LatestVersion() + 1,
+		Version:     max(env.History.NextVersion(), env.lastVersion+1),
 		Name:        name,
 		Explanation: explanation,
 		Output:      output,
 		CreatedAt:   time.Now(),
+		State:       state,
+		Annotations: maps.Clone(env.annotations),
 		container:   newState,
+
+		SetupResults: env.setupResults,
+		RuntimeEnv:   slices.Clone(env.runtimeEnv),
 	}
-	containerID, err := revision.container.ID(ctx)
-	if err != nil {
-		return err
+	env.setupResults = nil
+	if parent != nil {
+		revision.Parent = parent.Version
 	}
-	revision.State = string(containerID)
+	env.addRevision(revision)
+	return revision
+}
+
+// addRevision appends revision to the history and makes it the current state,
+// on the environment and its mirrors. It must be called with env.mu held.
+func (env *Environment) addRevision(revision *Revision) {
 	env.container = revision.container
 	env.History = append(env.History, revision)
-
-	return nil
+	env.historyIndex.appended(env.History)
+	env.lastVersion = max(env.lastVersion, revision.Version)
+	env.replicateLocked(func(mirror *Environment) {
+		mirror.addRevision(copyRevision(revision))
+	})
 }
 
-var environments = map[string]*Environment{}
+// replaceHistory swaps the history of the environment for h and makes its
+// latest revision the current state. It must be called with env.mu held.
+// Versions handed out before the swap are never reused.
+func (env *Environment) replaceHistory(h History) {
+	for _, revision := range h {
+		if revision.container == nil && revision.State != "" && dag != nil {
+			revision.container = dag.LoadContainerFromID(dagger.ContainerID(revision.State))
+		}
+		env.lastVersion = max(env.lastVersion, revision.Version)
+	}
+	env.History = h
+	env.historyIndex.reset(h)
+	if latest := h.Latest(); latest != nil {
+		if latest.container != nil {
+			env.container = latest.container
+		}
+		env.runtimeEnv = slices.Clone(latest.RuntimeEnv)
+	}
+	env.replicateLocked(func(mirror *Environment) {
+		mirror.replaceHistory(mirrorHistory(h))
+	})
+}
 
-func Create(ctx context.Context, explanation, source, name string) (*Environment, error) {
+// Create creates an environment from the config found in source. Services
+// with profiles only start if one of their profiles is among the given ones.
+func Create(ctx context.Context, explanation, source, name string, profiles ...string) (_ *Environment, rerr error) {
 	env := &Environment{
-		ID:     fmt.Sprintf("%s/%s", name, petname.Generate(2, "-")),
-		Name:   name,
-		Source: source,
-		Config: DefaultConfig(),
+		ID:       NewEnvironmentID(name),
+		Name:     name,
+		Source:   source,
+		Config:   DefaultConfig(),
+		profiles: profiles,
 	}
+	defer releaseIDOnError(env.ID, &rerr)
 	if err := env.Config.Load(source); err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return nil, err
@@ -125,17 +318,19 @@ func Create(ctx context.Context, explanation, source, name string) (*Environment
 	}
 	env.Worktree = worktreePath
 
-	container, err := env.buildBase(ctx)
+	container, err := env.buildBase(ctx, false)
 	if err != nil {
 		return nil, err
 	}
+	defer env.abortBuildOnError(ctx, &rerr)
 
 	slog.Info("Creating environment", "id", env.ID, "name", env.Name, "workdir", env.Config.Workdir)
 
 	if err := env.apply(ctx, "Create environment", "Create the environment", "", container); err != nil {
 		return nil, err
 	}
-	environments[env.ID] = env
+	env.audit(ctx, "create", source)
+	registerEnvironment(env)
 
 	if err := env.propagateToWorktree(ctx, "Init env "+name, explanation); err != nil {
 		return nil, fmt.Errorf("failed to propagate to worktree: %w", err)
@@ -144,15 +339,54 @@ func Create(ctx context.Context, explanation, source, name string) (*Environment
 	return env, nil
 }
 
-func Open(ctx context.Context, explanation, source, id string) (*Environment, error) {
+// CreateEphemeral creates an environment that is never persisted. The source
+// directory, if any, is copied into the workdir but changes are not written
+// back. Reverting still works within the process, but nothing survives a
+// restart. profiles are the service profiles to activate, as with Create.
+func CreateEphemeral(ctx context.Context, source, name string, config *EnvironmentConfig, profiles ...string) (_ *Environment, rerr error) {
+	env := &Environment{
+		ID:        NewEnvironmentID(name),
+		Name:      name,
+		Source:    source,
+		Worktree:  source,
+		profiles:  profiles,
+		Config:    config,
+		Ephemeral: true,
+	}
+	defer releaseIDOnError(env.ID, &rerr)
+	if env.Config == nil {
+		env.Config = DefaultConfig()
+	}
+
+	container, err := env.buildBase(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer env.abortBuildOnError(ctx, &rerr)
+
+	slog.Info("Creating ephemeral environment", "id", env.ID, "name", env.Name, "workdir", env.Config.Workdir)
+
+	if err := env.apply(ctx, "Create environment", "Create the ephemeral environment", "", container); err != nil {
+		return nil, err
+	}
+	env.audit(ctx, "create", "ephemeral")
+	registerEnvironment(env)
+
+	return env, nil
+}
+
+func Open(ctx context.Context, explanation, source, id string, profiles ...string) (_ *Environment, rerr error) {
 	// FIXME(aluzzardi): DO NOT USE THIS FUNCTION. It's broken.
 
-	name, _, _ := strings.Cut(id, "/")
+	name, _, err := ParseEnvironmentID(id)
+	if err != nil {
+		return nil, err
+	}
 	env := &Environment{
-		Name:   name,
-		ID:     id,
-		Source: source,
-		Config: DefaultConfig(),
+		Name:     name,
+		ID:       id,
+		Source:   source,
+		profiles: profiles,
 	}
 	worktreePath, err := env.InitializeWorktree(ctx, source)
 	if err != nil {
@@ -160,22 +394,34 @@ func Open(ctx context.Context, explanation, source, id string) (*Environment, er
 	}
 	env.Worktree = worktreePath
 
-	if err := env.Config.Load(worktreePath); err != nil {
+	config, err := env.loadConfig(worktreePath)
+	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return Create(ctx, explanation, source, name)
+			return Create(ctx, explanation, source, name, profiles...)
 		}
 		return nil, err
 	}
+	env.Config = config
+
+	history, err := env.loadHistory()
+	if err != nil {
+		return nil, err
+	}
+	env.mu.Lock()
+	env.replaceHistory(history)
+	env.mu.Unlock()
 
-	container, err := env.buildBase(ctx)
+	container, err := env.buildBase(ctx, false)
 	if err != nil {
 		return nil, err
 	}
+	defer env.abortBuildOnError(ctx, &rerr)
+
 	if err := env.apply(ctx, "Open environment", "Open the environment", "", container); err != nil {
 		return nil, err
 	}
 
-	environments[env.ID] = env
+	registerEnvironment(env)
 
 	return env, nil
 
@@ -192,102 +438,445 @@ func Open(ctx context.Context, explanation, source, id string) (*Environment, er
 	// }
 }
 
+// parseKV splits a KEY=VALUE entry on the first "=". Entries without a "=" or
+// with an empty key are rejected; the value may be empty or contain "=".
+func parseKV(entry string) (key, value string, ok bool) {
+	key, value, found := strings.Cut(entry, "=")
+	if !found || key == "" {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+func validateKV(entry string) error {
+	if _, _, ok := parseKV(entry); !ok {
+		return fmt.Errorf("invalid entry %q, expected KEY=VALUE", entry)
+	}
+	return nil
+}
+
 func containerWithEnvAndSecrets(container *dagger.Container, envs, secrets []string) (*dagger.Container, error) {
 	for _, env := range envs {
-		k, v, found := strings.Cut(env, "=")
-		if !found {
+		k, v, ok := parseKV(env)
+		if !ok {
 			return nil, fmt.Errorf("invalid env variable: %s", env)
 		}
-		if !found {
-			return nil, fmt.Errorf("invalid environment variable: %s", env)
-		}
 		container = container.WithEnvVariable(k, v)
 	}
 
 	for _, secret := range secrets {
-		k, v, found := strings.Cut(secret, "=")
-		if !found {
+		k, v, ok := parseKV(secret)
+		if !ok {
 			return nil, fmt.Errorf("invalid secret: %s", secret)
 		}
-		container = container.WithSecretVariable(k, dag.Secret(v))
+		container = container.WithSecretVariable(k, resolveSecret(v))
 	}
 
 	return container, nil
 }
 
-func (env *Environment) buildBase(ctx context.Context) (*dagger.Container, error) {
-	sourceDir := dag.Host().Directory(env.Worktree, dagger.HostDirectoryOpts{
-		NoCache: true,
-	})
+// buildBase builds the container of the environment from its config. With
+// resume, setup layers completed by the previous build are reused as long as
+// their inputs are unchanged (see resumeSetup).
+func (env *Environment) buildBase(ctx context.Context, resume bool) (_ *dagger.Container, rerr error) {
+	start := time.Now()
+	env.emit(Event{Type: EventBuildStart})
+	env.setupResults = nil
+	defer func() {
+		if rerr != nil {
+			// No revision records the results of a failed build, its error
+			// does.
+			if setupErr := (*SetupError)(nil); errors.As(rerr, &setupErr) {
+				setupErr.Results = env.setupResults
+			}
+			env.setupResults = nil
+		}
+		env.emit(Event{Type: EventBuildEnd, Duration: Duration(time.Since(start)), Error: errorString(rerr)})
+	}()
 
-	container := dag.
-		Container().
-		From(env.Config.BaseImage).
-		WithWorkdir(env.Config.Workdir)
+	if err := env.Config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
-	container, err := containerWithEnvAndSecrets(container, env.Config.Env, env.Config.Secrets)
+	var container *dagger.Container
+	var baseImage PinnedImage
+	var err error
+	if env.Config.BaseBuild != nil {
+		baseImage.Ref = env.Config.BaseBuild.Context
+		container, baseImage.Digest, err = buildBaseImage(ctx, env.Config.BaseBuild)
+	} else {
+		baseImage.Ref = env.Config.BaseImage
+		container, err = env.containerFrom(ctx, env.Config.BaseImage, env.Config.PullPolicy)
+		if err == nil {
+			baseImage.Digest, err = imageDigest(ctx, container)
+			if err != nil {
+				err = fmt.Errorf("failed to resolve digest of %s: %w", env.Config.BaseImage, err)
+			}
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	env.mu.Lock()
+	env.baseImage = baseImage
+	env.mu.Unlock()
+	container, err = env.withWorkdirPolicy(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	container = env.withSetupUser(container.WithWorkdir(env.Config.Workdir))
 
-	for _, command := range env.Config.SetupCommands {
-		var err error
+	env.mu.Lock()
+	env.shell = nil
+	env.hasTimeout = nil
+	env.started = false
+	env.mu.Unlock()
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+
+	container, err = containerWithEnvAndSecrets(container, append(env.Config.Proxy.Env(), env.Config.Env...), env.Config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	container = withCACerts(container, shell, env.Config.CACerts)
+
+	container, err = env.withFiles(container)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Config.ScratchDir != "" {
+		// Scratch lives on a cache volume so it isn't part of the container
+		// state recorded in revisions.
+		container = container.WithMountedCache(env.Config.ScratchDir, dag.CacheVolume("container-use-scratch-"+env.ID))
+	}
 
-		container = container.WithExec([]string{"sh", "-c", command})
+	container, err = env.withPackages(ctx, container)
+	if err != nil {
+		return nil, err
+	}
 
-		stdout, err := container.Stdout(ctx)
+	container, err = env.withRuntime(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+
+	container, err = env.runCheckpointedSetup(ctx, container, resume)
+	if err != nil {
+		return nil, err
+	}
+	container = env.withRunAsUser(container)
+
+	if err := env.checkRequiredTools(ctx, container); err != nil {
+		return nil, err
+	}
+
+	container, err = env.withServices(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	container = env.withRuntimeEnv(container)
+
+	if env.Worktree != "" {
+		sourceDir := dag.Host().Directory(env.Worktree, dagger.HostDirectoryOpts{
+			NoCache: true,
+		})
+		container = container.WithDirectory(".", sourceDir, dagger.ContainerWithDirectoryOpts{
+			Owner: env.Config.RunAsUser,
+		})
+	}
+
+	return container, nil
+}
+
+func (env *Environment) runSetupCommands(ctx context.Context, container *dagger.Container, commands []string) (*dagger.Container, error) {
+	for _, layer := range setupLayers(commands, env.Config.SetupLayering, env.Config.SetupUsers) {
+		var err error
+		container, err = env.runSetupLayer(ctx, container, layer)
 		if err != nil {
-			var exitErr *dagger.ExecError
-			if errors.As(err, &exitErr) {
-				_ = env.addGitNote(ctx,
-					fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
-						command,
-						exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr,
-					),
-				)
-				return nil, fmt.Errorf("setup command failed with exit code %d.\nstdout: %s\nstderr: %s\n%w\n", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr, err)
-			}
+			return nil, err
+		}
+	}
+	return container, nil
+}
 
-			return nil, fmt.Errorf("failed to execute setup command: %w", err)
+func (env *Environment) runSetupLayer(ctx context.Context, container *dagger.Container, layer []string) (*dagger.Container, error) {
+	script, command := reportingSetupScript(layer, env.Config.SetupExitCodes), setupCommand(layer)
+	start := time.Now()
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	// Layers never mix users, so the first command tells the user of the
+	// layer.
+	user, setupUser := env.Config.SetupUsers[layer[0]], ""
+	if user != "" {
+		if setupUser, err = container.User(ctx); err != nil {
+			return nil, err
 		}
+		container = container.WithUser(user)
+	}
+	container = container.WithExec(append(shell, "-c", withUlimits(env.Config.Ulimits, script)))
 
-		_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, stdout))
+	stdout, err := container.Stdout(ctx)
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			stderr, statuses := parseSetupStatuses(exitErr.Stderr)
+			failed := command
+			if len(layer) == 1 {
+				failed = layer[0]
+			} else if len(statuses) > 0 {
+				// The script stops at the first failure, the last one reported.
+				failed = layer[slices.Max(slices.Collect(maps.Keys(statuses)))]
+			}
+			env.setupResults = append(env.setupResults, SetupResult{
+				Command:  failed,
+				ExitCode: exitErr.ExitCode,
+				Duration: Duration(time.Since(start)),
+			})
+			setupErr := &SetupError{
+				Command:  failed,
+				ExitCode: exitErr.ExitCode,
+				Stdout:   truncateLines(exitErr.Stdout),
+				Stderr:   truncateLines(stderr),
+				err:      err,
+			}
+			_ = env.addGitNote(ctx,
+				fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
+					command,
+					setupErr.ExitCode, setupErr.Stdout, setupErr.Stderr,
+				),
+			)
+			if env.Config.SetupLogMode == SetupLogNever {
+				setupErr.Stdout, setupErr.Stderr = "", ""
+			}
+			return nil, setupErr
+		}
+
+		return nil, fmt.Errorf("failed to execute setup command: %w", err)
 	}
 
-	env.Services, err = env.startServices(ctx)
+	if user != "" {
+		container = container.WithUser(setupUser)
+	}
+
+	_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, truncateLines(stdout)))
+	result := SetupResult{
+		Command:  command,
+		Duration: Duration(time.Since(start)),
+	}
+	if script != layer[0] {
+		// Commands allowed to exit non-zero reported their exit code.
+		stderr, err := container.Stderr(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, statuses := parseSetupStatuses(stderr); len(statuses) > 0 {
+			result.ExitCode = statuses[slices.Max(slices.Collect(maps.Keys(statuses)))]
+		}
+	}
+	if env.Config.SetupLogMode == SetupLogAlways {
+		result.Output = tailOutput(stdout)
+	}
+	env.setupResults = append(env.setupResults, result)
+	return container, nil
+}
+
+// withServices starts the services of the config and binds them to container.
+func (env *Environment) withServices(ctx context.Context, container *dagger.Container) (_ *dagger.Container, rerr error) {
+	var err error
+	env.Services, env.serviceFailures, err = env.startServices(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start services: %w", err)
 	}
+	defer func() {
+		if rerr != nil {
+			_ = stopServices(context.WithoutCancel(ctx), env.Services)
+			env.Services = nil
+		}
+	}()
+
 	for _, service := range env.Services {
 		container = container.WithServiceBinding(service.Config.Name, service.svc)
-	}
-
-	container = container.WithDirectory(".", sourceDir)
 
+		exports, err := service.Exports()
+		if err != nil {
+			return nil, err
+		}
+		container, err = containerWithEnvAndSecrets(container, exports, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return container, nil
 }
 
+// abortBuildOnError is deferred by build paths once services are started. If
+// the build fails, it stops those services and removes the environment from
+// the registry so that nothing is leaked.
+func (env *Environment) abortBuildOnError(ctx context.Context, rerr *error) {
+	if *rerr == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if err := stopServices(ctx, env.Services); err != nil {
+		slog.Warn("Failed to clean up services of failed build", "id", env.ID, "err", err)
+	}
+	env.Services = nil
+	env.serviceFailures = nil
+	unregisterEnvironment(env.ID)
+}
+
 func (env *Environment) UpdateConfig(ctx context.Context, explanation string, newConfig *EnvironmentConfig) error {
-	if env.Config.Locked(env.Source) {
-		return fmt.Errorf("Environment is locked, no updates allowed. Try to make do with the current environment or ask a human to remove the lock file (%s)", path.Join(env.Source, configDir, lockFile))
+	if env.Locked() {
+		return env.errLocked()
+	}
+	return env.rebuild(ctx, "update_config", "Update environment", explanation, newConfig, false)
+}
+
+// Rebuild builds the environment again from its current config. With resume,
+// the setup layers completed by the previous build, including one that
+// failed, are skipped when their inputs are unchanged.
+func (env *Environment) Rebuild(ctx context.Context, explanation string, resume bool) error {
+	return env.rebuild(ctx, "rebuild", "Rebuild environment", explanation, env.Config, resume)
+}
+
+func (env *Environment) rebuild(ctx context.Context, kind, name, explanation string, newConfig *EnvironmentConfig, resume bool) error {
+	env.opMu.Lock()
+	defer env.opMu.Unlock()
+
+	ctx, done := env.trackOperation(ctx, kind)
+	defer done()
+	return env.rebuildLocked(ctx, kind, name, explanation, newConfig, resume)
+}
+
+// rebuildLocked is the only way an environment gets rebuilt, so locked
+// environments are refused here rather than by each caller. It must be called
+// with the operation lock held.
+func (env *Environment) rebuildLocked(ctx context.Context, kind, name, explanation string, newConfig *EnvironmentConfig, resume bool) error {
+	if env.Locked() {
+		return env.errLocked()
+	}
+	if err := env.beginBuild(); err != nil {
+		return err
 	}
+	defer env.endBuild()
 
+	ctx, cancel := env.withDefaultTimeout(ctx)
+	defer cancel()
+
+	env.mu.Lock()
+	diff := DiffConfigs(env.builtConfig(), newConfig)
+	oldConfig, oldServices, oldFailures := env.Config, env.Services, env.serviceFailures
+	oldBaseImage := env.baseImage
 	env.Config = newConfig
+	env.mu.Unlock()
+	restore := func() {
+		env.mu.Lock()
+		defer env.mu.Unlock()
+		env.Config, env.Services, env.serviceFailures = oldConfig, oldServices, oldFailures
+		env.baseImage = oldBaseImage
+	}
 
 	// Re-build the base image from the worktree
-	container, err := env.buildBase(ctx)
+	container, err := env.buildBase(ctx, resume)
 	if err != nil {
+		restore()
 		return err
 	}
 
-	if err := env.apply(ctx, "Update environment", explanation, "", container); err != nil {
+	if err := env.apply(ctx, name, explanation, "", container); err != nil {
+		_ = stopServices(context.WithoutCancel(ctx), env.Services)
+		restore()
 		return err
 	}
+	env.mu.Lock()
+	env.appliedConfig = nil
+	env.mu.Unlock()
+	env.audit(ctx, kind, strings.Join(diff.Fields(), ", "))
 
-	return env.propagateToWorktree(ctx, "Update environment "+env.Name, explanation)
+	if err := env.propagateToWorktree(ctx, name+" "+env.Name, explanation); err != nil {
+		return err
+	}
+
+	if !diff.Empty() {
+		fireConfigChange(env, diff)
+	}
+	return nil
+}
+
+// EffectiveConfig returns a copy of the config with the runtime changes made
+// to the environment (e.g. SetEnv) applied.
+func (env *Environment) EffectiveConfig() *EnvironmentConfig {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	config := env.Config.Copy()
+	config.Env = mergeEnv(config.Env, env.runtimeEnv)
+	if env.runtimeInstructions != "" {
+		config.Instructions = env.runtimeInstructions
+	}
+	return config
+}
+
+// SetInstructions overrides the instructions of the environment for as long
+// as it lives, e.g. with task-specific context, without changing the config
+// that gets saved. An empty text removes the override.
+func (env *Environment) SetInstructions(ctx context.Context, text string) {
+	env.mu.Lock()
+	env.runtimeInstructions = text
+	env.mu.Unlock()
+	env.audit(ctx, "set_instructions", "")
+}
+
+// Instructions returns the effective instructions: the ones set with
+// SetInstructions if any, otherwise the ones from the config.
+func (env *Environment) Instructions() string {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.runtimeInstructions != "" {
+		return env.runtimeInstructions
+	}
+	return env.Config.Instructions
+}
+
+// Drift returns the differences between the config stored in baseDir and the
+// effective config of the running environment. A missing config is reported
+// as every field having drifted.
+func (env *Environment) Drift(baseDir string) (ConfigDiff, error) {
+	onDisk := &EnvironmentConfig{}
+	if err := onDisk.Load(baseDir); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return ConfigDiff{}, err
+		}
+		onDisk = &EnvironmentConfig{}
+	}
+	return DiffConfigs(onDisk, env.EffectiveConfig()), nil
+}
+
+func (env *Environment) Locked() bool {
+	if env.Ephemeral {
+		return false
+	}
+	if s := currentStore(); s != nil {
+		lock, err := s.ReadLock(env.ID)
+		return err != nil || lock != nil
+	}
+	return env.Config.Locked(env.Source)
+}
+
+func (env *Environment) errLocked() error {
+	return fmt.Errorf("Environment is locked, no updates allowed. Try to make do with the current environment or ask a human to remove the lock file (%s)", path.Join(env.Source, configDir, lockFile))
 }
 
 func Get(idOrName string) *Environment {
+	environmentsMu.RLock()
+	defer environmentsMu.RUnlock()
+
 	if environment, ok := environments[idOrName]; ok {
 		return environment
 	}
@@ -322,43 +911,49 @@ func List(ctx context.Context, source string) ([]string, error) {
 }
 
 func (env *Environment) Run(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (string, error) {
-	args := []string{}
-	if command != "" {
-		args = []string{shell, "-c", command}
-	}
-	newState := env.container.WithExec(args, dagger.ContainerWithExecOpts{
-		UseEntrypoint: useEntrypoint,
-	})
-	stdout, err := newState.Stdout(ctx)
+	result, err := env.Exec(ctx, explanation, command, shell, useEntrypoint)
 	if err != nil {
-		var exitErr *dagger.ExecError
-		if errors.As(err, &exitErr) {
-			_ = env.addGitNote(ctx,
-				fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
-					command,
-					exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr,
-				),
-			)
-			return fmt.Sprintf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr), nil
+		if result != nil {
+			return fmt.Sprintf("stdout: %s\nstderr: %s", result.Stdout, result.Stderr), err
 		}
 		return "", err
 	}
-	_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, stdout))
-	if err := env.apply(ctx, "Run "+command, explanation, stdout, newState); err != nil {
-		return "", err
+	if result.ExitCode != 0 {
+		return fmt.Sprintf("command failed with exit code %d.\nstdout: %s\nstderr: %s", result.ExitCode, result.Stdout, result.Stderr), nil
 	}
+	return result.Stdout, nil
+}
 
-	if err := env.propagateToWorktree(ctx, "Run "+command, explanation); err != nil {
-		return "", fmt.Errorf("failed to propagate to worktree: %w", err)
-	}
+const pingTimeout = 10 * time.Second
+
+// Ping verifies that the environment container is able to run commands.
+func (env *Environment) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
 
-	return stdout, nil
+	// Bust the exec cache so the container is actually exercised.
+	_, err := env.container.
+		WithEnvVariable("CU_PING", time.Now().String()).
+		WithExec([]string{"true"}).
+		Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("environment %s is not responsive: %w", env.ID, err)
+	}
+	return nil
 }
 
 func (env *Environment) RunBackground(ctx context.Context, explanation, command, shell string, ports []int, useEntrypoint bool) (EndpointMappings, error) {
+	ctx, done, err := env.beginOperation(ctx, "run_background")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, cancel := env.withDefaultTimeout(ctx)
+	defer cancel()
+
 	args := []string{}
 	if command != "" {
-		args = []string{shell, "-c", command}
+		args = []string{shell, "-c", withUlimits(env.Config.Ulimits, command)}
 	}
 	serviceState := env.container
 
@@ -386,6 +981,7 @@ func (env *Environment) RunBackground(ctx context.Context, explanation, command,
 	_ = env.addGitNote(ctx,
 		fmt.Sprintf("$ %s &\n\n", command),
 	)
+	env.audit(ctx, "run_background", redactCommand(command))
 
 	endpoints := EndpointMappings{}
 	for _, port := range ports {
@@ -423,46 +1019,201 @@ func (env *Environment) RunBackground(ctx context.Context, explanation, command,
 	return endpoints, nil
 }
 
+// SetEnv sets variables on the current container in place: the new revision is
+// the current state plus the variables, with no rebuild and no command run,
+// so the cost is a single sync of the container definition. Variables that
+// are part of the config (env, secrets, proxy, service exports) are instead
+// changed with UpdateConfig, which rebuilds from the base image because they
+// can affect setup commands and services.
 func (env *Environment) SetEnv(ctx context.Context, explanation string, envs []string) error {
+	ctx, done, err := env.beginOperation(ctx, "set_env")
+	if err != nil {
+		return err
+	}
+	defer done()
+	return env.setEnv(ctx, explanation, envs)
+}
+
+// setEnv must be called with the operation lock held.
+func (env *Environment) setEnv(ctx context.Context, explanation string, envs []string) error {
+	for _, entry := range envs {
+		if err := validateKV(entry); err != nil {
+			return fmt.Errorf("invalid environment variable: %w", err)
+		}
+	}
 	state := env.container
-	for _, env := range envs {
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid environment variable: %s", env)
+	for _, entry := range envs {
+		k, v, _ := parseKV(entry)
+		state = state.WithEnvVariable(k, v)
+	}
+	// The revision records the variables, so they must be set before it is
+	// appended.
+	env.mu.Lock()
+	oldRuntimeEnv := env.runtimeEnv
+	env.runtimeEnv = mergeEnv(env.runtimeEnv, envs)
+	env.mu.Unlock()
+	if err := env.apply(ctx, "Set env "+strings.Join(envs, ", "), explanation, "", state); err != nil {
+		env.mu.Lock()
+		env.runtimeEnv = oldRuntimeEnv
+		env.mu.Unlock()
+		return err
+	}
+	keys := make([]string, 0, len(envs))
+	for _, entry := range envs {
+		k, _, _ := parseKV(entry)
+		keys = append(keys, k)
+	}
+	env.audit(ctx, "set_env", strings.Join(keys, ", "))
+	return nil
+}
+
+const redactedValue = "<redacted>"
+
+var sensitiveEnvMarkers = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "API_KEY", "PRIVATE_KEY", "CREDENTIAL"}
+
+// Env returns the environment variables currently set in the container.
+// Values of variables that look sensitive, or that are declared as secrets,
+// are redacted unless raw is set. Secrets are always listed, redacted, since
+// the container doesn't expose their values.
+func (env *Environment) Env(ctx context.Context, raw bool) (map[string]string, error) {
+	env.mu.Lock()
+	container, secrets := env.container, kvMap(env.Config.Secrets)
+	env.mu.Unlock()
+	variables, err := container.EnvVariables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := make(map[string]string, len(variables))
+	for _, variable := range variables {
+		name, err := variable.Name(ctx)
+		if err != nil {
+			return nil, err
+		}
+		value, err := variable.Value(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, isSecret := secrets[name]; !raw && (isSecret || isSensitiveEnv(name)) {
+			value = redactedValue
 		}
-		state = state.WithEnvVariable(parts[0], parts[1])
+		envs[name] = value
 	}
-	return env.apply(ctx, "Set env "+strings.Join(envs, ", "), explanation, "", state)
+	for name := range secrets {
+		if _, ok := envs[name]; !ok {
+			envs[name] = redactedValue
+		}
+	}
+	return envs, nil
+}
+
+func isSensitiveEnv(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, marker := range sensitiveEnvMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeEnv returns base with the entries of overrides added, replacing the
+// entries of base with the same key.
+func mergeEnv(base, overrides []string) []string {
+	merged := slices.Clone(base)
+	for _, entry := range overrides {
+		k, _, _ := parseKV(entry)
+		idx := slices.IndexFunc(merged, func(e string) bool {
+			key, _, _ := parseKV(e)
+			return key == k
+		})
+		if idx == -1 {
+			merged = append(merged, entry)
+			continue
+		}
+		merged[idx] = entry
+	}
+	return merged
 }
 
 func (env *Environment) Revert(ctx context.Context, explanation string, version Version) error {
-	revision := env.History.Get(version)
+	ctx, done, err := env.beginOperation(ctx, "revert")
+	if err != nil {
+		return err
+	}
+	defer done()
+	revision := env.revision(version)
 	if revision == nil {
 		return errors.New("no revisions found")
 	}
-	if err := env.apply(ctx, "Revert to "+revision.Name, explanation, "", revision.container); err != nil {
+	if err := env.applyFrom(ctx, revision, "Revert to "+revision.Name, explanation, "", revision.container); err != nil {
 		return err
 	}
+	env.audit(ctx, "revert", fmt.Sprintf("to version %d", version))
 	return env.propagateToWorktree(ctx, "Revert to "+revision.Name, explanation)
 }
 
-func (env *Environment) Fork(ctx context.Context, explanation, name string, version *Version) (*Environment, error) {
+// Reset discards every change made since the environment was built by
+// restoring the container state of the root revision, without rebuilding. The
+// reset is recorded as a new revision, which is returned.
+func (env *Environment) Reset(ctx context.Context) (*Revision, error) {
+	ctx, done, err := env.beginOperation(ctx, "reset")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := env.resetToRoot(ctx, "Reset to initial state"); err != nil {
+		return nil, err
+	}
+
+	env.mu.Lock()
+	revision := env.History.Latest()
+	env.mu.Unlock()
+
+	if err := env.propagateToWorktree(ctx, "Reset to initial state", "Reset to the initial state"); err != nil {
+		return nil, fmt.Errorf("failed to propagate to worktree: %w", err)
+	}
+	return revision, nil
+}
+
+// resetToRoot restores the container state of the root revision, recording it
+// as a new revision, which drops runtime changes. It must be called with the
+// operation lock held.
+func (env *Environment) resetToRoot(ctx context.Context, name string) error {
+	root := env.History.Root()
+	if root == nil || root.container == nil {
+		return errors.New("no initial revision to reset to")
+	}
+	if err := env.applyFrom(ctx, root, name, "Reset to the initial state", "", root.container); err != nil {
+		return err
+	}
+	env.audit(ctx, "reset", fmt.Sprintf("to version %d", root.Version))
+	return nil
+}
+
+func (env *Environment) Fork(ctx context.Context, explanation, name string, version *Version) (_ *Environment, rerr error) {
 	revision := env.History.Latest()
 	if version != nil {
-		revision = env.History.Get(*version)
+		revision = env.revision(*version)
 	}
 	if revision == nil {
 		return nil, errors.New("version not found")
 	}
 
 	forkedEnvironment := &Environment{
-		ID:   fmt.Sprintf("%s/%s", name, petname.Generate(2, "-")),
-		Name: name,
+		ID:          NewEnvironmentID(name),
+		Name:        name,
+		annotations: maps.Clone(revision.Annotations),
+		runtimeEnv:  slices.Clone(revision.RuntimeEnv),
+		profiles:    env.Profiles(),
 	}
+	defer releaseIDOnError(forkedEnvironment.ID, &rerr)
 	if err := forkedEnvironment.apply(ctx, "Fork from "+env.Name, explanation, "", revision.container); err != nil {
 		return nil, err
 	}
-	environments[forkedEnvironment.ID] = forkedEnvironment
+	registerEnvironment(forkedEnvironment)
+	env.audit(ctx, "fork", fmt.Sprintf("version %d to %s", revision.Version, forkedEnvironment.ID))
 	return forkedEnvironment, nil
 }
 
@@ -470,7 +1221,9 @@ func (env *Environment) Terminal(ctx context.Context) error {
 	container := env.container
 	var cmd []string
 	var sourceRC string
-	if shells, err := container.File("/etc/shells").Contents(ctx); err == nil {
+	if env.Config.Shell != "" {
+		cmd = strings.Fields(env.Config.Shell)
+	} else if shells, err := container.File("/etc/shells").Contents(ctx); err == nil {
 		for shell := range strings.Lines(shells) {
 			if shell[0] == '#' {
 				continue
@@ -485,10 +1238,16 @@ func (env *Environment) Terminal(ctx context.Context) error {
 	}
 	// Try to show the same pretty PS1 as for the default /bin/sh terminal in dagger
 	container = container.WithNewFile("/cu/rc.sh", sourceRC+`export PS1="\033[33mcu\033[0m \033[02m\$(pwd | sed \"s|^\$HOME|~|\")\033[0m \$ "`+"\n")
-	if cmd == nil {
+	if cmd == nil || sourceRC == "" {
 		// If bash not available, assume POSIX shell
 		container = container.WithEnvVariable("ENV", "/cu/rc.sh")
-		cmd = []string{"sh"}
+	}
+	if cmd == nil {
+		shell, err := env.resolveShell(ctx, env.container)
+		if err != nil {
+			return err
+		}
+		cmd = shell
 	}
 	if _, err := container.Terminal(dagger.ContainerTerminalOpts{
 		Cmd: cmd,
@@ -502,6 +1261,30 @@ func (env *Environment) Checkpoint(ctx context.Context, target string) (string,
 	return env.container.Publish(ctx, target)
 }
 
+// Close stops the services of the environment and releases it from memory.
+// Persisted state, if any, is left untouched.
+func (env *Environment) Close(ctx context.Context) error {
+	env.runOnStop(ctx)
+
+	env.mu.Lock()
+	services := env.Services
+	env.Services = nil
+	env.state = StateClosed
+	env.mu.Unlock()
+
+	var errs []error
+	for _, service := range services {
+		if _, err := service.svc.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop service %s: %w", service.Config.Name, err))
+		}
+	}
+
+	unregisterEnvironment(env.ID)
+	env.audit(ctx, "close", "")
+
+	return errors.Join(errs...)
+}
+
 func (env *Environment) Delete(ctx context.Context) error {
 	env.mu.Lock()
 	defer env.mu.Unlock()
@@ -514,8 +1297,11 @@ func (env *Environment) Delete(ctx context.Context) error {
 		return err
 	}
 
+	env.state = StateClosed
+
 	// Remove from global environments map
-	delete(environments, env.ID)
+	unregisterEnvironment(env.ID)
+	env.audit(ctx, "delete", "")
 
 	return nil
 }
@@ -0,0 +1,396 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestInitializeUnreachableEngine(t *testing.T) {
+	if err := Initialize(context.Background(), nil); !errors.Is(err, ErrEngineUnavailable) {
+		t.Fatalf("Initialize(nil) = %v, want ErrEngineUnavailable", err)
+	}
+
+	// Point the client at a port nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	t.Setenv("DAGGER_SESSION_PORT", strconv.Itoa(port))
+	t.Setenv("DAGGER_SESSION_TOKEN", "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := dagger.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = Initialize(ctx, client)
+	if !errors.Is(err, ErrEngineUnavailable) {
+		t.Fatalf("Initialize() = %v, want ErrEngineUnavailable", err)
+	}
+	if err.Error() == ErrEngineUnavailable.Error() {
+		t.Errorf("Initialize() = %v, want the underlying error wrapped", err)
+	}
+}
+
+// BenchmarkSetEnv compares setting a variable in place with SetEnv against
+// changing it in the config, which rebuilds from the base image.
+func BenchmarkSetEnv(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("in-place", func(b *testing.B) {
+		env := newEngineEnvironment(b, nil)
+		for i := 0; b.Loop(); i++ {
+			if err := env.SetEnv(ctx, "benchmark", []string{fmt.Sprintf("BENCH=%d", i)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("rebuild", func(b *testing.B) {
+		env := newEngineEnvironment(b, nil)
+		base := env.Config.Copy()
+		for i := 0; b.Loop(); i++ {
+			config := base.Copy()
+			config.Env = append(config.Env, fmt.Sprintf("BENCH=%d", i))
+			if err := env.UpdateConfig(ctx, "benchmark", config); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestParseKV(t *testing.T) {
+	for _, tt := range []struct {
+		entry      string
+		key, value string
+		ok         bool
+	}{
+		{"FOO=bar", "FOO", "bar", true},
+		{"FOO=", "FOO", "", true},
+		{"FOO=a=b=c", "FOO", "a=b=c", true},
+		{"FOO= spaced ", "FOO", " spaced ", true},
+		{"=bar", "", "", false},
+		{"=", "", "", false},
+		{"FOO", "", "", false},
+		{"", "", "", false},
+	} {
+		key, value, ok := parseKV(tt.entry)
+		if key != tt.key || value != tt.value || ok != tt.ok {
+			t.Errorf("parseKV(%q) = %q, %q, %v, want %q, %q, %v", tt.entry, key, value, ok, tt.key, tt.value, tt.ok)
+		}
+		if err := validateKV(tt.entry); (err == nil) != tt.ok {
+			t.Errorf("validateKV(%q) = %v, want ok %v", tt.entry, err, tt.ok)
+		}
+	}
+}
+
+func TestEphemeralEnvironmentsArentPersisted(t *testing.T) {
+	store := NewMemoryStore()
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+
+	env := &Environment{ID: "ephemeral", Ephemeral: true, Config: DefaultConfig()}
+	if err := store.WriteLock(env.ID, &LockMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if env.Locked() {
+		t.Error("ephemeral environment is locked")
+	}
+	if lock, err := env.LockInfo(); lock != nil || err != nil {
+		t.Errorf("LockInfo() = %v, %v, want nil", lock, err)
+	}
+
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", nil, "")
+	env.mu.Unlock()
+	if err := env.persistHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.propagateToWorktree(context.Background(), "create", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadHistory(env.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ephemeral history was stored: %v", err)
+	}
+	if _, err := store.ReadConfig(env.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ephemeral config was stored: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	if err := env.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() of a healthy environment = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := env.Ping(ctx); err == nil {
+		t.Error("Ping() with a canceled context succeeded")
+	}
+
+	// An empty container has no true(1) to run.
+	broken := &Environment{ID: "broken", container: dag.Container()}
+	if err := broken.Ping(context.Background()); err == nil {
+		t.Error("Ping() of a broken container succeeded")
+	}
+}
+
+func TestIsSensitiveEnv(t *testing.T) {
+	for name, want := range map[string]bool{
+		"GITHUB_TOKEN":    true,
+		"db_password":     true,
+		"AWS_SECRET_KEY":  true,
+		"OPENAI_API_KEY":  true,
+		"SSH_PRIVATE_KEY": true,
+		"GCP_CREDENTIALS": true,
+		"PATH":            false,
+		"HOME":            false,
+		"TOKENIZER_MODEL": true,
+		"KEYBOARD_LAYOUT": false,
+	} {
+		if got := isSensitiveEnv(name); got != want {
+			t.Errorf("isSensitiveEnv(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CONTAINER_USE_TEST_SECRET", "hunter2")
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Env = []string{"FOO=bar", "QUERY=a=b&c=", "EMPTY=", "GITHUB_TOKEN=ghp_test"}
+	config.Secrets = []string{"DB_URL=env://CONTAINER_USE_TEST_SECRET"}
+	env := newEngineEnvironment(t, config)
+
+	envs, err := env.Env(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envs["FOO"] != "bar" || envs["GITHUB_TOKEN"] != redactedValue {
+		t.Errorf("Env() = %v, want FOO set and GITHUB_TOKEN redacted", envs)
+	}
+	if value, ok := envs["QUERY"]; !ok || value != "a=b&c=" {
+		t.Errorf("Env() QUERY = %q, %v, want everything after the first =", value, ok)
+	}
+	if value, ok := envs["EMPTY"]; !ok || value != "" {
+		t.Errorf("Env() EMPTY = %q, %v, want an empty value", value, ok)
+	}
+	if envs["DB_URL"] != redactedValue {
+		t.Errorf("Env() DB_URL = %q, want the secret listed and redacted", envs["DB_URL"])
+	}
+
+	raw, err := env.Env(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw["GITHUB_TOKEN"] != "ghp_test" {
+		t.Errorf("Env(raw) GITHUB_TOKEN = %q", raw["GITHUB_TOKEN"])
+	}
+}
+
+func TestAbortBuildOnError(t *testing.T) {
+	env := &Environment{ID: "abort/build", serviceFailures: map[string]*ServiceFailure{"db": {}}}
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(env.ID) })
+
+	var err error
+	env.abortBuildOnError(context.Background(), &err)
+	if Get(env.ID) == nil {
+		t.Fatal("a successful build was unregistered")
+	}
+
+	err = errors.New("setup failed")
+	env.abortBuildOnError(context.Background(), &err)
+	if Get(env.ID) != nil {
+		t.Error("a failed build is still registered")
+	}
+	if env.Services != nil || env.serviceFailures != nil {
+		t.Errorf("a failed build kept its services: %v, %v", env.Services, env.serviceFailures)
+	}
+}
+
+func TestFailedBuildIsNotRegistered(t *testing.T) {
+	requireEngine(t)
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupCommands = []string{"exit 3"}
+	config.Services = ServiceConfigs{{Name: "web", Image: alpineImage, Command: "httpd -f", ExposedPorts: []int{80}}}
+
+	name := "failed-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := CreateEphemeral(context.Background(), "", name, config); err == nil {
+		t.Fatal("CreateEphemeral() with a failing setup command succeeded")
+	}
+	for _, info := range ListInfo() {
+		if info.Name == name {
+			t.Errorf("the failed environment %s is registered", info.ID)
+		}
+	}
+}
+
+func TestResetWithoutInitialState(t *testing.T) {
+	env := &Environment{}
+	if _, err := env.Reset(context.Background()); err == nil {
+		t.Error("Reset() of an empty history succeeded")
+	}
+
+	// Imported revisions have no container to restore.
+	env.mu.Lock()
+	env.appendRevision(nil, "imported", "", "", nil, "")
+	env.mu.Unlock()
+	if _, err := env.Reset(context.Background()); err == nil {
+		t.Error("Reset() to a root without a container succeeded")
+	}
+}
+
+func TestReset(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+	root := env.History.Root()
+
+	if _, err := env.Run(ctx, "mutate", "echo changed > added && mkdir -p dir && touch dir/file", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.FileWrite(ctx, "write", "written", "contents"); err != nil {
+		t.Fatal(err)
+	}
+
+	revision, err := env.Reset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision == nil || revision.Version != env.History.LatestVersion() || revision.Parent != root.Version {
+		t.Errorf("Reset() = %+v, want a new revision on top of the root %d", revision, root.Version)
+	}
+	diff, err := env.RevisionDiff(ctx, env.Config.Workdir, root.Version, revision.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Errorf("workdir after Reset() differs from the initial state:\n%s", diff)
+	}
+}
+
+func TestSetEnvInPlace(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupCommands = []string{"date +%s%N >> /setup-runs"}
+	env := newEngineEnvironment(t, config)
+
+	before := env.History.LatestVersion()
+	if err := env.SetEnv(ctx, "set", []string{"FOO=bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := env.History.LatestVersion(); got != before+1 {
+		t.Errorf("version after SetEnv() = %d, want %d", got, before+1)
+	}
+
+	out, err := env.Run(ctx, "check", "echo $FOO; wc -l < /setup-runs", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(out); !slices.Equal(got, []string{"bar", "1"}) {
+		t.Errorf("after SetEnv() = %q, want FOO set and setup run once", out)
+	}
+
+	if err := env.SetEnv(ctx, "set", []string{"=missing-key"}); err == nil {
+		t.Error("SetEnv() accepted an invalid variable")
+	}
+}
+
+func TestRuntimeInstructionsArentSaved(t *testing.T) {
+	store := NewMemoryStore()
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+
+	config := DefaultConfig()
+	config.Instructions = "Run make test."
+	env := &Environment{ID: "instructions/test", Config: config}
+	env.SetInstructions(context.Background(), "Fix the flaky login test.")
+
+	if got := env.Instructions(); got != "Fix the flaky login test." {
+		t.Errorf("Instructions() = %q, want the runtime ones", got)
+	}
+	if got := env.EffectiveConfig().Instructions; got != "Fix the flaky login test." {
+		t.Errorf("EffectiveConfig().Instructions = %q, want the runtime ones", got)
+	}
+
+	dir := t.TempDir()
+	if err := env.saveConfig(dir); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(filepath.Join(dir, configDir, instructionsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != "Run make test." {
+		t.Errorf("saved instructions = %q, want the config ones", saved)
+	}
+	stored, err := store.ReadConfig(env.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Instructions != "Run make test." {
+		t.Errorf("stored instructions = %q, want the config ones", stored.Instructions)
+	}
+
+	env.SetInstructions(context.Background(), "")
+	if got := env.Instructions(); got != "Run make test." {
+		t.Errorf("Instructions() after clearing the override = %q", got)
+	}
+}
+
+func TestFailedServiceStopsStartedOnes(t *testing.T) {
+	requireEngine(t)
+	var mu sync.Mutex
+	var stopped []string
+	stop := stopService
+	stopService = func(ctx context.Context, service *Service) error {
+		mu.Lock()
+		stopped = append(stopped, service.Config.Name)
+		mu.Unlock()
+		return stop(ctx, service)
+	}
+	t.Cleanup(func() { stopService = stop })
+
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Services = ServiceConfigs{
+		{Name: "web", Image: alpineImage, Command: "httpd -f", ExposedPorts: []int{80}},
+		{Name: "broken", Image: "alpine:container-use-missing-tag", DependsOn: []string{"web"}},
+	}
+	name := "failed-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := CreateEphemeral(context.Background(), "", name, config); err == nil {
+		t.Fatal("CreateEphemeral() with a failing required service succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Contains(stopped, "web") {
+		t.Errorf("stopped services = %v, want web stopped once broken failed", stopped)
+	}
+	for _, info := range ListInfo() {
+		if info.Name == name {
+			t.Errorf("the failed environment %s is registered", info.ID)
+		}
+	}
+}
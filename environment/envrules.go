@@ -0,0 +1,73 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// EnvRule constrains the value of an environment variable. Pattern must match
+// the whole value. An unset variable only violates Required.
+type EnvRule struct {
+	Required bool     `json:"required,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	OneOf    []string `json:"one_of,omitempty"`
+}
+
+// EnvRules map environment variable names to their rule.
+type EnvRules map[string]EnvRule
+
+// validateEnvRules checks the rules against the env of the config, as set in
+// the container: proxy variables overridden by Env entries, themselves
+// overridden by secrets. Secrets count as set, but their values can't be
+// checked. Every violation is reported, without the values of variables that
+// look sensitive.
+func validateEnvRules(config *EnvironmentConfig) error {
+	env := map[string]string{}
+	for _, entry := range slices.Concat(config.Proxy.Env(), config.Env) {
+		if k, v, ok := parseKV(entry); ok {
+			env[k] = v
+		}
+	}
+	secrets := map[string]bool{}
+	for _, entry := range config.Secrets {
+		if k, _, ok := parseKV(entry); ok {
+			secrets[k] = true
+		}
+	}
+
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(config.EnvRules)) {
+		rule := config.EnvRules[key]
+		if secrets[key] {
+			continue
+		}
+		value, ok := env[key]
+		if !ok {
+			if rule.Required {
+				errs = append(errs, fmt.Errorf("env %s: required but not set", key))
+			}
+			continue
+		}
+		shown := strconv.Quote(value)
+		if isSensitiveEnv(key) {
+			shown = "value"
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				errs = append(errs, fmt.Errorf("env %s: invalid pattern %q: %w", key, rule.Pattern, err))
+			} else if !re.MatchString(value) {
+				errs = append(errs, fmt.Errorf("env %s: %s doesn't match pattern %q", key, shown, rule.Pattern))
+			}
+		}
+		if len(rule.OneOf) > 0 && !slices.Contains(rule.OneOf, value) {
+			errs = append(errs, fmt.Errorf("env %s: %s is not one of %s", key, shown, strings.Join(rule.OneOf, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,110 @@
+package environment
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEnvRules(t *testing.T) {
+	rules := EnvRules{
+		"PORT":        {Pattern: `[0-9]+`},
+		"LOG_LEVEL":   {OneOf: []string{"debug", "info", "warn"}},
+		"API_URL":     {Required: true, Pattern: `https?://.+`},
+		"API_TOKEN":   {Required: true},
+		"DB_PASSWORD": {Pattern: `.{12,}`},
+	}
+	for _, tt := range []struct {
+		name    string
+		env     []string
+		secrets []string
+		proxy   *ProxyConfig
+		want    []string
+	}{
+		{
+			name:    "valid",
+			env:     []string{"PORT=8080", "LOG_LEVEL=info", "API_URL=https://api"},
+			secrets: []string{"API_TOKEN=env://TOKEN"},
+		},
+		{
+			name:    "pattern",
+			env:     []string{"PORT=abc", "API_URL=https://api"},
+			secrets: []string{"API_TOKEN=env://TOKEN"},
+			want:    []string{`env PORT: "abc" doesn't match pattern "[0-9]+"`},
+		},
+		{
+			// Patterns match whole values.
+			name:    "partial match",
+			env:     []string{"PORT=80a", "API_URL=https://api"},
+			secrets: []string{"API_TOKEN=env://TOKEN"},
+			want:    []string{`env PORT: "80a" doesn't match pattern`},
+		},
+		{
+			name:    "enum",
+			env:     []string{"LOG_LEVEL=trace", "API_URL=https://api"},
+			secrets: []string{"API_TOKEN=env://TOKEN"},
+			want:    []string{`env LOG_LEVEL: "trace" is not one of debug, info, warn`},
+		},
+		{
+			name: "required missing",
+			env:  []string{"PORT=8080"},
+			want: []string{"env API_TOKEN: required but not set", "env API_URL: required but not set"},
+		},
+		{
+			// Values of sensitive variables aren't echoed.
+			name:    "sensitive value",
+			env:     []string{"API_URL=https://api", "DB_PASSWORD=hunter2"},
+			secrets: []string{"API_TOKEN=env://TOKEN"},
+			want:    []string{`env DB_PASSWORD: value doesn't match pattern`},
+		},
+		{
+			// Later Env entries override proxy variables and earlier entries.
+			name:  "overrides",
+			env:   []string{"API_URL=ftp://api", "API_URL=http://api", "API_TOKEN=x"},
+			proxy: &ProxyConfig{HTTP: "http://proxy:3128"},
+		},
+	} {
+		config := DefaultConfig()
+		config.EnvRules = rules
+		config.Env = tt.env
+		config.Secrets = tt.secrets
+		config.Proxy = tt.proxy
+		err := validateEnvRules(config)
+		if len(tt.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: validateEnvRules() = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: validateEnvRules() succeeded, want %q", tt.name, tt.want)
+			continue
+		}
+		if got := strings.Count(err.Error(), "\n") + 1; got != len(tt.want) {
+			t.Errorf("%s: validateEnvRules() = %v, want %d violations", tt.name, err, len(tt.want))
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: validateEnvRules() = %v, want %q", tt.name, err, want)
+			}
+		}
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("%s: validateEnvRules() = %v, leaks a sensitive value", tt.name, err)
+		}
+	}
+}
+
+func TestEnvRulesInValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.Env = []string{"PORT=abc"}
+	config.EnvRules = EnvRules{"PORT": {Pattern: `[0-9]+`}, "MODE": {Pattern: `(`}}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("Validate() = %v, want the PORT violation", err)
+	}
+
+	// An invalid pattern is only reported once its variable is set.
+	config.Env = []string{"PORT=80", "MODE=x"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("Validate() = %v, want the invalid pattern reported", err)
+	}
+}
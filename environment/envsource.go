@@ -0,0 +1,75 @@
+package environment
+
+import (
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+// The EnvSource constants name the layers the variables of the environment
+// container come from. Each layer overrides the variables of the layers before
+// it, key by key:
+//
+//  1. the base image
+//  2. the proxy config
+//  3. config env
+//  4. config secrets
+//  5. service exports, in service order
+//  6. SetEnv
+//
+// Rebuilds and config updates keep this order: SetEnv values survive a
+// rebuild, and changing a layer doesn't clobber a key set by a later one.
+const (
+	EnvSourceImage   = "image"
+	EnvSourceProxy   = "proxy"
+	EnvSourceConfig  = "config"
+	EnvSourceSecret  = "secret"
+	EnvSourceRuntime = "runtime"
+)
+
+// EnvSource returns the layer the value of key comes from: one of the
+// EnvSource constants, or "service:<name>" for service exports. Keys not set
+// by any layer report EnvSourceImage, whether or not the base image sets
+// them.
+func (env *Environment) EnvSource(key string) string {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.envSource(key)
+}
+
+func (env *Environment) envSource(key string) string {
+	if hasKey(env.runtimeEnv, key) {
+		return EnvSourceRuntime
+	}
+	for _, svc := range slices.Backward(env.Services) {
+		exports, err := svc.Exports()
+		if err == nil && hasKey(exports, key) {
+			return "service:" + svc.Config.Name
+		}
+	}
+	switch {
+	case hasKey(env.Config.Secrets, key):
+		return EnvSourceSecret
+	case hasKey(env.Config.Env, key):
+		return EnvSourceConfig
+	case hasKey(env.Config.Proxy.Env(), key):
+		return EnvSourceProxy
+	}
+	return EnvSourceImage
+}
+
+// withRuntimeEnv re-applies the variables set with SetEnv on top of container.
+func (env *Environment) withRuntimeEnv(container *dagger.Container) *dagger.Container {
+	for _, entry := range env.runtimeEnv {
+		k, v, _ := parseKV(entry)
+		container = container.WithEnvVariable(k, v)
+	}
+	return container
+}
+
+func hasKey(entries []string, key string) bool {
+	return slices.ContainsFunc(entries, func(entry string) bool {
+		k, _, _ := parseKV(entry)
+		return k == key
+	})
+}
@@ -0,0 +1,125 @@
+package environment
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestEnvSource(t *testing.T) {
+	config := DefaultConfig()
+	config.Proxy = &ProxyConfig{HTTP: "http://proxy:3128"}
+	config.Env = []string{"HTTP_PROXY=http://other:3128", "DB_URL=postgres://db", "DB_HOST=localhost", "LEVEL=config"}
+	config.Secrets = []string{"DB_URL=env://DB_URL"}
+	env := &Environment{
+		Config: config,
+		Services: []*Service{
+			{Config: &ServiceConfig{Name: "db", Exports: map[string]string{"DB_HOST": "$host", "SHARED": "db"}}},
+			{Config: &ServiceConfig{Name: "cache", Exports: map[string]string{"SHARED": "cache"}}},
+		},
+		runtimeEnv: []string{"LEVEL=runtime"},
+	}
+
+	for key, want := range map[string]string{
+		"PATH":       EnvSourceImage,
+		"http_proxy": EnvSourceProxy,
+		"HTTP_PROXY": EnvSourceConfig,
+		"DB_URL":     EnvSourceSecret,
+		"DB_HOST":    "service:db",
+		"SHARED":     "service:cache",
+		"LEVEL":      EnvSourceRuntime,
+	} {
+		if got := env.EnvSource(key); got != want {
+			t.Errorf("EnvSource(%s) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Proxy = &ProxyConfig{HTTP: "http://proxy:3128"}
+	config.Env = []string{"HTTP_PROXY=http://other:3128", "LEVEL=config"}
+	env := newEngineEnvironment(t, config)
+
+	if err := env.SetEnv(ctx, "override", []string{"LEVEL=runtime"}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string) {
+		t.Helper()
+		vars, err := env.Env(ctx, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{
+			"http_proxy": "http://proxy:3128",
+			"HTTP_PROXY": "http://other:3128",
+			"LEVEL":      "runtime",
+		} {
+			if vars[key] != want {
+				t.Errorf("%s: %s = %q, want %q", when, key, vars[key], want)
+			}
+		}
+	}
+	check("after SetEnv")
+
+	// Rebuilding from a changed config layer keeps the runtime layer on top.
+	config = env.Config.Copy()
+	config.Env = append(config.Env, "EXTRA=1")
+	env.Config = config
+	if err := env.Rebuild(ctx, "config change", false); err != nil {
+		t.Fatal(err)
+	}
+	check("after Rebuild")
+}
+
+func TestRevisionsRecordRuntimeEnv(t *testing.T) {
+	env := &Environment{Config: DefaultConfig()}
+	env.mu.Lock()
+	before := env.appendRevision(nil, "create", "", "", nil, "")
+	env.runtimeEnv = []string{"LEVEL=runtime"}
+	after := env.appendRevision(nil, "set env", "", "", nil, "")
+	env.mu.Unlock()
+	if before.RuntimeEnv != nil || !slices.Equal(after.RuntimeEnv, []string{"LEVEL=runtime"}) {
+		t.Fatalf("recorded runtime env = %v then %v", before.RuntimeEnv, after.RuntimeEnv)
+	}
+
+	// Going back to an earlier history takes its runtime layer along.
+	env.mu.Lock()
+	env.replaceHistory(History{before})
+	env.mu.Unlock()
+	if got := env.EnvSource("LEVEL"); got == EnvSourceRuntime {
+		t.Errorf("EnvSource(LEVEL) after going back = %q", got)
+	}
+}
+
+func TestRevertRestoresRuntimeEnv(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Env = []string{"LEVEL=config"}
+	env := newEngineEnvironment(t, config)
+	version := env.History.LatestVersion()
+
+	if err := env.SetEnv(ctx, "override", []string{"LEVEL=runtime"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Revert(ctx, "undo", version); err != nil {
+		t.Fatal(err)
+	}
+	if got := env.EnvSource("LEVEL"); got != EnvSourceConfig {
+		t.Errorf("EnvSource(LEVEL) after Revert = %q, want %q", got, EnvSourceConfig)
+	}
+	if !slices.Contains(env.EffectiveConfig().Env, "LEVEL=config") {
+		t.Errorf("effective env after Revert = %v", env.EffectiveConfig().Env)
+	}
+
+	// Reverting to the revision SetEnv made brings the variable back.
+	if err := env.Revert(ctx, "redo", version+1); err != nil {
+		t.Fatal(err)
+	}
+	if got := env.EnvSource("LEVEL"); got != EnvSourceRuntime {
+		t.Errorf("EnvSource(LEVEL) after reverting to SetEnv = %q, want %q", got, EnvSourceRuntime)
+	}
+}
@@ -0,0 +1,93 @@
+package environment
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventSchemaVersion is bumped whenever the event layout changes in a way
+// consumers need to know about.
+const eventSchemaVersion = 1
+
+type EventType string
+
+const (
+	EventBuildStart EventType = "build_start"
+	EventBuildEnd   EventType = "build_end"
+	EventCommand    EventType = "command"
+	EventRevision   EventType = "revision"
+	EventService    EventType = "service"
+	EventPullStart  EventType = "pull_start"
+	EventPull       EventType = "pull"
+)
+
+// Event is a lifecycle event written to the event sink as a JSON line. Type
+// tells which of the optional fields are set.
+type Event struct {
+	Schema        int       `json:"schema"`
+	Type          EventType `json:"type"`
+	Time          time.Time `json:"time"`
+	EnvironmentID string    `json:"environment_id"`
+
+	Command  string       `json:"command,omitempty"`
+	ExitCode int          `json:"exit_code,omitempty"`
+	Version  Version      `json:"version,omitempty"`
+	Service  string       `json:"service,omitempty"`
+	Image    string       `json:"image,omitempty"`
+	Attempt  int          `json:"attempt,omitempty"`
+	State    ServiceState `json:"state,omitempty"`
+	Duration Duration     `json:"duration,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+var (
+	eventSinkMu sync.Mutex
+	eventSink   io.Writer
+)
+
+// SetEventSink sets the writer receiving every lifecycle event as newline
+// delimited JSON. A nil writer disables it.
+func SetEventSink(w io.Writer) {
+	eventSinkMu.Lock()
+	defer eventSinkMu.Unlock()
+	eventSink = w
+}
+
+func (env *Environment) emit(event Event) {
+	eventSinkMu.Lock()
+	defer eventSinkMu.Unlock()
+	if eventSink == nil {
+		return
+	}
+
+	event.Schema = eventSchemaVersion
+	event.Time = time.Now()
+	event.EnvironmentID = env.ID
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	_, _ = eventSink.Write(append(data, '\n'))
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// redactCommand hides the values of KEY=VALUE words whose key looks
+// sensitive.
+func redactCommand(command string) string {
+	words := strings.Fields(command)
+	for i, word := range words {
+		if k, _, ok := parseKV(word); ok && isSensitiveEnv(k) {
+			words[i] = k + "=" + redactedValue
+		}
+	}
+	return strings.Join(words, " ")
+}
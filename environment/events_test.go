@@ -0,0 +1,51 @@
+package environment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventSink(t *testing.T) {
+	var buf bytes.Buffer
+	SetEventSink(&buf)
+	t.Cleanup(func() { SetEventSink(nil) })
+
+	env := &Environment{ID: "events/test"}
+	env.emit(Event{Type: EventBuildStart})
+	env.emit(Event{Type: EventCommand, Command: redactCommand("GITHUB_TOKEN=ghp_secret make test"), ExitCode: 2})
+	env.emit(Event{Type: EventBuildEnd, Duration: Duration(time.Second), Error: errorString(errors.New("setup failed"))})
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("sink got %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	events := make([]Event, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+			t.Fatalf("line %d isn't valid JSON: %v\n%s", i, err, line)
+		}
+		if events[i].Schema != eventSchemaVersion || events[i].EnvironmentID != env.ID || events[i].Time.IsZero() {
+			t.Errorf("event %d = %+v, want the schema, environment and time set", i, events[i])
+		}
+	}
+
+	if events[0].Type != EventBuildStart || events[2].Type != EventBuildEnd || events[2].Error != "setup failed" {
+		t.Errorf("events = %+v", events)
+	}
+	if got := events[1].Command; got != "GITHUB_TOKEN=<redacted> make test" || events[1].ExitCode != 2 {
+		t.Errorf("command event = %+v, want the token redacted", events[1])
+	}
+	if strings.Contains(buf.String(), "ghp_secret") {
+		t.Error("sink got the secret")
+	}
+
+	SetEventSink(nil)
+	env.emit(Event{Type: EventBuildStart})
+	if got := strings.Count(buf.String(), "\n"); got != 3 {
+		t.Errorf("sink got %d lines after being unset, want 3", got)
+	}
+}
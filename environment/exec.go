@@ -0,0 +1,345 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"dagger.io/dagger"
+)
+
+// execTimeoutGrace is how long before the context deadline a command is
+// stopped inside the container, which leaves enough time to collect whatever
+// output it produced.
+const execTimeoutGrace = 2 * time.Second
+
+// defaultMaxLineBytes is generous enough for any line meant to be read, while
+// keeping minified files or encoded blobs from flooding the output.
+const defaultMaxLineBytes = 64 * 1024
+
+var (
+	maxLineBytesMu sync.RWMutex
+	maxLineBytes   = defaultMaxLineBytes
+)
+
+// SetMaxLineBytes sets the length past which lines of captured command output
+// and service logs are truncated. Zero or less disables truncation.
+func SetMaxLineBytes(n int) {
+	maxLineBytesMu.Lock()
+	defer maxLineBytesMu.Unlock()
+	maxLineBytes = n
+}
+
+// truncateLines shortens the lines of output longer than the configured
+// limit, marking how much was cut. Other lines are left untouched.
+func truncateLines(output string) string {
+	maxLineBytesMu.RLock()
+	limit := maxLineBytes
+	maxLineBytesMu.RUnlock()
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+
+	out := &strings.Builder{}
+	for line := range strings.Lines(output) {
+		content := strings.TrimSuffix(line, "\n")
+		if len(content) <= limit {
+			out.WriteString(line)
+			continue
+		}
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		fmt.Fprintf(out, "%s... [%d bytes truncated]", content[:cut], len(content)-cut)
+		if len(content) < len(line) {
+			out.WriteString("\n")
+		}
+	}
+	return out.String()
+}
+
+type ExecResult struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// Exec runs command in the environment and records the resulting state as a
+// new revision if it succeeds. A non-zero exit code is not an error. If ctx
+// expires while the command is running, the error wraps
+// context.DeadlineExceeded. When the image provides timeout(1), the command
+// is stopped inside the container just before the deadline and the output
+// captured so far is returned too.
+func (env *Environment) Exec(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (*ExecResult, error) {
+	ctx, done, err := env.beginOperation(ctx, "run")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return env.exec(ctx, explanation, command, shell, useEntrypoint)
+}
+
+// exec must be called with the operation lock held.
+func (env *Environment) exec(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (result *ExecResult, rerr error) {
+	ctx, cancel := env.withDefaultTimeout(ctx)
+	defer cancel()
+
+	args := []string{}
+	if command != "" {
+		args = []string{shell, "-c", withUlimits(env.Config.Ulimits, command)}
+	}
+	var timeout time.Duration
+	if _, ok := ctx.Deadline(); ok && !useEntrypoint && env.hasTimeoutCommand(ctx, env.container) {
+		args, timeout = withDeadline(ctx, args)
+	}
+
+	start := time.Now()
+	defer func() {
+		event := Event{Type: EventCommand, Command: redactCommand(command), Duration: Duration(time.Since(start)), Error: errorString(rerr)}
+		if result != nil {
+			event.ExitCode = result.ExitCode
+		}
+		env.emit(event)
+	}()
+
+	newState := env.container.WithExec(args, dagger.ContainerWithExecOpts{
+		UseEntrypoint: useEntrypoint,
+	})
+	stdout, err := newState.Stdout(ctx)
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if !errors.As(err, &exitErr) {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("command timed out: %w", context.DeadlineExceeded)
+			}
+			return nil, err
+		}
+		result = &ExecResult{
+			Stdout:   truncateLines(exitErr.Stdout),
+			Stderr:   truncateLines(exitErr.Stderr),
+			ExitCode: exitErr.ExitCode,
+		}
+		_ = env.addGitNote(ctx,
+			fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
+				command,
+				result.ExitCode, result.Stdout, result.Stderr,
+			),
+		)
+		if timeout > 0 && exitErr.ExitCode == timeoutExitCode {
+			return result, fmt.Errorf("command timed out after %s: %w", timeout, context.DeadlineExceeded)
+		}
+		return result, nil
+	}
+	stderr, err := newState.Stderr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr = truncateLines(stdout), truncateLines(stderr)
+
+	_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, stdout))
+	if err := env.applyConfined(ctx, "Run "+command, explanation, stdout, newState); err != nil {
+		return nil, err
+	}
+	env.audit(ctx, "run", redactCommand(command))
+
+	if err := env.propagateToWorktree(ctx, "Run "+command, explanation); err != nil {
+		return nil, fmt.Errorf("failed to propagate to worktree: %w", err)
+	}
+
+	return &ExecResult{Stdout: stdout, Stderr: stderr}, nil
+}
+
+// SetDefaultTimeout sets the timeout applied to commands and builds when the
+// context they are given has no deadline. Zero disables it.
+func (env *Environment) SetDefaultTimeout(d time.Duration) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.defaultTimeout = d
+}
+
+func (env *Environment) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	env.mu.Lock()
+	timeout := env.defaultTimeout
+	env.mu.Unlock()
+
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutExitCode is the exit code of timeout(1) when it stopped the command.
+const timeoutExitCode = 124
+
+var (
+	timeoutCacheMu sync.Mutex
+	// timeoutCache holds whether timeout(1) runs in each image.
+	timeoutCache = map[string]bool{}
+)
+
+// timeoutWorks runs timeout(1) in container. It is a variable so it can be
+// swapped out.
+var timeoutWorks = func(ctx context.Context, container *dagger.Container) bool {
+	_, err := container.WithExec([]string{"timeout", "1", "true"}).Sync(ctx)
+	return err == nil
+}
+
+// probeTimeout reports whether timeout(1) runs in container. When image is
+// set, the result is cached for that image.
+func probeTimeout(ctx context.Context, image string, container *dagger.Container) bool {
+	if image != "" {
+		timeoutCacheMu.Lock()
+		works, ok := timeoutCache[image]
+		timeoutCacheMu.Unlock()
+		if ok {
+			return works
+		}
+	}
+
+	works := timeoutWorks(ctx, container)
+	if ctx.Err() != nil {
+		return false
+	}
+	if image != "" {
+		timeoutCacheMu.Lock()
+		timeoutCache[image] = works
+		timeoutCacheMu.Unlock()
+	}
+	return works
+}
+
+// hasTimeoutCommand reports whether timeout(1) runs in the environment,
+// probing container the first time after each build.
+func (env *Environment) hasTimeoutCommand(ctx context.Context, container *dagger.Container) bool {
+	env.mu.Lock()
+	hasTimeout, image := env.hasTimeout, env.Config.BaseImage
+	env.mu.Unlock()
+	if hasTimeout != nil {
+		return *hasTimeout
+	}
+
+	works := probeTimeout(ctx, image, container)
+	if ctx.Err() == nil {
+		env.mu.Lock()
+		env.hasTimeout = &works
+		env.mu.Unlock()
+	}
+	return works
+}
+
+// withDeadline wraps args with timeout(1) so that the command is stopped in
+// the container shortly before the deadline of ctx, instead of the exec being
+// cancelled and its output lost. It returns the timeout applied, or zero if
+// args were left untouched. Callers check that timeout(1) exists first; a
+// command stopped by it exits with timeoutExitCode.
+func withDeadline(ctx context.Context, args []string) ([]string, time.Duration) {
+	deadline, ok := ctx.Deadline()
+	if !ok || len(args) == 0 {
+		return args, 0
+	}
+	timeout := time.Until(deadline) - execTimeoutGrace
+	if timeout < time.Second {
+		return args, 0
+	}
+	timeout = timeout.Truncate(time.Second)
+	return append([]string{"timeout", strconv.Itoa(int(timeout.Seconds()))}, args...), timeout
+}
+
+// RunImageOptions configure RunInImage. Env and Secrets use the same KEY=VALUE
+// and KEY=secret-ref forms as the config. With MountWorkdir, the workdir of
+// the environment is copied into the container at the same path; changes to
+// it are discarded.
+type RunImageOptions struct {
+	Env          []string
+	Secrets      []string
+	Workdir      string
+	MountWorkdir bool
+	PullPolicy   PullPolicy
+}
+
+// RunInImage runs cmd in a throwaway container from image, like docker run
+// --rm. The container can reach the services of the environment but nothing
+// it does is recorded: the environment is left untouched.
+func (env *Environment) RunInImage(ctx context.Context, image string, cmd []string, opts RunImageOptions) (result *ExecResult, rerr error) {
+	if env.State() == StateClosed {
+		return nil, ErrClosed
+	}
+	if err := opts.PullPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := env.withDefaultTimeout(ctx)
+	defer cancel()
+
+	container, err := env.containerFrom(ctx, image, opts.PullPolicy)
+	if err != nil {
+		return nil, err
+	}
+	container, err = containerWithEnvAndSecrets(container, opts.Env, opts.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	env.mu.Lock()
+	services, state, workdir := slices.Clone(env.Services), env.container, env.Config.Workdir
+	env.mu.Unlock()
+	for _, service := range services {
+		container = container.WithServiceBinding(service.Config.Name, service.svc)
+	}
+	if opts.MountWorkdir {
+		container = container.WithDirectory(workdir, state.Directory(workdir))
+	}
+	if opts.Workdir != "" {
+		container = container.WithWorkdir(opts.Workdir)
+	} else if opts.MountWorkdir {
+		container = container.WithWorkdir(workdir)
+	}
+
+	start := time.Now()
+	defer func() {
+		event := Event{Type: EventCommand, Command: redactCommand(strings.Join(cmd, " ")), Duration: Duration(time.Since(start)), Error: errorString(rerr)}
+		if result != nil {
+			event.ExitCode = result.ExitCode
+		}
+		env.emit(event)
+	}()
+
+	args, timeout := cmd, time.Duration(0)
+	if _, ok := ctx.Deadline(); ok && probeTimeout(ctx, image, container) {
+		args, timeout = withDeadline(ctx, cmd)
+	}
+	container = container.WithExec(args, dagger.ContainerWithExecOpts{
+		Expect: dagger.ReturnTypeAny,
+	})
+	stdout, err := container.Stdout(ctx)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("command timed out: %w", context.DeadlineExceeded)
+		}
+		return nil, err
+	}
+	stderr, err := container.Stderr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exitCode, err := container.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env.audit(ctx, "run_in_image", image+" "+redactCommand(strings.Join(cmd, " ")))
+
+	result = &ExecResult{
+		Stdout:   truncateLines(stdout),
+		Stderr:   truncateLines(stderr),
+		ExitCode: exitCode,
+	}
+	if timeout > 0 && exitCode == timeoutExitCode {
+		return result, fmt.Errorf("command timed out after %s: %w", timeout, context.DeadlineExceeded)
+	}
+	return result, nil
+}
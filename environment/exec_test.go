@@ -0,0 +1,228 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestWithDeadline(t *testing.T) {
+	args := []string{"sh", "-c", "make test"}
+
+	if got, timeout := withDeadline(context.Background(), args); !slices.Equal(got, args) || timeout != 0 {
+		t.Errorf("withDeadline() without a deadline = %q, %s", got, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeoutGrace+500*time.Millisecond)
+	defer cancel()
+	if got, timeout := withDeadline(ctx, args); !slices.Equal(got, args) || timeout != 0 {
+		t.Errorf("withDeadline() too close to the deadline = %q, %s", got, timeout)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), execTimeoutGrace+10*time.Second+500*time.Millisecond)
+	defer cancel()
+	got, timeout := withDeadline(ctx, args)
+	if want := append([]string{"timeout", "10"}, args...); !slices.Equal(got, want) || timeout != 10*time.Second {
+		t.Errorf("withDeadline() = %q, %s, want %q, 10s", got, timeout, want)
+	}
+
+	if got, timeout := withDeadline(ctx, nil); len(got) != 0 || timeout != 0 {
+		t.Errorf("withDeadline() of the default command = %q, %s", got, timeout)
+	}
+}
+
+func TestProbeTimeoutCachesPerImage(t *testing.T) {
+	probes := 0
+	works := false
+	orig := timeoutWorks
+	timeoutWorks = func(context.Context, *dagger.Container) bool {
+		probes++
+		return works
+	}
+	t.Cleanup(func() { timeoutWorks = orig })
+
+	ctx := context.Background()
+	image := "test/no-timeout:" + t.Name()
+	for range 3 {
+		if probeTimeout(ctx, image, nil) {
+			t.Fatal("probeTimeout() = true for an image without timeout(1)")
+		}
+	}
+	if probes != 1 {
+		t.Errorf("probed %d times, want the result cached", probes)
+	}
+
+	// Without an image, e.g. for a base build, nothing is cached.
+	works = true
+	for range 2 {
+		if !probeTimeout(ctx, "", nil) {
+			t.Fatal("probeTimeout() = false for a container with timeout(1)")
+		}
+	}
+	if probes != 3 {
+		t.Errorf("probed %d times, want 3", probes)
+	}
+}
+
+func TestExecTimeoutKeepsPartialOutput(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeoutGrace+3*time.Second)
+	defer cancel()
+
+	result, err := env.Exec(ctx, "slow", "echo started; sleep 60; echo finished", "sh", false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Exec() = %v, want context.DeadlineExceeded", err)
+	}
+	if result == nil || !strings.Contains(result.Stdout, "started") || strings.Contains(result.Stdout, "finished") {
+		t.Errorf("Exec() result = %+v, want the output printed before the deadline", result)
+	}
+}
+
+func TestWithDefaultTimeout(t *testing.T) {
+	env := &Environment{}
+
+	ctx, cancel := env.withDefaultTimeout(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("a zero default timeout set a deadline")
+	}
+
+	env.SetDefaultTimeout(time.Minute)
+	ctx, cancel = env.withDefaultTimeout(context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("deadline = %v, %v, want within a minute", deadline, ok)
+	}
+
+	// A deadline of the caller wins, even a later one.
+	want := time.Now().Add(time.Hour)
+	parent, cancelParent := context.WithDeadline(context.Background(), want)
+	defer cancelParent()
+	ctx, cancel = env.withDefaultTimeout(parent)
+	defer cancel()
+	if deadline, _ := ctx.Deadline(); !deadline.Equal(want) {
+		t.Errorf("deadline = %v, want the caller's %v", deadline, want)
+	}
+}
+
+func TestExecDefaultTimeout(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	env.SetDefaultTimeout(execTimeoutGrace + 3*time.Second)
+
+	start := time.Now()
+	_, err := env.Exec(context.Background(), "slow", "sleep 60", "sh", false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Exec() = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Exec() returned after %s, want it aborted by the default timeout", elapsed)
+	}
+}
+
+func TestTruncateLines(t *testing.T) {
+	SetMaxLineBytes(8)
+	t.Cleanup(func() { SetMaxLineBytes(defaultMaxLineBytes) })
+
+	for _, tt := range []struct{ output, want string }{
+		{"short\n", "short\n"},
+		{"before\n" + strings.Repeat("x", 20) + "\nafter\n", "before\nxxxxxxxx... [12 bytes truncated]\nafter\n"},
+		{"exactly8\nno newline at end", "exactly8\nno newli... [9 bytes truncated]"},
+		// Multi-byte characters are never split.
+		{"1234567é€€\n", "1234567... [8 bytes truncated]\n"},
+	} {
+		if got := truncateLines(tt.output); got != tt.want {
+			t.Errorf("truncateLines(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+
+	SetMaxLineBytes(0)
+	if long := strings.Repeat("x", 100); truncateLines(long) != long {
+		t.Error("truncateLines() truncated with truncation disabled")
+	}
+}
+
+func TestExecTruncatesLongLines(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	SetMaxLineBytes(1024)
+	t.Cleanup(func() { SetMaxLineBytes(defaultMaxLineBytes) })
+
+	result, err := env.Exec(context.Background(), "giant line", "echo first; head -c 100000 /dev/zero | tr '\\0' x; echo; echo last", "sh", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(result.Stdout, "\n"), "\n")
+	if len(lines) != 3 || lines[0] != "first" || lines[2] != "last" {
+		t.Fatalf("Exec() stdout lines = %d, want the giant line between intact ones", len(lines))
+	}
+	if want := strings.Repeat("x", 1024) + "... [98976 bytes truncated]"; lines[1] != want {
+		t.Errorf("giant line = %.40q (%d bytes), want it truncated to 1024 bytes", lines[1], len(lines[1]))
+	}
+}
+
+func TestRunInImageErrors(t *testing.T) {
+	ctx := context.Background()
+	env := &Environment{ID: "run-image/test", Config: DefaultConfig()}
+	if _, err := env.RunInImage(ctx, alpineImage, []string{"true"}, RunImageOptions{PullPolicy: "sometimes"}); err == nil {
+		t.Error("RunInImage() accepted an invalid pull policy")
+	}
+	if _, err := env.RunInImage(ctx, "Not An Image", []string{"true"}, RunImageOptions{}); err == nil {
+		t.Error("RunInImage() accepted an invalid image")
+	}
+
+	env.state = StateClosed
+	if _, err := env.RunInImage(ctx, alpineImage, []string{"true"}, RunImageOptions{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("RunInImage() of a closed environment = %v, want ErrClosed", err)
+	}
+}
+
+func TestRunInImage(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+	if _, err := env.Run(ctx, "seed", "echo hello > greeting", "", false); err != nil {
+		t.Fatal(err)
+	}
+	before := env.History.LatestVersion()
+
+	for _, opts := range []RunImageOptions{
+		{Env: []string{"MISSING_VALUE"}},
+		{Secrets: []string{"NO_REF"}},
+	} {
+		if _, err := env.RunInImage(ctx, alpineImage, []string{"true"}, opts); err == nil {
+			t.Errorf("RunInImage() with %+v succeeded", opts)
+		}
+	}
+
+	result, err := env.RunInImage(ctx, alpineImage, []string{"sh", "-c", `cat greeting; echo "$WHO"; touch leaked; exit 3`}, RunImageOptions{
+		Env:          []string{"WHO=world"},
+		MountWorkdir: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 3 || result.Stdout != "hello\nworld\n" {
+		t.Errorf("RunInImage() = %+v, want the workdir and env, and exit code 3", result)
+	}
+
+	// Nothing the throwaway container did reaches the environment.
+	if got := env.History.LatestVersion(); got != before {
+		t.Errorf("version after RunInImage() = %d, want %d", got, before)
+	}
+	if out, _ := env.Run(ctx, "check", "if test -e leaked; then echo leaked; fi", "", false); out != "" {
+		t.Error("a file created by RunInImage() showed up in the environment")
+	}
+
+	logger := setTestAuditLogger(t)
+	if _, err := env.RunInImage(ctx, alpineImage, []string{"env", "API_TOKEN=hunter2", "true"}, RunImageOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range logger.Entries() {
+		if strings.Contains(entry.Summary, "hunter2") {
+			t.Errorf("audit entry leaks a value: %+v", entry)
+		}
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"dagger.io/dagger"
 )
@@ -36,19 +39,49 @@ func (s *Environment) FileRead(ctx context.Context, targetFile string, shouldRea
 }
 
 func (s *Environment) FileWrite(ctx context.Context, explanation, targetFile, contents string) error {
-	err := s.apply(ctx, "Write "+targetFile, explanation, "", s.container.WithNewFile(targetFile, contents))
+	ctx, done, err := s.beginOperation(ctx, "write_file")
+	if err != nil {
+		return err
+	}
+	defer done()
+	return s.fileWrite(ctx, explanation, targetFile, contents)
+}
+
+// fileWrite must be called with the operation lock held.
+func (s *Environment) fileWrite(ctx context.Context, explanation, targetFile, contents string) error {
+	if err := s.checkWritable(targetFile); err != nil {
+		return err
+	}
+	err := s.applyConfined(ctx, "Write "+targetFile, explanation, "", s.container.WithNewFile(targetFile, contents, dagger.ContainerWithNewFileOpts{
+		Owner: s.Config.RunAsUser,
+	}))
 	if err != nil {
 		return fmt.Errorf("failed applying file write, skipping git propogation: %w", err)
 	}
+	s.audit(ctx, "write_file", targetFile)
 
 	return s.propagateToWorktree(ctx, "Write "+targetFile, explanation)
 }
 
 func (s *Environment) FileDelete(ctx context.Context, explanation, targetFile string) error {
-	err := s.apply(ctx, "Delete "+targetFile, explanation, "", s.container.WithoutFile(targetFile))
+	ctx, done, err := s.beginOperation(ctx, "delete_file")
 	if err != nil {
 		return err
 	}
+	defer done()
+	return s.fileDelete(ctx, explanation, targetFile)
+}
+
+// fileDelete must be called with the operation lock held.
+func (s *Environment) fileDelete(ctx context.Context, explanation, targetFile string) error {
+	if err := s.checkWritable(targetFile); err != nil {
+		return err
+	}
+	err := s.applyConfined(ctx, "Delete "+targetFile, explanation, "", s.container.WithoutFile(targetFile))
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, "delete_file", targetFile)
 
 	return s.propagateToWorktree(ctx, "Delete "+targetFile, explanation)
 }
@@ -65,6 +98,63 @@ func (s *Environment) FileList(ctx context.Context, path string) (string, error)
 	return out.String(), nil
 }
 
+func (s *Environment) ClearScratch(ctx context.Context) error {
+	ctx, done, err := s.beginOperation(ctx, "clear_scratch")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := s.clearScratch(ctx); err != nil {
+		return err
+	}
+	s.audit(ctx, "clear_scratch", s.Config.ScratchDir)
+	return nil
+}
+
+func (s *Environment) clearScratch(ctx context.Context) error {
+	if s.Config.ScratchDir == "" {
+		return errors.New("environment has no scratch directory")
+	}
+	shell, err := s.resolveShell(ctx, s.container)
+	if err != nil {
+		return err
+	}
+	// Bust the exec cache: the scratch volume contents aren't part of the cache key.
+	_, err = s.container.
+		WithEnvVariable("CU_SCRATCH_CLEARED_AT", time.Now().String()).
+		WithExec(append(shell, "-c", `find "$1" -mindepth 1 -delete`, "sh", s.Config.ScratchDir)).
+		Sync(ctx)
+	return err
+}
+
+// pathExists reports whether the slash-separated relative path exists in dir.
+// It walks the directory entries instead of interpreting engine error
+// messages, so a failing engine isn't mistaken for a missing path.
+func pathExists(ctx context.Context, dir *dagger.Directory, name string) (bool, error) {
+	exists, _, err := statPath(ctx, dir, name)
+	return exists, err
+}
+
+// statPath is pathExists also telling whether the path is a directory.
+func statPath(ctx context.Context, dir *dagger.Directory, name string) (exists, isDir bool, err error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if parts[0] == "" {
+		return true, true, nil
+	}
+	for i, part := range parts {
+		entries, err := dir.Entries(ctx)
+		if err != nil {
+			return false, false, err
+		}
+		isDir = slices.Contains(entries, part+"/")
+		if !isDir && (i < len(parts)-1 || !slices.Contains(entries, part)) {
+			return false, false, nil
+		}
+		dir = dir.Directory(part)
+	}
+	return true, isDir, nil
+}
+
 func urlToDirectory(url string) *dagger.Directory {
 	switch {
 	case strings.HasPrefix(url, "file://"):
@@ -79,10 +169,21 @@ func urlToDirectory(url string) *dagger.Directory {
 }
 
 func (s *Environment) Upload(ctx context.Context, explanation, source string, target string) error {
-	err := s.apply(ctx, "Upload "+source+" to "+target, explanation, "", s.container.WithDirectory(target, urlToDirectory(source)))
+	ctx, done, err := s.beginOperation(ctx, "upload")
 	if err != nil {
 		return err
 	}
+	defer done()
+	if err := s.checkWritable(target); err != nil {
+		return err
+	}
+	err = s.applyConfined(ctx, "Upload "+source+" to "+target, explanation, "", s.container.WithDirectory(target, urlToDirectory(source), dagger.ContainerWithDirectoryOpts{
+		Owner: s.Config.RunAsUser,
+	}))
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, "upload", source+" to "+target)
 
 	return s.propagateToWorktree(ctx, "Upload "+source+" to "+target, explanation)
 }
@@ -144,18 +245,18 @@ func (s *Environment) revisionDiff(ctx context.Context, path string, fromVersion
 		diffCtr = diffCtr.
 			WithMountedDirectory(
 				filepath.Join("versions", fmt.Sprintf("%d", fromVersion)),
-				s.History.Get(fromVersion).container.Directory(path)).
+				s.revision(fromVersion).container.Directory(path)).
 			WithMountedDirectory(
 				filepath.Join("versions", fmt.Sprintf("%d", toVersion)),
-				s.History.Get(toVersion).container.Directory(path))
+				s.revision(toVersion).container.Directory(path))
 	} else {
 		diffCtr = diffCtr.
 			WithMountedFile(
 				filepath.Join("versions", fmt.Sprintf("%d", fromVersion)),
-				s.History.Get(fromVersion).container.File(path)).
+				s.revision(fromVersion).container.File(path)).
 			WithMountedFile(
 				filepath.Join("versions", fmt.Sprintf("%d", toVersion)),
-				s.History.Get(toVersion).container.File(path))
+				s.revision(toVersion).container.File(path))
 	}
 
 	diffCmd := []string{"diff", "-burN",
@@ -176,3 +277,64 @@ func (s *Environment) revisionDiff(ctx context.Context, path string, fromVersion
 	}
 	return diff, nil
 }
+
+// CopyBetween copies a file or directory from the container of src to the
+// container of dst, recording a revision on dst.
+func CopyBetween(ctx context.Context, src *Environment, srcPath string, dst *Environment, dstPath string) error {
+	if src.State() == StateClosed {
+		return fmt.Errorf("source environment %s: %w", src.ID, ErrClosed)
+	}
+	ctx, done, err := dst.beginOperation(ctx, "copy")
+	if err != nil {
+		return fmt.Errorf("destination environment %s: %w", dst.ID, err)
+	}
+	defer done()
+	if err := dst.checkWritable(dstPath); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("Copy %s from %s to %s", srcPath, src.ID, dstPath)
+	var state *dagger.Container
+	if _, err := src.container.Directory(srcPath).Sync(ctx); err == nil {
+		state = dst.container.WithDirectory(dstPath, src.container.Directory(srcPath))
+	} else if _, err := src.container.File(srcPath).Sync(ctx); err == nil {
+		state = dst.container.WithFile(dstPath, src.container.File(srcPath))
+	} else {
+		return fmt.Errorf("%s not found in environment %s: %w", srcPath, src.ID, err)
+	}
+
+	if err := dst.applyConfined(ctx, name, "Copy from another environment", "", state); err != nil {
+		return err
+	}
+	dst.audit(ctx, "copy", fmt.Sprintf("%s from %s to %s", srcPath, src.ID, dstPath))
+
+	return dst.propagateToWorktree(ctx, name, "Copy from another environment")
+}
+
+// EnvDiff is the difference between two environments.
+type EnvDiff struct {
+	Config ConfigDiff `json:"config"`
+	// Files is a unified diff of the workdirs.
+	Files string `json:"files"`
+}
+
+// DiffEnvironments compares the effective configs and the workdirs of two
+// environments. The workdirs are compared even if they are at different
+// paths or come from different base images.
+func DiffEnvironments(ctx context.Context, a, b *Environment) (*EnvDiff, error) {
+	diff, err := dag.Container().From(alpineImage).
+		WithMountedDirectory("/a", a.container.Directory(a.Config.Workdir)).
+		WithMountedDirectory("/b", b.container.Directory(b.Config.Workdir)).
+		WithExec([]string{"diff", "-burN", "/a", "/b"}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s and %s: %w", a.ID, b.ID, err)
+	}
+
+	return &EnvDiff{
+		Config: DiffConfigs(a.EffectiveConfig(), b.EffectiveConfig()),
+		Files:  diff,
+	}, nil
+}
@@ -0,0 +1,165 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScratchStaysOutOfRevisions(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+
+	from := env.History.LatestVersion()
+	if _, err := env.Run(ctx, "write scratch", "mkdir -p /tmp/probe && echo data > /tmp/scratch/file && echo data > /tmp/probe/file", "", false); err != nil {
+		t.Fatal(err)
+	}
+	to := env.History.LatestVersion()
+
+	diff, err := env.RevisionDiff(ctx, "/tmp", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "probe/file") {
+		t.Fatalf("diff doesn't show the tracked write:\n%s", diff)
+	}
+	if strings.Contains(diff, "scratch/file") {
+		t.Errorf("diff shows the scratch write:\n%s", diff)
+	}
+
+	if err := env.ClearScratch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	out, err := env.Run(ctx, "list scratch", "ls -A /tmp/scratch", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "" {
+		t.Errorf("scratch after ClearScratch = %q, want it empty", out)
+	}
+}
+
+func TestPathExists(t *testing.T) {
+	requireEngine(t)
+	ctx := context.Background()
+	dir := dag.Directory().
+		WithNewFile(".container-use/environment.json", "{}").
+		WithNewDirectory("empty")
+
+	for name, want := range map[string]bool{
+		"":                                true,
+		".container-use":                  true,
+		".container-use/":                 true,
+		".container-use/environment.json": true,
+		"empty":                           true,
+		".container-use/AGENT.md":         false,
+		"missing":                         false,
+		"missing/environment.json":        false,
+		// A file isn't a directory.
+		".container-use/environment.json/x": false,
+	} {
+		got, err := pathExists(ctx, dir, name)
+		if err != nil {
+			t.Fatalf("pathExists(%q): %v", name, err)
+		}
+		if got != want {
+			t.Errorf("pathExists(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	for name, want := range map[string]bool{
+		".container-use":                  true,
+		".container-use/environment.json": false,
+		"empty":                           true,
+	} {
+		exists, isDir, err := statPath(ctx, dir, name)
+		if err != nil || !exists || isDir != want {
+			t.Errorf("statPath(%q) = %v, %v, %v, want a directory %v", name, exists, isDir, err, want)
+		}
+	}
+}
+
+func TestCopyBetweenClosed(t *testing.T) {
+	open, closed := &Environment{ID: "open"}, &Environment{ID: "closed", state: StateClosed}
+	if err := CopyBetween(context.Background(), closed, "/out", open, "/in"); !errors.Is(err, ErrClosed) {
+		t.Errorf("CopyBetween() from a closed environment = %v, want ErrClosed", err)
+	}
+	if err := CopyBetween(context.Background(), open, "/out", closed, "/in"); !errors.Is(err, ErrClosed) {
+		t.Errorf("CopyBetween() to a closed environment = %v, want ErrClosed", err)
+	}
+}
+
+func TestCopyBetween(t *testing.T) {
+	ctx := context.Background()
+	builder := newEngineEnvironment(t, nil)
+	runner := newEngineEnvironment(t, nil)
+
+	if _, err := builder.Run(ctx, "build", "mkdir -p /out/lib && echo bin > /out/app && echo lib > /out/lib/a.so", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runner.History.LatestVersion()
+	if err := CopyBetween(ctx, builder, "/out/app", runner, "/opt/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyBetween(ctx, builder, "/out/lib", runner, "/opt/lib"); err != nil {
+		t.Fatal(err)
+	}
+	if got := runner.History.LatestVersion(); got != before+2 {
+		t.Errorf("destination version = %d, want a revision per copy after %d", got, before)
+	}
+
+	out, err := runner.Run(ctx, "check", "cat /opt/app /opt/lib/a.so", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "bin\nlib" {
+		t.Errorf("copied files = %q", out)
+	}
+
+	if err := CopyBetween(ctx, builder, "/missing", runner, "/opt/missing"); err == nil {
+		t.Error("CopyBetween() of a missing path succeeded")
+	}
+}
+
+func TestDiffEnvironments(t *testing.T) {
+	ctx := context.Background()
+	working := newEngineEnvironment(t, nil)
+	config := DefaultConfig()
+	config.BaseImage = "busybox:1.36"
+	config.Env = []string{"DEBUG=1"}
+	broken := newEngineEnvironment(t, config)
+
+	for env, script := range map[*Environment]string{
+		working: "echo v1 > shared && echo only > working-only",
+		broken:  "echo v2 > shared",
+	} {
+		if _, err := env.Run(ctx, "write", script, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diff, err := DiffEnvironments(ctx, working, broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := diff.Config.Fields()
+	if !slices.Contains(fields, "base_image") || !slices.Contains(fields, "env.DEBUG") {
+		t.Errorf("config changes = %q, want base_image and env.DEBUG", fields)
+	}
+	for _, want := range []string{"-v1", "+v2", "working-only"} {
+		if !strings.Contains(diff.Files, want) {
+			t.Errorf("files diff doesn't mention %q:\n%s", want, diff.Files)
+		}
+	}
+
+	same, err := DiffEnvironments(ctx, working, working)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Config.Empty() || same.Files != "" {
+		t.Errorf("DiffEnvironments() of an environment with itself = %+v", same)
+	}
+}
@@ -215,6 +215,10 @@ func runGitCommand(ctx context.Context, dir string, args ...string) (out string,
 }
 
 func (env *Environment) propagateToWorktree(ctx context.Context, name, explanation string) (rerr error) {
+	if env.Ephemeral {
+		return nil
+	}
+
 	slog.Info("Propagating to worktree...",
 		"environment.id", env.ID,
 		"environment.name", env.Name,
@@ -244,7 +248,7 @@ func (env *Environment) propagateToWorktree(ctx context.Context, name, explanati
 	}
 
 	slog.Info("Saving environment")
-	if err := env.Config.Save(worktreePath); err != nil {
+	if err := env.saveConfig(worktreePath); err != nil {
 		return err
 	}
 
@@ -256,6 +260,10 @@ func (env *Environment) propagateToWorktree(ctx context.Context, name, explanati
 		return fmt.Errorf("failed to add notes: %w", err)
 	}
 
+	if err := env.persistHistory(); err != nil {
+		return err
+	}
+
 	localRepoPath, err := filepath.Abs(env.Source)
 	if err != nil {
 		return err
@@ -313,6 +321,9 @@ func (env *Environment) commitStateToNotes(ctx context.Context) error {
 }
 
 func (env *Environment) addGitNote(ctx context.Context, note string) error {
+	if env.Ephemeral {
+		return nil
+	}
 	_, err := runGitCommand(ctx, env.Worktree, "notes", "--ref", gitNotesLogRef, "append", "-m", note)
 	if err != nil {
 		return err
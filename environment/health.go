@@ -0,0 +1,100 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	defaultHealthCheckInterval = time.Second
+	defaultHealthCheckRetries  = 30
+)
+
+// HealthCheck is a command telling whether something is ready: it is, once
+// the command exits with 0. The command is retried every Interval, up to
+// Retries times, and each attempt is given at most Timeout.
+type HealthCheck struct {
+	Command  string   `json:"command"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	Retries  int      `json:"retries,omitempty"`
+}
+
+func (h *HealthCheck) Validate() error {
+	if strings.TrimSpace(h.Command) == "" {
+		return errors.New("health check command cannot be empty")
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.Retries < 0 {
+		return errors.New("health check interval, timeout and retries cannot be negative")
+	}
+	return nil
+}
+
+// WaitReady blocks until the environment is ready to be worked in: any build
+// in progress has finished and, if the config has a health check, it passes.
+// Without a health check, the environment is ready once setup completes. The
+// on_start commands of the config then run, once per build.
+//
+// Nothing keeps running in the environment container between commands: each
+// one, health check attempts included, runs in its own exec of the current
+// state. A check therefore sees the files left by setup and reaches the
+// services of the config by name, but never a process started by an earlier
+// command. A server that needs warming up must run as a service, and the
+// check target it, e.g. curl -f http://api:8080/health.
+func (env *Environment) WaitReady(ctx context.Context) error {
+	if err := env.waitBuild(ctx, true); err != nil {
+		return err
+	}
+
+	env.mu.Lock()
+	check, container := env.Config.HealthCheck, env.container
+	env.mu.Unlock()
+	if check == nil {
+		return env.runOnStart(ctx)
+	}
+	interval, retries := time.Duration(check.Interval), check.Retries
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	if retries == 0 {
+		retries = defaultHealthCheckRetries
+	}
+
+	var lastErr error
+	for attempt := range retries {
+		if attempt > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if lastErr = env.runHealthCheck(ctx, container, check); lastErr == nil {
+			return env.runOnStart(ctx)
+		}
+	}
+	return fmt.Errorf("environment not ready after %d health checks: %w", retries, lastErr)
+}
+
+func (env *Environment) runHealthCheck(ctx context.Context, container *dagger.Container, check *HealthCheck) error {
+	if check.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(check.Timeout))
+		defer cancel()
+	}
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return err
+	}
+	// Bust the exec cache: every attempt must actually run.
+	_, err = container.
+		WithEnvVariable("CU_HEALTH_CHECK_AT", time.Now().String()).
+		WithExec(append(shell, "-c", check.Command)).
+		Sync(ctx)
+	return err
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckValidate(t *testing.T) {
+	for _, tt := range []struct {
+		check HealthCheck
+		ok    bool
+	}{
+		{HealthCheck{Command: "curl -f http://api:8080/health"}, true},
+		{HealthCheck{Command: "true", Interval: Duration(time.Second), Timeout: Duration(time.Second), Retries: 3}, true},
+		{HealthCheck{Command: "  "}, false},
+		{HealthCheck{Command: "true", Interval: Duration(-time.Second)}, false},
+		{HealthCheck{Command: "true", Retries: -1}, false},
+	} {
+		if err := tt.check.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate() of %+v = %v, want ok %v", tt.check, err, tt.ok)
+		}
+	}
+}
+
+func TestWaitReadyWithoutHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	env := &Environment{ID: "ready/test", Config: DefaultConfig()}
+	if err := env.WaitReady(ctx); err != nil {
+		t.Errorf("WaitReady() of a built environment without health check = %v", err)
+	}
+	env.state = StateClosed
+	if err := env.WaitReady(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("WaitReady() of a closed environment = %v, want ErrClosed", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	env := newEngineEnvironment(t, config)
+
+	// The check only passes a few seconds from now.
+	readyAt := time.Now().Add(3 * time.Second)
+	env.Config.HealthCheck = &HealthCheck{
+		Command:  fmt.Sprintf("test $(date +%%s) -ge %d", readyAt.Unix()+1),
+		Interval: Duration(500 * time.Millisecond),
+		Retries:  60,
+	}
+	if err := env.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(readyAt) {
+		t.Error("WaitReady() returned before the health check passed")
+	}
+
+	env.Config.HealthCheck = &HealthCheck{Command: "exit 1", Interval: Duration(10 * time.Millisecond), Retries: 2}
+	if err := env.WaitReady(ctx); err == nil || !strings.Contains(err.Error(), "after 2 health checks") {
+		t.Errorf("WaitReady() with a failing health check = %v", err)
+	}
+}
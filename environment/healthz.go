@@ -0,0 +1,99 @@
+package environment
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Health aggregates the status of the registered environments.
+type Health struct {
+	Status       string                   `json:"status"`
+	Environments int                      `json:"environments"`
+	States       map[EnvironmentState]int `json:"states"`
+	Unhealthy    []UnhealthyService       `json:"unhealthy_services,omitempty"`
+	Errors       []string                 `json:"errors,omitempty"`
+}
+
+type UnhealthyService struct {
+	Environment string       `json:"environment"`
+	Service     string       `json:"service"`
+	State       ServiceState `json:"state"`
+	Optional    bool         `json:"optional,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+var (
+	healthCacheMu sync.Mutex
+	healthCache   = map[string]*Status{}
+)
+
+// HealthHandler serves the health of the registered environments as JSON,
+// e.g. on /healthz. It answers 503 when a required service isn't running.
+//
+// The handler never waits on an environment: the status of an environment in
+// the middle of an operation holding its lock is the last one seen, reported
+// in errors if there is none yet. No container is ever queried.
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := currentHealth()
+		w.Header().Set("Content-Type", "application/json")
+		if health.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(health)
+	})
+}
+
+func currentHealth() *Health {
+	environmentsMu.RLock()
+	envs := make([]*Environment, 0, len(environments))
+	for _, env := range environments {
+		envs = append(envs, env)
+	}
+	environmentsMu.RUnlock()
+	slices.SortFunc(envs, func(a, b *Environment) int { return strings.Compare(a.ID, b.ID) })
+
+	health := &Health{
+		Status:       "ok",
+		Environments: len(envs),
+		States:       map[EnvironmentState]int{},
+	}
+	healthCacheMu.Lock()
+	defer healthCacheMu.Unlock()
+	for id := range healthCache {
+		if !slices.ContainsFunc(envs, func(env *Environment) bool { return env.ID == id }) {
+			delete(healthCache, id)
+		}
+	}
+	for _, env := range envs {
+		if env.mu.TryLock() {
+			healthCache[env.ID] = env.statusLocked()
+			env.mu.Unlock()
+		}
+		status := healthCache[env.ID]
+		if status == nil {
+			health.Errors = append(health.Errors, env.ID+": status unavailable, environment is busy")
+			continue
+		}
+		health.States[status.State]++
+		for _, svc := range status.Services {
+			if svc.State == ServiceRunning {
+				continue
+			}
+			health.Unhealthy = append(health.Unhealthy, UnhealthyService{
+				Environment: env.ID,
+				Service:     svc.Name,
+				State:       svc.State,
+				Optional:    svc.Optional,
+				Error:       svc.Error,
+			})
+			if !svc.Optional {
+				health.Status = "degraded"
+			}
+		}
+	}
+	return health
+}
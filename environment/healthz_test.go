@@ -0,0 +1,102 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func getHealth(t *testing.T) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("health isn't JSON: %v\n%s", err, rec.Body)
+	}
+	return rec.Code, body
+}
+
+func registerHealthEnvironment(t *testing.T, id string, services ServiceConfigs, failures map[string]*ServiceFailure) *Environment {
+	t.Helper()
+	config := DefaultConfig()
+	config.Services = services
+	env := &Environment{ID: id, Config: config, serviceFailures: failures}
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(id) })
+	return env
+}
+
+func TestHealthHandler(t *testing.T) {
+	registerHealthEnvironment(t, "healthz/a", ServiceConfigs{
+		{Name: "db"},
+		{Name: "cache", Optional: true},
+	}, map[string]*ServiceFailure{"cache": {Err: errors.New("image not found")}})
+	registerHealthEnvironment(t, "healthz/b", nil, nil)
+
+	code, body := getHealth(t)
+	if code != http.StatusOK {
+		t.Errorf("status code = %d, want 200 with only an optional service down", code)
+	}
+	want := map[string]any{
+		"status":       "ok",
+		"environments": float64(2),
+		"states":       map[string]any{string(StateReady): float64(2)},
+		"unhealthy_services": []any{map[string]any{
+			"environment": "healthz/a",
+			"service":     "cache",
+			"state":       string(ServiceFailed),
+			"optional":    true,
+			"error":       "image not found",
+		}},
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("health = %v, want %v", body, want)
+	}
+
+	// A required service down degrades the health.
+	registerHealthEnvironment(t, "healthz/c", ServiceConfigs{{Name: "api", DependsOn: []string{"db"}}, {Name: "db"}},
+		map[string]*ServiceFailure{"db": {Err: errors.New("exited")}, "api": {Skipped: true, Err: errors.New("db failed")}})
+	code, body = getHealth(t)
+	if code != http.StatusServiceUnavailable || body["status"] != "degraded" {
+		t.Errorf("health = %d %v, want 503 and degraded", code, body["status"])
+	}
+	if unhealthy, _ := body["unhealthy_services"].([]any); len(unhealthy) != 3 {
+		t.Errorf("unhealthy services = %v, want cache, api and db", body["unhealthy_services"])
+	}
+
+	unregisterEnvironment("healthz/c")
+	if code, body = getHealth(t); code != http.StatusOK || body["environments"] != float64(2) {
+		t.Errorf("health after unregistering = %d %v", code, body)
+	}
+}
+
+func TestHealthHandlerNeverBlocks(t *testing.T) {
+	env := registerHealthEnvironment(t, "healthz/busy", nil, nil)
+
+	// Busy before its status was ever seen: reported in errors.
+	env.mu.Lock()
+	_, body := getHealth(t)
+	env.mu.Unlock()
+	if errs, _ := body["errors"].([]any); len(errs) != 1 {
+		t.Errorf("errors = %v, want the busy environment", body["errors"])
+	}
+	if body["states"].(map[string]any)[string(StateReady)] != nil {
+		t.Errorf("states = %v, want the busy environment left out", body["states"])
+	}
+
+	// Busy after a status was seen: the cached one is reported.
+	getHealth(t)
+	env.mu.Lock()
+	_, body = getHealth(t)
+	env.mu.Unlock()
+	if body["errors"] != nil || body["states"].(map[string]any)[string(StateReady)] != float64(1) {
+		t.Errorf("health = %v, want the cached status of the busy environment", body)
+	}
+}
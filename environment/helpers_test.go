@@ -0,0 +1,63 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+var (
+	engineOnce sync.Once
+	engineErr  error
+)
+
+// requireEngine connects to the dagger engine of the session the tests run in
+// and skips the test outside of one. Run them with dagger run go test ./...
+// to include the engine tests.
+func requireEngine(tb testing.TB) {
+	tb.Helper()
+	if os.Getenv("DAGGER_SESSION_PORT") == "" {
+		tb.Skip("needs a dagger engine, run with dagger run go test")
+	}
+	engineOnce.Do(func() {
+		client, err := dagger.Connect(context.Background())
+		if err != nil {
+			engineErr = err
+			return
+		}
+		engineErr = Initialize(context.Background(), client)
+	})
+	if engineErr != nil {
+		tb.Fatalf("failed to connect to the dagger engine: %v", engineErr)
+	}
+}
+
+// newEngineEnvironment builds an ephemeral environment from config, or from a
+// minimal alpine config if config is nil. It is closed at the end of the test.
+func newEngineEnvironment(tb testing.TB, config *EnvironmentConfig) *Environment {
+	tb.Helper()
+	requireEngine(tb)
+	if config == nil {
+		config = DefaultConfig()
+		config.BaseImage = alpineImage
+	}
+	env, err := CreateEphemeral(context.Background(), "", "test", config)
+	if err != nil {
+		tb.Fatalf("failed to create environment: %v", err)
+	}
+	tb.Cleanup(func() { _ = env.Close(context.Background()) })
+	return env
+}
+
+// requireShell skips tests running scripts meant for containers when the host
+// has no POSIX shell.
+func requireShell(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+}
@@ -0,0 +1,299 @@
+package environment
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyArchiveVersion is bumped whenever the archive layout changes in a way
+// older readers can't understand.
+const historyArchiveVersion = 1
+
+type historyArchive struct {
+	Version int     `json:"version"`
+	History History `json:"history"`
+	// Annotations are the current annotations of the environment, which
+	// may not be recorded on any revision yet.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ExportHistory writes the full revision lineage of the environment to w as a
+// portable, versioned archive, along with its current annotations.
+func (env *Environment) ExportHistory(w io.Writer) error {
+	env.mu.Lock()
+	archive := &historyArchive{
+		Version:     historyArchiveVersion,
+		History:     env.History,
+		Annotations: env.annotations,
+	}
+	data, err := json.MarshalIndent(archive, "", "  ")
+	env.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// ImportHistory replaces the history of the environment with the archive read
+// from r. The latest imported revision becomes the current container state.
+func (env *Environment) ImportHistory(ctx context.Context, r io.Reader) error {
+	var archive historyArchive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return fmt.Errorf("invalid history archive: %w", err)
+	}
+	if archive.Version < 1 || archive.Version > historyArchiveVersion {
+		return fmt.Errorf("unsupported history archive version %d (supported: %d)", archive.Version, historyArchiveVersion)
+	}
+	if err := archive.History.validate(); err != nil {
+		return fmt.Errorf("invalid history archive: %w", err)
+	}
+
+	env.mu.Lock()
+	env.replaceHistory(archive.History)
+	if archive.Annotations != nil {
+		env.annotations = maps.Clone(archive.Annotations)
+	} else if latest := env.History.Latest(); latest != nil {
+		// Archives written before annotations were exported.
+		env.annotations = maps.Clone(latest.Annotations)
+	}
+	env.mu.Unlock()
+	env.audit(ctx, "import_history", fmt.Sprintf("%d revisions", len(archive.History)))
+	return nil
+}
+
+// Root returns the oldest revision of the history.
+func (h History) Root() *Revision {
+	var root *Revision
+	for _, revision := range h {
+		if root == nil || revision.Version < root.Version {
+			root = revision
+		}
+	}
+	return root
+}
+
+// Tree renders the history as an ASCII tree following Parent links. Linear
+// lineages stay in the same column; only branch points are indented.
+// Revisions are labeled as the head (the latest revision), branch points
+// (revisions with several children) or tips (other revisions without
+// children).
+func (h History) Tree() string {
+	byVersion := map[Version]*Revision{}
+	for _, revision := range h {
+		byVersion[revision.Version] = revision
+	}
+
+	children := map[Version][]*Revision{}
+	roots := []*Revision{}
+	for _, revision := range h {
+		if _, ok := byVersion[revision.Parent]; revision.Parent == 0 || !ok {
+			roots = append(roots, revision)
+			continue
+		}
+		children[revision.Parent] = append(children[revision.Parent], revision)
+	}
+	byVersionOrder := func(a, b *Revision) int { return cmp.Compare(a.Version, b.Version) }
+	slices.SortFunc(roots, byVersionOrder)
+	for _, kids := range children {
+		slices.SortFunc(kids, byVersionOrder)
+	}
+
+	head := h.Latest()
+	label := func(revision *Revision) string {
+		switch kids := len(children[revision.Version]); {
+		case revision == head:
+			return " (head)"
+		case kids > 1:
+			return " (branch point)"
+		case kids == 0:
+			return " (tip)"
+		default:
+			return ""
+		}
+	}
+
+	out := &strings.Builder{}
+	var render func(revision *Revision, linePrefix, childPrefix string)
+	render = func(revision *Revision, linePrefix, childPrefix string) {
+		fmt.Fprintf(out, "%s* %d %s%s\n", linePrefix, revision.Version, revision.Name, label(revision))
+		kids := children[revision.Version]
+		if len(kids) == 1 {
+			render(kids[0], childPrefix, childPrefix)
+			return
+		}
+		for i, kid := range kids {
+			if i == len(kids)-1 {
+				render(kid, childPrefix+"└─ ", childPrefix+"   ")
+				continue
+			}
+			render(kid, childPrefix+"├─ ", childPrefix+"│  ")
+		}
+	}
+	for _, root := range roots {
+		render(root, "", "")
+	}
+	return out.String()
+}
+
+// validate checks that the history forms a well-formed graph: versions are
+// unique and every parent refers to an existing revision without cycles.
+func (h History) validate() error {
+	byVersion := make(map[Version]*Revision, len(h))
+	for _, revision := range h {
+		if revision == nil {
+			return fmt.Errorf("empty revision")
+		}
+		if revision.Version < 1 {
+			return fmt.Errorf("invalid revision version %d", revision.Version)
+		}
+		if _, ok := byVersion[revision.Version]; ok {
+			return fmt.Errorf("duplicate revision version %d", revision.Version)
+		}
+		byVersion[revision.Version] = revision
+	}
+
+	for _, revision := range h {
+		seen := map[Version]bool{revision.Version: true}
+		for current := revision; current.Parent != 0; {
+			parent, ok := byVersion[current.Parent]
+			if !ok {
+				return fmt.Errorf("revision %d has unknown parent %d", current.Version, current.Parent)
+			}
+			if seen[parent.Version] {
+				return fmt.Errorf("revision %d is part of a cycle", revision.Version)
+			}
+			seen[parent.Version] = true
+			current = parent
+		}
+	}
+
+	return nil
+}
+
+// HistoryStats summarizes the history of an environment. HistoryStats
+// computes it from the revision metadata only and leaves TotalSize unset;
+// HistoryStatsWithSize fills it in, at the cost of measuring every revision.
+type HistoryStats struct {
+	Revisions     int       `json:"revisions"`
+	LatestVersion Version   `json:"latest_version"`
+	Oldest        time.Time `json:"oldest,omitzero"`
+	Newest        time.Time `json:"newest,omitzero"`
+	TotalSize     int64     `json:"total_size,omitempty"`
+}
+
+func (env *Environment) HistoryStats() HistoryStats {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	stats := HistoryStats{
+		Revisions:     len(env.History),
+		LatestVersion: env.History.LatestVersion(),
+	}
+	for _, revision := range env.History {
+		if stats.Oldest.IsZero() || revision.CreatedAt.Before(stats.Oldest) {
+			stats.Oldest = revision.CreatedAt
+		}
+		if revision.CreatedAt.After(stats.Newest) {
+			stats.Newest = revision.CreatedAt
+		}
+	}
+	return stats
+}
+
+// HistoryStatsWithSize returns the history stats along with the total size of
+// the history, as estimated by TotalSize.
+func (env *Environment) HistoryStatsWithSize(ctx context.Context) (HistoryStats, error) {
+	stats := env.HistoryStats()
+	size, err := env.TotalSize(ctx)
+	if err != nil {
+		return stats, err
+	}
+	stats.TotalSize = size
+	return stats, nil
+}
+
+// FleetHistoryStats returns the history stats of every registered
+// environment, keyed by ID.
+func FleetHistoryStats() map[string]HistoryStats {
+	environmentsMu.RLock()
+	envs := slices.Collect(maps.Values(environments))
+	environmentsMu.RUnlock()
+
+	stats := make(map[string]HistoryStats, len(envs))
+	for _, env := range envs {
+		stats[env.ID] = env.HistoryStats()
+	}
+	return stats
+}
+
+// historyIndex maps versions to their position in the history of an
+// environment so lookups don't scan it. History is exported and can be
+// replaced or reshaped without going through the environment, so every hit is
+// checked against the slice and every miss rebuilds the index before giving
+// up.
+type historyIndex struct {
+	mu        sync.Mutex
+	positions map[Version]int
+}
+
+// get returns the revision with the given version in h, or nil.
+func (idx *historyIndex) get(h History, version Version) *Revision {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if revision := idx.lookup(h, version); revision != nil {
+		return revision
+	}
+	idx.rebuild(h)
+	return idx.lookup(h, version)
+}
+
+// appended records that the last revision of h was just appended.
+func (idx *historyIndex) appended(h History) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.positions == nil || len(idx.positions) != len(h)-1 {
+		idx.rebuild(h)
+		return
+	}
+	idx.positions[h[len(h)-1].Version] = len(h) - 1
+}
+
+// reset rebuilds the index for a history replaced as a whole.
+func (idx *historyIndex) reset(h History) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.rebuild(h)
+}
+
+func (idx *historyIndex) lookup(h History, version Version) *Revision {
+	pos, ok := idx.positions[version]
+	if !ok || pos >= len(h) || h[pos].Version != version {
+		return nil
+	}
+	return h[pos]
+}
+
+func (idx *historyIndex) rebuild(h History) {
+	idx.positions = make(map[Version]int, len(h))
+	for i, revision := range h {
+		idx.positions[revision.Version] = i
+	}
+}
+
+// revision returns the revision with the given version, or nil.
+func (env *Environment) revision(version Version) *Revision {
+	return env.historyIndex.get(env.History, version)
+}
@@ -0,0 +1,323 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scanHistory is the reference lookup the index must agree with.
+func scanHistory(h History, version Version) *Revision {
+	for _, revision := range h {
+		if revision.Version == version {
+			return revision
+		}
+	}
+	return nil
+}
+
+func TestHistoryIndexNeverDiverges(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	env := &Environment{}
+
+	check := func(step int) {
+		t.Helper()
+		for version := Version(0); version <= env.lastVersion+1; version++ {
+			want := scanHistory(env.History, version)
+			if got := env.revision(version); got != want {
+				t.Fatalf("step %d: revision(%d) = %v, want %v", step, version, got, want)
+			}
+			if got := env.History.Get(version); got != want {
+				t.Fatalf("step %d: History.Get(%d) = %v, want %v", step, version, got, want)
+			}
+		}
+	}
+
+	for step := range 500 {
+		env.mu.Lock()
+		switch op := rng.IntN(10); {
+		case op < 6 || len(env.History) == 0:
+			env.appendRevision(nil, fmt.Sprintf("step %d", step), "", "", nil, "")
+		case op < 7:
+			// Drop a random revision, reparenting nothing: the index only
+			// cares about positions.
+			i := rng.IntN(len(env.History))
+			env.replaceHistory(slices.Delete(slices.Clone(env.History), i, i+1))
+		case op < 8:
+			// Replace the history behind the environment's back with one of
+			// the same length but other versions.
+			h := make(History, len(env.History))
+			for i := range h {
+				h[i] = &Revision{Version: env.lastVersion + Version(i) + 1}
+			}
+			env.History = h
+			env.lastVersion += Version(len(h))
+		case op < 9:
+			rng.Shuffle(len(env.History), func(i, j int) {
+				env.History[i], env.History[j] = env.History[j], env.History[i]
+			})
+		default:
+			env.History = env.History[:rng.IntN(len(env.History)+1)]
+		}
+		env.mu.Unlock()
+		check(step)
+	}
+}
+
+func BenchmarkHistoryGet(b *testing.B) {
+	for _, size := range []int{10, 1000, 10000} {
+		env := &Environment{}
+		env.mu.Lock()
+		for range size {
+			env.appendRevision(nil, "", "", "", nil, "")
+		}
+		env.mu.Unlock()
+		versions := make([]Version, 0, size)
+		for _, revision := range env.History {
+			versions = append(versions, revision.Version)
+		}
+
+		b.Run(fmt.Sprintf("scan/%d", size), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				scanHistory(env.History, versions[i%size])
+			}
+		})
+		b.Run(fmt.Sprintf("Get/%d", size), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				env.History.Get(versions[i%size])
+			}
+		})
+		b.Run(fmt.Sprintf("index/%d", size), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				env.revision(versions[i%size])
+			}
+		})
+	}
+}
+
+func TestHistoryExportImport(t *testing.T) {
+	src := &Environment{}
+	src.mu.Lock()
+	src.appendRevision(nil, "create", "", "", nil, "")
+	src.appendRevision(nil, "install", "", "", nil, "")
+	src.History[1].Annotations = map[string]string{"ticket": "42"}
+	src.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := src.ExportHistory(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &Environment{}
+	if err := dst.ImportHistory(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.History) != 2 || dst.History[1].Name != "install" || dst.History[1].Parent != 1 {
+		t.Fatalf("imported history = %v", dst.History)
+	}
+	if dst.annotations["ticket"] != "42" {
+		t.Errorf("imported annotations = %v, want the latest revision's", dst.annotations)
+	}
+
+	// Imports go through the locked path, so versions keep increasing.
+	dst.mu.Lock()
+	dst.appendRevision(nil, "next", "", "", nil, "")
+	dst.mu.Unlock()
+	if got := dst.History.LatestVersion(); got != 3 {
+		t.Errorf("version after import = %d, want 3", got)
+	}
+}
+
+func TestHistoryImportRejectsMalformedArchives(t *testing.T) {
+	for name, archive := range map[string]string{
+		"not json":        `history`,
+		"future version":  `{"version": 99, "history": []}`,
+		"missing version": `{"history": []}`,
+		"duplicate":       `{"version": 1, "history": [{"version": 1}, {"version": 1}]}`,
+		"zero version":    `{"version": 1, "history": [{"version": 0}]}`,
+		"dangling parent": `{"version": 1, "history": [{"version": 1}, {"version": 2, "parent": 5}]}`,
+		"cycle":           `{"version": 1, "history": [{"version": 1, "parent": 2}, {"version": 2, "parent": 1}]}`,
+		"self parent":     `{"version": 1, "history": [{"version": 1, "parent": 1}]}`,
+		"null revision":   `{"version": 1, "history": [null]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := &Environment{}
+			if err := env.ImportHistory(context.Background(), strings.NewReader(archive)); err == nil {
+				t.Fatalf("ImportHistory accepted %s", archive)
+			}
+			if len(env.History) != 0 {
+				t.Errorf("failed import changed the history: %v", env.History)
+			}
+		})
+	}
+}
+
+func TestHistoryTree(t *testing.T) {
+	h := History{
+		{Version: 1, Name: "create"},
+		{Version: 2, Parent: 1, Name: "install"},
+		{Version: 3, Parent: 2, Name: "try a"},
+		{Version: 4, Parent: 3, Name: "refine a"},
+		{Version: 5, Parent: 2, Name: "try b"},
+		{Version: 6, Parent: 2, Name: "try c"},
+		{Version: 7, Name: "import"},
+		// Parent pruned from the history: rendered as a root.
+		{Version: 9, Parent: 8, Name: "orphan"},
+	}
+	want := `* 1 create
+* 2 install (branch point)
+├─ * 3 try a
+│  * 4 refine a (tip)
+├─ * 5 try b (tip)
+└─ * 6 try c (tip)
+* 7 import (tip)
+* 9 orphan (head)
+`
+	if got := h.Tree(); got != want {
+		t.Errorf("Tree() =\n%s\nwant\n%s", got, want)
+	}
+
+	// The order of the slice doesn't matter.
+	slices.Reverse(h)
+	if got := h.Tree(); got != want {
+		t.Errorf("Tree() of the reversed history =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAppendRevisionMonotonic(t *testing.T) {
+	ctx := context.Background()
+	env := &Environment{ID: "versions/test", Config: DefaultConfig()}
+	const workers, appends = 8, 100
+
+	versions := make(chan Version, workers*appends)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			last := Version(0)
+			for range appends {
+				revision := env.commitRevision(nil, "append", "", "", nil, "")
+				if revision.Version <= last {
+					t.Errorf("version %d after %d", revision.Version, last)
+				}
+				last = revision.Version
+				versions <- revision.Version
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			last := Version(0)
+			for range appends {
+				next := env.NextVersion()
+				if next < last {
+					t.Errorf("next version %d after %d", next, last)
+				}
+				last = next
+			}
+		}()
+	}
+	wg.Wait()
+	close(versions)
+
+	seen := map[Version]bool{}
+	for version := range versions {
+		if seen[version] {
+			t.Fatalf("version %d handed out twice", version)
+		}
+		seen[version] = true
+	}
+	if got := env.NextVersion(); got != workers*appends+1 {
+		t.Errorf("NextVersion() = %d, want %d", got, workers*appends+1)
+	}
+
+	// Versions dropped from the history are never reused.
+	var archive bytes.Buffer
+	truncated := &Environment{ID: "versions/truncated", Config: DefaultConfig()}
+	truncated.commitRevision(nil, "only", "", "", nil, "")
+	if err := truncated.ExportHistory(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.ImportHistory(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if got := env.History.NextVersion(); got != 2 {
+		t.Errorf("History.NextVersion() after truncating = %d, want 2", got)
+	}
+	if got := env.NextVersion(); got != workers*appends+1 {
+		t.Errorf("NextVersion() after truncating = %d, want %d", got, workers*appends+1)
+	}
+}
+
+func TestHistoryStats(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	env := &Environment{ID: "stats/test"}
+	env.mu.Lock()
+	for _, offset := range []time.Duration{time.Hour, 0, 3 * time.Hour, 2 * time.Hour} {
+		revision := env.appendRevision(nil, "step", "", "", nil, "")
+		revision.CreatedAt = base.Add(offset)
+	}
+	env.mu.Unlock()
+
+	want := HistoryStats{
+		Revisions:     4,
+		LatestVersion: 4,
+		Oldest:        base,
+		Newest:        base.Add(3 * time.Hour),
+	}
+	if got := env.HistoryStats(); got != want {
+		t.Errorf("HistoryStats() = %+v, want %+v", got, want)
+	}
+	if got := (&Environment{}).HistoryStats(); got != (HistoryStats{}) {
+		t.Errorf("HistoryStats() of an empty history = %+v", got)
+	}
+
+	// Revisions without a container, like imported ones, can't be measured.
+	if _, err := env.HistoryStatsWithSize(context.Background()); err == nil {
+		t.Error("HistoryStatsWithSize() measured revisions without a container")
+	}
+
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(env.ID) })
+	if got := FleetHistoryStats()[env.ID]; got != want {
+		t.Errorf("FleetHistoryStats()[%s] = %+v, want %+v", env.ID, got, want)
+	}
+}
+
+func TestHistoryLatestOutOfOrder(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := History{
+		{Version: 1, CreatedAt: base},
+		{Version: 3, CreatedAt: base.Add(time.Minute)},
+		{Version: 2, CreatedAt: base.Add(2 * time.Minute)},
+	}
+	if got := h.Latest(); got != h[1] {
+		t.Errorf("Latest() = %+v, want version 3", got)
+	}
+	if got := h.LatestVersion(); got != 3 {
+		t.Errorf("LatestVersion() = %d, want 3", got)
+	}
+
+	// Among revisions sharing the highest version, the newest one wins,
+	// wherever it is.
+	newer := &Revision{Version: 3, Name: "newer", CreatedAt: base.Add(3 * time.Minute)}
+	older := &Revision{Version: 3, Name: "older", CreatedAt: base}
+	for _, h := range []History{append(slices.Clone(h), newer, older), {newer, older, h[0]}} {
+		if got := h.Latest(); got != newer {
+			t.Errorf("Latest() = %+v, want the newest revision of version 3", got)
+		}
+	}
+
+	if got := (History{}).Latest(); got != nil {
+		t.Errorf("Latest() of an empty history = %+v", got)
+	}
+	if got := (History{}).LatestVersion(); got != 0 {
+		t.Errorf("LatestVersion() of an empty history = %d", got)
+	}
+}
@@ -0,0 +1,71 @@
+package environment
+
+import "sync"
+
+type RevisionHook func(env *Environment, revision *Revision)
+
+type ConfigChangeHook func(env *Environment, diff ConfigDiff)
+
+type ReapHook func(env *Environment)
+
+var (
+	hooksMu           sync.RWMutex
+	revisionHooks     []RevisionHook
+	configChangeHooks []ConfigChangeHook
+	reapHooks         []ReapHook
+)
+
+// OnRevision registers fn to be called every time a revision is recorded.
+func OnRevision(fn RevisionHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	revisionHooks = append(revisionHooks, fn)
+}
+
+// OnConfigChange registers fn to be called every time the config of an
+// environment is updated. It fires after the OnRevision hooks for the revision
+// produced by the update, and only if the config actually changed. Each hook
+// receives its own copy of the diff.
+func OnConfigChange(fn ConfigChangeHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	configChangeHooks = append(configChangeHooks, fn)
+}
+
+// OnReap registers fn to be called right before an expired environment is
+// closed by ReapExpired.
+func OnReap(fn ReapHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	reapHooks = append(reapHooks, fn)
+}
+
+func fireRevision(env *Environment, revision *Revision) {
+	hooksMu.RLock()
+	hooks := revisionHooks
+	hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(env, revision)
+	}
+}
+
+func fireConfigChange(env *Environment, diff ConfigDiff) {
+	hooksMu.RLock()
+	hooks := configChangeHooks
+	hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(env, diff.Copy())
+	}
+}
+
+func fireReap(env *Environment) {
+	hooksMu.RLock()
+	hooks := reapHooks
+	hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(env)
+	}
+}
@@ -0,0 +1,94 @@
+package environment
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestConfigChangeHooksGetTheirOwnDiff(t *testing.T) {
+	env := &Environment{}
+	var seen []ConfigDiff
+	for range 2 {
+		OnConfigChange(func(e *Environment, diff ConfigDiff) {
+			if e != env {
+				return
+			}
+			seen = append(seen, diff)
+			diff.Changes[0].New = "mutated"
+		})
+	}
+
+	diff := ConfigDiff{Changes: []ConfigChange{{Field: "base_image", Old: "alpine", New: "ubuntu"}}}
+	fireConfigChange(env, diff)
+
+	if len(seen) != 2 {
+		t.Fatalf("hooks fired %d times, want 2", len(seen))
+	}
+	if diff.Changes[0].New != "ubuntu" {
+		t.Errorf("a hook mutated the caller's diff: %v", diff)
+	}
+	if &seen[0].Changes[0] == &seen[1].Changes[0] {
+		t.Error("hooks share the same diff")
+	}
+}
+
+func TestConfigChangeFiresAfterRevision(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+
+	var mu sync.Mutex
+	var events []string
+	OnRevision(func(e *Environment, revision *Revision) {
+		if e == env {
+			mu.Lock()
+			events = append(events, "revision")
+			mu.Unlock()
+		}
+	})
+	OnConfigChange(func(e *Environment, diff ConfigDiff) {
+		if e == env {
+			mu.Lock()
+			events = append(events, "config:"+diff.String())
+			mu.Unlock()
+		}
+	})
+
+	config := env.Config.Copy()
+	config.Env = append(config.Env, "FOO=bar")
+	if err := env.UpdateConfig(context.Background(), "add FOO", config); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"revision", "config:added env.FOO: bar"}
+	if !slices.Equal(events, want) {
+		t.Errorf("hook events = %q, want %q", events, want)
+	}
+}
+
+func TestAddServiceFiresConfigChange(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+
+	var mu sync.Mutex
+	var changes []string
+	OnConfigChange(func(e *Environment, diff ConfigDiff) {
+		if e == env {
+			mu.Lock()
+			changes = append(changes, diff.Fields()...)
+			mu.Unlock()
+		}
+	})
+
+	cfg := &ServiceConfig{Name: "web", Image: alpineImage, Command: "httpd -f", ExposedPorts: []int{80}}
+	if _, err := env.AddService(context.Background(), "add web", cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(changes, []string{"services.web"}) {
+		t.Errorf("config changes = %q, want services.web", changes)
+	}
+}
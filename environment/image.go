@@ -0,0 +1,202 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// PullPolicy controls when images are fetched from their registry.
+//
+// Images are pulled into the dagger engine, which keeps its own image store.
+// With "if-not-present", the default, images are fetched the way the engine
+// does on its own: layers it already holds aren't downloaded again. "always"
+// resolves the tag against the registry on every build, so a moved tag is
+// picked up. "never" only uses images the engine holds, pinned to the digest
+// they were pulled at, and fails up front, naming the image, otherwise.
+type PullPolicy string
+
+const (
+	PullAlways       PullPolicy = "always"
+	PullIfNotPresent PullPolicy = "if-not-present"
+	PullNever        PullPolicy = "never"
+)
+
+func (p PullPolicy) Validate() error {
+	switch p {
+	case "", PullAlways, PullIfNotPresent, PullNever:
+		return nil
+	default:
+		return fmt.Errorf("invalid pull policy %q, expected one of %s, %s or %s", p, PullAlways, PullIfNotPresent, PullNever)
+	}
+}
+
+// pulledImagePrefix starts the description the engine gives to the cached
+// layers of a pulled image, followed by the digest-pinned reference.
+const pulledImagePrefix = "pulled from "
+
+// imagePresent returns ref pinned to the digest of the image the engine holds
+// for it, or "" if the engine doesn't hold it. The engine cache is scanned
+// entry by entry, so it is only used for the "never" policy. Entries that
+// can't be read count as missing. It is a variable so it can be swapped out.
+var imagePresent = func(ctx context.Context, ref string) string {
+	entries, err := dag.Engine().LocalCache().EntrySet().Entries(ctx)
+	if err != nil {
+		slog.Warn("Failed to list the engine cache", "image", ref, "err", err)
+		return ""
+	}
+	var pinned string
+	var newest int
+	for _, entry := range entries {
+		description, err := entry.Description(ctx)
+		if err != nil {
+			continue
+		}
+		match, ok := matchPulledImage(ref, description)
+		if !ok {
+			continue
+		}
+		// A tag pulled again after it moved has several entries: the most
+		// recent pull wins.
+		created, err := entry.CreatedTimeUnixNano(ctx)
+		if err != nil {
+			continue
+		}
+		if pinned == "" || created > newest {
+			pinned, newest = match, created
+		}
+	}
+	return pinned
+}
+
+// matchPulledImage reports whether description is the engine cache
+// description of an image pulled for ref, and returns ref pinned to the
+// digest that was pulled.
+func matchPulledImage(ref, description string) (string, bool) {
+	pulled, ok := strings.CutPrefix(description, pulledImagePrefix)
+	if !ok {
+		return "", false
+	}
+	registry, repository, tag, digest, err := parseImageRef(ref)
+	if err != nil {
+		return "", false
+	}
+	pulledRegistry, pulledRepository, pulledTag, pulledDigest, err := parseImageRef(pulled)
+	if err != nil || pulledDigest == "" || pulledRegistry != registry || pulledRepository != repository {
+		return "", false
+	}
+	if digest != "" && pulledDigest != digest || digest == "" && pulledTag != tag {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s@%s", registry, repository, pulledDigest), true
+}
+
+// shouldPull decides whether ref has to be pulled under the policy. When it
+// doesn't, it returns the pinned reference of the image present in the
+// engine. present is only consulted for the "never" policy.
+func shouldPull(ctx context.Context, ref string, policy PullPolicy, present func(ctx context.Context, ref string) string) (bool, string, error) {
+	switch policy {
+	case "", PullIfNotPresent, PullAlways:
+		return true, "", nil
+	case PullNever:
+		pinned := present(ctx, ref)
+		if pinned == "" {
+			return false, "", fmt.Errorf("image %s is not present in the engine and the pull policy is %q", ref, PullNever)
+		}
+		return false, pinned, nil
+	default:
+		return false, "", policy.Validate()
+	}
+}
+
+func (env *Environment) containerFrom(ctx context.Context, ref string, policy PullPolicy) (*dagger.Container, error) {
+	if err := ValidateImageRef(ref); err != nil {
+		return nil, err
+	}
+	pull, pinned, err := shouldPull(ctx, ref, policy, imagePresent)
+	if err != nil {
+		return nil, err
+	}
+	if !pull {
+		return dag.Container().From(pinned), nil
+	}
+	return env.pullImage(ctx, ref, policy == PullAlways)
+}
+
+// imageDigest returns the digest of the image container was created from.
+func imageDigest(ctx context.Context, container *dagger.Container) (string, error) {
+	imageRef, err := container.ImageRef(ctx)
+	if err != nil {
+		return "", err
+	}
+	_, _, _, digest, err := parseImageRef(imageRef)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return "", fmt.Errorf("no digest in image reference %s", imageRef)
+	}
+	return digest, nil
+}
+
+const defaultRegistry = "docker.io"
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// parseImageRef splits an image reference into its parts, filling in the
+// defaults docker applies: images without a registry come from docker.io,
+// official images live under library/ and the tag is latest unless a digest
+// is given. The first path component is a registry when it contains a dot or
+// a port, or is localhost.
+func parseImageRef(s string) (registry, repository, tag, digest string, err error) {
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+		if !digestPattern.MatchString(digest) {
+			return "", "", "", "", fmt.Errorf("invalid image reference %q: invalid digest %q", s, digest)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+		if !tagPattern.MatchString(tag) {
+			return "", "", "", "", fmt.Errorf("invalid image reference %q: invalid tag %q", s, tag)
+		}
+	}
+
+	registry = defaultRegistry
+	repository = name
+	if first, rest, found := strings.Cut(name, "/"); found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		registry, repository = first, rest
+	}
+	if registry == defaultRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	if !repositoryPattern.MatchString(repository) {
+		return "", "", "", "", fmt.Errorf("invalid image reference %q: invalid repository %q", s, repository)
+	}
+
+	if tag == "" && digest == "" {
+		tag = "latest"
+	}
+	return registry, repository, tag, digest, nil
+}
+
+// ValidateImageRef checks that s is a well-formed image reference, like
+// alpine, alpine:3.21, ghcr.io/org/image@sha256:... or
+// localhost:5000/image:tag.
+func ValidateImageRef(s string) error {
+	if s == "" {
+		return errors.New("image reference cannot be empty")
+	}
+	_, _, _, _, err := parseImageRef(s)
+	return err
+}
@@ -0,0 +1,123 @@
+package environment
+
+import (
+	"context"
+	"testing"
+)
+
+const testDigest = "sha256:a8560b36e8b8210634f77d9f7f9efd7ffa463e380b75e2e74aff4511df3ef88c"
+
+func TestMatchPulledImage(t *testing.T) {
+	for _, tt := range []struct {
+		ref, description string
+		want             string
+	}{
+		{"alpine", "pulled from docker.io/library/alpine:latest@" + testDigest, "docker.io/library/alpine@" + testDigest},
+		{"alpine:3.21", "pulled from docker.io/library/alpine:3.21@" + testDigest, "docker.io/library/alpine@" + testDigest},
+		{"docker.io/library/alpine:3.21", "pulled from docker.io/library/alpine:3.21@" + testDigest, "docker.io/library/alpine@" + testDigest},
+		{"alpine@" + testDigest, "pulled from docker.io/library/alpine:3.21@" + testDigest, "docker.io/library/alpine@" + testDigest},
+		{"alpine:3.20", "pulled from docker.io/library/alpine:3.21@" + testDigest, ""},
+		{"ghcr.io/org/alpine:3.21", "pulled from docker.io/library/alpine:3.21@" + testDigest, ""},
+		{"alpine:3.21", "pulled from docker.io/library/alpine:3.21", ""},
+		{"alpine:3.21", "exec apk add git", ""},
+	} {
+		got, ok := matchPulledImage(tt.ref, tt.description)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("matchPulledImage(%q, %q) = %q, %v, want %q", tt.ref, tt.description, got, ok, tt.want)
+		}
+	}
+}
+
+func TestShouldPull(t *testing.T) {
+	ctx := context.Background()
+	pinned := "docker.io/library/alpine@" + testDigest
+	present := func(context.Context, string) string { return pinned }
+	absent := func(context.Context, string) string { return "" }
+
+	for _, tt := range []struct {
+		name       string
+		policy     PullPolicy
+		present    func(context.Context, string) string
+		pull       bool
+		wantPinned string
+		wantErr    bool
+	}{
+		{"default", "", present, true, "", false},
+		{"if-not-present", PullIfNotPresent, present, true, "", false},
+		{"always", PullAlways, present, true, "", false},
+		{"never present", PullNever, present, false, pinned, false},
+		{"never absent", PullNever, absent, false, "", true},
+		{"invalid policy", "sometimes", present, false, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var scanned bool
+			scan := func(ctx context.Context, ref string) string {
+				scanned = true
+				return tt.present(ctx, ref)
+			}
+			pull, got, err := shouldPull(ctx, "alpine:3.21", tt.policy, scan)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("shouldPull() error = %v, want error %v", err, tt.wantErr)
+			}
+			if pull != tt.pull || got != tt.wantPinned {
+				t.Errorf("shouldPull() = %v, %q, want %v, %q", pull, got, tt.pull, tt.wantPinned)
+			}
+			// Only "never" pays for scanning the engine cache.
+			if scanned != (tt.policy == PullNever) {
+				t.Errorf("shouldPull() scanned the engine cache: %v", scanned)
+			}
+		})
+	}
+}
+
+func TestParseImageRef(t *testing.T) {
+	for _, tt := range []struct {
+		ref                               string
+		registry, repository, tag, digest string
+	}{
+		{"alpine", "docker.io", "library/alpine", "latest", ""},
+		{"alpine:3.21", "docker.io", "library/alpine", "3.21", ""},
+		{"library/alpine", "docker.io", "library/alpine", "latest", ""},
+		{"bitnami/redis:7.2", "docker.io", "bitnami/redis", "7.2", ""},
+		{"docker.io/library/alpine:3.21", "docker.io", "library/alpine", "3.21", ""},
+		{"alpine@" + testDigest, "docker.io", "library/alpine", "", testDigest},
+		{"alpine:3.21@" + testDigest, "docker.io", "library/alpine", "3.21", testDigest},
+		{"ghcr.io/org/team/image:v1.2.3", "ghcr.io", "org/team/image", "v1.2.3", ""},
+		{"localhost/image", "localhost", "image", "latest", ""},
+		{"localhost:5000/image:dev", "localhost:5000", "image", "dev", ""},
+		{"registry.internal:5000/a/b@" + testDigest, "registry.internal:5000", "a/b", "", testDigest},
+		{"my_org/my-image.v2:1_0-rc", "docker.io", "my_org/my-image.v2", "1_0-rc", ""},
+	} {
+		registry, repository, tag, digest, err := parseImageRef(tt.ref)
+		if err != nil {
+			t.Errorf("parseImageRef(%q) = %v", tt.ref, err)
+			continue
+		}
+		if registry != tt.registry || repository != tt.repository || tag != tt.tag || digest != tt.digest {
+			t.Errorf("parseImageRef(%q) = %q, %q, %q, %q, want %q, %q, %q, %q", tt.ref,
+				registry, repository, tag, digest, tt.registry, tt.repository, tt.tag, tt.digest)
+		}
+	}
+}
+
+func TestValidateImageRef(t *testing.T) {
+	for _, ref := range []string{
+		"",
+		"Alpine",
+		"alpine:",
+		"alpine:bad tag",
+		"alpine:-dash",
+		"alpine@sha256:short",
+		"ghcr.io/",
+		"/alpine",
+		"alpine//image",
+		"Not A Ref",
+	} {
+		if err := ValidateImageRef(ref); err == nil {
+			t.Errorf("ValidateImageRef(%q) succeeded", ref)
+		}
+	}
+	if err := ValidateImageRef("ghcr.io/org/image:v1@" + testDigest); err != nil {
+		t.Error(err)
+	}
+}
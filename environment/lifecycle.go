@@ -0,0 +1,106 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// OnStartFailure controls what a failing on_start command does to WaitReady:
+// "block", the default, fails it, and "warn" only logs the failure.
+type OnStartFailure string
+
+const (
+	OnStartBlock OnStartFailure = "block"
+	OnStartWarn  OnStartFailure = "warn"
+)
+
+func (f OnStartFailure) Validate() error {
+	switch f {
+	case "", OnStartBlock, OnStartWarn:
+		return nil
+	default:
+		return fmt.Errorf("invalid on_start_failure %q, expected %s or %s", f, OnStartBlock, OnStartWarn)
+	}
+}
+
+// runOnStart runs the on_start commands, in order, unless they already ran
+// since the last build. When they block and fail, they run again on the next
+// WaitReady.
+//
+// Like health checks, they run in fresh execs of the current container and
+// don't record a revision: they are meant for side effects outside of it,
+// such as notifying or preparing services. env.mu isn't held while they run.
+func (env *Environment) runOnStart(ctx context.Context) error {
+	env.onStartMu.Lock()
+	defer env.onStartMu.Unlock()
+
+	env.mu.Lock()
+	if env.started || len(env.Config.OnStart) == 0 {
+		env.mu.Unlock()
+		return nil
+	}
+	container, build := env.container, env.buildDone
+	commands, failure := slices.Clone(env.Config.OnStart), env.Config.OnStartFailure
+	env.mu.Unlock()
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range commands {
+		if err := runLifecycleCommand(ctx, container, shell, command); err != nil {
+			if failure != OnStartWarn {
+				return fmt.Errorf("on_start command %q failed: %w", command, err)
+			}
+			slog.Warn("on_start command failed", "id", env.ID, "command", command, "err", err)
+		}
+	}
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	// A build that started meanwhile needs its own run.
+	if env.buildDone == build {
+		env.started = true
+	}
+	return nil
+}
+
+// runOnStop runs the on_stop commands, in order. Failures are only logged so
+// that they never prevent the environment from closing. env.mu isn't held
+// while they run.
+func (env *Environment) runOnStop(ctx context.Context) {
+	env.mu.Lock()
+	container, commands := env.container, slices.Clone(env.Config.OnStop)
+	if container == nil || len(commands) == 0 {
+		env.mu.Unlock()
+		return
+	}
+	env.mu.Unlock()
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		slog.Warn("on_stop commands skipped", "id", env.ID, "err", err)
+		return
+	}
+
+	for _, command := range commands {
+		if err := runLifecycleCommand(ctx, container, shell, command); err != nil {
+			slog.Warn("on_stop command failed", "id", env.ID, "command", command, "err", err)
+		}
+	}
+}
+
+// runLifecycleCommand runs an on_start or on_stop command. It is a variable
+// so it can be swapped out.
+var runLifecycleCommand = func(ctx context.Context, container *dagger.Container, shell []string, command string) error {
+	// Bust the exec cache: every start and stop must actually run.
+	_, err := container.
+		WithEnvVariable("CU_LIFECYCLE_AT", time.Now().String()).
+		WithExec(slices.Concat(shell, []string{"-c", command})).
+		Sync(ctx)
+	return err
+}
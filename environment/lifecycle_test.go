@@ -0,0 +1,108 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+// recordLifecycleCommands records the lifecycle commands run instead of
+// running them, failing those listed in failing.
+func recordLifecycleCommands(t *testing.T, failing ...string) *[]string {
+	var ran []string
+	orig := runLifecycleCommand
+	runLifecycleCommand = func(ctx context.Context, container *dagger.Container, shell []string, command string) error {
+		ran = append(ran, command)
+		if slices.Contains(failing, command) {
+			return errors.New("exit code 1")
+		}
+		return nil
+	}
+	t.Cleanup(func() { runLifecycleCommand = orig })
+	return &ran
+}
+
+func lifecycleEnvironment(config *EnvironmentConfig) *Environment {
+	config.Shell = "sh"
+	env := &Environment{ID: "lifecycle/test", Config: config, container: &dagger.Container{}}
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", env.container, "")
+	env.mu.Unlock()
+	return env
+}
+
+func TestOnStart(t *testing.T) {
+	ran := recordLifecycleCommands(t)
+	config := DefaultConfig()
+	config.OnStart = []string{"start-agent", "notify"}
+	env := lifecycleEnvironment(config)
+
+	for range 2 {
+		if err := env.WaitReady(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(*ran, config.OnStart) {
+		t.Errorf("ran %q, want the on_start commands once, in order", *ran)
+	}
+}
+
+func TestOnStartFailure(t *testing.T) {
+	ran := recordLifecycleCommands(t, "start-agent")
+	config := DefaultConfig()
+	config.OnStart = []string{"start-agent", "notify"}
+	env := lifecycleEnvironment(config)
+
+	// Blocking failures stop at the failing command and run again next time.
+	for range 2 {
+		if err := env.WaitReady(context.Background()); err == nil || !strings.Contains(err.Error(), "start-agent") {
+			t.Errorf("WaitReady() = %v, want the on_start failure", err)
+		}
+	}
+	if !slices.Equal(*ran, []string{"start-agent", "start-agent"}) {
+		t.Errorf("ran %q", *ran)
+	}
+
+	*ran = nil
+	env.Config.OnStartFailure = OnStartWarn
+	if err := env.WaitReady(context.Background()); err != nil {
+		t.Errorf("WaitReady() with warnings = %v", err)
+	}
+	if !slices.Equal(*ran, config.OnStart) {
+		t.Errorf("ran %q, want every on_start command despite the failure", *ran)
+	}
+}
+
+func TestOnStop(t *testing.T) {
+	ran := recordLifecycleCommands(t, "flush")
+	config := DefaultConfig()
+	config.OnStop = []string{"flush", "stop-agent"}
+	env := lifecycleEnvironment(config)
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(env.ID) })
+
+	if err := env.Close(context.Background()); err != nil {
+		t.Errorf("Close() = %v, want on_stop failures ignored", err)
+	}
+	if !slices.Equal(*ran, config.OnStop) {
+		t.Errorf("ran %q, want every on_stop command", *ran)
+	}
+	if env.State() != StateClosed || Get(env.ID) != nil {
+		t.Errorf("environment is %s after Close()", env.State())
+	}
+}
+
+func TestOnStartFailureValidate(t *testing.T) {
+	for _, failure := range []OnStartFailure{"", OnStartBlock, OnStartWarn} {
+		if err := failure.Validate(); err != nil {
+			t.Errorf("Validate(%q) = %v", failure, err)
+		}
+	}
+	if err := OnStartFailure("ignore").Validate(); err == nil {
+		t.Error("Validate() accepted an unknown on_start failure mode")
+	}
+}
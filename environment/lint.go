@@ -0,0 +1,119 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxSetupCommands is the number of setup commands above which Lint suggests
+// combining them.
+const maxSetupCommands = 10
+
+type LintSeverity string
+
+const (
+	LintWarning LintSeverity = "warning"
+	LintInfo    LintSeverity = "info"
+)
+
+type LintIssue struct {
+	Severity LintSeverity `json:"severity"`
+	Field    string       `json:"field"`
+	Message  string       `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Severity, i.Field, i.Message)
+}
+
+// Lint returns advisory issues with the config. Unlike Validate, none of them
+// prevent the environment from being built.
+func (config *EnvironmentConfig) Lint() []LintIssue {
+	issues := []LintIssue{}
+
+	if unpinnedImage(config.BaseImage) {
+		issues = append(issues, LintIssue{
+			Severity: LintWarning,
+			Field:    "base_image",
+			Message:  fmt.Sprintf("%s uses the latest tag, pin a version for reproducible builds", config.BaseImage),
+		})
+	}
+
+	for i, entry := range config.Env {
+		if k, _, ok := parseKV(entry); ok && isSensitiveEnv(k) {
+			issues = append(issues, LintIssue{
+				Severity: LintWarning,
+				Field:    fmt.Sprintf("env[%d]", i),
+				Message:  fmt.Sprintf("%s looks like a secret, declare it in secrets instead so its value isn't stored in the config", k),
+			})
+		}
+	}
+
+	if len(config.SetupCommands) > maxSetupCommands && (config.SetupLayering == "" || config.SetupLayering == SetupPerCommand) {
+		issues = append(issues, LintIssue{
+			Severity: LintInfo,
+			Field:    "setup_commands",
+			Message:  fmt.Sprintf("%d setup commands, consider combining related ones or setting setup_layering", len(config.SetupCommands)),
+		})
+	}
+
+	if config.Instructions == DefaultConfig().Instructions {
+		issues = append(issues, LintIssue{
+			Severity: LintInfo,
+			Field:    "instructions",
+			Message:  "instructions are the default placeholder, describe how to build and test the project",
+		})
+	}
+
+	if config.SecurityProfile != "" || config.NoNewPrivileges || len(config.DropCapabilities) > 0 {
+		issues = append(issues, LintIssue{
+			Severity: LintWarning,
+			Field:    "security_profile",
+			Message:  "security_profile, no_new_privileges and drop_capabilities aren't enforced by dagger",
+		})
+	}
+
+	dependents := map[string][]string{}
+	for _, svc := range config.Services {
+		for _, dep := range svc.DependsOn {
+			dependents[dep] = append(dependents[dep], svc.Name)
+		}
+	}
+
+	for _, svc := range config.Services {
+		field := "services." + svc.Name
+		// Services have no health check of their own: dagger considers them
+		// ready once their exposed ports listen.
+		if len(svc.ExposedPorts) == 0 && len(dependents[svc.Name]) > 0 {
+			issues = append(issues, LintIssue{
+				Severity: LintWarning,
+				Field:    field + ".exposed_ports",
+				Message:  fmt.Sprintf("nothing checks it is ready before %s start, expose the port it serves on so that they wait for it to listen", strings.Join(dependents[svc.Name], ", ")),
+			})
+		}
+		if unpinnedImage(svc.Image) {
+			issues = append(issues, LintIssue{
+				Severity: LintWarning,
+				Field:    field + ".image",
+				Message:  fmt.Sprintf("%s uses the latest tag, pin a version for reproducible builds", svc.Image),
+			})
+		}
+		for i, entry := range svc.Env {
+			if k, _, ok := parseKV(entry); ok && isSensitiveEnv(k) {
+				issues = append(issues, LintIssue{
+					Severity: LintWarning,
+					Field:    fmt.Sprintf("%s.env[%d]", field, i),
+					Message:  fmt.Sprintf("%s looks like a secret, declare it in secrets instead so its value isn't stored in the config", k),
+				})
+			}
+		}
+	}
+
+	return issues
+}
+
+// unpinnedImage reports whether ref has no tag or digest, or uses latest.
+func unpinnedImage(ref string) bool {
+	_, _, tag, digest, err := parseImageRef(ref)
+	return err == nil && digest == "" && tag == "latest"
+}
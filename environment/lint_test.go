@@ -0,0 +1,73 @@
+package environment
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	config := DefaultConfig()
+	config.Instructions = "Run go test ./..."
+	config.BaseImage = "golang:1.24"
+	if issues := config.Lint(); len(issues) != 0 {
+		t.Fatalf("Lint() of a clean config = %v", issues)
+	}
+
+	config.BaseImage = "ubuntu"
+	config.Env = []string{"PATH=/usr/bin", "GITHUB_TOKEN=ghp_test"}
+	config.SetupCommands = make([]string, maxSetupCommands+1)
+	config.NoNewPrivileges = true
+	config.Services = ServiceConfigs{{
+		Name:  "db",
+		Image: "postgres:latest",
+		Env:   []string{"POSTGRES_PASSWORD=postgres"},
+	}, {
+		Name:         "api",
+		Image:        "api:1.0",
+		ExposedPorts: []int{8080},
+		DependsOn:    []string{"db"},
+	}}
+
+	fields := []string{}
+	for _, issue := range config.Lint() {
+		fields = append(fields, issue.Field)
+	}
+	want := []string{
+		"base_image",
+		"env[1]",
+		"setup_commands",
+		"security_profile",
+		"services.db.exposed_ports",
+		"services.db.image",
+		"services.db.env[0]",
+	}
+	if !slices.Equal(fields, want) {
+		t.Errorf("Lint() fields = %q, want %q", fields, want)
+	}
+
+	// Combining setup commands silences the suggestion, and exposing the
+	// port of a dependency lets dagger wait for it.
+	config.SetupLayering = SetupCombined
+	config.Services[0].ExposedPorts = []int{5432}
+	for _, issue := range config.Lint() {
+		if issue.Field == "setup_commands" || issue.Field == "services.db.exposed_ports" {
+			t.Errorf("Lint() of the fixed config = %v", issue)
+		}
+	}
+}
+
+func TestUnpinnedImage(t *testing.T) {
+	for ref, want := range map[string]bool{
+		"alpine":                      true,
+		"alpine:latest":               true,
+		"ghcr.io/org/app:latest":      true,
+		"alpine:3.21":                 false,
+		"alpine@" + testDigest:        false,
+		"alpine:latest@" + testDigest: false,
+		"Not A Ref":                   false,
+	} {
+		if got := unpinnedImage(ref); got != want {
+			t.Errorf("unpinnedImage(%q) = %v, want %v", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LockMetadata describes who locked an environment and why. The lock file may
+// hold it as JSON; an empty lock file locks the environment without any
+// metadata.
+type LockMetadata struct {
+	Owner     string    `json:"owner,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+}
+
+// LockInfo reads the lock file of the config stored in baseDir. It returns
+// nil if the config isn't locked.
+func (config *EnvironmentConfig) LockInfo(baseDir string) (*LockMetadata, error) {
+	lockPath := path.Join(baseDir, configDir, lockFile)
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	metadata := &LockMetadata{}
+	if strings.TrimSpace(string(data)) == "" {
+		return metadata, nil
+	}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("malformed lock file %s: %w", lockPath, err)
+	}
+	return metadata, nil
+}
+
+// LockInfo returns the lock metadata of the environment, or nil if it isn't
+// locked. Ephemeral environments are never locked.
+func (env *Environment) LockInfo() (*LockMetadata, error) {
+	if env.Ephemeral {
+		return nil, nil
+	}
+	if s := currentStore(); s != nil {
+		return s.ReadLock(env.ID)
+	}
+	return env.Config.LockInfo(env.Source)
+}
+
+// EnvironmentInfo is a registered environment along with its lock state.
+// Warning is set when the lock file couldn't be read: the environment is then
+// reported as locked, without metadata.
+type EnvironmentInfo struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Lock    *LockMetadata `json:"lock,omitempty"`
+	Warning string        `json:"warning,omitempty"`
+}
+
+// ListInfo returns the registered environments, sorted by ID, with their
+// lock state.
+func ListInfo() []EnvironmentInfo {
+	environmentsMu.RLock()
+	envs := make([]*Environment, 0, len(environments))
+	for _, env := range environments {
+		envs = append(envs, env)
+	}
+	environmentsMu.RUnlock()
+	slices.SortFunc(envs, func(a, b *Environment) int { return strings.Compare(a.ID, b.ID) })
+
+	infos := make([]EnvironmentInfo, 0, len(envs))
+	for _, env := range envs {
+		info := EnvironmentInfo{ID: env.ID, Name: env.Name}
+		lock, err := env.LockInfo()
+		if err != nil {
+			info.Lock = &LockMetadata{}
+			info.Warning = err.Error()
+		} else {
+			info.Lock = lock
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,67 @@
+package environment
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListInfo(t *testing.T) {
+	created := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	locks := map[string]string{
+		"lock/unlocked":  "",
+		"lock/empty":     " \n",
+		"lock/owned":     `{"owner": "ci", "reason": "release", "created_at": "2025-06-01T12:00:00Z"}`,
+		"lock/malformed": `{"owner":`,
+	}
+	for id, lock := range locks {
+		dir := t.TempDir()
+		if id != "lock/unlocked" {
+			writeFiles(t, dir, map[string]string{configDir + "/" + lockFile: lock})
+		}
+		registerEnvironment(&Environment{ID: id, Name: id, Source: dir, Config: DefaultConfig()})
+		t.Cleanup(func() { unregisterEnvironment(id) })
+	}
+
+	got := map[string]EnvironmentInfo{}
+	var ids []string
+	for _, info := range ListInfo() {
+		if _, ok := locks[info.ID]; ok {
+			got[info.ID] = info
+			ids = append(ids, info.ID)
+		}
+	}
+	if want := "lock/empty lock/malformed lock/owned lock/unlocked"; strings.Join(ids, " ") != want {
+		t.Fatalf("ListInfo() = %v, want %s in order", ids, want)
+	}
+	if info := got["lock/unlocked"]; info.Lock != nil || info.Warning != "" {
+		t.Errorf("unlocked environment = %+v", info)
+	}
+	if info := got["lock/empty"]; info.Lock == nil || *info.Lock != (LockMetadata{}) || info.Warning != "" {
+		t.Errorf("environment with an empty lock file = %+v, want locked without metadata", info)
+	}
+	if info := got["lock/owned"]; info.Lock == nil || *info.Lock != (LockMetadata{Owner: "ci", Reason: "release", CreatedAt: created}) {
+		t.Errorf("environment locked by ci = %+v", info)
+	}
+	// A malformed lock file only warns, and still counts as locked.
+	if info := got["lock/malformed"]; info.Lock == nil || !strings.Contains(info.Warning, "malformed lock file") {
+		t.Errorf("environment with a malformed lock file = %+v", info)
+	}
+}
+
+func TestLockInfoFromStore(t *testing.T) {
+	store := NewMemoryStore()
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+
+	env := &Environment{ID: "lock/store", Config: DefaultConfig()}
+	if lock, err := env.LockInfo(); lock != nil || err != nil {
+		t.Errorf("LockInfo() before locking = %v, %v", lock, err)
+	}
+	if err := store.WriteLock(env.ID, &LockMetadata{Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err := env.LockInfo(); err != nil || lock == nil || lock.Owner != "alice" {
+		t.Errorf("LockInfo() = %v, %v, want alice's lock", lock, err)
+	}
+}
@@ -0,0 +1,239 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// LogConfig caps the output a service keeps. The output of the service
+// command is written to files of about MaxSizeBytes each, and only the
+// MaxFiles most recent ones are kept: the oldest output is dropped first. The
+// output is still streamed to dagger as usual, stdout and stderr apart.
+// ServiceLogs reads what's retained, both streams interleaved.
+//
+// The files live in a cache volume of the environment, so they survive
+// service restarts and rebuilds. Only services with a log config are
+// captured: a small shell script sets up the capture and then execs the
+// service command, which gets the signals sent to the service. The output
+// goes through pipes read line by line, so it's line buffered. Images without
+// a shell run uncaptured.
+type LogConfig struct {
+	MaxSizeBytes int64 `json:"max_size_bytes,omitempty"`
+	MaxFiles     int   `json:"max_files,omitempty"`
+}
+
+const (
+	defaultLogMaxSizeBytes = 10 << 20
+	defaultLogMaxFiles     = 5
+
+	// serviceLogDir is where the log volume is mounted in service containers.
+	serviceLogDir = "/var/log/container-use"
+)
+
+var (
+	defaultLogConfigMu sync.RWMutex
+	defaultLogConfig   = LogConfig{MaxSizeBytes: defaultLogMaxSizeBytes, MaxFiles: defaultLogMaxFiles}
+)
+
+// SetDefaultLogConfig sets the limits used for the fields service log configs
+// leave at zero. Fields left at zero here, or a nil config, fall back to the
+// built-in defaults of 10 MiB per file and 5 files.
+func SetDefaultLogConfig(config *LogConfig) {
+	defaultLogConfigMu.Lock()
+	defer defaultLogConfigMu.Unlock()
+	defaultLogConfig = LogConfig{MaxSizeBytes: defaultLogMaxSizeBytes, MaxFiles: defaultLogMaxFiles}
+	if config != nil {
+		defaultLogConfig = config.withDefaults(defaultLogConfig)
+	}
+}
+
+func (c *LogConfig) Validate() error {
+	if c.MaxSizeBytes < 0 {
+		return errors.New("log max_size_bytes cannot be negative")
+	}
+	if c.MaxFiles < 0 {
+		return errors.New("log max_files cannot be negative")
+	}
+	return nil
+}
+
+func (c LogConfig) withDefaults(defaults LogConfig) LogConfig {
+	if c.MaxSizeBytes == 0 {
+		c.MaxSizeBytes = defaults.MaxSizeBytes
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = defaults.MaxFiles
+	}
+	return c
+}
+
+// effectiveLogConfig returns the log config of the service with defaults
+// filled in.
+func (cfg *ServiceConfig) effectiveLogConfig() LogConfig {
+	defaultLogConfigMu.RLock()
+	defaults := defaultLogConfig
+	defaultLogConfigMu.RUnlock()
+
+	if cfg.Logs == nil {
+		return defaults
+	}
+	return cfg.Logs.withDefaults(defaults)
+}
+
+// logRotationScript runs its arguments after the log directory, the service
+// name and the limits, appending their output to $dir/$name.log and shifting
+// full files to $name.log.1, $name.log.2 and so on, the highest being the
+// oldest. The command is exec'd with its stdout and stderr connected to fifos
+// copied to the script's own stdout and stderr and to the log, so its exit
+// status and signals are its own. The fifos are removed once the log is
+// written. It only relies on POSIX sh, mkfifo and mv.
+const logRotationScript = `dir=$1 name=$2 max_size=$3 max_files=$4
+shift 4
+log=$dir/$name.log
+pipes=$dir/.$name.pipes
+rotate() {
+	i=$((max_files - 1))
+	while [ "$i" -gt 1 ]; do
+		if [ -f "$log.$((i - 1))" ]; then mv -f "$log.$((i - 1))" "$log.$i"; fi
+		i=$((i - 1))
+	done
+	if [ "$max_files" -gt 1 ] && [ -f "$log" ]; then mv -f "$log" "$log.1"; fi
+}
+copy() {
+	while IFS= read -r line || [ -n "$line" ]; do
+		printf '%s\n' "$line"
+		printf '%s\n' "$line" >&3
+	done
+}
+mkdir -p "$dir"
+rm -rf "$pipes"
+mkdir "$pipes"
+mkfifo "$pipes/out" "$pipes/err" "$pipes/log"
+if [ -s "$log" ]; then rotate; fi
+{
+	exec 3> "$log"
+	size=0
+	while IFS= read -r line || [ -n "$line" ]; do
+		printf '%s\n' "$line" >&3
+		size=$((size + ${#line} + 1))
+		if [ "$size" -ge "$max_size" ]; then
+			exec 3>&-
+			rotate
+			exec 3> "$log"
+			size=0
+		fi
+	done < "$pipes/log"
+	rm -rf "$pipes"
+} &
+copy < "$pipes/out" 3> "$pipes/log" &
+copy < "$pipes/err" 3> "$pipes/log" >&2 &
+exec "$@" > "$pipes/out" 2> "$pipes/err"`
+
+// logReadScript prints the files written by logRotationScript, oldest first.
+const logReadScript = `dir=$1 name=$2 max_files=$3
+log=$dir/$name.log
+i=$((max_files - 1))
+while [ "$i" -ge 1 ]; do
+	if [ -f "$log.$i" ]; then cat "$log.$i"; fi
+	i=$((i - 1))
+done
+if [ -f "$log" ]; then cat "$log"; fi`
+
+// argsWithLogRotation wraps command, the full command of the service, so
+// that its output is rotated according to the log config of the service.
+func argsWithLogRotation(cfg *ServiceConfig, shell, command []string) []string {
+	if len(command) == 0 {
+		return command
+	}
+	config := cfg.effectiveLogConfig()
+	return slices.Concat(shell, []string{
+		"-c", logRotationScript, "sh",
+		serviceLogDir, cfg.Name, strconv.FormatInt(config.MaxSizeBytes, 10), strconv.Itoa(config.MaxFiles),
+	}, command)
+}
+
+// logVolume is the cache volume holding the service logs of the environment.
+func (env *Environment) logVolume() *dagger.CacheVolume {
+	return dag.CacheVolume("container-use-logs-" + env.ID)
+}
+
+// withServiceLogs prepares container to run the service with rotated logs if
+// it has a log config. It returns the args to run it with, and whether the
+// entrypoint of the image is still to be used. args are the args of the
+// service config.
+func (env *Environment) withServiceLogs(ctx context.Context, cfg *ServiceConfig, container *dagger.Container, args []string) (*dagger.Container, []string, bool, error) {
+	if cfg.Logs == nil {
+		return container, args, true, nil
+	}
+	shell, err := probeShell(ctx, cfg.Image, container)
+	if errors.Is(err, ErrNoShell) {
+		slog.Warn("Service image has no shell, its logs aren't capped", "service", cfg.Name, "image", cfg.Image)
+		return container, args, true, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// The image entrypoint and default args are resolved here since the
+	// wrapper replaces them.
+	entrypoint, err := container.Entrypoint(ctx)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	if len(args) == 0 {
+		if args, err = container.DefaultArgs(ctx); err != nil {
+			return nil, nil, false, fmt.Errorf("service %s: %w", cfg.Name, err)
+		}
+	}
+	command := slices.Concat(entrypoint, args)
+	if len(command) == 0 {
+		return container, args, true, nil
+	}
+
+	container = container.WithMountedCache(serviceLogDir, env.logVolume(), dagger.ContainerWithMountedCacheOpts{
+		Sharing: dagger.CacheSharingModeShared,
+	})
+	return container, argsWithLogRotation(cfg, shell, command), false, nil
+}
+
+// ServiceLogs returns the output of a service retained under its log config,
+// oldest first. It's read from the log files, so it includes the output of
+// previous runs of the service, within the limits. Long lines are truncated
+// like command output (see SetMaxLineBytes).
+func (env *Environment) ServiceLogs(ctx context.Context, service string) (string, error) {
+	env.mu.Lock()
+	cfg := env.Config.Services.Get(service)
+	if idx := slices.IndexFunc(env.Services, func(s *Service) bool { return s.Config.Name == service }); idx != -1 {
+		cfg = env.Services[idx].Config
+	}
+	env.mu.Unlock()
+	if cfg == nil {
+		return "", fmt.Errorf("unknown service %s", service)
+	}
+	if cfg.Logs == nil {
+		return "", fmt.Errorf("service %s has no log config, its output isn't retained", service)
+	}
+
+	config := cfg.effectiveLogConfig()
+	logs, err := dag.Container().
+		From(alpineImage).
+		WithMountedCache(serviceLogDir, env.logVolume(), dagger.ContainerWithMountedCacheOpts{
+			Sharing: dagger.CacheSharingModeShared,
+		}).
+		// The files change while the service runs: never reuse a read.
+		WithEnvVariable("CONTAINER_USE_LOGS_READ_AT", strconv.FormatInt(time.Now().UnixNano(), 10)).
+		WithExec([]string{"sh", "-c", logReadScript, "sh", serviceLogDir, cfg.Name, strconv.Itoa(config.MaxFiles)}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the logs of service %s: %w", service, err)
+	}
+	return truncateLines(logs), nil
+}
@@ -0,0 +1,207 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestEffectiveLogConfig(t *testing.T) {
+	t.Cleanup(func() { SetDefaultLogConfig(nil) })
+
+	cfg := &ServiceConfig{Name: "web"}
+	if got := cfg.effectiveLogConfig(); got != (LogConfig{MaxSizeBytes: defaultLogMaxSizeBytes, MaxFiles: defaultLogMaxFiles}) {
+		t.Errorf("effectiveLogConfig() = %+v, want the built-in defaults", got)
+	}
+
+	SetDefaultLogConfig(&LogConfig{MaxFiles: 2})
+	cfg.Logs = &LogConfig{MaxSizeBytes: 1024}
+	if got := cfg.effectiveLogConfig(); got != (LogConfig{MaxSizeBytes: 1024, MaxFiles: 2}) {
+		t.Errorf("effectiveLogConfig() = %+v, want the service size and the default file count", got)
+	}
+
+	for _, invalid := range []LogConfig{{MaxSizeBytes: -1}, {MaxFiles: -1}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", invalid)
+		}
+	}
+}
+
+// runLogRotation runs command through logRotationScript with the host shell,
+// as a service would, and returns what logReadScript reads back.
+func runLogRotation(t *testing.T, dir string, config LogConfig, command string) (string, int) {
+	t.Helper()
+	cfg := &ServiceConfig{Name: "svc", Logs: &config}
+	args := argsWithLogRotation(cfg, []string{"sh"}, []string{"sh", "-c", command})
+	// Point the script at dir instead of the log volume.
+	args[slices.Index(args, serviceLogDir)] = dir
+
+	code := 0
+	if err := exec.Command(args[0], args[1:]...).Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		code = exitErr.ExitCode()
+	}
+	waitLogWritten(t, dir)
+	out, err := exec.Command("sh", "-c", logReadScript, "sh", dir, "svc", strconv.Itoa(config.MaxFiles)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), code
+}
+
+// waitLogWritten waits for the log writer of logRotationScript, which outlives
+// the command, to be done.
+func waitLogWritten(t *testing.T, dir string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".svc.pipes")); os.IsNotExist(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the log writer never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLogRotationTrimsOldestFirst(t *testing.T) {
+	requireShell(t)
+	dir := t.TempDir()
+	config := LogConfig{MaxSizeBytes: 100, MaxFiles: 3}
+
+	// 100 lines of 10 bytes: 10 lines per file, and only 3 files kept.
+	out, code := runLogRotation(t, dir, config, `i=0; while [ $i -lt 100 ]; do printf 'line %04d\n' $i; i=$((i + 1)); done; exit 3`)
+	if code != 3 {
+		t.Errorf("exit code = %d, want the command's 3", code)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) > 30 || len(lines) < 20 {
+		t.Fatalf("retained %d lines, want the last 2 to 3 files:\n%s", len(lines), out)
+	}
+	if lines[len(lines)-1] != "line 0099" {
+		t.Errorf("last retained line = %q, want the newest", lines[len(lines)-1])
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("line %04d", 100-len(lines)+i); line != want {
+			t.Fatalf("retained line %d = %q, want %q: the oldest output must go first", i, line, want)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != "svc.log" && name != "svc.log.1" && name != "svc.log.2" {
+			t.Errorf("unexpected log file %s", name)
+		}
+	}
+
+	// A restart keeps the previous output within the limits.
+	out, _ = runLogRotation(t, dir, config, "echo restarted")
+	if !strings.HasSuffix(out, "line 0099\nrestarted\n") {
+		t.Errorf("logs after a restart end with %q", out[max(0, len(out)-40):])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "svc.log.3")); err == nil {
+		t.Error("rotation kept more files than max_files")
+	}
+}
+
+func TestLogRotationKeepsStreamsApart(t *testing.T) {
+	requireShell(t)
+	dir := t.TempDir()
+	cfg := &ServiceConfig{Name: "svc", Logs: &LogConfig{MaxSizeBytes: 1 << 20, MaxFiles: 2}}
+	args := argsWithLogRotation(cfg, []string{"sh"}, []string{"sh", "-c", `echo out; echo err >&2; echo "pid $$"; exit 4`})
+	args[slices.Index(args, serviceLogDir)] = dir
+
+	cmd := exec.Command(args[0], args[1:]...)
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 4 {
+		t.Errorf("exit = %v, want the command's 4", err)
+	}
+	waitLogWritten(t, dir)
+
+	// The command replaced the script, so signals sent to the service reach
+	// it.
+	if want := fmt.Sprintf("out\npid %d\n", pid); stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+	if stderr.String() != "err\n" {
+		t.Errorf("stderr = %q, want only the command's stderr", stderr.String())
+	}
+	out, err := exec.Command("sh", "-c", logReadScript, "sh", dir, "svc", "2").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(out))
+	slices.Sort(lines)
+	if got := strings.Join(lines, " "); got != fmt.Sprintf("%d err out pid", pid) {
+		t.Errorf("retained logs = %q, want both streams", out)
+	}
+}
+
+func TestServicesWithoutLogConfigAreNotWrapped(t *testing.T) {
+	env := &Environment{ID: "logs/test", Config: DefaultConfig()}
+	cfg := &ServiceConfig{Name: "web", Image: alpineImage, CommandArgs: []string{"httpd", "-f"}}
+	container := &dagger.Container{}
+	got, args, useEntrypoint, err := env.withServiceLogs(context.Background(), cfg, container, cfg.Args(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != container || !slices.Equal(args, cfg.CommandArgs) || !useEntrypoint {
+		t.Errorf("withServiceLogs() = %q, %v, want the service left alone", args, useEntrypoint)
+	}
+
+	env.Config.Services = ServiceConfigs{cfg}
+	if _, err := env.ServiceLogs(context.Background(), "web"); err == nil {
+		t.Error("ServiceLogs() of a service without a log config succeeded")
+	}
+}
+
+func TestServiceLogsTruncatesLongLines(t *testing.T) {
+	SetMaxLineBytes(16)
+	t.Cleanup(func() { SetMaxLineBytes(defaultMaxLineBytes) })
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Services = ServiceConfigs{{
+		Name:         "web",
+		Image:        alpineImage,
+		Command:      "printf 'short\\n%0200d\\n' 0 && httpd -f",
+		ExposedPorts: []int{80},
+		Logs:         &LogConfig{},
+	}}
+	env := newEngineEnvironment(t, config)
+
+	var logs string
+	for range 50 {
+		var err error
+		if logs, err = env.ServiceLogs(context.Background(), "web"); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(logs, "truncated") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(logs, "short\n") || !strings.Contains(logs, "... [184 bytes truncated]") {
+		t.Errorf("ServiceLogs() = %q, want the long line truncated", logs)
+	}
+}
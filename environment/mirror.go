@@ -0,0 +1,136 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// Mirror creates a standby replica of the environment. Every revision recorded
+// on the primary is copied to the mirror, with the same version, right after it
+// is recorded and before the primary's operation returns, so the mirror lags
+// by at most the revision being recorded. Revisions share their containers, so
+// mirroring is cheap.
+//
+// The mirror is ephemeral and read-only until it's promoted: it doesn't write
+// to the worktree and doesn't run services of its own.
+func (env *Environment) Mirror(ctx context.Context) (*Environment, error) {
+	// The registry lock is never taken while holding env.mu: the ID is
+	// reserved before and the mirror registered after.
+	id := NewEnvironmentID(env.Name)
+
+	env.mu.Lock()
+	if env.stateLocked() == StateClosed {
+		env.mu.Unlock()
+		releaseEnvironmentID(id)
+		return nil, ErrClosed
+	}
+	mirror := &Environment{
+		ID:          id,
+		Name:        env.Name,
+		Source:      env.Source,
+		Config:      env.Config.Copy(),
+		Ephemeral:   true,
+		container:   env.container,
+		baseImage:   env.baseImage,
+		lastVersion: env.lastVersion,
+		annotations: maps.Clone(env.annotations),
+		profiles:    slices.Clone(env.profiles),
+		primary:     env,
+	}
+	mirror.mu.Lock()
+	mirror.replaceHistory(mirrorHistory(env.History))
+	mirror.mu.Unlock()
+	env.mirrors = append(env.mirrors, mirror)
+	env.mu.Unlock()
+
+	registerEnvironment(mirror)
+	env.audit(ctx, "mirror", mirror.ID)
+
+	slog.Info("Mirroring environment", "id", env.ID, "mirror", mirror.ID)
+	return mirror, nil
+}
+
+// Promote turns a mirror into the primary: it stops following the primary,
+// takes over its ID and worktree, and the old primary is closed, which stops
+// its services. Callers looking the environment up by ID get the promoted
+// mirror from then on, and the other mirrors of the old primary follow it.
+// Only one mirror of a primary can be promoted.
+func (env *Environment) Promote(ctx context.Context) error {
+	env.mu.Lock()
+	primary := env.primary
+	env.mu.Unlock()
+	if primary == nil {
+		return errors.New("environment is not a mirror")
+	}
+
+	primary.mu.Lock()
+	if primary.stateLocked() == StateClosed || !slices.Contains(primary.mirrors, env) {
+		primary.mu.Unlock()
+		return errors.New("the primary of the mirror is closed or was already taken over")
+	}
+	siblings := slices.DeleteFunc(primary.mirrors, func(m *Environment) bool { return m == env })
+	primary.mirrors = nil
+	id, worktree, ephemeral := primary.ID, primary.Worktree, primary.Ephemeral
+	primary.mu.Unlock()
+
+	closeErr := primary.Close(ctx)
+	unregisterEnvironment(env.ID)
+
+	env.mu.Lock()
+	env.primary = nil
+	env.ID = id
+	env.Worktree = worktree
+	env.Ephemeral = ephemeral
+	env.mirrors = append(env.mirrors, siblings...)
+	for _, sibling := range siblings {
+		sibling.mu.Lock()
+		sibling.primary = env
+		sibling.mu.Unlock()
+	}
+	env.mu.Unlock()
+
+	registerEnvironment(env)
+	env.audit(ctx, "promote", "")
+	slog.Info("Promoted mirror", "id", env.ID)
+	if closeErr != nil {
+		return fmt.Errorf("promoted, but failed to close the old primary: %w", closeErr)
+	}
+	return nil
+}
+
+// replicateLocked applies fn, a change just made to the environment, to its
+// mirrors, after giving them its current config. It must be called with
+// env.mu held, so that a mirror taken meanwhile gets either the state before
+// the change or the change, never both.
+func (env *Environment) replicateLocked(fn func(mirror *Environment)) {
+	for _, mirror := range env.mirrors {
+		mirror.mu.Lock()
+		mirror.Config = env.Config.Copy()
+		mirror.baseImage = env.baseImage
+		mirror.annotations = maps.Clone(env.annotations)
+		fn(mirror)
+		mirror.mu.Unlock()
+	}
+}
+
+// mirrorHistory copies the revisions of h for a mirror. Containers are
+// shared.
+func mirrorHistory(h History) History {
+	history := make(History, 0, len(h))
+	for _, revision := range h {
+		history = append(history, copyRevision(revision))
+	}
+	return history
+}
+
+func copyRevision(revision *Revision) *Revision {
+	revisionCopy := *revision
+	revisionCopy.Annotations = maps.Clone(revision.Annotations)
+	revisionCopy.SetupResults = slices.Clone(revision.SetupResults)
+	revisionCopy.RuntimeEnv = slices.Clone(revision.RuntimeEnv)
+	return &revisionCopy
+}
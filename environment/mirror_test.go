@@ -0,0 +1,238 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestMirrorFollowsPrimary(t *testing.T) {
+	primary := &Environment{ID: "mirror/primary", Name: "mirror", Config: DefaultConfig()}
+	primary.mu.Lock()
+	primary.appendRevision(nil, "create", "", "", &dagger.Container{}, "")
+	primary.mu.Unlock()
+	registerEnvironment(primary)
+	t.Cleanup(func() { unregisterEnvironment(primary.ID) })
+
+	mirror, err := primary.Mirror(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterEnvironment(mirror.ID) })
+	if mirror.ID == primary.ID || len(mirror.History) != 1 {
+		t.Fatalf("mirror = %s with %d revisions, want a copy of the primary", mirror.ID, len(mirror.History))
+	}
+
+	container := &dagger.Container{}
+	primary.mu.Lock()
+	revision := primary.appendRevision(nil, "run", "", "", container, "")
+	primary.mu.Unlock()
+
+	mirrored := mirror.History.Get(revision.Version)
+	if mirrored == nil || mirrored.Name != "run" {
+		t.Fatalf("mirror history = %v, want version %d", mirror.History, revision.Version)
+	}
+	if mirrored == revision || mirror.container != container {
+		t.Error("mirror should hold a copy of the revision sharing its container")
+	}
+
+	if _, _, err := mirror.beginOperation(context.Background(), "run"); !errors.Is(err, ErrMirror) {
+		t.Errorf("operation on the mirror = %v, want ErrMirror", err)
+	}
+
+	if err := mirror.Promote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if mirror.ID != "mirror/primary" || Get("mirror/primary") != mirror {
+		t.Errorf("promoted mirror = %s, want it registered as the primary", mirror.ID)
+	}
+	if primary.State() != StateClosed {
+		t.Errorf("old primary state = %s, want closed", primary.State())
+	}
+	if _, done, err := mirror.beginOperation(context.Background(), "run"); err != nil {
+		t.Errorf("operation on the promoted mirror = %v", err)
+	} else {
+		done()
+	}
+	if err := mirror.Promote(context.Background()); err == nil {
+		t.Error("Promote() of a primary succeeded")
+	}
+}
+
+// newMirroredEnvironment returns a registered primary with a revision, and n
+// mirrors of it.
+func newMirroredEnvironment(t *testing.T, id string, n int) (*Environment, []*Environment) {
+	t.Helper()
+	primary := &Environment{ID: id, Name: "mirror", Config: DefaultConfig()}
+	primary.mu.Lock()
+	primary.appendRevision(nil, "create", "", "", &dagger.Container{}, "")
+	primary.mu.Unlock()
+	registerEnvironment(primary)
+	t.Cleanup(func() { unregisterEnvironment(primary.ID) })
+
+	var mirrors []*Environment
+	for range n {
+		mirror, err := primary.Mirror(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { unregisterEnvironment(mirror.ID) })
+		mirrors = append(mirrors, mirror)
+	}
+	return primary, mirrors
+}
+
+func TestMirrorFollowsConfigAndHistoryChanges(t *testing.T) {
+	primary, mirrors := newMirroredEnvironment(t, "mirror/changes", 1)
+	mirror := mirrors[0]
+
+	// A config change comes with the revision of the rebuild applying it.
+	config := primary.Config.Copy()
+	config.SetupCommands = []string{"make deps"}
+	primary.Config = config
+	primary.mu.Lock()
+	primary.appendRevision(nil, "rebuild", "", "", &dagger.Container{}, "")
+	primary.mu.Unlock()
+	if !slices.Equal(mirror.Config.SetupCommands, config.SetupCommands) {
+		t.Errorf("mirror setup commands = %q, want the primary's", mirror.Config.SetupCommands)
+	}
+	if mirror.Config == primary.Config {
+		t.Error("mirror shares the config of the primary")
+	}
+
+	primary.mu.Lock()
+	primary.replaceHistory(History{primary.History.Root()})
+	primary.mu.Unlock()
+	if len(mirror.History) != 1 || mirror.History[0] == primary.History[0] || mirror.History[0].Version != 1 {
+		t.Errorf("mirror history = %v, want a copy of the replaced history", mirror.History)
+	}
+}
+
+func TestMirrorTakenDuringAppendsGetsEachRevisionOnce(t *testing.T) {
+	primary, _ := newMirroredEnvironment(t, "mirror/race", 0)
+	const appends = 200
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range appends {
+			primary.mu.Lock()
+			primary.appendRevision(nil, "run", "", "", &dagger.Container{}, "")
+			primary.mu.Unlock()
+		}
+	}()
+	var mirrors []*Environment
+	for range 20 {
+		mirror, err := primary.Mirror(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { unregisterEnvironment(mirror.ID) })
+		mirrors = append(mirrors, mirror)
+	}
+	wg.Wait()
+
+	for _, mirror := range mirrors {
+		mirror.mu.Lock()
+		versions := make([]Version, 0, len(mirror.History))
+		for _, revision := range mirror.History {
+			versions = append(versions, revision.Version)
+		}
+		mirror.mu.Unlock()
+		want := make([]Version, appends+1)
+		for i := range want {
+			want[i] = Version(i + 1)
+		}
+		if !slices.Equal(versions, want) {
+			t.Errorf("mirror %s has versions %v, want each of the %d versions once", mirror.ID, versions, appends+1)
+		}
+	}
+}
+
+func TestPromoteClosesPrimaryAndKeepsSiblings(t *testing.T) {
+	ctx := context.Background()
+	ran := recordLifecycleCommands(t)
+	primary, mirrors := newMirroredEnvironment(t, "mirror/promote", 3)
+	primary.Config.OnStop = []string{"flush"}
+	primary.Config.Shell = "sh"
+	promoted, sibling := mirrors[0], mirrors[1]
+
+	if err := promoted.Promote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if primary.State() != StateClosed || !slices.Equal(*ran, []string{"flush"}) {
+		t.Errorf("old primary is %s after running %q, want it closed through Close", primary.State(), *ran)
+	}
+	if err := sibling.Promote(ctx); err != nil {
+		t.Fatalf("Promote() of a sibling, now following the promoted mirror = %v", err)
+	}
+	if promoted.State() != StateClosed || Get("mirror/promote") != sibling {
+		t.Error("the sibling didn't take over from the promoted mirror")
+	}
+
+	// The last mirror follows the new primary.
+	sibling.mu.Lock()
+	sibling.appendRevision(nil, "run", "", "", &dagger.Container{}, "")
+	sibling.mu.Unlock()
+	if got, want := mirrors[2].History.LatestVersion(), sibling.History.LatestVersion(); got != want {
+		t.Errorf("remaining mirror at version %d, want %d", got, want)
+	}
+}
+
+func TestPromoteTwice(t *testing.T) {
+	primary, mirrors := newMirroredEnvironment(t, "mirror/twice", 2)
+	primary.Config.Shell = "sh"
+	// A mirror left pointing at a primary taken over by another one.
+	mirrors[0].mu.Lock()
+	mirrors[0].primary = primary
+	mirrors[0].mu.Unlock()
+	primary.mu.Lock()
+	primary.mirrors = primary.mirrors[1:]
+	primary.mu.Unlock()
+
+	if err := mirrors[0].Promote(context.Background()); err == nil {
+		t.Error("Promote() of a mirror its primary no longer knows succeeded")
+	}
+	if err := mirrors[1].Promote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if Get("mirror/twice") != mirrors[1] {
+		t.Error("the promoted mirror isn't registered under the primary's ID")
+	}
+}
+
+func TestMirrorOfClosedEnvironment(t *testing.T) {
+	env := &Environment{ID: "mirror/closed", Name: "mirror", Config: DefaultConfig(), state: StateClosed}
+	if _, err := env.Mirror(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Mirror() of a closed environment = %v, want ErrClosed", err)
+	}
+}
+
+func TestMirrorGetsPrimaryRevisions(t *testing.T) {
+	ctx := context.Background()
+	primary := newEngineEnvironment(t, nil)
+	mirror, err := primary.Mirror(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterEnvironment(mirror.ID) })
+
+	if err := primary.FileWrite(ctx, "write", "mirrored", "contents"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mirror.History.LatestVersion(), primary.History.LatestVersion(); got != want {
+		t.Errorf("mirror version = %d, want the primary's %d", got, want)
+	}
+	out, err := mirror.FileRead(ctx, "mirrored", true, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "contents" {
+		t.Errorf("file on the mirror = %q", out)
+	}
+}
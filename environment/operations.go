@@ -0,0 +1,81 @@
+package environment
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Operation is an operation in flight on an environment.
+type Operation struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type operation struct {
+	Operation
+	cancel context.CancelFunc
+}
+
+var ErrUnknownOperation = errors.New("unknown operation, it may have already finished")
+
+// Operations lists the operations in flight, oldest first.
+func (env *Environment) Operations() []Operation {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	ops := make([]Operation, 0, len(env.operations))
+	for _, op := range env.operations {
+		ops = append(ops, op.Operation)
+	}
+	slices.SortFunc(ops, func(a, b Operation) int {
+		return cmp.Or(a.StartedAt.Compare(b.StartedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return ops
+}
+
+// Cancel cancels the context of an operation in flight. It returns
+// ErrUnknownOperation, and does nothing, if there is no such operation.
+func (env *Environment) Cancel(opID string) error {
+	env.mu.Lock()
+	op, ok := env.operations[opID]
+	env.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownOperation, opID)
+	}
+	op.cancel()
+	return nil
+}
+
+// trackOperation registers an operation of the given kind so it can be listed
+// and cancelled. The returned function must be called when it finishes.
+func (env *Environment) trackOperation(ctx context.Context, kind string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.lastOperation++
+	op := &operation{
+		Operation: Operation{
+			ID:        fmt.Sprintf("op-%d", env.lastOperation),
+			Kind:      kind,
+			StartedAt: time.Now(),
+		},
+		cancel: cancel,
+	}
+	if env.operations == nil {
+		env.operations = map[string]*operation{}
+	}
+	env.operations[op.ID] = op
+
+	return ctx, func() {
+		cancel()
+		env.mu.Lock()
+		delete(env.operations, op.ID)
+		env.mu.Unlock()
+	}
+}
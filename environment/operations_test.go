@@ -0,0 +1,39 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCancelOperation(t *testing.T) {
+	env := &Environment{}
+	buildCtx, buildDone := env.trackOperation(context.Background(), "rebuild")
+	runCtx, runDone := env.trackOperation(context.Background(), "run")
+	defer runDone()
+
+	ops := env.Operations()
+	if len(ops) != 2 || ops[0].Kind != "rebuild" || ops[1].Kind != "run" {
+		t.Fatalf("Operations() = %+v, want the rebuild then the run", ops)
+	}
+
+	if err := env.Cancel(ops[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(buildCtx.Err(), context.Canceled) {
+		t.Errorf("cancelled operation context = %v, want context.Canceled", buildCtx.Err())
+	}
+	if runCtx.Err() != nil {
+		t.Errorf("other operation context = %v, want it untouched", runCtx.Err())
+	}
+
+	buildDone()
+	if ops := env.Operations(); len(ops) != 1 || ops[0].Kind != "run" {
+		t.Errorf("Operations() after the rebuild finished = %+v", ops)
+	}
+	for _, id := range []string{ops[0].ID, "op-42"} {
+		if err := env.Cancel(id); !errors.Is(err, ErrUnknownOperation) {
+			t.Errorf("Cancel(%q) = %v, want ErrUnknownOperation", id, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+type packageManager string
+
+const (
+	packageManagerApt packageManager = "apt-get"
+	packageManagerApk packageManager = "apk"
+	packageManagerDnf packageManager = "dnf"
+	packageManagerYum packageManager = "yum"
+)
+
+// packageNamePattern allows names with version constraints (pkg=1.0,
+// pkg-1.0, pkg@edge) while keeping them safe to use unquoted in a shell.
+var packageNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_:=@~-]*$`)
+
+func validatePackage(name string) error {
+	if !packageNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid package name %q", name)
+	}
+	return nil
+}
+
+// installCommand returns the command installing packages with pm and cleaning
+// up its caches afterwards.
+func (pm packageManager) installCommand(packages []string) string {
+	list := strings.Join(packages, " ")
+	switch pm {
+	case packageManagerApt:
+		return "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " + list + " && rm -rf /var/lib/apt/lists/*"
+	case packageManagerApk:
+		return "apk add --no-cache " + list
+	case packageManagerDnf, packageManagerYum:
+		return string(pm) + " install -y " + list + " && " + string(pm) + " clean all"
+	default:
+		return ""
+	}
+}
+
+// detectPackageManager probes the container for a known package manager,
+// using shell.
+func detectPackageManager(ctx context.Context, container *dagger.Container, shell []string) (packageManager, error) {
+	out, err := container.WithExec(append(shell, "-c", "command -v apt-get || command -v apk || command -v dnf || command -v yum || true")).Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect package manager: %w", err)
+	}
+	switch pm := packageManager(path.Base(strings.TrimSpace(out))); pm {
+	case packageManagerApt, packageManagerApk, packageManagerDnf, packageManagerYum:
+		return pm, nil
+	default:
+		return "", fmt.Errorf("no supported package manager (apt-get, apk, dnf or yum) found in the base image, install packages with setup_commands instead")
+	}
+}
+
+// withPackages installs the configured packages.
+func (env *Environment) withPackages(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	if len(env.Config.Packages) == 0 {
+		return container, nil
+	}
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := detectPackageManager(ctx, container, shell)
+	if err != nil {
+		return nil, err
+	}
+	return env.runSetupCommands(ctx, container, []string{pm.installCommand(env.Config.Packages)})
+}
@@ -0,0 +1,58 @@
+package environment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInstallCommand(t *testing.T) {
+	packages := []string{"git", "curl=8.5.0-r0"}
+	for pm, want := range map[packageManager]string{
+		packageManagerApt: "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends git curl=8.5.0-r0 && rm -rf /var/lib/apt/lists/*",
+		packageManagerApk: "apk add --no-cache git curl=8.5.0-r0",
+		packageManagerDnf: "dnf install -y git curl=8.5.0-r0 && dnf clean all",
+		packageManagerYum: "yum install -y git curl=8.5.0-r0 && yum clean all",
+		"pacman":          "",
+	} {
+		if got := pm.installCommand(packages); got != want {
+			t.Errorf("%s installCommand() = %q, want %q", pm, got, want)
+		}
+	}
+}
+
+func TestValidatePackage(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"git":            true,
+		"python3.12":     true,
+		"libstdc++":      true,
+		"curl=8.5.0-r0":  true,
+		"nodejs@edge":    true,
+		"":               false,
+		"-y":             false,
+		"git; rm -rf /":  false,
+		"$(id)":          false,
+		"two words":      false,
+		"git\nmalicious": false,
+	} {
+		if err := validatePackage(name); (err == nil) != ok {
+			t.Errorf("validatePackage(%q) = %v, want ok %v", name, err, ok)
+		}
+	}
+}
+
+func TestDetectPackageManager(t *testing.T) {
+	requireEngine(t)
+	ctx := context.Background()
+
+	pm, err := detectPackageManager(ctx, dag.Container().From(alpineImage), []string{"/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm != packageManagerApk {
+		t.Errorf("detectPackageManager() of alpine = %s, want apk", pm)
+	}
+
+	if _, err := detectPackageManager(ctx, dag.Container().From("busybox:1.36"), []string{"/bin/sh"}); err == nil {
+		t.Error("detectPackageManager() of busybox succeeded")
+	}
+}
@@ -0,0 +1,271 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ErrPoolExhausted is returned by Acquire when every environment of the pool is
+// in use.
+var ErrPoolExhausted = errors.New("every environment of the pool is in use")
+
+// EnvironmentPool keeps pre-built ephemeral environments around so they can be
+// handed out without paying the build cost on demand.
+type EnvironmentPool struct {
+	name    string
+	maxSize int
+
+	mu     sync.Mutex
+	config *EnvironmentConfig
+	idle   []*Environment
+	inUse  int
+	// warming counts the environments Warm is building, which already count
+	// towards the size of the pool.
+	warming int
+	// snapshots are the states environments are reset to on release,
+	// recorded right after they were built.
+	snapshots map[*Environment]*poolSnapshot
+}
+
+func NewEnvironmentPool(name string, maxSize int) *EnvironmentPool {
+	return &EnvironmentPool{
+		name:      name,
+		maxSize:   maxSize,
+		snapshots: map[*Environment]*poolSnapshot{},
+	}
+}
+
+// Warm builds environments from config until n of them are idle in the pool,
+// or the pool is full. Idle environments built from a different config are
+// closed and replaced.
+func (p *EnvironmentPool) Warm(ctx context.Context, config *EnvironmentConfig, n int) error {
+	if n > p.maxSize {
+		return fmt.Errorf("cannot warm %d environments, the pool holds at most %d", n, p.maxSize)
+	}
+
+	p.mu.Lock()
+	var stale []*Environment
+	if p.config != nil && !DiffConfigs(p.config, config).Empty() {
+		stale, p.idle = p.idle, nil
+		for _, env := range stale {
+			delete(p.snapshots, env)
+		}
+	}
+	p.config = config.Copy()
+	// Environments in use or being built count towards the size of the pool.
+	missing := max(min(n-len(p.idle), p.maxSize-p.size()), 0)
+	p.warming += missing
+	p.mu.Unlock()
+
+	var errs []error
+	for _, env := range stale {
+		errs = append(errs, env.Close(ctx))
+	}
+	if err := errors.Join(errs...); err != nil {
+		slog.Warn("Failed to close environments built from a previous config", "pool", p.name, "err", err)
+	}
+
+	for i := range missing {
+		env, err := p.build(ctx)
+		p.mu.Lock()
+		p.warming--
+		if err != nil {
+			p.warming -= missing - i - 1
+			p.mu.Unlock()
+			return err
+		}
+		if !p.current(env) {
+			// The pool was warmed with another config in the meantime.
+			delete(p.snapshots, env)
+			p.mu.Unlock()
+			_ = env.Close(ctx)
+			continue
+		}
+		p.idle = append(p.idle, env)
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// size returns the number of environments of the pool, whether idle, in use
+// or being built.
+func (p *EnvironmentPool) size() int {
+	return len(p.idle) + p.inUse + p.warming
+}
+
+// current reports whether env was built from the current config of the pool.
+func (p *EnvironmentPool) current(env *Environment) bool {
+	snapshot := p.snapshots[env]
+	return snapshot != nil && DiffConfigs(snapshot.config, p.config).Empty()
+}
+
+// Acquire returns an environment from the pool, building one if none is idle.
+// At most maxSize environments are handed out at once; past that, Acquire
+// returns ErrPoolExhausted. The returned release function resets the
+// environment to its initial state and hands it back to the pool.
+func (p *EnvironmentPool) Acquire(ctx context.Context) (*Environment, func(), error) {
+	p.mu.Lock()
+	var env *Environment
+	if len(p.idle) > 0 {
+		env = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+	} else if p.size() >= p.maxSize {
+		p.mu.Unlock()
+		return nil, nil, fmt.Errorf("pool %s: %w", p.name, ErrPoolExhausted)
+	}
+	p.inUse++
+	p.mu.Unlock()
+
+	if env == nil {
+		var err error
+		env, err = p.build(ctx)
+		if err != nil {
+			p.mu.Lock()
+			p.inUse--
+			p.mu.Unlock()
+			return nil, nil, err
+		}
+	}
+
+	release := sync.OnceFunc(func() {
+		p.release(context.WithoutCancel(ctx), env)
+	})
+	return env, release, nil
+}
+
+// Close closes every idle environment of the pool.
+func (p *EnvironmentPool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	for _, env := range idle {
+		delete(p.snapshots, env)
+	}
+	p.mu.Unlock()
+
+	var errs []error
+	for _, env := range idle {
+		errs = append(errs, env.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (p *EnvironmentPool) build(ctx context.Context) (*Environment, error) {
+	p.mu.Lock()
+	config := p.config
+	p.mu.Unlock()
+	if config == nil {
+		return nil, errors.New("pool has not been warmed")
+	}
+	env, err := CreateEphemeral(ctx, "", p.name, config.Copy())
+	if err != nil {
+		return nil, err
+	}
+	snapshot := env.poolSnapshot()
+	p.mu.Lock()
+	p.snapshots[env] = snapshot
+	p.mu.Unlock()
+	return env, nil
+}
+
+// release puts env back into the state recorded when it was built, so the
+// next user inherits nothing from the previous one, and returns it to the
+// pool.
+func (p *EnvironmentPool) release(ctx context.Context, env *Environment) {
+	p.mu.Lock()
+	snapshot := p.snapshots[env]
+	p.mu.Unlock()
+	err := errors.New("no snapshot to reset to")
+	if snapshot != nil {
+		err = env.restorePoolSnapshot(ctx, snapshot)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse--
+	if err != nil || !p.current(env) || p.size() >= p.maxSize {
+		if err != nil {
+			slog.Warn("Failed to reset pooled environment", "id", env.ID, "err", err)
+		}
+		delete(p.snapshots, env)
+		_ = env.Close(ctx)
+		return
+	}
+	p.idle = append(p.idle, env)
+}
+
+// poolSnapshot is the state of an environment right after it was built.
+type poolSnapshot struct {
+	root            *Revision
+	config          *EnvironmentConfig
+	services        []*Service
+	serviceFailures map[string]*ServiceFailure
+	checkpoints     []setupCheckpoint
+	baseImage       PinnedImage
+	annotations     map[string]string
+	started         bool
+}
+
+func (env *Environment) poolSnapshot() *poolSnapshot {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return &poolSnapshot{
+		root:            env.History.Root(),
+		config:          env.Config.Copy(),
+		services:        slices.Clone(env.Services),
+		serviceFailures: maps.Clone(env.serviceFailures),
+		checkpoints:     slices.Clone(env.setupCheckpoints),
+		baseImage:       env.baseImage,
+		annotations:     maps.Clone(env.annotations),
+		started:         env.started,
+	}
+}
+
+// restorePoolSnapshot makes the environment look as it did when snapshot was
+// taken, without recording anything: later revisions, config and runtime
+// changes are dropped, services started since are stopped and the scratch
+// directory is emptied.
+func (env *Environment) restorePoolSnapshot(ctx context.Context, snapshot *poolSnapshot) error {
+	ctx, done, err := env.beginOperation(ctx, "reset")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if snapshot.root == nil || snapshot.root.container == nil {
+		return errors.New("no initial revision to reset to")
+	}
+	env.mu.Lock()
+	added := slices.DeleteFunc(slices.Clone(env.Services), func(svc *Service) bool {
+		return slices.Contains(snapshot.services, svc)
+	})
+	env.replaceHistory(History{snapshot.root})
+	env.Config = snapshot.config.Copy()
+	env.appliedConfig = nil
+	env.Services = slices.Clone(snapshot.services)
+	env.serviceFailures = maps.Clone(snapshot.serviceFailures)
+	env.setupCheckpoints = slices.Clone(snapshot.checkpoints)
+	env.setupResults = nil
+	env.baseImage = snapshot.baseImage
+	env.annotations = maps.Clone(snapshot.annotations)
+	env.started = snapshot.started
+	env.runtimeEnv = nil
+	env.runtimeInstructions = ""
+	scratchDir := env.Config.ScratchDir
+	env.mu.Unlock()
+
+	if err := stopServices(ctx, added); err != nil {
+		return fmt.Errorf("failed to stop services added since the environment was built: %w", err)
+	}
+	if scratchDir != "" {
+		if err := env.clearScratch(ctx); err != nil {
+			return fmt.Errorf("failed to clear the scratch directory: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+// newPooledEnvironment adds an idle environment to the pool as Warm would
+// build it, without building a container.
+func newPooledEnvironment(pool *EnvironmentPool, id string) *Environment {
+	if pool.config == nil {
+		pool.config = DefaultConfig()
+		// Clearing the scratch directory on release needs an engine.
+		pool.config.ScratchDir = ""
+	}
+	env := &Environment{ID: id, Ephemeral: true, Config: pool.config.Copy()}
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", &dagger.Container{}, "")
+	env.mu.Unlock()
+	pool.idle = append(pool.idle, env)
+	pool.snapshots[env] = env.poolSnapshot()
+	return env
+}
+
+func TestPoolAcquireEnforcesMaxSize(t *testing.T) {
+	ctx := context.Background()
+	pool := NewEnvironmentPool("test", 1)
+	pooled := newPooledEnvironment(pool, "pool/1")
+
+	env, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env != pooled {
+		t.Fatal("Acquire() didn't hand out the idle environment")
+	}
+	if _, _, err := pool.Acquire(ctx); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Acquire() of a full pool = %v, want ErrPoolExhausted", err)
+	}
+
+	release()
+	release()
+	if pool.inUse != 0 || len(pool.idle) != 1 {
+		t.Fatalf("after release: %d in use, %d idle, want 0 and 1", pool.inUse, len(pool.idle))
+	}
+	if env, _, err = pool.Acquire(ctx); err != nil || env != pooled {
+		t.Fatalf("Acquire() after release = %v, %v", env, err)
+	}
+}
+
+func TestPoolReleaseDropsRevisions(t *testing.T) {
+	ctx := context.Background()
+	pool := NewEnvironmentPool("test", 2)
+	newPooledEnvironment(pool, "pool/1")
+
+	env, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := env.History.Root()
+	env.mu.Lock()
+	for range 3 {
+		env.appendRevision(nil, "work", "", "", &dagger.Container{}, "")
+	}
+	env.mu.Unlock()
+	env.runtimeEnv = []string{"FOO=bar"}
+
+	release()
+	if len(env.History) != 1 || env.History[0] != root {
+		t.Errorf("history after release = %v, want only the root", env.History)
+	}
+	if env.container != root.container {
+		t.Error("released environment isn't back to its root container")
+	}
+	if env.runtimeEnv != nil {
+		t.Errorf("runtime env after release = %v", env.runtimeEnv)
+	}
+}
+
+func TestPoolReleaseRestoresSnapshot(t *testing.T) {
+	ctx := context.Background()
+	pool := NewEnvironmentPool("test", 1)
+	newPooledEnvironment(pool, "pool/1")
+	want := pool.config.Copy()
+
+	env, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mu.Lock()
+	env.Config.Env = append(env.Config.Env, "BORROWED=1")
+	env.Config.Services = append(env.Config.Services, &ServiceConfig{Name: "db", Image: "postgres:16"})
+	env.serviceFailures = map[string]*ServiceFailure{"db": {Err: errors.New("failed")}}
+	env.setupResults = []SetupResult{{Command: "make"}}
+	env.annotations = map[string]string{"ticket": "42"}
+	env.runtimeInstructions = "borrowed"
+	env.mu.Unlock()
+	env.RestoreConfig(DefaultConfig())
+
+	release()
+	if pool.inUse != 0 || len(pool.idle) != 1 {
+		t.Fatalf("after release: %d in use, %d idle, want 0 and 1", pool.inUse, len(pool.idle))
+	}
+	if diff := DiffConfigs(want, env.Config); !diff.Empty() {
+		t.Errorf("config after release differs from the built one: %s", diff)
+	}
+	if env.appliedConfig != nil || env.serviceFailures != nil || env.setupResults != nil ||
+		env.annotations != nil || env.runtimeInstructions != "" {
+		t.Errorf("released environment kept state: applied config %v, failures %v, setup results %v, annotations %v, instructions %q",
+			env.appliedConfig, env.serviceFailures, env.setupResults, env.annotations, env.runtimeInstructions)
+	}
+}
+
+func TestPoolWarmCountsEnvironmentsBeingBuilt(t *testing.T) {
+	pool := NewEnvironmentPool("test", 2)
+	pool.config = DefaultConfig()
+	pool.inUse = 1
+	pool.warming = 1
+
+	// The pool is full, so there is nothing to build.
+	if err := pool.Warm(context.Background(), DefaultConfig(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if pool.warming != 1 || len(pool.idle) != 0 {
+		t.Errorf("Warm() of a full pool: %d warming, %d idle", pool.warming, len(pool.idle))
+	}
+	if _, _, err := pool.Acquire(context.Background()); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Acquire() while the pool fills up = %v, want ErrPoolExhausted", err)
+	}
+}
+
+func TestPoolWarmReplacesStaleEnvironments(t *testing.T) {
+	ctx := context.Background()
+	pool := NewEnvironmentPool("test", 2)
+	stale := newPooledEnvironment(pool, "pool/1")
+	borrowed := newPooledEnvironment(pool, "pool/2")
+	env, release, err := pool.Acquire(ctx)
+	if err != nil || env != borrowed {
+		t.Fatalf("Acquire() = %v, %v", env, err)
+	}
+
+	config := pool.config.Copy()
+	config.Env = []string{"CHANGED=1"}
+	if err := pool.Warm(ctx, config, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.idle) != 0 || pool.snapshots[stale] != nil {
+		t.Errorf("Warm() with a new config kept %d idle environments", len(pool.idle))
+	}
+	if diff := DiffConfigs(config, pool.config); !diff.Empty() {
+		t.Errorf("pool config after Warm(): %s", diff)
+	}
+
+	// An environment built from the old config isn't handed out again.
+	release()
+	if len(pool.idle) != 0 || pool.snapshots[borrowed] != nil {
+		t.Errorf("an environment built from the old config went back to the pool")
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	ctx := context.Background()
+	pool := NewEnvironmentPool("test", 2)
+	if err := pool.Warm(ctx, DefaultConfig(), 3); err == nil {
+		t.Error("Warm() past the pool size succeeded")
+	}
+	if _, _, err := pool.Acquire(ctx); err == nil {
+		t.Error("Acquire() from a pool never warmed succeeded")
+	}
+	if pool.inUse != 0 {
+		t.Errorf("failed Acquire() left %d environments in use", pool.inUse)
+	}
+}
+
+func TestPoolWarm(t *testing.T) {
+	requireEngine(t)
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	pool := NewEnvironmentPool("test", 2)
+	t.Cleanup(func() { _ = pool.Close(context.Background()) })
+
+	if err := pool.Warm(ctx, config, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.idle) != 2 {
+		t.Fatalf("%d idle environments after Warm(2)", len(pool.idle))
+	}
+	env, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Run(ctx, "touch", "touch /workdir/dirty /tmp/scratch/dirty", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.AddService(ctx, "Add web", &ServiceConfig{
+		Name:         "web",
+		Image:        alpineImage,
+		CommandArgs:  []string{"httpd", "-f", "-p", "8080"},
+		ExposedPorts: []int{8080},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	env, release, err = pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if out, _ := env.Run(ctx, "check", "if test -e /workdir/dirty -o -e /tmp/scratch/dirty; then echo dirty; fi", "", false); out != "" {
+		t.Errorf("pooled environment kept the previous user's files: %q", out)
+	}
+	if len(env.Services) != 0 || len(env.Config.Services) != 0 {
+		t.Errorf("pooled environment kept the previous user's services: %v", env.Services)
+	}
+}
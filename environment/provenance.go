@@ -0,0 +1,124 @@
+package environment
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// provenanceSchemaVersion is bumped whenever the JSON shape of Provenance
+// changes in a way consumers need to know about.
+const provenanceSchemaVersion = 1
+
+// Provenance records exactly what produced an environment, to be attached to
+// build artifacts as JSON.
+type Provenance struct {
+	Schema      int    `json:"schema"`
+	ID          string `json:"id"`
+	ToolVersion string `json:"tool_version"`
+
+	// Config is the effective config, including runtime env changes. Values
+	// of sensitive variables are redacted, as by Environment.Env.
+	Config *EnvironmentConfig `json:"config"`
+
+	// Images are the images the environment runs, pinned to their digest.
+	// Base builds are identified by the digest of their context instead.
+	Images []PinnedImage `json:"images"`
+
+	Head          Version       `json:"head"`
+	RootCreatedAt time.Time     `json:"root_created_at"`
+	SetupResults  []SetupResult `json:"setup_results"`
+}
+
+type PinnedImage struct {
+	// Service is empty for the base image.
+	Service string `json:"service,omitempty"`
+	Ref     string `json:"ref"`
+	Digest  string `json:"digest"`
+}
+
+var (
+	toolVersionMu sync.Mutex
+	toolVersion   = buildVersion()
+)
+
+// SetToolVersion sets the version of the tool recorded in provenance, e.g.
+// the release version of the binary.
+func SetToolVersion(version string) {
+	toolVersionMu.Lock()
+	defer toolVersionMu.Unlock()
+	toolVersion = version
+}
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "dev"
+	}
+	return info.Main.Version
+}
+
+// Provenance returns the provenance of the environment: its effective config,
+// the digests of its images, its head and the setup results of the build the
+// head derives from. The digests are the ones recorded when the base image was
+// built and the services started, so tags moved since don't affect them.
+func (env *Environment) Provenance() (*Provenance, error) {
+	config := env.EffectiveConfig()
+	secrets := kvMap(config.Secrets)
+	config.Env = redactEnv(config.Env, secrets)
+	for _, svc := range config.Services {
+		svc.Env = redactEnv(svc.Env, kvMap(svc.Secrets))
+	}
+
+	env.mu.Lock()
+	baseImage := env.baseImage
+	images := []PinnedImage{}
+	for _, svc := range env.Services {
+		images = append(images, PinnedImage{Service: svc.Config.Name, Ref: svc.Config.Image, Digest: svc.digest})
+	}
+	head := env.History.LatestVersion()
+	var rootCreatedAt time.Time
+	if root := env.History.Root(); root != nil {
+		rootCreatedAt = root.CreatedAt
+	}
+	setupResults := []SetupResult{}
+	for revision := env.revision(head); revision != nil; revision = env.revision(revision.Parent) {
+		if len(revision.SetupResults) > 0 {
+			setupResults = append(setupResults, revision.SetupResults...)
+			break
+		}
+	}
+	env.mu.Unlock()
+	if baseImage.Digest == "" {
+		return nil, errors.New("the environment has no recorded base image digest, rebuild it first")
+	}
+
+	toolVersionMu.Lock()
+	provenance := &Provenance{
+		Schema:        provenanceSchemaVersion,
+		ID:            env.ID,
+		ToolVersion:   toolVersion,
+		Config:        config,
+		Images:        append([]PinnedImage{baseImage}, images...),
+		Head:          head,
+		RootCreatedAt: rootCreatedAt,
+		SetupResults:  setupResults,
+	}
+	toolVersionMu.Unlock()
+	return provenance, nil
+}
+
+// redactEnv returns the KEY=VALUE entries of envs with the values of the
+// variables that look sensitive, or are declared as secrets, redacted.
+func redactEnv(envs []string, secrets map[string]string) []string {
+	redacted := make([]string, 0, len(envs))
+	for _, entry := range envs {
+		k, _, _ := parseKV(entry)
+		if _, isSecret := secrets[k]; isSecret || isSensitiveEnv(k) {
+			entry = k + "=" + redactedValue
+		}
+		redacted = append(redacted, entry)
+	}
+	return redacted
+}
@@ -0,0 +1,112 @@
+package environment
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	SetToolVersion("v1.2.3")
+	t.Cleanup(func() { SetToolVersion(buildVersion()) })
+
+	config := DefaultConfig()
+	config.BaseImage = "alpine:3"
+	config.SetupCommands = []string{"apk add git"}
+	config.Env = []string{"DB_URL=postgres://app:hunter2@db/app", "LOG_LEVEL=debug"}
+	config.Secrets = []string{"DB_URL=env://DB_URL"}
+	config.Services = ServiceConfigs{{Name: "db", Image: "postgres:16", Env: []string{"POSTGRES_PASSWORD=hunter2"}}}
+	env := &Environment{ID: "provenance/test", Config: config}
+	if _, err := env.Provenance(); err == nil {
+		t.Error("Provenance() succeeded without a recorded base image digest")
+	}
+
+	base := PinnedImage{Ref: "alpine:3", Digest: "sha256:" + strings.Repeat("a", 64)}
+	db := &Service{Config: &ServiceConfig{Name: "db", Image: "postgres:16"}, digest: "sha256:" + strings.Repeat("b", 64)}
+	results := []SetupResult{{Command: "apk add git", Duration: Duration(3 * time.Second)}}
+	env.mu.Lock()
+	env.baseImage = base
+	env.Services = []*Service{db}
+	env.runtimeEnv = []string{"DEBUG=1", "API_TOKEN=hunter2"}
+	env.setupResults = results
+	root := env.appendRevision(nil, "create", "", "", nil, "")
+	env.setupResults = nil
+	env.appendRevision(nil, "exec", "", "", nil, "")
+	env.mu.Unlock()
+
+	provenance, err := env.Provenance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PinnedImage{base, {Service: "db", Ref: "postgres:16", Digest: db.digest}}; !reflect.DeepEqual(provenance.Images, want) {
+		t.Errorf("images = %+v, want %+v", provenance.Images, want)
+	}
+	// Setup results come from the build the head derives from.
+	if !reflect.DeepEqual(provenance.SetupResults, results) {
+		t.Errorf("setup results = %+v, want %+v", provenance.SetupResults, results)
+	}
+	if provenance.Head != 2 || !provenance.RootCreatedAt.Equal(root.CreatedAt) {
+		t.Errorf("head %d created at %s, want 2 created at %s", provenance.Head, provenance.RootCreatedAt, root.CreatedAt)
+	}
+	if provenance.ToolVersion != "v1.2.3" || provenance.Schema != provenanceSchemaVersion || provenance.ID != env.ID {
+		t.Errorf("provenance = %+v", provenance)
+	}
+	if !strings.Contains(strings.Join(provenance.Config.Env, " "), "DEBUG=1") {
+		t.Errorf("config env = %q, want the effective config", provenance.Config.Env)
+	}
+	wantEnv := []string{"DB_URL=" + redactedValue, "LOG_LEVEL=debug", "DEBUG=1", "API_TOKEN=" + redactedValue}
+	if !reflect.DeepEqual(provenance.Config.Env, wantEnv) {
+		t.Errorf("config env = %q, want %q", provenance.Config.Env, wantEnv)
+	}
+	if got := provenance.Config.Services[0].Env; !reflect.DeepEqual(got, []string{"POSTGRES_PASSWORD=" + redactedValue}) {
+		t.Errorf("service env = %q, want the password redacted", got)
+	}
+	// The environment itself keeps the values.
+	if env.Config.Env[0] != "DB_URL=postgres://app:hunter2@db/app" || env.Config.Services[0].Env[0] != "POSTGRES_PASSWORD=hunter2" {
+		t.Errorf("Provenance() redacted the live config: %q, %q", env.Config.Env, env.Config.Services[0].Env)
+	}
+
+	data, err := json.Marshal(provenance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Provenance
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Images, provenance.Images) || !reflect.DeepEqual(decoded.SetupResults, provenance.SetupResults) {
+		t.Errorf("provenance after a JSON round trip = %+v, want %+v", decoded, provenance)
+	}
+}
+
+func TestProvenanceOfBuiltEnvironment(t *testing.T) {
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupLogMode = SetupLogAlways
+	config.SetupCommands = []string{"echo built"}
+	config.Services = ServiceConfigs{{
+		Name:         "web",
+		Image:        alpineImage,
+		CommandArgs:  []string{"httpd", "-f", "-p", "8080"},
+		ExposedPorts: []int{8080},
+	}}
+	env := newEngineEnvironment(t, config)
+
+	provenance, err := env.Provenance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provenance.Images) != 2 {
+		t.Fatalf("images = %+v, want the base image and the service", provenance.Images)
+	}
+	for _, image := range provenance.Images {
+		if image.Ref != alpineImage || !strings.HasPrefix(image.Digest, "sha256:") {
+			t.Errorf("image = %+v, want %s pinned to a digest", image, alpineImage)
+		}
+	}
+	if len(provenance.SetupResults) != 1 || strings.TrimSpace(provenance.SetupResults[0].Output) != "built" {
+		t.Errorf("setup results = %+v, want the setup command", provenance.SetupResults)
+	}
+}
@@ -0,0 +1,77 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+// FileProvision is a file written into the container at build time, before
+// the setup commands run. At most one of Content, SourcePath (a host path,
+// relative to the source directory) or Secret (a secret reference such as
+// env://TLS_KEY) can be set; if none is, an empty file is created.
+// Secret-backed files are mounted rather than written, so their contents
+// never end up in the container layers.
+type FileProvision struct {
+	Path       string      `json:"path"`
+	Content    string      `json:"content,omitempty"`
+	SourcePath string      `json:"source_path,omitempty"`
+	Secret     string      `json:"secret,omitempty"`
+	Mode       os.FileMode `json:"mode,omitempty"`
+}
+
+func (f *FileProvision) Validate() error {
+	if !path.IsAbs(f.Path) {
+		return fmt.Errorf("file path must be absolute: %q", f.Path)
+	}
+	sources := 0
+	for _, source := range []string{f.Content, f.SourcePath, f.Secret} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("file %s: only one of content, source_path and secret can be set", f.Path)
+	}
+	return nil
+}
+
+func (env *Environment) withFiles(container *dagger.Container) (*dagger.Container, error) {
+	for _, f := range env.Config.Files {
+		if err := f.Validate(); err != nil {
+			return nil, err
+		}
+
+		mode := int(f.Mode)
+		if mode == 0 {
+			mode = 0644
+		}
+
+		switch {
+		case f.Secret != "":
+			container = container.WithMountedSecret(f.Path, resolveSecret(f.Secret), dagger.ContainerWithMountedSecretOpts{
+				Mode: mode,
+			})
+		case f.SourcePath != "":
+			sourcePath := f.SourcePath
+			if !filepath.IsAbs(sourcePath) {
+				if env.Source == "" {
+					return nil, errors.New("relative source_path requires a source directory")
+				}
+				sourcePath = filepath.Join(env.Source, sourcePath)
+			}
+			container = container.WithFile(f.Path, dag.Host().File(sourcePath), dagger.ContainerWithFileOpts{
+				Permissions: mode,
+			})
+		default:
+			container = container.WithNewFile(f.Path, f.Content, dagger.ContainerWithNewFileOpts{
+				Permissions: mode,
+			})
+		}
+	}
+	return container, nil
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileProvisionValidate(t *testing.T) {
+	for _, tt := range []struct {
+		file FileProvision
+		ok   bool
+	}{
+		{FileProvision{Path: "/etc/app.conf"}, true},
+		{FileProvision{Path: "/etc/app.conf", Content: "x"}, true},
+		{FileProvision{Path: "/etc/app.conf", SourcePath: "app.conf"}, true},
+		{FileProvision{Path: "/etc/app.key", Secret: "env://KEY"}, true},
+		{FileProvision{Path: "etc/app.conf", Content: "x"}, false},
+		{FileProvision{Path: "/etc/app.conf", Content: "x", SourcePath: "app.conf"}, false},
+		{FileProvision{Path: "/etc/app.conf", Content: "x", Secret: "env://KEY"}, false},
+	} {
+		if err := tt.file.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate() of %+v = %v, want ok %v", tt.file, err, tt.ok)
+		}
+	}
+}
+
+func TestProvisionRelativeSourceNeedsSource(t *testing.T) {
+	env := &Environment{Config: DefaultConfig()}
+	env.Config.Files = []FileProvision{{Path: "/etc/app.conf", SourcePath: "app.conf"}}
+	if _, err := env.withFiles(nil); err == nil {
+		t.Error("withFiles() resolved a relative source_path without a source directory")
+	}
+}
+
+func TestProvisionFiles(t *testing.T) {
+	ctx := context.Background()
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "app.conf"), []byte("from source"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONTAINER_USE_TEST_KEY", "secret key")
+
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Files = []FileProvision{
+		{Path: "/etc/inline.conf", Content: "inline", Mode: 0o600},
+		{Path: "/etc/app.conf", SourcePath: filepath.Join(source, "app.conf")},
+		{Path: "/etc/app.key", Secret: "env://CONTAINER_USE_TEST_KEY"},
+		{Path: "/etc/empty"},
+	}
+	config.SetupCommands = []string{"cat /etc/app.key > /tmp/key-at-setup"}
+	env := newEngineEnvironment(t, config)
+
+	out, err := env.Run(ctx, "read", "stat -c %a /etc/inline.conf; cat /etc/inline.conf; echo; cat /etc/app.conf; echo; cat /tmp/key-at-setup; echo; wc -c < /etc/empty", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "600\ninline\nfrom source\nsecret key\n0"
+	if strings.TrimSpace(out) != want {
+		t.Errorf("provisioned files = %q, want %q", out, want)
+	}
+}
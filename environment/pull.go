@@ -0,0 +1,122 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	defaultPullRetries = 2
+	defaultPullBackoff = time.Second
+)
+
+var (
+	pullRetriesMu sync.Mutex
+	pullRetries   = defaultPullRetries
+	pullBackoff   = defaultPullBackoff
+)
+
+// SetPullRetries sets how many times a failed image pull is retried, and the
+// delay before the first retry, which doubles after each attempt. Zero
+// retries disable them.
+func SetPullRetries(n int, backoff time.Duration) {
+	pullRetriesMu.Lock()
+	defer pullRetriesMu.Unlock()
+	pullRetries = max(n, 0)
+	pullBackoff = backoff
+}
+
+// pullNonceVar is set on the container From is called on when a pull must
+// resolve the tag again. From keeps the variables of the container it's
+// called on, so the nonce makes the call unique without changing the image,
+// and it's removed right after.
+const pullNonceVar = "CONTAINER_USE_PULL_NONCE"
+
+// imagePuller pulls ref into the engine. fresh forces the tag to be resolved
+// against the registry instead of reusing an earlier resolution. It is a
+// variable so it can be swapped out.
+var imagePuller = func(ctx context.Context, ref string, fresh bool) (*dagger.Container, error) {
+	container := dag.Container()
+	if !fresh {
+		return container.From(ref).Sync(ctx)
+	}
+	return container.
+		WithEnvVariable(pullNonceVar, strconv.FormatInt(time.Now().UnixNano(), 10)).
+		From(ref).
+		WithoutEnvVariable(pullNonceVar).
+		Sync(ctx)
+}
+
+// permanentPullErrors are markers of pull failures retrying can't fix. The
+// engine reports registry errors as plain messages, so they are matched by
+// text.
+var permanentPullErrors = []string{
+	"not found",
+	"manifest unknown",
+	"name unknown",
+	"repository does not exist",
+	"unauthorized",
+	"authentication required",
+	"denied",
+	"forbidden",
+	"invalid reference format",
+}
+
+// transientPullError reports whether a failed pull is worth retrying.
+func transientPullError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return !slices.ContainsFunc(permanentPullErrors, func(marker string) bool {
+		return strings.Contains(msg, marker)
+	})
+}
+
+// pullImage pulls ref, retrying transient failures with exponential backoff.
+// Retries resume where the previous attempt stopped: layers already fetched
+// are kept in the engine cache. Authentication failures and missing images
+// fail right away.
+//
+// The engine doesn't report byte-level progress to clients, so progress is
+// reported per attempt: a pull_start event when it begins and a pull event
+// with its outcome.
+func (env *Environment) pullImage(ctx context.Context, ref string, fresh bool) (*dagger.Container, error) {
+	pullRetriesMu.Lock()
+	retries, backoff := pullRetries, pullBackoff
+	pullRetriesMu.Unlock()
+
+	var lastErr error
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("pull of %s canceled: %w", ref, ctx.Err())
+			}
+			backoff *= 2
+		}
+
+		env.emit(Event{Type: EventPullStart, Image: ref, Attempt: attempt})
+		start := time.Now()
+		container, err := imagePuller(ctx, ref, fresh)
+		env.emit(Event{Type: EventPull, Image: ref, Attempt: attempt, Duration: Duration(time.Since(start)), Error: errorString(err)})
+		if err == nil {
+			return container, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("pull of %s canceled: %w", ref, err)
+		}
+		if !transientPullError(err) {
+			return nil, fmt.Errorf("failed to pull %s: %w", ref, err)
+		}
+		lastErr = err
+		slog.Warn("Image pull failed", "image", ref, "attempt", attempt, "err", err)
+	}
+	return nil, fmt.Errorf("failed to pull %s after %d attempts: %w", ref, retries+1, lastErr)
+}
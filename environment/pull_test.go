@@ -0,0 +1,130 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// mockPuller makes image pulls fail with errs in turn, then succeed.
+func mockPuller(t *testing.T, errs ...error) *int {
+	t.Helper()
+	attempts := 0
+	orig := imagePuller
+	imagePuller = func(ctx context.Context, ref string, fresh bool) (*dagger.Container, error) {
+		attempts++
+		if attempts <= len(errs) {
+			return nil, errs[attempts-1]
+		}
+		return &dagger.Container{}, nil
+	}
+	t.Cleanup(func() { imagePuller = orig })
+	return &attempts
+}
+
+func setPullRetries(t *testing.T, n int, backoff time.Duration) {
+	SetPullRetries(n, backoff)
+	t.Cleanup(func() { SetPullRetries(defaultPullRetries, defaultPullBackoff) })
+}
+
+func TestPullRetries(t *testing.T) {
+	attempts := mockPuller(t, errors.New("connection reset by peer"), errors.New("i/o timeout"))
+	setPullRetries(t, 3, 10*time.Millisecond)
+	var events bytes.Buffer
+	SetEventSink(&events)
+	t.Cleanup(func() { SetEventSink(nil) })
+
+	env := &Environment{ID: "pull/test"}
+	start := time.Now()
+	container, err := env.pullImage(context.Background(), alpineImage, false)
+	if err != nil || container == nil {
+		t.Fatalf("pullImage() = %v, %v, want the third attempt to succeed", container, err)
+	}
+	if *attempts != 3 {
+		t.Errorf("pulled %d times, want 3", *attempts)
+	}
+	// Backoff doubles: 10ms, then 20ms.
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("retries took %s, want at least 30ms of backoff", elapsed)
+	}
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Image != alpineImage {
+			t.Errorf("event %s is for image %q, want %q", event.Type, event.Image, alpineImage)
+		}
+		got = append(got, fmt.Sprintf("%s %d %t", event.Type, event.Attempt, event.Error != ""))
+	}
+	want := []string{"pull_start 1 false", "pull 1 true", "pull_start 2 false", "pull 2 true", "pull_start 3 false", "pull 3 false"}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestPullRetriesExhausted(t *testing.T) {
+	attempts := mockPuller(t, errors.New("i/o timeout"), errors.New("i/o timeout"), errors.New("connection refused"))
+	setPullRetries(t, 2, time.Millisecond)
+
+	_, err := (&Environment{}).pullImage(context.Background(), "example.com/app:1", false)
+	if err == nil || !strings.Contains(err.Error(), "example.com/app:1") || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("pullImage() = %v, want the image and the last error", err)
+	}
+	if *attempts != 3 {
+		t.Errorf("pulled %d times, want 3", *attempts)
+	}
+}
+
+func TestPullPermanentErrorsAreNotRetried(t *testing.T) {
+	setPullRetries(t, 5, time.Millisecond)
+	for _, msg := range []string{
+		"failed to resolve source metadata: docker.io/library/nope:latest: not found",
+		"pull access denied, repository does not exist or may require authorization",
+		"401 Unauthorized",
+	} {
+		attempts := mockPuller(t, errors.New(msg))
+		if _, err := (&Environment{}).pullImage(context.Background(), "nope", false); err == nil {
+			t.Errorf("pullImage() succeeded after %q", msg)
+		}
+		if *attempts != 1 {
+			t.Errorf("pulled %d times after %q, want no retry", *attempts, msg)
+		}
+	}
+}
+
+func TestPullRespectsCancellation(t *testing.T) {
+	attempts := mockPuller(t, errors.New("i/o timeout"), errors.New("i/o timeout"))
+	setPullRetries(t, 2, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := (&Environment{}).pullImage(ctx, alpineImage, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pullImage() = %v, want context.DeadlineExceeded", err)
+	}
+	if *attempts != 1 {
+		t.Errorf("pulled %d times, want the backoff interrupted", *attempts)
+	}
+}
+
+func TestSetPullRetriesDisablesRetries(t *testing.T) {
+	attempts := mockPuller(t, errors.New("i/o timeout"))
+	setPullRetries(t, -1, time.Millisecond)
+	if _, err := (&Environment{}).pullImage(context.Background(), alpineImage, false); err == nil {
+		t.Error("pullImage() retried with retries disabled")
+	}
+	if *attempts != 1 {
+		t.Errorf("pulled %d times, want 1", *attempts)
+	}
+}
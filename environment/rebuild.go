@@ -0,0 +1,62 @@
+package environment
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// inPlaceFields are config fields that never require a rebuild: they aren't
+// part of the container or are enforced on later revisions.
+var inPlaceFields = []string{
+	"instructions", "instruction_sources", "ttl", "read_only_root", "writable_paths",
+	"security_profile", "no_new_privileges", "drop_capabilities", "health_check",
+	"env_rules", "on_start", "on_start_failure", "on_stop", "setup_log_mode",
+}
+
+// RebuildReason reports whether updating the environment to cfg requires a
+// full rebuild, along with a human readable reason. It only advises:
+// UpdateConfig always rebuilds.
+func (env *Environment) RebuildReason(cfg *EnvironmentConfig) (bool, string) {
+	return rebuildReason(env.builtConfig(), cfg)
+}
+
+func rebuildReason(oldConfig, newConfig *EnvironmentConfig) (bool, string) {
+	diff := DiffConfigs(oldConfig, newConfig)
+	if diff.Empty() {
+		return false, "no changes, no rebuild"
+	}
+
+	envChanged := false
+	for _, change := range diff.Changes {
+		switch {
+		case slices.Contains(inPlaceFields, change.Field):
+		case strings.HasPrefix(change.Field, "env."):
+			envChanged = true
+			if len(newConfig.SetupCommands) > 0 || len(newConfig.Services) > 0 || len(newConfig.Packages) > 0 || newConfig.Runtime != nil {
+				return true, fmt.Sprintf("%s changed and setup commands or services may depend on it", change.Field)
+			}
+		case change.Field == "base_image", change.Field == "base_build":
+			return true, "base image changed"
+		case strings.HasPrefix(change.Field, "setup_commands["):
+			i, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(change.Field, "setup_commands["), "]"))
+			switch {
+			case change.Old == "":
+				return true, fmt.Sprintf("setup command %d added", i+1)
+			case change.New == "":
+				return true, fmt.Sprintf("setup command %d removed", i+1)
+			default:
+				return true, fmt.Sprintf("setup command %d modified", i+1)
+			}
+		case strings.HasPrefix(change.Field, "services."):
+			return true, fmt.Sprintf("service %s changed", strings.TrimPrefix(change.Field, "services."))
+		default:
+			return true, fmt.Sprintf("%s changed", change.Field)
+		}
+	}
+	if envChanged {
+		return false, "env-only change, no rebuild required"
+	}
+	return false, "only metadata changed, no rebuild"
+}
@@ -0,0 +1,59 @@
+package environment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRebuildReason(t *testing.T) {
+	current := DefaultConfig()
+	current.SetupCommands = []string{"apk add git", "go mod download"}
+
+	for _, tt := range []struct {
+		name    string
+		change  func(*EnvironmentConfig)
+		rebuild bool
+		reason  string
+	}{
+		{"unchanged", func(*EnvironmentConfig) {}, false, "no changes, no rebuild"},
+		{"instructions", func(c *EnvironmentConfig) { c.Instructions = "new" }, false, "only metadata changed, no rebuild"},
+		{"ttl", func(c *EnvironmentConfig) { c.TTL = Duration(time.Hour) }, false, "only metadata changed, no rebuild"},
+		{"base image", func(c *EnvironmentConfig) { c.BaseImage = "golang:1.24" }, true, "base image changed"},
+		{"base build", func(c *EnvironmentConfig) {
+			c.BaseImage = ""
+			c.BaseBuild = &BaseBuild{Context: "."}
+		}, true, "base image changed"},
+		{"setup modified", func(c *EnvironmentConfig) {
+			c.SetupCommands = []string{"apk add git", "go mod tidy"}
+		}, true, "setup command 2 modified"},
+		{"setup added", func(c *EnvironmentConfig) {
+			c.SetupCommands = []string{"apk add git", "go mod download", "make"}
+		}, true, "setup command 3 added"},
+		{"setup removed", func(c *EnvironmentConfig) {
+			c.SetupCommands = []string{"apk add git"}
+		}, true, "setup command 2 removed"},
+		{"env with setup", func(c *EnvironmentConfig) { c.Env = []string{"FOO=bar"} }, true, "env.FOO changed and setup commands or services may depend on it"},
+		{"service", func(c *EnvironmentConfig) {
+			c.Services = ServiceConfigs{{Name: "db", Image: "postgres"}}
+		}, true, "service db changed"},
+		{"other field", func(c *EnvironmentConfig) { c.Workdir = "/src" }, true, "workdir changed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proposed := current.Copy()
+			proposed.SetupCommands = append([]string(nil), current.SetupCommands...)
+			tt.change(proposed)
+			rebuild, reason := rebuildReason(current, proposed)
+			if rebuild != tt.rebuild || reason != tt.reason {
+				t.Errorf("rebuildReason() = %v, %q, want %v, %q", rebuild, reason, tt.rebuild, tt.reason)
+			}
+		})
+	}
+
+	// Without setup or services, env changes don't need a rebuild.
+	bare := DefaultConfig()
+	proposed := bare.Copy()
+	proposed.Env = []string{"FOO=bar"}
+	if rebuild, reason := rebuildReason(bare, proposed); rebuild || reason != "env-only change, no rebuild required" {
+		t.Errorf("rebuildReason() of an env-only change = %v, %q", rebuild, reason)
+	}
+}
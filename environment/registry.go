@@ -0,0 +1,145 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	petname "github.com/dustinkirkland/golang-petname"
+)
+
+const maxIDAttempts = 10
+
+var (
+	environmentsMu sync.RWMutex
+	environments   = map[string]*Environment{}
+	// reservedIDs holds IDs handed out by NewEnvironmentID whose environment
+	// isn't registered yet, so concurrent constructors never share an ID.
+	reservedIDs = map[string]struct{}{}
+)
+
+func registerEnvironment(env *Environment) {
+	environmentsMu.Lock()
+	defer environmentsMu.Unlock()
+	environments[env.ID] = env
+	delete(reservedIDs, env.ID)
+}
+
+func unregisterEnvironment(id string) {
+	environmentsMu.Lock()
+	defer environmentsMu.Unlock()
+	delete(environments, id)
+}
+
+// releaseEnvironmentID gives back an ID reserved by NewEnvironmentID whose
+// environment failed to build.
+func releaseEnvironmentID(id string) {
+	environmentsMu.Lock()
+	defer environmentsMu.Unlock()
+	delete(reservedIDs, id)
+}
+
+// releaseIDOnError releases id when the constructor reserving it fails. It's
+// meant to be deferred.
+func releaseIDOnError(id string, rerr *error) {
+	if *rerr != nil {
+		releaseEnvironmentID(id)
+	}
+}
+
+// NewEnvironmentID returns an ID of the form name/adjective-animal that isn't
+// used by any registered environment, and reserves it until the environment
+// is registered or the ID released.
+func NewEnvironmentID(name string) string {
+	environmentsMu.Lock()
+	defer environmentsMu.Unlock()
+
+	taken := func(id string) bool {
+		_, registered := environments[id]
+		_, reserved := reservedIDs[id]
+		return registered || reserved
+	}
+	reserve := func(id string) string {
+		reservedIDs[id] = struct{}{}
+		return id
+	}
+	for _, words := range []int{2, 3} {
+		for range maxIDAttempts {
+			if id := fmt.Sprintf("%s/%s", name, petname.Generate(words, "-")); !taken(id) {
+				return reserve(id)
+			}
+		}
+	}
+	// Fall back to a numeric suffix, which terminates since only finitely
+	// many IDs are taken.
+	base := fmt.Sprintf("%s/%s", name, petname.Generate(2, "-"))
+	for n := 2; ; n++ {
+		if id := fmt.Sprintf("%s-%d", base, n); !taken(id) {
+			return reserve(id)
+		}
+	}
+}
+
+// ParseEnvironmentID splits an ID generated by NewEnvironmentID into the
+// environment name and its random suffix. Names may contain "/", suffixes
+// never do.
+func ParseEnvironmentID(id string) (name, suffix string, err error) {
+	i := strings.LastIndex(id, "/")
+	if i == -1 {
+		return "", "", fmt.Errorf("invalid environment ID %q, expected name/suffix", id)
+	}
+	name, suffix = id[:i], id[i+1:]
+	if name == "" || suffix == "" {
+		return "", "", fmt.Errorf("invalid environment ID %q, expected name/suffix", id)
+	}
+	return name, suffix, nil
+}
+
+// Expired reports whether the environment has outlived its TTL. Environments
+// without a TTL never expire.
+func (env *Environment) Expired(now time.Time) bool {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	if env.Config.TTL <= 0 {
+		return false
+	}
+	root := env.History.Root()
+	if root == nil {
+		return false
+	}
+	return now.Sub(root.CreatedAt) > time.Duration(env.Config.TTL)
+}
+
+// ReapExpired closes and unregisters every environment that outlived its TTL
+// and returns their IDs.
+func ReapExpired(ctx context.Context) ([]string, error) {
+	now := time.Now()
+
+	environmentsMu.RLock()
+	all := slices.Collect(maps.Values(environments))
+	environmentsMu.RUnlock()
+
+	expired := []*Environment{}
+	for _, env := range all {
+		if env.Expired(now) {
+			expired = append(expired, env)
+		}
+	}
+
+	reaped := []string{}
+	var errs []error
+	for _, env := range expired {
+		fireReap(env)
+		if err := env.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reap %s: %w", env.ID, err))
+		}
+		reaped = append(reaped, env.ID)
+	}
+	return reaped, errors.Join(errs...)
+}
@@ -0,0 +1,180 @@
+package environment
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewEnvironmentIDUnique(t *testing.T) {
+	const n = 1000
+	ids := make(chan string, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- NewEnvironmentID("project")
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[string]bool{}
+	for id := range ids {
+		t.Cleanup(func() { releaseEnvironmentID(id) })
+		if seen[id] {
+			t.Fatalf("NewEnvironmentID returned %s twice", id)
+		}
+		seen[id] = true
+
+		name, suffix, err := ParseEnvironmentID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "project" || suffix == "" {
+			t.Errorf("ParseEnvironmentID(%q) = %q, %q", id, name, suffix)
+		}
+	}
+}
+
+func TestNewEnvironmentIDSkipsRegistered(t *testing.T) {
+	id := NewEnvironmentID("project")
+	env := &Environment{ID: id}
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(id) })
+
+	for range 100 {
+		other := NewEnvironmentID("project")
+		releaseEnvironmentID(other)
+		if other == id {
+			t.Fatalf("NewEnvironmentID returned the registered ID %s", id)
+		}
+	}
+}
+
+func TestParseEnvironmentIDInvalid(t *testing.T) {
+	for _, id := range []string{"", "project", "project/", "/suffix", "a/b/"} {
+		if _, _, err := ParseEnvironmentID(id); err == nil {
+			t.Errorf("ParseEnvironmentID(%q) succeeded", id)
+		}
+	}
+}
+
+func TestParseEnvironmentIDNestedName(t *testing.T) {
+	id := NewEnvironmentID("org/project")
+	t.Cleanup(func() { releaseEnvironmentID(id) })
+	name, suffix, err := ParseEnvironmentID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "org/project" || suffix == "" || strings.Contains(suffix, "/") {
+		t.Errorf("ParseEnvironmentID(%q) = %q, %q, want org/project and the suffix", id, name, suffix)
+	}
+}
+
+// newTestEnvironment returns an environment with a config and a root revision
+// created at createdAt, without a container.
+func newTestEnvironment(id string, config *EnvironmentConfig, createdAt time.Time) *Environment {
+	env := &Environment{ID: id, Ephemeral: true, Config: config}
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", nil, "")
+	env.History[0].CreatedAt = createdAt
+	env.mu.Unlock()
+	return env
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	config := DefaultConfig()
+	config.TTL = Duration(time.Hour)
+
+	if env := newTestEnvironment("fresh", config, now.Add(-time.Minute)); env.Expired(now) {
+		t.Error("environment within its TTL expired")
+	}
+	if env := newTestEnvironment("old", config, now.Add(-2*time.Hour)); !env.Expired(now) {
+		t.Error("environment past its TTL didn't expire")
+	}
+	if env := newTestEnvironment("forever", DefaultConfig(), now.Add(-24*time.Hour)); env.Expired(now) {
+		t.Error("environment without a TTL expired")
+	}
+
+	// Expired reads the history under the lock, so it can race appends.
+	env := newTestEnvironment("busy", config, now)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			env.mu.Lock()
+			env.appendRevision(nil, "append", "", "", nil, "")
+			env.mu.Unlock()
+		}
+	}()
+	for range 100 {
+		env.Expired(now)
+	}
+	wg.Wait()
+}
+
+func TestExpiredDuringRebuild(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	config := env.Config.Copy()
+	config.TTL = Duration(time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := env.UpdateConfig(context.Background(), "set a TTL", config); err != nil {
+			t.Error(err)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if env.Expired(time.Now()) {
+				t.Error("environment expired right after getting a TTL")
+			}
+			return
+		default:
+			env.Expired(time.Now())
+		}
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	config := DefaultConfig()
+	config.TTL = Duration(time.Hour)
+	old := newTestEnvironment("reap/old", config, time.Now().Add(-2*time.Hour))
+	fresh := newTestEnvironment("reap/fresh", config, time.Now())
+	registerEnvironment(old)
+	registerEnvironment(fresh)
+	t.Cleanup(func() { unregisterEnvironment(fresh.ID) })
+
+	var reapedByHook []string
+	OnReap(func(env *Environment) {
+		if strings.HasPrefix(env.ID, "reap/") {
+			reapedByHook = append(reapedByHook, env.ID)
+		}
+	})
+
+	reaped, err := ReapExpired(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reaped, []string{old.ID}) || !slices.Equal(reapedByHook, []string{old.ID}) {
+		t.Errorf("reaped %v (hook saw %v), want [%s]", reaped, reapedByHook, old.ID)
+	}
+	if old.State() != StateClosed {
+		t.Errorf("reaped environment is %s, want closed", old.State())
+	}
+	if Get(old.ID) != nil {
+		t.Error("reaped environment is still registered")
+	}
+	if Get(fresh.ID) == nil {
+		t.Error("fresh environment was unregistered")
+	}
+}
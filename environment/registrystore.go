@@ -0,0 +1,160 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// registrySnapshotVersion is bumped whenever the snapshot layout changes in a
+// way older readers can't understand.
+const registrySnapshotVersion = 1
+
+type registryEntry struct {
+	Version     int               `json:"version"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Source      string            `json:"source"`
+	Worktree    string            `json:"worktree,omitempty"`
+	Config      json.RawMessage   `json:"config"`
+	History     History           `json:"history"`
+	LastVersion Version           `json:"last_version,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Profiles    []string          `json:"profiles,omitempty"`
+}
+
+// SaveRegistry writes every registered environment to baseDir, one file per
+// environment, so that they can be restored with LoadRegistry. Each
+// environment is snapshotted under its own lock, so every file is consistent.
+// Ephemeral environments aren't saved, and the files of environments that are
+// no longer registered are removed.
+func SaveRegistry(baseDir string) error {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return err
+	}
+
+	environmentsMu.RLock()
+	envs := make([]*Environment, 0, len(environments))
+	for _, env := range environments {
+		if !env.Ephemeral {
+			envs = append(envs, env)
+		}
+	}
+	environmentsMu.RUnlock()
+
+	saved := map[string]bool{}
+	for _, env := range envs {
+		data, err := env.snapshot()
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", env.ID, err)
+		}
+		file := url.PathEscape(env.ID) + ".json"
+		name := filepath.Join(baseDir, file)
+		if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(name+".tmp", name); err != nil {
+			return err
+		}
+		saved[file] = true
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || saved[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(baseDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove the snapshot of a deleted environment: %w", err)
+		}
+	}
+	return nil
+}
+
+func (env *Environment) snapshot() ([]byte, error) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	config, err := env.Config.Bundle()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&registryEntry{
+		Version:     registrySnapshotVersion,
+		ID:          env.ID,
+		Name:        env.Name,
+		Source:      env.Source,
+		Worktree:    env.Worktree,
+		Config:      config,
+		History:     env.History,
+		LastVersion: env.lastVersion,
+		Annotations: env.annotations,
+		Profiles:    env.profiles,
+	}, "", "  ")
+}
+
+// LoadRegistry registers the environments saved in baseDir by SaveRegistry.
+// Containers are loaded lazily from the revision states, so nothing is rebuilt
+// until they are used. Services aren't restarted.
+func LoadRegistry(ctx context.Context, baseDir string) error {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(baseDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		env, err := restoreEnvironment(data)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entry.Name(), err)
+		}
+		registerEnvironment(env)
+	}
+	return nil
+}
+
+func restoreEnvironment(data []byte) (*Environment, error) {
+	var entry registryEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	if entry.Version < 1 || entry.Version > registrySnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d (supported: %d)", entry.Version, registrySnapshotVersion)
+	}
+	config, err := UnbundleConfig(entry.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := entry.History.validate(); err != nil {
+		return nil, err
+	}
+
+	env := &Environment{
+		ID:          entry.ID,
+		Name:        entry.Name,
+		Source:      entry.Source,
+		Worktree:    entry.Worktree,
+		Config:      config,
+		annotations: maps.Clone(entry.Annotations),
+		profiles:    entry.Profiles,
+		lastVersion: entry.LastVersion,
+	}
+	env.mu.Lock()
+	env.replaceHistory(entry.History)
+	env.mu.Unlock()
+	return env, nil
+}
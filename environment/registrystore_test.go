@@ -0,0 +1,139 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestSaveLoadRegistry(t *testing.T) {
+	config := DefaultConfig()
+	config.Instructions = "Run make test."
+	config.Env = []string{"FOO=bar"}
+	first := &Environment{ID: "snapshot/first", Name: "snapshot", Source: "/src", Worktree: "/worktrees/first", Config: config, profiles: []string{"dev"}}
+	first.mu.Lock()
+	first.appendRevision(nil, "create", "", "", nil, "")
+	first.appendRevision(nil, "install", "apt", "", nil, "")
+	first.annotations = map[string]string{"ticket": "42"}
+	first.mu.Unlock()
+	// Versions up to 5 were handed out, then the later revisions dropped.
+	first.lastVersion = 5
+	second := &Environment{ID: "snapshot/second", Name: "snapshot", Config: DefaultConfig()}
+	second.mu.Lock()
+	second.appendRevision(nil, "create", "", "", nil, "")
+	second.mu.Unlock()
+	ephemeral := &Environment{ID: "snapshot/ephemeral", Name: "snapshot", Ephemeral: true, Config: DefaultConfig()}
+
+	for _, env := range []*Environment{first, second, ephemeral} {
+		registerEnvironment(env)
+		t.Cleanup(func() { unregisterEnvironment(env.ID) })
+	}
+
+	dir := t.TempDir()
+	// Left over from an environment deleted since the last save.
+	writeFiles(t, dir, map[string]string{"snapshot%2Fdeleted.json": "{}"})
+	if err := SaveRegistry(dir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("saved %d files, want only the two persistent environments", len(entries))
+	}
+	for _, env := range []*Environment{first, second, ephemeral} {
+		unregisterEnvironment(env.ID)
+	}
+	if err := LoadRegistry(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	if Get(ephemeral.ID) != nil {
+		t.Error("an ephemeral environment was restored")
+	}
+
+	for _, want := range []*Environment{first, second} {
+		got := Get(want.ID)
+		if got == nil || got == want {
+			t.Fatalf("Get(%s) = %p, want a restored environment", want.ID, got)
+		}
+		if got.Name != want.Name || got.Source != want.Source || got.Worktree != want.Worktree {
+			t.Errorf("restored %s = %+v", want.ID, got)
+		}
+		if !reflect.DeepEqual(got.Config, want.Config) {
+			t.Errorf("restored %s config = %+v, want %+v", want.ID, got.Config, want.Config)
+		}
+		if got.History.Tree() != want.History.Tree() || got.History.LatestVersion() != want.History.LatestVersion() {
+			t.Errorf("restored %s history =\n%s\nwant\n%s", want.ID, got.History.Tree(), want.History.Tree())
+		}
+		if !reflect.DeepEqual(got.annotations, want.annotations) || !slices.Equal(got.profiles, want.profiles) {
+			t.Errorf("restored %s annotations %v, profiles %q", want.ID, got.annotations, got.profiles)
+		}
+	}
+
+	// Versions keep increasing after a restore.
+	restored := Get(first.ID)
+	restored.mu.Lock()
+	revision := restored.appendRevision(nil, "next", "", "", nil, "")
+	restored.mu.Unlock()
+	if revision.Version != 6 {
+		t.Errorf("version after restoring = %d, want 6", revision.Version)
+	}
+}
+
+func TestLoadRegistryRejectsInvalidSnapshots(t *testing.T) {
+	for name, snapshot := range map[string]string{
+		"not json":       `snapshot`,
+		"future version": `{"version": 99, "id": "a/b", "config": {"version": 1, "config": {}}}`,
+		"bad config":     `{"version": 1, "id": "a/b", "config": {}}`,
+		"bad history":    `{"version": 1, "id": "a/b", "config": {"version": 1, "config": {}}, "history": [{"version": 2, "parent": 1}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "a%2Fb.json"), []byte(snapshot), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := LoadRegistry(context.Background(), dir); err == nil {
+				unregisterEnvironment("a/b")
+				t.Error("LoadRegistry() accepted an invalid snapshot")
+			}
+		})
+	}
+}
+
+func TestSaveRegistryWhileMirroring(t *testing.T) {
+	env := &Environment{ID: "snapshot/mirrored", Name: "snapshot", Config: DefaultConfig()}
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(env.ID) })
+
+	// Mirror and SaveRegistry take the registry and environment locks; they
+	// must never wait on each other in opposite orders.
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			mirror, err := env.Mirror(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			unregisterEnvironment(mirror.ID)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			if err := SaveRegistry(dir); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
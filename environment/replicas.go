@@ -0,0 +1,118 @@
+package environment
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const replicaIndex = "${index}"
+
+// Expand returns the services started for this one: a single copy if it has
+// at most one replica, otherwise one service per replica. In replica i,
+// counting from 0, ${index} is replaced by i in the name, command, command
+// arguments, env and exports, and exposed ports are shifted by i times
+// PortStride (1 by default). Replicas whose name doesn't use ${index} are
+// named <name>-<i>.
+func (cfg ServiceConfig) Expand() ([]ServiceConfig, error) {
+	if cfg.Replicas <= 1 {
+		cfg.Replicas = 0
+		return []ServiceConfig{cfg}, nil
+	}
+	name := cfg.Name
+	if !strings.Contains(name, replicaIndex) {
+		name += "-" + replicaIndex
+	}
+	stride := cfg.PortStride
+	if stride == 0 {
+		stride = 1
+	}
+
+	replicas := make([]ServiceConfig, cfg.Replicas)
+	names := map[string]bool{}
+	ports := map[int]string{}
+	for i := range replicas {
+		index := strconv.Itoa(i)
+		expand := func(s string) string { return strings.ReplaceAll(s, replicaIndex, index) }
+		expandAll := func(values []string) []string {
+			if values == nil {
+				return nil
+			}
+			expanded := make([]string, len(values))
+			for j, value := range values {
+				expanded[j] = expand(value)
+			}
+			return expanded
+		}
+
+		replica := cfg
+		replica.Replicas, replica.PortStride = 0, 0
+		replica.Name = expand(name)
+		replica.Command = expand(cfg.Command)
+		replica.CommandArgs = expandAll(cfg.CommandArgs)
+		replica.Env = expandAll(cfg.Env)
+		if cfg.Exports != nil {
+			replica.Exports = map[string]string{}
+			for key, value := range cfg.Exports {
+				replica.Exports[key] = expand(value)
+			}
+		}
+		replica.ExposedPorts = make([]int, len(cfg.ExposedPorts))
+		for j, port := range cfg.ExposedPorts {
+			replica.ExposedPorts[j] = port + i*stride
+		}
+
+		if names[replica.Name] {
+			return nil, fmt.Errorf("service %s: replicas are all named %s", cfg.Name, replica.Name)
+		}
+		names[replica.Name] = true
+		for _, port := range replica.ExposedPorts {
+			if owner, ok := ports[port]; ok {
+				return nil, fmt.Errorf("service %s: replicas %s and %s both expose port %d, increase port_stride", cfg.Name, owner, replica.Name, port)
+			}
+			ports[port] = replica.Name
+		}
+		replicas[i] = replica
+	}
+	return replicas, nil
+}
+
+// Expand replaces the replicated services by their replicas. Dependencies on
+// a replicated service become dependencies on all of its replicas.
+func (sc ServiceConfigs) Expand() (ServiceConfigs, error) {
+	expanded := ServiceConfigs{}
+	replicaNames := map[string][]string{}
+	isReplica := map[string]bool{}
+	for _, cfg := range sc {
+		replicas, err := cfg.Expand()
+		if err != nil {
+			return nil, err
+		}
+		for _, replica := range replicas {
+			if expanded.Get(replica.Name) != nil && (cfg.Replicas > 1 || isReplica[replica.Name]) {
+				return nil, fmt.Errorf("service name %s is used by a replica and another service", replica.Name)
+			}
+			if cfg.Replicas > 1 {
+				replicaNames[cfg.Name] = append(replicaNames[cfg.Name], replica.Name)
+				isReplica[replica.Name] = true
+			}
+			expanded = append(expanded, &replica)
+		}
+	}
+	if len(replicaNames) == 0 {
+		return expanded, nil
+	}
+	for _, cfg := range expanded {
+		var dependsOn []string
+		for _, dep := range cfg.DependsOn {
+			if names, ok := replicaNames[dep]; ok {
+				dependsOn = append(dependsOn, names...)
+				continue
+			}
+			dependsOn = append(dependsOn, dep)
+		}
+		cfg.DependsOn = slices.Clip(dependsOn)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,127 @@
+package environment
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestServiceExpand(t *testing.T) {
+	worker := ServiceConfig{
+		Name:         "worker-${index}",
+		Image:        "worker:latest",
+		CommandArgs:  []string{"serve", "--id=${index}"},
+		Env:          []string{"WORKER_ID=${index}"},
+		Exports:      map[string]string{"WORKER_${index}_URL": "http://worker-${index}:8080"},
+		ExposedPorts: []int{8080, 9090},
+		Replicas:     3,
+		PortStride:   10,
+	}
+	replicas, err := worker.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != 3 {
+		t.Fatalf("Expand() = %d services, want 3", len(replicas))
+	}
+	names := map[string]bool{}
+	ports := map[int]bool{}
+	for i, replica := range replicas {
+		want := ServiceConfig{
+			Name:         []string{"worker-0", "worker-1", "worker-2"}[i],
+			Image:        "worker:latest",
+			CommandArgs:  []string{"serve", "--id=" + []string{"0", "1", "2"}[i]},
+			Env:          []string{"WORKER_ID=" + []string{"0", "1", "2"}[i]},
+			ExposedPorts: []int{8080 + 10*i, 9090 + 10*i},
+		}
+		want.Exports = map[string]string{"WORKER_${index}_URL": "http://" + want.Name + ":8080"}
+		if !reflect.DeepEqual(replica, want) {
+			t.Errorf("replica %d = %+v, want %+v", i, replica, want)
+		}
+		names[replica.Name] = true
+		for _, port := range replica.ExposedPorts {
+			ports[port] = true
+		}
+	}
+	if len(names) != 3 || len(ports) != 6 {
+		t.Errorf("replicas use %d names and %d ports, want them unique", len(names), len(ports))
+	}
+	// The template is left alone.
+	if worker.Name != "worker-${index}" || worker.ExposedPorts[0] != 8080 {
+		t.Errorf("Expand() changed the template: %+v", worker)
+	}
+
+	// Names without ${index} get the index as a suffix, and the stride
+	// defaults to 1.
+	replicas, err = ServiceConfig{Name: "worker", ExposedPorts: []int{8080}, Replicas: 2}.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas[0].Name != "worker-0" || replicas[1].Name != "worker-1" || replicas[1].ExposedPorts[0] != 8081 {
+		t.Errorf("Expand() = %+v, want worker-0 and worker-1 on consecutive ports", replicas)
+	}
+
+	for _, count := range []int{0, 1} {
+		single := ServiceConfig{Name: "db", ExposedPorts: []int{5432}, Replicas: count}
+		replicas, err := single.Expand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		single.Replicas = 0
+		if len(replicas) != 1 || !reflect.DeepEqual(replicas[0], single) {
+			t.Errorf("Expand() of %d replicas = %+v, want the service itself", count, replicas)
+		}
+	}
+}
+
+func TestServiceExpandCollisions(t *testing.T) {
+	for name, cfg := range map[string]ServiceConfig{
+		"port overlap":     {Name: "worker", ExposedPorts: []int{8080, 8081}, Replicas: 2},
+		"stride too small": {Name: "worker-${index}", ExposedPorts: []int{8080, 8085}, Replicas: 6, PortStride: 5},
+	} {
+		if _, err := cfg.Expand(); err == nil {
+			t.Errorf("Expand() of %s succeeded", name)
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate() of %s succeeded", name)
+		}
+	}
+	if err := (&ServiceConfig{Name: "worker", Replicas: -1}).Validate(); err == nil {
+		t.Error("Validate() accepted negative replicas")
+	}
+
+	// A wider stride resolves the port overlap.
+	if _, err := (ServiceConfig{Name: "worker", ExposedPorts: []int{8080, 8081}, Replicas: 2, PortStride: 2}).Expand(); err != nil {
+		t.Errorf("Expand() with a wide enough stride = %v", err)
+	}
+}
+
+func TestServiceConfigsExpand(t *testing.T) {
+	services := ServiceConfigs{
+		{Name: "queue"},
+		{Name: "worker", DependsOn: []string{"queue"}, Replicas: 2},
+		{Name: "api", DependsOn: []string{"worker", "queue"}},
+	}
+	expanded, err := services.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, cfg := range expanded {
+		names = append(names, cfg.Name)
+	}
+	if want := []string{"queue", "worker-0", "worker-1", "api"}; !slices.Equal(names, want) {
+		t.Errorf("expanded services = %q, want %q", names, want)
+	}
+	if got := expanded.Get("api").DependsOn; !slices.Equal(got, []string{"worker-0", "worker-1", "queue"}) {
+		t.Errorf("api depends on %q, want every replica of worker", got)
+	}
+	if got := expanded.Get("worker-1").DependsOn; !slices.Equal(got, []string{"queue"}) {
+		t.Errorf("worker-1 depends on %q, want queue", got)
+	}
+
+	services = append(services, &ServiceConfig{Name: "worker-1"})
+	if _, err := services.Expand(); err == nil {
+		t.Error("Expand() accepted a service named like a replica")
+	}
+}
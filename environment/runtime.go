@@ -0,0 +1,120 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// RuntimeConfig declares the primary language runtime of the environment so
+// agents know which toolchain to use.
+//
+// For known runtimes (go, node, python, rust) the build installs the toolchain
+// with the system package manager if it's missing from the base image, and
+// mounts cache volumes for its package manager under /root. Version is
+// informational: distribution packages don't allow pinning it, so pick a base
+// image shipping the right version when it matters. Other names are accepted
+// as-is without any defaults.
+type RuntimeConfig struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type runtimeDefaults struct {
+	binary   string
+	packages map[packageManager][]string
+	caches   []string
+}
+
+var knownRuntimes = map[string]runtimeDefaults{
+	"go": {
+		binary: "go",
+		packages: map[packageManager][]string{
+			packageManagerApt: {"golang-go"},
+			packageManagerApk: {"go"},
+			packageManagerDnf: {"golang"},
+			packageManagerYum: {"golang"},
+		},
+		caches: []string{"/root/go/pkg/mod", "/root/.cache/go-build"},
+	},
+	"node": {
+		binary: "node",
+		packages: map[packageManager][]string{
+			packageManagerApt: {"nodejs", "npm"},
+			packageManagerApk: {"nodejs", "npm"},
+			packageManagerDnf: {"nodejs", "npm"},
+			packageManagerYum: {"nodejs", "npm"},
+		},
+		caches: []string{"/root/.npm"},
+	},
+	"python": {
+		binary: "python3",
+		packages: map[packageManager][]string{
+			packageManagerApt: {"python3", "python3-pip"},
+			packageManagerApk: {"python3", "py3-pip"},
+			packageManagerDnf: {"python3", "python3-pip"},
+			packageManagerYum: {"python3", "python3-pip"},
+		},
+		caches: []string{"/root/.cache/pip"},
+	},
+	"rust": {
+		binary: "cargo",
+		packages: map[packageManager][]string{
+			packageManagerApt: {"cargo"},
+			packageManagerApk: {"cargo"},
+			packageManagerDnf: {"cargo"},
+			packageManagerYum: {"cargo"},
+		},
+		caches: []string{"/root/.cargo/registry"},
+	},
+}
+
+var runtimeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._+-]*$`)
+
+func (r *RuntimeConfig) Validate() error {
+	if !runtimeNamePattern.MatchString(r.Name) {
+		return fmt.Errorf("invalid runtime name %q", r.Name)
+	}
+	if strings.ContainsAny(r.Version, " \t\n") {
+		return fmt.Errorf("invalid runtime version %q", r.Version)
+	}
+	return nil
+}
+
+// withRuntime applies the defaults of the configured runtime, if known.
+func (env *Environment) withRuntime(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	if env.Config.Runtime == nil {
+		return container, nil
+	}
+	defaults, ok := knownRuntimes[env.Config.Runtime.Name]
+	if !ok {
+		return container, nil
+	}
+
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	found, err := container.WithExec(append(shell, "-c", "command -v "+defaults.binary+" || true")).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for the %s toolchain: %w", env.Config.Runtime.Name, err)
+	}
+	if strings.TrimSpace(found) == "" {
+		pm, err := detectPackageManager(ctx, container, shell)
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't installed in the base image: %w", defaults.binary, err)
+		}
+		container, err = env.runSetupCommands(ctx, container, []string{pm.installCommand(defaults.packages[pm])})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cache := range defaults.caches {
+		container = container.WithMountedCache(cache, dag.CacheVolume("container-use-runtime"+strings.ReplaceAll(cache, "/", "-")))
+	}
+	return container, nil
+}
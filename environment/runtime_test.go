@@ -0,0 +1,84 @@
+package environment
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		runtime RuntimeConfig
+		ok      bool
+	}{
+		{RuntimeConfig{Name: "go", Version: "1.24"}, true},
+		{RuntimeConfig{Name: "python"}, true},
+		// Unknown runtimes are accepted without defaults.
+		{RuntimeConfig{Name: "zig", Version: "0.13.0"}, true},
+		{RuntimeConfig{Name: "c++"}, true},
+		{RuntimeConfig{}, false},
+		{RuntimeConfig{Name: "Go"}, false},
+		{RuntimeConfig{Name: "go; rm -rf /"}, false},
+		{RuntimeConfig{Name: "go", Version: "1.24 beta"}, false},
+	} {
+		if err := tt.runtime.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok %v", tt.runtime, err, tt.ok)
+		}
+	}
+}
+
+func TestRuntimeDefaults(t *testing.T) {
+	managers := []packageManager{packageManagerApt, packageManagerApk, packageManagerDnf, packageManagerYum}
+	for name, defaults := range knownRuntimes {
+		for _, pm := range managers {
+			packages := defaults.packages[pm]
+			if len(packages) == 0 {
+				t.Errorf("%s has no packages for %s", name, pm)
+			}
+			for _, pkg := range packages {
+				if err := validatePackage(pkg); err != nil {
+					t.Errorf("%s on %s: %v", name, pm, err)
+				}
+			}
+		}
+		for _, cache := range defaults.caches {
+			if !strings.HasPrefix(cache, "/root/") {
+				t.Errorf("%s cache %s isn't under /root", name, cache)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		runtime string
+		pm      packageManager
+		want    string
+	}{
+		{"go", packageManagerApk, "apk add --no-cache go"},
+		{"python", packageManagerApk, "apk add --no-cache python3 py3-pip"},
+		{"node", packageManagerDnf, "dnf install -y nodejs npm && dnf clean all"},
+		{"rust", packageManagerApt, "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends cargo && rm -rf /var/lib/apt/lists/*"},
+	} {
+		if got := tt.pm.installCommand(knownRuntimes[tt.runtime].packages[tt.pm]); got != tt.want {
+			t.Errorf("%s install on %s = %q, want %q", tt.runtime, tt.pm, got, tt.want)
+		}
+	}
+}
+
+func TestRuntimeInstallsToolchain(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Runtime = &RuntimeConfig{Name: "python"}
+	env := newEngineEnvironment(t, config)
+
+	out, err := env.Run(ctx, "check", "python3 -c 'print(1 + 1)'; grep -c ' /root/.cache/pip ' /proc/mounts", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(out); len(got) != 2 || got[0] != "2" || got[1] != "1" {
+		t.Errorf("python runtime = %q, want python3 installed and the pip cache mounted", out)
+	}
+	if got := env.EffectiveConfig().Runtime; got == nil || got.Name != "python" {
+		t.Errorf("EffectiveConfig().Runtime = %+v", got)
+	}
+}
@@ -0,0 +1,61 @@
+package environment
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// configSchemaVersion is the version of the environment file layout written by
+// Save. Bump it when fields are renamed or reshaped, and add the migration
+// from the previous version to configMigrations.
+const configSchemaVersion = 1
+
+// configMigrations upgrade the fields of an environment file from the schema
+// version they're indexed by to the next one. Files written before schema
+// versions existed are version 0, which has the same layout as version 1.
+var configMigrations = map[int]func(fields map[string]json.RawMessage) error{
+	0: func(fields map[string]json.RawMessage) error { return nil },
+}
+
+// migrateConfig parses an environment file of any supported schema version
+// into the current config struct.
+func migrateConfig(raw []byte) (*EnvironmentConfig, error) {
+	data, err := migrateConfigJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	config := &EnvironmentConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// migrateConfigJSON upgrades an environment file to the current schema
+// version.
+func migrateConfigJSON(raw []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	version := 0
+	if v, ok := fields["schema_version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, fmt.Errorf("invalid schema_version: %w", err)
+		}
+	}
+	if version == configSchemaVersion {
+		return raw, nil
+	}
+	if version < 0 || version > configSchemaVersion {
+		return nil, fmt.Errorf("unsupported config schema version %d (supported: up to %d)", version, configSchemaVersion)
+	}
+
+	for ; version < configSchemaVersion; version++ {
+		if err := configMigrations[version](fields); err != nil {
+			return nil, fmt.Errorf("failed to migrate config from schema version %d: %w", version, err)
+		}
+	}
+	fields["schema_version"] = json.RawMessage(fmt.Sprint(configSchemaVersion))
+	return json.Marshal(fields)
+}
@@ -0,0 +1,70 @@
+package environment
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	// Simulate a version 0 layout that named the base image "image".
+	orig := configMigrations[0]
+	configMigrations[0] = func(fields map[string]json.RawMessage) error {
+		if image, ok := fields["image"]; ok {
+			fields["base_image"] = image
+			delete(fields, "image")
+		}
+		return nil
+	}
+	t.Cleanup(func() { configMigrations[0] = orig })
+
+	config, err := migrateConfig([]byte(`{"image": "golang:1.24", "setup_commands": ["go mod download"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "golang:1.24" || !slices.Equal(config.SetupCommands, []string{"go mod download"}) {
+		t.Errorf("migrated config = %+v", config)
+	}
+
+	// Current files are left alone.
+	config, err = migrateConfig([]byte(`{"schema_version": 1, "image": "ignored", "base_image": "debian:12"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "debian:12" {
+		t.Errorf("BaseImage = %q, want the current file unmigrated", config.BaseImage)
+	}
+
+	for _, raw := range []string{`{"schema_version": 2}`, `{"schema_version": -1}`, `{"schema_version": "1"}`, `[]`} {
+		if _, err := migrateConfig([]byte(raw)); err == nil {
+			t.Errorf("migrateConfig(%s) succeeded", raw)
+		}
+	}
+}
+
+func TestSaveWritesSchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := DefaultConfig().Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, configDir, environmentFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"schema_version": 1`) {
+		t.Errorf("saved config doesn't have the schema version:\n%s", data)
+	}
+
+	// Files from before schema versions load as version 0.
+	writeFiles(t, dir, map[string]string{configDir + "/" + environmentFile: `{"base_image": "golang:1.24"}`})
+	config := DefaultConfig()
+	if err := config.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != "golang:1.24" {
+		t.Errorf("BaseImage = %q after loading an unversioned file", config.BaseImage)
+	}
+}
@@ -0,0 +1,283 @@
+package environment
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ToScript returns a POSIX shell script reproducing the environment with
+// plain docker commands, so it can be rebuilt without container-use. The
+// script starts the services active under profiles on a dedicated network,
+// runs the setup in a container committed as the environment image, and opens
+// a shell in it. The source is copied into the workdir after the setup
+// commands, from the directory in $SOURCE, the current one by default.
+//
+// Secrets aren't resolved: the script expects each of them in a variable of
+// the same name and fails early when one is missing. Relative env files and
+// host files are resolved against the directory the script runs from.
+// Files and CA certificates backed by secrets, and setup commands run by other
+// users, can't be reproduced and make ToScript fail.
+func (c *EnvironmentConfig) ToScript(profiles ...string) (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", fmt.Errorf("invalid config: %w", err)
+	}
+	for _, f := range c.Files {
+		if f.Secret != "" {
+			return "", fmt.Errorf("file %s is backed by a secret and can't be exported to a script", f.Path)
+		}
+	}
+	if len(c.SetupUsers) > 0 {
+		return "", fmt.Errorf("setup commands run by other users can't be exported to a script")
+	}
+	for _, cert := range c.CACerts {
+		if strings.Contains(cert, "://") && !strings.HasPrefix(cert, "file://") {
+			return "", fmt.Errorf("CA certificate %s is a secret and can't be exported to a script", cert)
+		}
+	}
+	services, err := c.Services.Expand()
+	if err != nil {
+		return "", err
+	}
+	services, err = services.Active(profiles...).TopoSort()
+	if err != nil {
+		return "", err
+	}
+
+	out := &strings.Builder{}
+	out.WriteString("#!/bin/sh\n")
+	out.WriteString("# Reproduces the environment with docker. Generated by container-use.\n")
+	out.WriteString("set -eu\n\n")
+	out.WriteString("NETWORK=\"${NETWORK:-container-use}\"\n")
+	out.WriteString("IMAGE=\"${IMAGE:-container-use-env}\"\n")
+	out.WriteString("SETUP=\"$IMAGE-setup\"\n")
+	out.WriteString("SOURCE=\"${SOURCE:-.}\"\n")
+
+	var secrets []string
+	secrets = append(secrets, c.Secrets...)
+	for _, svc := range services {
+		secrets = append(secrets, svc.Secrets...)
+	}
+	if len(secrets) > 0 {
+		out.WriteString("\n# Secrets\n")
+		seen := map[string]bool{}
+		for _, secret := range secrets {
+			key, ref, optional, _ := parseSecretEntry(secret)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if optional {
+				fmt.Fprintf(out, "# %s (optional): %s\n", key, ref)
+				continue
+			}
+			fmt.Fprintf(out, "# %s: %s\n", key, ref)
+			fmt.Fprintf(out, ": \"${%s:?%s must be set}\"\n", key, key)
+		}
+	}
+
+	out.WriteString("\ndocker network inspect \"$NETWORK\" >/dev/null 2>&1 || docker network create \"$NETWORK\" >/dev/null\n")
+
+	if len(services) > 0 {
+		out.WriteString("\n# Services\n")
+	}
+	exports := map[string][]string{}
+	for _, svc := range services {
+		svcExports, err := (&Service{Config: svc}).Exports()
+		if err != nil {
+			return "", err
+		}
+		exports[svc.Name] = svcExports
+
+		args := []string{"docker", "run", "-d", "--rm", "--name", svc.Name, "--network", "$NETWORK", "--network-alias", svc.Name}
+		for _, file := range svc.EnvFiles {
+			args = append(args, "--env-file", file)
+		}
+		envs := slices.Concat(c.Proxy.Env(), svc.Env)
+		for _, dep := range svc.DependsOn {
+			envs = append(envs, exports[dep]...)
+		}
+		args = append(args, scriptEnvFlags(envs, svc.Secrets)...)
+		args = append(args, scriptUlimitFlags(svc.Ulimits)...)
+		for _, port := range svc.ExposedPorts {
+			args = append(args, "-p", fmt.Sprintf("%d:%d", port, port))
+		}
+		args = append(args, svc.Image)
+		args = append(args, svc.Args([]string{"sh"})...)
+		fmt.Fprintf(out, "docker rm -f %s >/dev/null 2>&1 || true\n", shellQuote(svc.Name))
+		out.WriteString(scriptCommand(args) + " >/dev/null\n")
+	}
+
+	image := c.BaseImage
+	out.WriteString("\n# Base image\n")
+	if c.BaseBuild != nil {
+		image = "$IMAGE-base"
+		dockerfile := c.BaseBuild.Dockerfile
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		out.WriteString(scriptCommand([]string{"docker", "build", "-t", image, "-f", path.Join(c.BaseBuild.Context, dockerfile), c.BaseBuild.Context}) + "\n")
+	} else {
+		out.WriteString(scriptCommand([]string{"docker", "pull", image}) + "\n")
+	}
+
+	shell := []string{"sh"}
+	if c.Shell != "" {
+		shell = strings.Fields(c.Shell)
+	}
+
+	// Everything the environment depends on: config env, then the exports of
+	// all services.
+	envs := slices.Concat(c.Proxy.Env(), c.Env)
+	for _, svc := range services {
+		envs = append(envs, exports[svc.Name]...)
+	}
+	runFlags := []string{"--network", "$NETWORK", "-w", c.Workdir}
+	runFlags = append(runFlags, scriptEnvFlags(envs, c.Secrets)...)
+	runFlags = append(runFlags, scriptUlimitFlags(c.Ulimits)...)
+
+	setup, copies := c.scriptSetup()
+	out.WriteString("\n# Setup\n")
+	out.WriteString("docker rm -f \"$SETUP\" >/dev/null 2>&1 || true\n")
+	createArgs := slices.Concat([]string{"docker", "create", "--name", "$SETUP"}, runFlags)
+	if c.RunAsUser != "" {
+		createArgs = append(createArgs, "--user", "0")
+	}
+	createArgs = append(createArgs, image)
+	createArgs = append(createArgs, shell...)
+	createArgs = append(createArgs, "-c", setup)
+	out.WriteString(scriptCommand(createArgs) + " >/dev/null\n")
+	for _, cp := range copies {
+		out.WriteString(scriptCommand([]string{"docker", "cp", cp[0], "$SETUP:" + cp[1]}) + "\n")
+	}
+	out.WriteString("docker start -a \"$SETUP\"\n")
+	commitArgs := []string{"docker", "commit"}
+	if c.RunAsUser != "" {
+		commitArgs = append(commitArgs, "--change", "USER "+c.RunAsUser)
+	}
+	commitArgs = append(commitArgs, "--change", "WORKDIR "+c.Workdir, "$SETUP", "$IMAGE")
+	out.WriteString(scriptCommand(commitArgs) + " >/dev/null\n")
+	out.WriteString("docker rm \"$SETUP\" >/dev/null\n")
+
+	out.WriteString("\n# Environment\n")
+	runArgs := slices.Concat([]string{"docker", "run", "-it", "--rm"}, runFlags, []string{"$IMAGE"}, shell)
+	out.WriteString(scriptCommand(runArgs) + "\n")
+
+	return out.String(), nil
+}
+
+// scriptSourceDir is where the source is staged in the setup container.
+const scriptSourceDir = "/container-use-source"
+
+// scriptSetup returns the script run in the setup container, along with the
+// host files to copy into it beforehand as (host path, container path) pairs.
+func (c *EnvironmentConfig) scriptSetup() (string, [][2]string) {
+	var steps []string
+	var copies [][2]string
+
+	for i, f := range c.Files {
+		mode := f.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		target := shellQuote(f.Path)
+		step := fmt.Sprintf("mkdir -p %s && ", shellQuote(path.Dir(f.Path)))
+		if f.SourcePath != "" {
+			staged := fmt.Sprintf("/container-use-file-%d", i)
+			copies = append(copies, [2]string{f.SourcePath, staged})
+			step += fmt.Sprintf("mv %s %s", staged, target)
+		} else {
+			step += fmt.Sprintf("printf '%%s' %s > %s", shellQuote(f.Content), target)
+		}
+		steps = append(steps, step+fmt.Sprintf(" && chmod %o %s", mode, target))
+	}
+
+	if len(c.CACerts) > 0 {
+		for i, cert := range c.CACerts {
+			staged := fmt.Sprintf("/container-use-ca-%d.crt", i)
+			copies = append(copies, [2]string{strings.TrimPrefix(cert, "file://"), staged})
+			steps = append(steps, fmt.Sprintf("mkdir -p %s && mv %s %s/container-use-%d.crt", caCertsDir, staged, caCertsDir, i))
+		}
+		steps = append(steps, installCACertsScript)
+	}
+
+	if len(c.Packages) > 0 {
+		packages := map[packageManager][]string{}
+		for _, pm := range []packageManager{packageManagerApt, packageManagerApk, packageManagerDnf, packageManagerYum} {
+			packages[pm] = c.Packages
+		}
+		steps = append(steps, scriptInstall(packages))
+	}
+	if c.Runtime != nil {
+		if defaults, ok := knownRuntimes[c.Runtime.Name]; ok {
+			steps = append(steps, "command -v "+defaults.binary+" >/dev/null 2>&1 || { "+scriptInstall(defaults.packages)+"; }")
+		}
+	}
+
+	steps = append(steps, c.SetupCommands...)
+
+	copies = append(copies, [2]string{"$SOURCE/.", scriptSourceDir})
+	steps = append(steps, fmt.Sprintf("mkdir -p %s && cp -R %s/. %s && rm -rf %s",
+		shellQuote(c.Workdir), scriptSourceDir, shellQuote(c.Workdir), scriptSourceDir))
+
+	if c.RunAsUser != "" {
+		steps = append(steps, fmt.Sprintf("chown -R %s %s", shellQuote(c.RunAsUser), shellQuote(c.Workdir)))
+	}
+	return withUlimits(c.Ulimits, setupScript(steps, c.SetupExitCodes)), copies
+}
+
+// scriptInstall returns a script installing the packages of whichever package
+// manager is found.
+func scriptInstall(packages map[packageManager][]string) string {
+	var branches []string
+	for _, pm := range []packageManager{packageManagerApt, packageManagerApk, packageManagerDnf, packageManagerYum} {
+		if len(packages[pm]) == 0 {
+			continue
+		}
+		branches = append(branches, fmt.Sprintf("if command -v %s >/dev/null 2>&1; then %s", pm, pm.installCommand(packages[pm])))
+	}
+	return strings.Join(branches, "; el") + "; else echo 'no supported package manager found' >&2; exit 1; fi"
+}
+
+func scriptEnvFlags(envs, secrets []string) []string {
+	var flags []string
+	for _, env := range envs {
+		flags = append(flags, "-e", env)
+	}
+	for _, secret := range secrets {
+		key, _, _, _ := parseSecretEntry(secret)
+		flags = append(flags, "-e", key)
+	}
+	return flags
+}
+
+func scriptUlimitFlags(limits map[string]Ulimit) []string {
+	var flags []string
+	for _, name := range slices.Sorted(maps.Keys(limits)) {
+		flags = append(flags, "--ulimit", fmt.Sprintf("%s=%d:%d", name, limits[name].Soft, limits[name].Hard))
+	}
+	return flags
+}
+
+// scriptCommand quotes args for the script, leaving references to the
+// script's own variables expandable.
+func scriptCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "$NETWORK") || strings.HasPrefix(arg, "$IMAGE") || strings.HasPrefix(arg, "$SETUP") || strings.HasPrefix(arg, "$SOURCE") {
+			quoted[i] = `"` + arg + `"`
+			continue
+		}
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@%+,") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,102 @@
+package environment
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testScriptConfig() *EnvironmentConfig {
+	config := DefaultConfig()
+	config.BaseImage = "golang:1.24"
+	config.Env = []string{"GOFLAGS=-mod=mod"}
+	config.Secrets = []string{"GITHUB_TOKEN=env://GITHUB_TOKEN"}
+	config.SetupCommands = []string{"go mod download", "echo 'it''s done'"}
+	config.RunAsUser = "1000"
+	config.Services = ServiceConfigs{{
+		Name:         "db",
+		Image:        "postgres:16",
+		ExposedPorts: []int{5432},
+		Env:          []string{"POSTGRES_PASSWORD=postgres"},
+		Secrets:      []string{"TLS_CERT?=file:///certs/tls.pem"},
+	}}
+	return config
+}
+
+func TestToScript(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "ghp_not_inlined")
+	script, err := testScriptConfig().ToScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"#!/bin/sh\n",
+		"set -eu\n",
+		`: "${GITHUB_TOKEN:?GITHUB_TOKEN must be set}"`,
+		"# TLS_CERT (optional): file:///certs/tls.pem",
+		`docker run -d --rm --name db --network "$NETWORK" --network-alias db -e POSTGRES_PASSWORD=postgres -e TLS_CERT -p 5432:5432 postgres:16`,
+		"docker pull golang:1.24",
+		"go mod download",
+		`docker cp "$SOURCE/." "$SETUP:/container-use-source"`,
+		"cp -R /container-use-source/. ",
+		"chown -R 1000 ",
+		`--change 'USER 1000'`,
+		`docker run -it --rm --network "$NETWORK"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script doesn't contain %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "ghp_not_inlined") || strings.Contains(script, "env://GITHUB_TOKEN\"") {
+		t.Errorf("script inlines the secret:\n%s", script)
+	}
+
+	requireShell(t)
+	name := filepath.Join(t.TempDir(), "env.sh")
+	if err := os.WriteFile(name, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("sh", "-n", name).CombinedOutput(); err != nil {
+		t.Errorf("script isn't valid sh: %v\n%s", err, out)
+	}
+	if _, err := exec.LookPath("shellcheck"); err == nil {
+		if out, err := exec.Command("shellcheck", "-s", "sh", name).CombinedOutput(); err != nil {
+			t.Errorf("shellcheck: %v\n%s", err, out)
+		}
+	}
+}
+
+func TestToScriptUnsupported(t *testing.T) {
+	for name, change := range map[string]func(*EnvironmentConfig){
+		"secret file": func(c *EnvironmentConfig) {
+			c.Files = []FileProvision{{Path: "/etc/key", Secret: "env://KEY"}}
+		},
+		"setup users": func(c *EnvironmentConfig) {
+			c.SetupUsers = map[string]string{"go mod download": "dev"}
+		},
+		"secret CA": func(c *EnvironmentConfig) { c.CACerts = []string{"op://vault/ca"} },
+		"invalid":   func(c *EnvironmentConfig) { c.BaseImage = "" },
+	} {
+		config := testScriptConfig()
+		change(config)
+		if _, err := config.ToScript(); err == nil {
+			t.Errorf("%s: ToScript() succeeded", name)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	requireShell(t)
+	for _, s := range []string{"", "plain", "two words", "it's", `"$HOME"`, "$(id)", "a\nb", "back\\slash", "`id`"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != s {
+			t.Errorf("shellQuote(%q) read back as %q", s, out)
+		}
+	}
+}
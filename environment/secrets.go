@@ -0,0 +1,120 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// SecretAccessLogger is called every time a secret is resolved while building
+// an environment. name is the secret reference, e.g. "env://GITHUB_TOKEN" or
+// "op://vault/item/field", never its value.
+type SecretAccessLogger func(name string)
+
+var (
+	secretAccessMu     sync.RWMutex
+	secretAccessLogger SecretAccessLogger
+)
+
+// SetSecretAccessLogger sets the logger called on secret resolution. A nil
+// logger disables it.
+func SetSecretAccessLogger(logger SecretAccessLogger) {
+	secretAccessMu.Lock()
+	defer secretAccessMu.Unlock()
+	secretAccessLogger = logger
+}
+
+// resolveSecret is the only way secrets should be looked up so that every
+// access is reported.
+func resolveSecret(ref string) *dagger.Secret {
+	secretAccessMu.RLock()
+	logger := secretAccessLogger
+	secretAccessMu.RUnlock()
+	if logger != nil {
+		logger(ref)
+	}
+	return dag.Secret(ref)
+}
+
+// parseSecretEntry splits a KEY=REF secret entry. Service secrets whose key
+// ends with "?", as in TLS_CERT?=file:///certs/tls.pem, are optional.
+func parseSecretEntry(entry string) (key, ref string, optional, ok bool) {
+	key, ref, ok = parseKV(entry)
+	if !ok {
+		return "", "", false, false
+	}
+	if k, found := strings.CutSuffix(key, "?"); found {
+		if k == "" {
+			return "", "", false, false
+		}
+		return k, ref, true, true
+	}
+	return key, ref, false, true
+}
+
+// secretExists reports, by provider scheme, whether a secret exists without
+// reading it. Secrets are resolved by the dagger session this process starts,
+// so env:// and file:// secrets are looked up on this host.
+var secretExists = map[string]func(name string) bool{
+	"env": func(name string) bool {
+		_, ok := os.LookupEnv(name)
+		return ok
+	},
+	"file": func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	},
+}
+
+// secretResolvable reports whether ref can be resolved, without fetching its
+// value. Providers that can't tell without reading the secret, like op:// or
+// vault://, are assumed to resolve it: a missing secret then fails the build.
+// It is a variable so it can be swapped out.
+var secretResolvable = func(ctx context.Context, ref string) bool {
+	scheme, name, ok := strings.Cut(ref, "://")
+	if !ok {
+		return false
+	}
+	exists, ok := secretExists[scheme]
+	if !ok {
+		return true
+	}
+	return exists(name)
+}
+
+// MissingSecrets returns the keys of the required secrets of the service that
+// can't be resolved. Missing optional secrets are skipped when the service
+// starts, so they aren't reported.
+func (cfg *ServiceConfig) MissingSecrets(ctx context.Context) []string {
+	missing := []string{}
+	for _, entry := range cfg.Secrets {
+		key, ref, optional, ok := parseSecretEntry(entry)
+		if ok && !optional && !secretResolvable(ctx, ref) {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// resolveServiceSecrets returns the secrets of the service as KEY=REF entries,
+// without the optional secrets that can't be resolved.
+func resolveServiceSecrets(ctx context.Context, cfg *ServiceConfig) ([]string, error) {
+	secrets := []string{}
+	for _, entry := range cfg.Secrets {
+		key, ref, optional, ok := parseSecretEntry(entry)
+		if !ok {
+			return nil, fmt.Errorf("invalid secret: %s", entry)
+		}
+		if optional && !secretResolvable(ctx, ref) {
+			slog.Info("Skipping missing optional secret", "service", cfg.Name, "secret", key)
+			continue
+		}
+		secrets = append(secrets, key+"="+ref)
+	}
+	return secrets, nil
+}
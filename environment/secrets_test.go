@@ -0,0 +1,154 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSecretAccessLogger(t *testing.T) {
+	requireEngine(t)
+	const value = "s3cr3t-value"
+	t.Setenv("CU_TEST_TOKEN", value)
+
+	var mu sync.Mutex
+	names := []string{}
+	SetSecretAccessLogger(func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		names = append(names, name)
+	})
+	t.Cleanup(func() { SetSecretAccessLogger(nil) })
+
+	secrets := []string{"TOKEN=env://CU_TEST_TOKEN", "KEY=file:///run/key"}
+	if _, err := containerWithEnvAndSecrets(dag.Container(), []string{"FOO=bar"}, secrets); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"env://CU_TEST_TOKEN", "file:///run/key"}; !slices.Equal(names, want) {
+		t.Errorf("logged %q, want %q", names, want)
+	}
+	for _, name := range names {
+		if strings.Contains(name, value) {
+			t.Errorf("logged the secret value: %q", name)
+		}
+	}
+}
+
+func TestParseSecretEntry(t *testing.T) {
+	for _, tt := range []struct {
+		entry, key, ref string
+		optional, ok    bool
+	}{
+		{"TOKEN=env://TOKEN", "TOKEN", "env://TOKEN", false, true},
+		{"TLS_CERT?=file:///certs/tls.pem", "TLS_CERT", "file:///certs/tls.pem", true, true},
+		{"URL=op://vault/item?field=x", "URL", "op://vault/item?field=x", false, true},
+		{"?=env://X", "", "", false, false},
+		{"TOKEN", "", "", false, false},
+	} {
+		key, ref, optional, ok := parseSecretEntry(tt.entry)
+		if key != tt.key || ref != tt.ref || optional != tt.optional || ok != tt.ok {
+			t.Errorf("parseSecretEntry(%q) = %q, %q, %v, %v", tt.entry, key, ref, optional, ok)
+		}
+	}
+}
+
+func TestSecretResolvable(t *testing.T) {
+	t.Setenv("CU_TEST_SECRET", "value")
+	file := filepath.Join(t.TempDir(), "tls.pem")
+	if err := os.WriteFile(file, []byte("cert"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for ref, want := range map[string]bool{
+		"env://CU_TEST_SECRET":         true,
+		"env://CU_TEST_SECRET_MISSING": false,
+		"file://" + file:               true,
+		"file:///missing/tls.pem":      false,
+		// Providers that can't be checked without reading are assumed to
+		// resolve.
+		"op://vault/item/field": true,
+		"not a reference":       false,
+	} {
+		if got := secretResolvable(ctx, ref); got != want {
+			t.Errorf("secretResolvable(%q) = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+func TestOptionalServiceSecrets(t *testing.T) {
+	orig := secretResolvable
+	secretResolvable = func(ctx context.Context, ref string) bool { return ref == "env://PRESENT" }
+	t.Cleanup(func() { secretResolvable = orig })
+	ctx := context.Background()
+
+	cfg := &ServiceConfig{Name: "web", Image: "nginx", Secrets: []string{
+		"API_KEY=env://PRESENT",
+		"DB_PASSWORD=env://MISSING",
+		"TLS_CERT?=env://MISSING",
+		"TLS_KEY?=env://PRESENT",
+	}}
+	if got := cfg.MissingSecrets(ctx); !slices.Equal(got, []string{"DB_PASSWORD"}) {
+		t.Errorf("MissingSecrets() = %q, want only the required one", got)
+	}
+
+	// Missing optional secrets are skipped, required ones are kept so that
+	// starting the service fails on them.
+	secrets, err := resolveServiceSecrets(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"API_KEY=env://PRESENT", "DB_PASSWORD=env://MISSING", "TLS_KEY=env://PRESENT"}; !slices.Equal(secrets, want) {
+		t.Errorf("resolveServiceSecrets() = %q, want %q", secrets, want)
+	}
+
+	cfg.Secrets = []string{"?=env://PRESENT"}
+	if _, err := resolveServiceSecrets(ctx, cfg); err == nil {
+		t.Error("resolveServiceSecrets() accepted an invalid secret")
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() accepted an invalid secret")
+	}
+}
+
+func TestOptionalSecretsOnlyForServices(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{{Name: "web", Image: "nginx", Secrets: []string{"TLS_CERT?=env://CERT"}}}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() of a service with an optional secret = %v", err)
+	}
+	config.Secrets = []string{"API_TOKEN?=env://TOKEN"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "API_TOKEN") {
+		t.Errorf("Validate() of an optional environment secret = %v, want it rejected", err)
+	}
+}
+
+func TestServiceStartsWithoutOptionalSecrets(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+	service := func(secret string) ServiceConfigs {
+		return ServiceConfigs{{
+			Name:         "web",
+			Image:        alpineImage,
+			CommandArgs:  []string{"httpd", "-f", "-p", "8080"},
+			ExposedPorts: []int{8080},
+			Secrets:      []string{secret},
+		}}
+	}
+
+	if err := env.EnsureServices(ctx, service("TLS_CERT?=env://CU_TEST_MISSING_SECRET")); err != nil {
+		t.Fatalf("EnsureServices() with a missing optional secret = %v", err)
+	}
+	if len(env.Services) != 1 {
+		t.Errorf("running services = %d, want the service started without the secret", len(env.Services))
+	}
+	if err := env.EnsureServices(ctx, service("TLS_CERT=env://CU_TEST_MISSING_SECRET")); err == nil {
+		t.Error("EnsureServices() with a missing required secret succeeded")
+	}
+}
@@ -0,0 +1,125 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// Writable reports whether p (absolute, or relative to the workdir) may be
+// modified in the environment.
+//
+// Dagger has no primitive to mount the container root filesystem read-only,
+// so ReadOnlyRoot is enforced at the revision level instead: after a command
+// runs or a file operation, only the contents of WritablePaths are carried
+// over into the next revision and every other change to the filesystem is
+// discarded. File operations targeting a path outside WritablePaths are
+// rejected up front. Within a single command, writes outside WritablePaths
+// succeed but never persist.
+func (config *EnvironmentConfig) Writable(p string) bool {
+	if !config.ReadOnlyRoot {
+		return true
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(config.Workdir, p)
+	}
+	p = path.Clean(p)
+	for _, writable := range config.WritablePaths {
+		writable = path.Clean(writable)
+		if p == writable || strings.HasPrefix(p, strings.TrimSuffix(writable, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (env *Environment) checkWritable(p string) error {
+	if !env.Config.Writable(p) {
+		return fmt.Errorf("%s is read-only: the root filesystem is read-only and it isn't under any of the writable paths (%s)", p, strings.Join(env.Config.WritablePaths, ", "))
+	}
+	return nil
+}
+
+// confineToWritablePaths returns the current container with only the writable
+// paths taken from state. Writable paths may be files or directories. One
+// missing from state, e.g. because the command deleted it, is removed rather
+// than failing the operation.
+func (env *Environment) confineToWritablePaths(ctx context.Context, state *dagger.Container) (*dagger.Container, error) {
+	if !env.Config.ReadOnlyRoot {
+		return state, nil
+	}
+	confined := env.container
+	rootfs := state.Rootfs()
+	for _, p := range env.Config.WritablePaths {
+		exists, isDir, err := statPath(ctx, rootfs, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read writable path %s: %w", p, err)
+		}
+		switch {
+		case !exists:
+			confined = confined.WithoutDirectory(p)
+		case isDir:
+			confined = confined.WithoutDirectory(p).WithDirectory(p, state.Directory(p))
+		default:
+			confined = confined.WithoutFile(p).WithFile(p, state.File(p))
+		}
+	}
+	return confined, nil
+}
+
+// applyConfined records state as a new revision, confined to the writable
+// paths. Every operation changing the filesystem goes through it; operations
+// only changing the container metadata, like SetEnv, use apply directly.
+func (env *Environment) applyConfined(ctx context.Context, name, explanation, output string, state *dagger.Container) error {
+	confined, err := env.confineToWritablePaths(ctx, state)
+	if err != nil {
+		return err
+	}
+	return env.apply(ctx, name, explanation, output, confined)
+}
+
+// knownCapabilities are the capabilities DropCapabilities accepts.
+//
+// SecurityProfile, NoNewPrivileges and DropCapabilities are advisory. Dagger
+// doesn't let clients pick a seccomp or AppArmor profile, set no_new_privs or
+// change the capability set of a container: the engine applies its own
+// defaults, which never include the extra root capabilities granted by
+// InsecureRootCapabilities since the environment never requests them. The
+// fields are validated and reported by Lint so a config stays portable to a
+// runtime that can enforce them.
+var knownCapabilities = []string{
+	"AUDIT_CONTROL", "AUDIT_READ", "AUDIT_WRITE", "BLOCK_SUSPEND", "BPF",
+	"CHECKPOINT_RESTORE", "CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER",
+	"FSETID", "IPC_LOCK", "IPC_OWNER", "KILL", "LEASE", "LINUX_IMMUTABLE",
+	"MAC_ADMIN", "MAC_OVERRIDE", "MKNOD", "NET_ADMIN", "NET_BIND_SERVICE",
+	"NET_BROADCAST", "NET_RAW", "PERFMON", "SETFCAP", "SETGID", "SETPCAP",
+	"SETUID", "SYSLOG", "SYS_ADMIN", "SYS_BOOT", "SYS_CHROOT", "SYS_MODULE",
+	"SYS_NICE", "SYS_PACCT", "SYS_PTRACE", "SYS_RAWIO", "SYS_RESOURCE",
+	"SYS_TIME", "SYS_TTY_CONFIG", "WAKE_ALARM",
+}
+
+// validateCapability accepts capability names with or without the CAP_
+// prefix, in any case, as well as ALL.
+func validateCapability(name string) error {
+	upper := strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+	if upper == "ALL" || slices.Contains(knownCapabilities, upper) {
+		return nil
+	}
+	return fmt.Errorf("unknown capability %q", name)
+}
+
+// validateSecurityProfile accepts a profile name, like "default" or
+// "unconfined", or a path to a profile file.
+func validateSecurityProfile(profile string) error {
+	if profile == "" {
+		return nil
+	}
+	if strings.TrimSpace(profile) != profile || strings.ContainsAny(profile, "\n\t") {
+		return fmt.Errorf("invalid security profile %q", profile)
+	}
+	return nil
+}
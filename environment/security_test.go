@@ -0,0 +1,104 @@
+package environment
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWritable(t *testing.T) {
+	config := DefaultConfig()
+	config.ReadOnlyRoot = true
+	config.WritablePaths = []string{"/workdir", "/var/cache/"}
+
+	for p, want := range map[string]bool{
+		"/workdir":              true,
+		"/workdir/src/main":     true,
+		"src/main":              true,
+		"../etc/passwd":         false,
+		"/var/cache/apt":        true,
+		"/var/cache":            true,
+		"/var/cachet":           false,
+		"/workdir2":             false,
+		"/etc/hosts":            false,
+		"/workdir/../etc/hosts": false,
+	} {
+		if got := config.Writable(p); got != want {
+			t.Errorf("Writable(%q) = %v, want %v", p, got, want)
+		}
+	}
+
+	config.ReadOnlyRoot = false
+	if !config.Writable("/etc/hosts") {
+		t.Error("Writable() without read_only_root = false")
+	}
+}
+
+func TestReadOnlyRootValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.ReadOnlyRoot = true
+	config.WritablePaths = []string{"/tmp"}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() accepted a read-only root with a read-only workdir")
+	}
+	config.WritablePaths = []string{"/workdir", "relative"}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() accepted a relative writable path")
+	}
+}
+
+func TestSecurityValidate(t *testing.T) {
+	for _, tt := range []struct {
+		profile      string
+		capabilities []string
+		ok           bool
+	}{
+		{"", nil, true},
+		{"default", []string{"NET_RAW", "cap_sys_admin", "CAP_MKNOD", "all"}, true},
+		{"/etc/seccomp/agent.json", nil, true},
+		{"", []string{"NET_RAWR"}, false},
+		{"", []string{""}, false},
+		{" default", nil, false},
+		{"default\nunconfined", nil, false},
+	} {
+		config := DefaultConfig()
+		config.SecurityProfile = tt.profile
+		config.NoNewPrivileges = true
+		config.DropCapabilities = tt.capabilities
+		if err := config.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate() of profile %q, capabilities %q = %v, want ok %v", tt.profile, tt.capabilities, err, tt.ok)
+		}
+	}
+}
+
+func TestReadOnlyRoot(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.ReadOnlyRoot = true
+	config.WritablePaths = []string{"/workdir", "/tmp/missing", "/etc/motd"}
+	env := newEngineEnvironment(t, config)
+
+	if _, err := env.Run(ctx, "write", "echo kept > /workdir/kept && echo motd > /etc/motd && echo lost > /etc/lost", "", false); err != nil {
+		t.Fatal(err)
+	}
+	out, err := env.Run(ctx, "read", "cat /workdir/kept /etc/motd; if test -e /etc/lost; then echo leaked; fi", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(strings.Fields(out), " "); got != "kept motd" {
+		t.Errorf("read-only root output = %q, want only the writable files", out)
+	}
+
+	if err := env.FileWrite(ctx, "write", "/etc/hosts", "nope"); err == nil {
+		t.Error("FileWrite() outside the writable paths succeeded")
+	}
+
+	// Writable paths missing from the container don't fail operations.
+	if err := env.SetEnv(ctx, "set", []string{"FOO=bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.FileWrite(ctx, "write", "/workdir/file", "contents"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"dagger.io/dagger"
 )
@@ -13,42 +20,188 @@ type Service struct {
 	Endpoints EndpointMappings `json:"endpoints"`
 
 	svc *dagger.Service
+	// digest is the digest of the image the service was started from.
+	digest string
 }
 
 type EndpointMapping struct {
 	Internal string `json:"internal"`
 	External string `json:"external"`
+	// Forwarded is the host endpoint of the port while it's forwarded with
+	// Forward.
+	Forwarded string `json:"forwarded,omitempty"`
 }
 
 type EndpointMappings map[int]*EndpointMapping
 
-func (env *Environment) startServices(ctx context.Context) ([]*Service, error) {
+// Profiles returns the service profiles the environment was brought up with.
+func (env *Environment) Profiles() []string {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return slices.Clone(env.profiles)
+}
+
+// startServices starts the services of the config in dependency order. A
+// failing optional service doesn't abort the bring-up: it is reported in the
+// returned failures, and so are the services depending on it, which are
+// skipped whether they are optional or not. If a required service fails, the
+// services started so far are stopped before returning.
+func (env *Environment) startServices(ctx context.Context) (_ []*Service, _ map[string]*ServiceFailure, rerr error) {
 	services := []*Service{}
-	for _, cfg := range env.Config.Services {
-		service, err := env.startService(ctx, cfg)
+	defer func() {
+		if rerr != nil {
+			_ = stopServices(context.WithoutCancel(ctx), services)
+		}
+	}()
+
+	failures := map[string]*ServiceFailure{}
+	all, err := env.Config.Services.Expand()
+	if err != nil {
+		return nil, nil, err
+	}
+	active, err := all.Active(env.profiles...).TopoSort()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, cfg := range active {
+		if idx := slices.IndexFunc(cfg.DependsOn, func(dep string) bool {
+			return active.Get(dep) == nil && all.Get(dep) != nil
+		}); idx != -1 {
+			return nil, nil, fmt.Errorf("service %s depends on %s, which isn't in any of the active profiles", cfg.Name, cfg.DependsOn[idx])
+		}
+		if idx := slices.IndexFunc(cfg.DependsOn, func(dep string) bool { return failures[dep] != nil }); idx != -1 {
+			slog.Warn("Skipping service with failed dependency", "service", cfg.Name, "dependency", cfg.DependsOn[idx])
+			failures[cfg.Name] = &ServiceFailure{
+				Skipped: true,
+				Err:     fmt.Errorf("dependency %s failed to start", cfg.DependsOn[idx]),
+			}
+			env.emit(Event{Type: EventService, Service: cfg.Name, State: ServiceSkipped, Error: failures[cfg.Name].Err.Error()})
+			continue
+		}
+
+		exports, err := serviceExports(services, cfg.DependsOn)
 		if err != nil {
-			return nil, err
+			return nil, nil, fmt.Errorf("service %s: %w", cfg.Name, err)
 		}
+		service, err := env.startService(ctx, cfg, exports)
+		if err != nil {
+			env.emit(Event{Type: EventService, Service: cfg.Name, State: ServiceFailed, Error: err.Error()})
+			if !cfg.Optional {
+				return nil, nil, err
+			}
+			slog.Warn("Optional service failed to start", "service", cfg.Name, "err", err)
+			failures[cfg.Name] = &ServiceFailure{Err: err}
+			continue
+		}
+		env.emit(Event{Type: EventService, Service: cfg.Name, State: ServiceRunning})
 		services = append(services, service)
 	}
-	return services, nil
+	return services, failures, nil
+}
+
+// ServiceFailure records why a service of the config isn't running.
+type ServiceFailure struct {
+	// Skipped is set when the service wasn't started because one of its
+	// dependencies failed.
+	Skipped bool
+	Err     error
+}
+
+// Exports returns the exported variables of the service as KEY=VALUE entries,
+// sorted by key.
+func (s *Service) Exports() ([]string, error) {
+	host := s.Config.Name
+	vars := map[string]string{
+		"host": host,
+	}
+	if len(s.Config.ExposedPorts) > 0 {
+		vars["port"] = strconv.Itoa(s.Config.ExposedPorts[0])
+		vars["endpoint"] = fmt.Sprintf("%s:%d", host, s.Config.ExposedPorts[0])
+	}
+	for _, port := range s.Config.ExposedPorts {
+		vars[fmt.Sprintf("port_%d", port)] = strconv.Itoa(port)
+	}
+
+	keys := slices.Sorted(maps.Keys(s.Config.Exports))
+	exports := make([]string, 0, len(keys))
+	for _, key := range keys {
+		var missing []string
+		value := os.Expand(s.Config.Exports[key], func(name string) string {
+			v, ok := vars[name]
+			if !ok {
+				missing = append(missing, name)
+			}
+			return v
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("export %s of service %s: unknown variables %s", key, s.Config.Name, strings.Join(missing, ", "))
+		}
+		exports = append(exports, key+"="+value)
+	}
+	return exports, nil
+}
+
+// serviceExports collects the exports of the named services, which must
+// already be running.
+func serviceExports(services []*Service, names []string) ([]string, error) {
+	exports := []string{}
+	for _, name := range names {
+		idx := slices.IndexFunc(services, func(s *Service) bool { return s.Config.Name == name })
+		if idx == -1 {
+			return nil, fmt.Errorf("depends on service %s, which isn't running", name)
+		}
+		svcExports, err := services[idx].Exports()
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, svcExports...)
+	}
+	return exports, nil
 }
 
-func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*Service, error) {
-	container := dag.Container().From(cfg.Image)
-	container, err := containerWithEnvAndSecrets(container, cfg.Env, cfg.Secrets)
+func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig, exports []string) (*Service, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	fileEnv, err := env.loadEnvFiles(cfg.EnvFiles)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+
+	container, err := env.containerFrom(ctx, cfg.Image, cfg.PullPolicy)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := imageDigest(ctx, container)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: failed to resolve digest of %s: %w", cfg.Name, cfg.Image, err)
+	}
+	secrets, err := resolveServiceSecrets(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	envs := slices.Concat(env.Config.Proxy.Env(), fileEnv, cfg.Env, exports)
+	container, err = containerWithEnvAndSecrets(container, envs, secrets)
 	if err != nil {
 		return nil, err
 	}
 
+	var shell []string
+	if cfg.Command != "" || len(cfg.Ulimits) > 0 {
+		if shell, err = probeShell(ctx, cfg.Image, container); err != nil {
+			return nil, fmt.Errorf("service %s: %w", cfg.Name, err)
+		}
+	}
 	if cfg.Command != "" {
-		container = container.WithExec([]string{"sh", "-c", cfg.Command})
+		container = container.WithExec(append(slices.Clone(shell), "-c", cfg.Command))
 	}
 
-	args := []string{}
-	if cfg.Command != "" {
-		args = []string{"sh", "-c", cfg.Command}
+	container, args, useEntrypoint, err := env.withServiceLogs(ctx, cfg, container, cfg.Args(shell))
+	if err != nil {
+		return nil, err
 	}
+	args = argsWithUlimits(cfg.Ulimits, shell, args)
 
 	// Expose ports
 	for _, port := range cfg.ExposedPorts {
@@ -61,7 +214,7 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 	// Start the service
 	svc, err := container.AsService(dagger.ContainerAsServiceOpts{
 		Args:          args,
-		UseEntrypoint: true,
+		UseEntrypoint: useEntrypoint,
 	}).Start(ctx)
 	if err != nil {
 		var exitErr *dagger.ExecError
@@ -89,11 +242,13 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 			},
 		}).Start(ctx)
 		if err != nil {
+			_, _ = svc.Stop(context.WithoutCancel(ctx))
 			return nil, err
 		}
 
 		externalEndpoint, err := tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{})
 		if err != nil {
+			_, _ = svc.Stop(context.WithoutCancel(ctx))
 			return nil, fmt.Errorf("failed to get endpoint for service %s: %w", cfg.Name, err)
 		}
 		endpoint.External = externalEndpoint
@@ -103,24 +258,58 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 		Config:    cfg,
 		Endpoints: endpoints,
 		svc:       svc,
+		digest:    digest,
 	}, nil
 }
 
 func (env *Environment) AddService(ctx context.Context, explanation string, cfg *ServiceConfig) (*Service, error) {
+	ctx, done, err := env.beginOperation(ctx, "add_service")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return env.addService(ctx, explanation, cfg)
+}
+
+// addService must be called with the operation lock held.
+func (env *Environment) addService(ctx context.Context, explanation string, cfg *ServiceConfig) (*Service, error) {
 	if env.Config.Services.Get(cfg.Name) != nil {
 		return nil, fmt.Errorf("service %s already exists", cfg.Name)
 	}
-	svc, err := env.startService(ctx, cfg)
+	depExports, err := serviceExports(env.Services, cfg.DependsOn)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	svc, err := env.startService(ctx, cfg, depExports)
+	if err != nil {
+		return nil, err
+	}
+	exports, err := svc.Exports()
+	if err != nil {
+		_ = stopServices(context.WithoutCancel(ctx), []*Service{svc})
+		return nil, err
+	}
+	exports = slices.DeleteFunc(exports, func(entry string) bool {
+		k, _, _ := parseKV(entry)
+		return hasKey(env.runtimeEnv, k)
+	})
+	state, err := containerWithEnvAndSecrets(env.container.WithServiceBinding(cfg.Name, svc.svc), exports, nil)
 	if err != nil {
+		_ = stopServices(context.WithoutCancel(ctx), []*Service{svc})
 		return nil, err
 	}
+
+	oldConfig := env.Config.Copy()
 	env.Config.Services = append(env.Config.Services, cfg)
 	env.Services = append(env.Services, svc)
-
-	state := env.container.WithServiceBinding(cfg.Name, svc.svc)
 	if err := env.apply(ctx, "Add service "+cfg.Name, explanation, "", state); err != nil {
+		env.Config.Services = env.Config.Services[:len(env.Config.Services)-1]
+		env.Services = env.Services[:len(env.Services)-1]
+		_ = stopServices(context.WithoutCancel(ctx), []*Service{svc})
 		return nil, err
 	}
+	env.audit(ctx, "add_service", cfg.Name)
+	fireConfigChange(env, DiffConfigs(oldConfig, env.Config))
 
 	if err := env.propagateToWorktree(ctx, "Add service "+cfg.Name, explanation); err != nil {
 		return nil, fmt.Errorf("failed to propagate to worktree: %w", err)
@@ -128,3 +317,175 @@ func (env *Environment) AddService(ctx context.Context, explanation string, cfg
 
 	return svc, nil
 }
+
+func stopServices(ctx context.Context, services []*Service) error {
+	var errs []error
+	for _, service := range services {
+		if err := stopService(ctx, service); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop service %s: %w", service.Config.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopService stops a running service. It is a variable so it can be swapped
+// out.
+var stopService = func(ctx context.Context, service *Service) error {
+	_, err := service.svc.Stop(ctx)
+	return err
+}
+
+// Forward forwards containerPort of a running service to localPort on the host,
+// e.g. to attach a debugger. A localPort of 0 picks a free port. The host
+// endpoint is reported in the Forwarded field of the endpoint mapping of the
+// port until the returned function stops the forward.
+func (env *Environment) Forward(ctx context.Context, service string, containerPort, localPort int) (stop func(), err error) {
+	env.mu.Lock()
+	idx := slices.IndexFunc(env.Services, func(s *Service) bool { return s.Config.Name == service })
+	if idx == -1 {
+		declared := env.Config.Services.Get(service) != nil
+		env.mu.Unlock()
+		if declared {
+			return nil, fmt.Errorf("service %s is not running", service)
+		}
+		return nil, fmt.Errorf("unknown service %s", service)
+	}
+	svc := env.Services[idx]
+	env.mu.Unlock()
+	if !slices.Contains(svc.Config.ExposedPorts, containerPort) {
+		return nil, fmt.Errorf("port %d is not exposed by service %s", containerPort, service)
+	}
+
+	tunnel, err := dag.Host().Tunnel(svc.svc, dagger.HostTunnelOpts{
+		Ports: []dagger.PortForward{
+			{
+				Backend:  containerPort,
+				Frontend: localPort,
+				Protocol: dagger.NetworkProtocolTcp,
+			},
+		},
+	}).Start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to forward port %d of service %s: %w", containerPort, service, err)
+	}
+	stopTunnel := func() {
+		if _, err := tunnel.Stop(context.Background()); err != nil {
+			slog.Warn("Failed to stop port forward", "service", service, "port", containerPort, "err", err)
+		}
+	}
+
+	endpoint, err := tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{})
+	if err != nil {
+		stopTunnel()
+		return nil, fmt.Errorf("failed to get endpoint for service %s: %w", service, err)
+	}
+
+	env.mu.Lock()
+	if svc.Endpoints == nil {
+		svc.Endpoints = EndpointMappings{}
+	}
+	mapping := svc.Endpoints[containerPort]
+	if mapping == nil {
+		mapping = &EndpointMapping{}
+		svc.Endpoints[containerPort] = mapping
+	}
+	mapping.Forwarded = endpoint
+	env.mu.Unlock()
+
+	return sync.OnceFunc(func() {
+		env.mu.Lock()
+		if mapping.Forwarded == endpoint {
+			mapping.Forwarded = ""
+		}
+		env.mu.Unlock()
+		stopTunnel()
+	}), nil
+}
+
+// EnsureServices reconciles the services of the environment with desired.
+// Services that are already running with the same config are left alone, so
+// calling it again with the same input does nothing. Missing services are
+// added; if any service has to be removed or changed, the environment is
+// rebuilt with the desired services, since dagger can't unbind a service from
+// a container, and the old services are stopped. Services outside the active
+// profiles are ignored, and so are optional services that already failed to
+// start with the same config. A locked environment is left alone unless it
+// already matches desired.
+func (env *Environment) EnsureServices(ctx context.Context, desired ServiceConfigs) error {
+	ctx, done, err := env.beginOperation(ctx, "ensure_services")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	expanded, err := desired.Expand()
+	if err != nil {
+		return err
+	}
+	expanded = expanded.Active(env.profiles...)
+	declared, err := env.Config.Services.Expand()
+	if err != nil {
+		return err
+	}
+	declared = declared.Active(env.profiles...)
+	running := map[string]*Service{}
+	for _, svc := range env.Services {
+		running[svc.Config.Name] = svc
+	}
+
+	rebuild := false
+	stale := []*Service{}
+	for name, svc := range running {
+		cfg := expanded.Get(name)
+		if cfg == nil || !cfg.SemanticEqual(*svc.Config) {
+			rebuild = true
+			stale = append(stale, svc)
+		}
+	}
+	added := ServiceConfigs{}
+	for _, cfg := range expanded {
+		if running[cfg.Name] != nil {
+			continue
+		}
+		if old := declared.Get(cfg.Name); old != nil {
+			if env.serviceFailures[cfg.Name] != nil && cfg.SemanticEqual(*old) {
+				// An optional service that failed with this very config,
+				// which a rebuild would only retry.
+				continue
+			}
+			rebuild = true
+		}
+		added = append(added, cfg)
+	}
+
+	if rebuild {
+		config := env.Config.Copy()
+		config.Services = desired
+		if err := env.rebuildLocked(ctx, "ensure_services", "Ensure services", "Reconcile services", config, false); err != nil {
+			return err
+		}
+		// Changes that don't affect the service container, like exports,
+		// yield the same dagger service, which must keep running.
+		stale = slices.DeleteFunc(stale, func(old *Service) bool {
+			oldID, err := old.svc.ID(ctx)
+			return err != nil || slices.ContainsFunc(env.Services, func(svc *Service) bool {
+				id, err := svc.svc.ID(ctx)
+				return err == nil && id == oldID
+			})
+		})
+		if err := stopServices(ctx, stale); err != nil {
+			slog.Warn("Failed to stop replaced services", "id", env.ID, "err", err)
+		}
+		return nil
+	}
+
+	if len(added) > 0 && env.Locked() {
+		return env.errLocked()
+	}
+	for _, cfg := range added {
+		if _, err := env.addService(ctx, "Reconcile services", cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServiceExports(t *testing.T) {
+	db := &Service{Config: &ServiceConfig{
+		Name:         "db",
+		ExposedPorts: []int{5432, 9187},
+		Exports: map[string]string{
+			"DB_HOST":     "${host}",
+			"DB_PORT":     "$port",
+			"DB_URL":      "postgres://${endpoint}/app",
+			"METRICS_URL": "http://${host}:${port_9187}/metrics",
+		},
+	}}
+	cache := &Service{Config: &ServiceConfig{
+		Name:    "cache",
+		Exports: map[string]string{"CACHE_HOST": "${host}"},
+	}}
+
+	exports, err := serviceExports([]*Service{db, cache}, []string{"db", "cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DB_HOST=db",
+		"DB_PORT=5432",
+		"DB_URL=postgres://db:5432/app",
+		"METRICS_URL=http://db:9187/metrics",
+		"CACHE_HOST=cache",
+	}
+	if !slices.Equal(exports, want) {
+		t.Errorf("serviceExports() = %v, want %v", exports, want)
+	}
+
+	if _, err := serviceExports([]*Service{db}, []string{"cache"}); err == nil {
+		t.Error("serviceExports() of a service that isn't running succeeded")
+	}
+}
+
+func TestServiceExportsUnknownVariable(t *testing.T) {
+	svc := &Service{Config: &ServiceConfig{
+		Name:    "cache",
+		Exports: map[string]string{"CACHE_PORT": "${port}"},
+	}}
+	_, err := svc.Exports()
+	if err == nil || !strings.Contains(err.Error(), "port") {
+		t.Errorf("Exports() = %v, want an unknown variable error", err)
+	}
+}
+
+func TestServiceConfigArgs(t *testing.T) {
+	for _, tt := range []struct {
+		cfg  ServiceConfig
+		want []string
+	}{
+		{ServiceConfig{CommandArgs: []string{"redis-server", "--save", ""}}, []string{"redis-server", "--save", ""}},
+		{ServiceConfig{Command: "redis-server --port 7000"}, []string{"/bin/bash", "-c", "redis-server --port 7000"}},
+		{ServiceConfig{}, []string{}},
+	} {
+		if got := tt.cfg.Args([]string{"/bin/bash"}); !slices.Equal(got, tt.want) {
+			t.Errorf("Args() of %+v = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+
+	both := ServiceConfig{Name: "redis", Image: "redis", Command: "redis-server", CommandArgs: []string{"redis-server"}}
+	if err := both.Validate(); err == nil {
+		t.Error("Validate() accepted both command and command_args")
+	}
+}
+
+func TestStartServicesOptionalFailure(t *testing.T) {
+	// An invalid image fails the service before anything is pulled.
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "metrics", Image: "Not A Ref", Optional: true},
+		{Name: "dashboard", Image: "grafana/grafana", DependsOn: []string{"metrics"}},
+	}
+	env := &Environment{ID: "optional", Config: config}
+
+	services, failures, err := env.startServices(context.Background())
+	if err != nil {
+		t.Fatalf("startServices() = %v, want the optional failure tolerated", err)
+	}
+	if len(services) != 0 {
+		t.Errorf("started %d services", len(services))
+	}
+	if f := failures["metrics"]; f == nil || f.Skipped {
+		t.Errorf("metrics failure = %+v, want failed", f)
+	}
+	if f := failures["dashboard"]; f == nil || !f.Skipped {
+		t.Errorf("dashboard failure = %+v, want skipped", f)
+	}
+
+	env.serviceFailures = failures
+	states := map[string]ServiceState{}
+	for _, svc := range env.Status().Services {
+		states[svc.Name] = svc.State
+	}
+	if states["metrics"] != ServiceFailed || states["dashboard"] != ServiceSkipped {
+		t.Errorf("service states = %v", states)
+	}
+
+	config.Services[0].Optional = false
+	if _, _, err := env.startServices(context.Background()); err == nil {
+		t.Error("startServices() tolerated a required service failing")
+	}
+}
+
+func TestServiceConfigsActive(t *testing.T) {
+	services := ServiceConfigs{
+		{Name: "cache"},
+		{Name: "mock-api", Profiles: []string{"dev"}},
+		{Name: "api", Profiles: []string{"ci", "staging"}},
+	}
+	for _, tt := range []struct {
+		profiles []string
+		want     []string
+	}{
+		{nil, []string{"cache"}},
+		{[]string{"dev"}, []string{"cache", "mock-api"}},
+		{[]string{"staging"}, []string{"cache", "api"}},
+		{[]string{"dev", "ci"}, []string{"cache", "mock-api", "api"}},
+		{[]string{"prod"}, []string{"cache"}},
+	} {
+		names := []string{}
+		for _, cfg := range services.Active(tt.profiles...) {
+			names = append(names, cfg.Name)
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("Active(%q) = %q, want %q", tt.profiles, names, tt.want)
+		}
+	}
+}
+
+func TestStartServicesProfiles(t *testing.T) {
+	// Invalid images fail the services before anything is pulled, which
+	// shows which ones were started.
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "mock-api", Image: "Not A Ref", Optional: true, Profiles: []string{"dev"}},
+		{Name: "api", Image: "Not A Ref", Optional: true, Profiles: []string{"ci"}},
+	}
+	env := &Environment{ID: "profiles", Config: config, profiles: []string{"dev"}}
+
+	_, failures, err := env.startServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures["mock-api"] == nil || failures["api"] != nil {
+		t.Errorf("failures = %v, want only the dev service started", failures)
+	}
+	if got := env.Profiles(); !slices.Equal(got, []string{"dev"}) {
+		t.Errorf("Profiles() = %q", got)
+	}
+
+	config.Services = append(config.Services, &ServiceConfig{Name: "tests", Image: "Not A Ref", DependsOn: []string{"api"}})
+	if _, _, err := env.startServices(context.Background()); err == nil || !strings.Contains(err.Error(), "active profiles") {
+		t.Errorf("startServices() = %v, want the inactive dependency reported", err)
+	}
+}
+
+func TestForwardErrors(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "db", Image: "postgres", ExposedPorts: []int{5432}},
+		{Name: "cache", Image: "redis", ExposedPorts: []int{6379}},
+	}
+	env := &Environment{Config: config, Services: []*Service{{Config: config.Services[0]}}}
+
+	for _, tt := range []struct {
+		service string
+		port    int
+		want    string
+	}{
+		{"web", 80, "unknown service web"},
+		{"cache", 6379, "service cache is not running"},
+		{"db", 5433, "port 5433 is not exposed by service db"},
+	} {
+		if _, err := env.Forward(context.Background(), tt.service, tt.port, 0); err == nil || err.Error() != tt.want {
+			t.Errorf("Forward(%s, %d) = %v, want %q", tt.service, tt.port, err, tt.want)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.Services = ServiceConfigs{{
+		Name:         "web",
+		Image:        alpineImage,
+		CommandArgs:  []string{"sh", "-c", "mkdir -p /www && echo hello > /www/index.html && httpd -f -p 8080 -h /www"},
+		ExposedPorts: []int{8080},
+	}}
+	env := newEngineEnvironment(t, config)
+
+	stop, err := env.Forward(ctx, "web", 8080, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := env.Services[0].Endpoints[8080].Forwarded
+	if endpoint == "" {
+		t.Fatal("Forward() didn't report the local endpoint")
+	}
+	resp, err := http.Get("http://" + endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "hello" {
+		t.Errorf("forwarded response = %q", body)
+	}
+
+	stop()
+	stop()
+	if got := env.Services[0].Endpoints[8080].Forwarded; got != "" {
+		t.Errorf("Forwarded after stop = %q", got)
+	}
+}
+
+func TestEnsureServicesNoop(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "db", Image: "postgres:16", ExposedPorts: []int{5432, 5433}, Env: []string{"A=1", "B=2"}},
+	}
+	db := &Service{Config: config.Services[0]}
+	env := &Environment{Config: config, Services: []*Service{db}}
+
+	// The same services, declared differently.
+	desired := ServiceConfigs{
+		{Name: "db", Image: "postgres:16", ExposedPorts: []int{5433, 5432}, Env: []string{"B=2", "A=1"}},
+	}
+	for range 2 {
+		if err := env.EnsureServices(context.Background(), desired); err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Services) != 1 || env.Services[0] != db || len(env.History) != 0 {
+			t.Fatalf("EnsureServices() changed the environment: services %v, history %v", env.Services, env.History)
+		}
+	}
+}
+
+func TestEnsureServicesConverges(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "db", Image: "postgres:16"},
+		{Name: "debugger", Image: "delve", Profiles: []string{"debug"}},
+		{Name: "cache", Image: "redis", Optional: true},
+	}
+	db := &Service{Config: config.Services[0]}
+	env := &Environment{
+		Config:          config,
+		Services:        []*Service{db},
+		serviceFailures: map[string]*ServiceFailure{"cache": {Err: errors.New("pull failed")}},
+	}
+
+	// Neither the service of an inactive profile nor the optional service
+	// that failed with the same config needs reconciling.
+	for range 2 {
+		if err := env.EnsureServices(context.Background(), config.Copy().Services); err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Services) != 1 || env.Services[0] != db || len(env.History) != 0 {
+			t.Fatalf("EnsureServices() changed the environment: services %v, history %v", env.Services, env.History)
+		}
+	}
+}
+
+func TestEnsureServices(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+	desired := ServiceConfigs{{
+		Name:         "web",
+		Image:        alpineImage,
+		CommandArgs:  []string{"httpd", "-f", "-p", "8080"},
+		ExposedPorts: []int{8080},
+	}}
+
+	if err := env.EnsureServices(ctx, desired); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Services) != 1 {
+		t.Fatalf("running services = %d, want 1", len(env.Services))
+	}
+	svc, version := env.Services[0], env.History.LatestVersion()
+
+	if err := env.EnsureServices(ctx, desired); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Services) != 1 || env.Services[0] != svc || env.History.LatestVersion() != version {
+		t.Error("second EnsureServices() with the same services wasn't a no-op")
+	}
+
+	if err := env.EnsureServices(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Services) != 0 {
+		t.Errorf("running services after removing them = %d", len(env.Services))
+	}
+}
+
+func TestEnsureServicesLocked(t *testing.T) {
+	store := NewMemoryStore()
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+	if err := store.WriteLock("locked", &LockMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Environment{ID: "locked", Config: DefaultConfig()}
+	if err := env.EnsureServices(context.Background(), nil); err != nil {
+		t.Errorf("EnsureServices() of a locked environment already matching = %v", err)
+	}
+	added := ServiceConfigs{{Name: "db", Image: "postgres:16"}}
+	if err := env.EnsureServices(context.Background(), added); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("EnsureServices() adding to a locked environment = %v, want it refused", err)
+	}
+
+	env.Config.Services = added
+	env.Services = []*Service{{Config: &ServiceConfig{Name: "db", Image: "postgres:15"}}}
+	if err := env.EnsureServices(context.Background(), added); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("EnsureServices() changing a locked environment = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,135 @@
+package environment
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ServicePlan describes how the services of an environment would be started,
+// in order, along with the problems that would prevent it.
+type ServicePlan struct {
+	Steps     []ServicePlanStep `json:"steps"`
+	Conflicts []string          `json:"conflicts,omitempty"`
+}
+
+type ServicePlanStep struct {
+	Name       string     `json:"name"`
+	Image      string     `json:"image"`
+	PullPolicy PullPolicy `json:"pull_policy"`
+	Ports      []int      `json:"ports,omitempty"`
+	DependsOn  []string   `json:"depends_on,omitempty"`
+	Optional   bool       `json:"optional,omitempty"`
+
+	// Readiness is how the service is considered started: dagger waits for
+	// exposed ports to accept connections, and for nothing otherwise.
+	Readiness string `json:"readiness"`
+}
+
+// PlanServices computes the start plan of the active services of the config,
+// with replicas expanded, without pulling or starting anything. With a
+// dependency cycle, the steps follow the declaration order instead and the
+// cycle is reported as a conflict.
+func (env *Environment) PlanServices() (*ServicePlan, error) {
+	plan := &ServicePlan{Steps: []ServicePlanStep{}}
+	all, err := env.Config.Services.Expand()
+	if err != nil {
+		plan.Conflicts = append(plan.Conflicts, err.Error())
+		all = env.Config.Services
+	}
+	active := all.Active(env.profiles...)
+
+	sorted, err := active.TopoSort()
+	if err != nil {
+		plan.Conflicts = append(plan.Conflicts, err.Error())
+		sorted = active
+	}
+
+	names := map[string]int{}
+	portOwners := map[int][]string{}
+	for _, cfg := range all {
+		names[cfg.Name]++
+	}
+	for _, cfg := range sorted {
+		step := ServicePlanStep{
+			Name:       cfg.Name,
+			Image:      cfg.Image,
+			PullPolicy: cfg.PullPolicy,
+			Ports:      cfg.ExposedPorts,
+			DependsOn:  cfg.DependsOn,
+			Optional:   cfg.Optional,
+			Readiness:  "started",
+		}
+		if step.PullPolicy == "" {
+			step.PullPolicy = PullIfNotPresent
+		}
+		if len(cfg.ExposedPorts) > 0 {
+			ports := make([]string, len(cfg.ExposedPorts))
+			for i, port := range cfg.ExposedPorts {
+				ports[i] = fmt.Sprint(port)
+			}
+			step.Readiness = "ports " + strings.Join(ports, ", ") + " accept connections"
+		}
+		plan.Steps = append(plan.Steps, step)
+
+		if err := cfg.Validate(); err != nil {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("service %s: %s", cfg.Name, err))
+		}
+		if names[cfg.Name] > 1 {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("service %s is declared %d times", cfg.Name, names[cfg.Name]))
+			names[cfg.Name] = 1
+		}
+		for _, dep := range cfg.DependsOn {
+			switch {
+			case all.Get(dep) == nil:
+				plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("service %s depends on unknown service %s", cfg.Name, dep))
+			case active.Get(dep) == nil:
+				plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("service %s depends on %s, which isn't in any of the active profiles", cfg.Name, dep))
+			}
+		}
+		seen := map[int]bool{}
+		for _, port := range cfg.ExposedPorts {
+			if seen[port] {
+				plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("service %s exposes port %d more than once", cfg.Name, port))
+				continue
+			}
+			seen[port] = true
+			portOwners[port] = append(portOwners[port], cfg.Name)
+		}
+	}
+
+	// Services have their own hostname, so sharing a port only conflicts once
+	// published on the host, as ToScript does.
+	for _, port := range slices.Sorted(maps.Keys(portOwners)) {
+		if owners := portOwners[port]; len(owners) > 1 {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("port %d is exposed by %s and can't be published on the host by all of them", port, strings.Join(owners, ", ")))
+		}
+	}
+	return plan, nil
+}
+
+func (p *ServicePlan) String() string {
+	out := &strings.Builder{}
+	if len(p.Steps) == 0 {
+		out.WriteString("No services to start.\n")
+	}
+	for i, step := range p.Steps {
+		fmt.Fprintf(out, "%d. %s (%s, pull %s)", i+1, step.Name, step.Image, step.PullPolicy)
+		if step.Optional {
+			out.WriteString(" [optional]")
+		}
+		out.WriteString("\n")
+		if len(step.DependsOn) > 0 {
+			fmt.Fprintf(out, "   after: %s\n", strings.Join(step.DependsOn, ", "))
+		}
+		fmt.Fprintf(out, "   ready when: %s\n", step.Readiness)
+	}
+	if len(p.Conflicts) > 0 {
+		out.WriteString("Conflicts:\n")
+		for _, conflict := range p.Conflicts {
+			fmt.Fprintf(out, "- %s\n", conflict)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,97 @@
+package environment
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func planNames(plan *ServicePlan) []string {
+	names := make([]string, len(plan.Steps))
+	for i, step := range plan.Steps {
+		names[i] = step.Name
+	}
+	return names
+}
+
+func TestPlanServices(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "web", Image: "nginx:1.27", ExposedPorts: []int{80}, DependsOn: []string{"api"}},
+		{Name: "api", Image: "example/api:1", ExposedPorts: []int{8080, 5432}, DependsOn: []string{"db"}, PullPolicy: PullAlways},
+		{Name: "db", Image: "postgres:16", ExposedPorts: []int{5432}},
+		{Name: "debug", Image: "busybox", Profiles: []string{"debug"}, Optional: true},
+	}
+	env := &Environment{ID: "plan/test", Config: config}
+
+	plan, err := env.PlanServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := planNames(plan); !slices.Equal(names, []string{"db", "api", "web"}) {
+		t.Errorf("plan order = %q, want dependencies first and debug left out", names)
+	}
+	want := []string{"port 5432 is exposed by db, api and can't be published on the host by all of them"}
+	if !slices.Equal(plan.Conflicts, want) {
+		t.Errorf("conflicts = %q, want %q", plan.Conflicts, want)
+	}
+	api := plan.Steps[1]
+	if api.PullPolicy != PullAlways || plan.Steps[0].PullPolicy != PullIfNotPresent || api.Readiness != "ports 8080, 5432 accept connections" {
+		t.Errorf("api step = %+v", api)
+	}
+
+	wantString := `1. db (postgres:16, pull if-not-present)
+   ready when: ports 5432 accept connections
+2. api (example/api:1, pull always)
+   after: db
+   ready when: ports 8080, 5432 accept connections
+3. web (nginx:1.27, pull if-not-present)
+   after: api
+   ready when: ports 80 accept connections
+Conflicts:
+- port 5432 is exposed by db, api and can't be published on the host by all of them
+`
+	if got := plan.String(); got != wantString {
+		t.Errorf("String() =\n%s\nwant\n%s", got, wantString)
+	}
+
+	env.profiles = []string{"debug"}
+	plan, _ = env.PlanServices()
+	if step := plan.Steps[len(plan.Steps)-1]; step.Name != "debug" || !step.Optional || step.Readiness != "started" {
+		t.Errorf("debug step = %+v", step)
+	}
+}
+
+func TestPlanServicesConflicts(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "a", Image: "busybox", DependsOn: []string{"b"}},
+		{Name: "b", Image: "busybox", DependsOn: []string{"a"}},
+		{Name: "c", Image: "busybox", DependsOn: []string{"missing", "debug"}, ExposedPorts: []int{80, 80}},
+		{Name: "debug", Image: "busybox", Profiles: []string{"debug"}},
+	}
+	env := &Environment{ID: "plan/test", Config: config}
+
+	plan, err := env.PlanServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a cycle, the declaration order is kept.
+	if names := planNames(plan); !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Errorf("plan order = %q, want the declaration order", names)
+	}
+	for _, want := range []string{
+		"dependency cycle between services",
+		"service c depends on unknown service missing",
+		"service c depends on debug, which isn't in any of the active profiles",
+		"service c exposes port 80 more than once",
+	} {
+		if !slices.ContainsFunc(plan.Conflicts, func(c string) bool { return strings.Contains(c, want) }) {
+			t.Errorf("conflicts = %q, want %q", plan.Conflicts, want)
+		}
+	}
+
+	if got := (&ServicePlan{}).String(); got != "No services to start.\n" {
+		t.Errorf("String() of an empty plan = %q", got)
+	}
+}
@@ -0,0 +1,345 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"dagger.io/dagger"
+)
+
+// SetupLayering controls how setup commands are turned into container layers.
+//
+// Running each command in its own layer ("per-command", the default) gives the
+// best incremental caching: editing a command only reruns it and the commands
+// after it. Combining everything into a single layer ("combined") produces a
+// smaller image with fewer layers, but any edit reruns every command. "auto"
+// sits in between and combines consecutive commands that use the same tool,
+// e.g. a run of apt-get or pip invocations.
+//
+// Combined commands still run in separate subshells, so a command can't rely
+// on a previous one changing directory or exporting variables, exactly like in
+// per-command mode.
+//
+// Layers are cached like any exec: a layer reruns when its script, or
+// anything before it, changes. The only step built with NoCache, the copy of
+// the source directory, comes after setup, so editing the sources never
+// reruns a layer whatever the layering. Setup commands themselves can't opt
+// out of caching, so one fetching remote content is only rerun along with
+// its layer: keep it in a layer of its own, last, so that forcing it to run
+// again (e.g. by editing it) doesn't rerun the commands before it.
+type SetupLayering string
+
+const (
+	SetupPerCommand SetupLayering = "per-command"
+	SetupCombined   SetupLayering = "combined"
+	SetupAuto       SetupLayering = "auto"
+)
+
+func (l SetupLayering) Validate() error {
+	switch l {
+	case "", SetupPerCommand, SetupCombined, SetupAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid setup layering %q, expected one of %s, %s or %s", l, SetupPerCommand, SetupCombined, SetupAuto)
+	}
+}
+
+// setupLayers groups commands into the layers they are executed in. Commands
+// run by different users never share a layer.
+func setupLayers(commands []string, layering SetupLayering, users map[string]string) [][]string {
+	layers := [][]string{}
+	for i, command := range commands {
+		switch {
+		case i == 0:
+		case users[command] != users[commands[i-1]]:
+		case layering == SetupCombined:
+			layers[len(layers)-1] = append(layers[len(layers)-1], command)
+			continue
+		case layering == SetupAuto && setupCategory(command) == setupCategory(commands[i-1]):
+			layers[len(layers)-1] = append(layers[len(layers)-1], command)
+			continue
+		}
+		layers = append(layers, []string{command})
+	}
+	return layers
+}
+
+// setupCategory returns the tool a setup command invokes, ignoring sudo and
+// leading variable assignments.
+func setupCategory(command string) string {
+	for _, field := range strings.Fields(command) {
+		if field == "sudo" || strings.Contains(field, "=") {
+			continue
+		}
+		return field
+	}
+	return ""
+}
+
+// setupScript returns the shell script running the commands of a layer.
+// Commands with allowed exit codes succeed when they exit with one of them.
+func setupScript(layer []string, allowExitCodes map[string][]int) string {
+	return buildSetupScript(layer, allowExitCodes, false)
+}
+
+// reportingSetupScript is setupScript, with the commands exiting non-zero
+// reporting it on stderr, see parseSetupStatuses.
+func reportingSetupScript(layer []string, allowExitCodes map[string][]int) string {
+	return buildSetupScript(layer, allowExitCodes, true)
+}
+
+func buildSetupScript(layer []string, allowExitCodes map[string][]int, reportStatus bool) string {
+	if len(layer) == 1 && len(allowExitCodes[layer[0]]) == 0 {
+		return layer[0]
+	}
+	parts := make([]string, 0, len(layer))
+	for i, command := range layer {
+		// Newlines keep a trailing comment in command from swallowing the
+		// closing parenthesis.
+		part := "(\n" + command + "\n)"
+		report := "rc=$?;"
+		if reportStatus {
+			report += fmt.Sprintf(` echo "%s%d $rc" >&2;`, setupStatusPrefix, i)
+		}
+		if codes := allowExitCodes[command]; len(codes) > 0 {
+			patterns := make([]string, len(codes))
+			for i, code := range codes {
+				patterns[i] = strconv.Itoa(code)
+			}
+			part = "{ " + part + " || { " + report + " case $rc in " + strings.Join(patterns, "|") + ") ;; *) exit $rc ;; esac; }; }"
+		} else {
+			part = "{ " + part + " || { " + report + " exit $rc; }; }"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " && ")
+}
+
+// setupStatusPrefix starts the lines setup scripts write to stderr when a
+// command exits non-zero, followed by the index of the command in the layer
+// and its exit code.
+const setupStatusPrefix = "container-use-setup-status "
+
+// parseSetupStatuses removes the status lines written by a setup script from
+// stderr, and returns the exit codes they report by command index.
+func parseSetupStatuses(stderr string) (string, map[int]int) {
+	out := &strings.Builder{}
+	statuses := map[int]int{}
+	for line := range strings.Lines(stderr) {
+		var idx, code int
+		if status, ok := strings.CutPrefix(line, setupStatusPrefix); ok {
+			if _, err := fmt.Sscanf(status, "%d %d", &idx, &code); err == nil {
+				statuses[idx] = code
+				continue
+			}
+		}
+		out.WriteString(line)
+	}
+	return out.String(), statuses
+}
+
+// setupCommand returns the text of the commands of a layer, as written in the
+// config.
+func setupCommand(layer []string) string {
+	return strings.Join(layer, " && ")
+}
+
+// validateSetupExitCodes checks that allowed exit codes are for setup commands
+// of the config and within the 0-255 range.
+func validateSetupExitCodes(allowExitCodes map[string][]int, commands []string) error {
+	for _, command := range slices.Sorted(maps.Keys(allowExitCodes)) {
+		if !slices.Contains(commands, command) {
+			return fmt.Errorf("allowed exit codes for unknown setup command %q", command)
+		}
+		for _, code := range allowExitCodes[command] {
+			if code < 0 || code > 255 {
+				return fmt.Errorf("invalid exit code %d for setup command %q", code, command)
+			}
+		}
+	}
+	return nil
+}
+
+// SetupError is returned when a setup command exits with a code it isn't
+// allowed to. Command is the failing command, and Results are the results of
+// the setup layers the build ran, the failing one last.
+type SetupError struct {
+	Command  string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Results  []SetupResult
+
+	err error
+}
+
+func (e *SetupError) Error() string {
+	return fmt.Sprintf("setup command failed with exit code %d.\nstdout: %s\nstderr: %s\n%s\n", e.ExitCode, e.Stdout, e.Stderr, e.err)
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.err
+}
+
+// setupCheckpoint is a setup layer completed by a build. key identifies the
+// layer and everything it was built on: the container before setup and all
+// the layers up to and including this one.
+type setupCheckpoint struct {
+	key       string
+	container *dagger.Container
+	result    SetupResult
+}
+
+// runCheckpointedSetup runs the setup commands of the config, recording a
+// checkpoint after each layer so that a later build can resume after the last
+// layer that completed.
+//
+// Resuming is correct as long as setup commands only depend on their inputs:
+// the container before setup (base image, env, secrets, files...) and the
+// previous commands. Host files are identified by path rather than content,
+// and commands fetching remote content (apt-get update, curl) won't be rerun,
+// so only resume when that's acceptable.
+func (env *Environment) runCheckpointedSetup(ctx context.Context, container *dagger.Container, resume bool) (*dagger.Container, error) {
+	id, err := container.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := string(id)
+
+	previous := env.setupCheckpoints
+	env.setupCheckpoints = nil
+	for i, layer := range setupLayers(env.Config.SetupCommands, env.Config.SetupLayering, env.Config.SetupUsers) {
+		key = checkpointKey(key, env.Config.SetupUsers[layer[0]]+"\x00"+setupScript(layer, env.Config.SetupExitCodes))
+		var result SetupResult
+		if resume && i < len(previous) && previous[i].key == key {
+			container = previous[i].container
+			result = previous[i].result
+			result.Cached = true
+			result.Duration = 0
+			env.setupResults = append(env.setupResults, result)
+		} else {
+			resume = false
+			container, err = env.runSetupLayer(ctx, container, layer)
+			if err != nil {
+				return nil, err
+			}
+			result = env.setupResults[len(env.setupResults)-1]
+		}
+		env.setupCheckpoints = append(env.setupCheckpoints, setupCheckpoint{key: key, container: container, result: result})
+	}
+	return container, nil
+}
+
+// defaultSetupEstimate is the estimated duration of setup layers that never
+// ran.
+const defaultSetupEstimate = 30 * time.Second
+
+// EstimateBuildTime estimates how long running the setup commands of the
+// config takes, from the last recorded duration of each layer in the history.
+// Layers without one, e.g. new or edited commands, count for
+// defaultSetupEstimate. Pulling the base image and installing packages aren't
+// included.
+func (env *Environment) EstimateBuildTime() time.Duration {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	known := map[string]time.Duration{}
+	for _, revision := range env.History {
+		for _, result := range revision.SetupResults {
+			if !result.Cached {
+				known[result.Command] = time.Duration(result.Duration)
+			}
+		}
+	}
+
+	var total time.Duration
+	for _, layer := range setupLayers(env.Config.SetupCommands, env.Config.SetupLayering, env.Config.SetupUsers) {
+		if d, ok := known[setupCommand(layer)]; ok {
+			total += d
+		} else {
+			total += defaultSetupEstimate
+		}
+	}
+	return total
+}
+
+func checkpointKey(previous, script string) string {
+	sum := sha256.Sum256([]byte(previous + "\x00" + script))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetupLogMode controls the output kept for setup commands: "on-failure", the
+// default, only keeps it in the SetupError of a failing command, "always" also
+// keeps it in the results of successful commands, and "never" keeps none.
+//
+// With "always", every revision produced by a build holds the output of its
+// setup, up to the last setupOutputBytes of each layer. That adds up with
+// many layers, since the history is kept in memory and in the git notes.
+type SetupLogMode string
+
+const (
+	SetupLogOnFailure SetupLogMode = "on-failure"
+	SetupLogAlways    SetupLogMode = "always"
+	SetupLogNever     SetupLogMode = "never"
+)
+
+func (m SetupLogMode) Validate() error {
+	switch m {
+	case "", SetupLogOnFailure, SetupLogAlways, SetupLogNever:
+		return nil
+	default:
+		return fmt.Errorf("invalid setup log mode %q, expected one of %s, %s or %s", m, SetupLogOnFailure, SetupLogAlways, SetupLogNever)
+	}
+}
+
+// setupOutputBytes is how much of the output of a setup command is kept in its
+// result, from the end, which is where errors usually are.
+const setupOutputBytes = 4096
+
+// SetupResult is the outcome of a setup layer: a setup command, or the
+// commands combined into the layer, as run by the build that produced a
+// revision. Package and runtime installs are recorded as well. Cached results
+// are for layers reused from a previous build.
+//
+// ExitCode is non-zero when a command exited with one of its allowed exit
+// codes, or for the failing command in the Results of a SetupError. In a
+// combined layer, it is the one of the last command that exited non-zero.
+type SetupResult struct {
+	Command  string   `json:"command"`
+	ExitCode int      `json:"exit_code"`
+	Duration Duration `json:"duration"`
+	Output   string   `json:"output,omitempty"`
+	Cached   bool     `json:"cached,omitempty"`
+}
+
+// SetupResults returns the setup results recorded in the given revision. Only
+// revisions produced by a build have any.
+func (env *Environment) SetupResults(version Version) ([]SetupResult, error) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	revision := env.revision(version)
+	if revision == nil {
+		return nil, fmt.Errorf("version %d not found", version)
+	}
+	return slices.Clone(revision.SetupResults), nil
+}
+
+func tailOutput(output string) string {
+	output = truncateLines(output)
+	if len(output) <= setupOutputBytes {
+		return output
+	}
+	cut := len(output) - setupOutputBytes
+	for cut < len(output) && !utf8.RuneStart(output[cut]) {
+		cut++
+	}
+	return fmt.Sprintf("[%d bytes truncated]...", cut) + output[cut:]
+}
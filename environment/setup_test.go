@@ -0,0 +1,415 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSetupLayers(t *testing.T) {
+	commands := []string{
+		"apt-get update",
+		"sudo apt-get install -y git",
+		"DEBIAN_FRONTEND=noninteractive apt-get install -y curl",
+		"pip install requests",
+		"pip install pytest",
+		"go mod download",
+	}
+	for _, tt := range []struct {
+		layering SetupLayering
+		want     [][]string
+	}{
+		{"", [][]string{{commands[0]}, {commands[1]}, {commands[2]}, {commands[3]}, {commands[4]}, {commands[5]}}},
+		{SetupPerCommand, [][]string{{commands[0]}, {commands[1]}, {commands[2]}, {commands[3]}, {commands[4]}, {commands[5]}}},
+		{SetupCombined, [][]string{commands}},
+		{SetupAuto, [][]string{commands[0:3], commands[3:5], commands[5:]}},
+	} {
+		if got := setupLayers(commands, tt.layering, nil); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("setupLayers(%q) = %q, want %q", tt.layering, got, tt.want)
+		}
+	}
+
+	if got := setupLayers(nil, SetupCombined, nil); len(got) != 0 {
+		t.Errorf("setupLayers() without commands = %q", got)
+	}
+}
+
+func TestSetupCategory(t *testing.T) {
+	for command, want := range map[string]string{
+		"apt-get install -y git": "apt-get",
+		"FOO=1 BAR=2 make build": "make",
+		"sudo FOO=1 npm ci":      "npm",
+		"":                       "",
+	} {
+		if got := setupCategory(command); got != want {
+			t.Errorf("setupCategory(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestRebuildResumesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	// Host files are identified by path, so changing the flag makes the
+	// second layer fail or pass without changing the inputs of the build.
+	flag := filepath.Join(t.TempDir(), "flag")
+	if err := os.WriteFile(flag, []byte("ok"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupLayering = SetupPerCommand
+	config.Files = []FileProvision{{Path: "/flag", SourcePath: flag}}
+	config.SetupCommands = []string{"date +%s%N > /first", `test "$(cat /flag)" = ok`}
+	env := newEngineEnvironment(t, config)
+
+	if err := os.WriteFile(flag, []byte("fail"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := env.History.LatestVersion()
+	if err := env.Rebuild(ctx, "fails on the second layer", false); err == nil {
+		t.Fatal("Rebuild() succeeded with a failing setup command")
+	}
+	if got := env.History.LatestVersion(); got != before {
+		t.Errorf("failed Rebuild() recorded version %d", got)
+	}
+
+	if err := os.WriteFile(flag, []byte("ok"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Rebuild(ctx, "resume", true); err != nil {
+		t.Fatal(err)
+	}
+	results, err := env.SetupResults(env.History.LatestVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Cached || results[1].Cached {
+		t.Errorf("setup results = %+v, want the first layer resumed and the second run", results)
+	}
+}
+
+func TestRebuildRefusesLockedEnvironments(t *testing.T) {
+	store := NewMemoryStore()
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+	if err := store.WriteLock("locked", &LockMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Environment{ID: "locked", Config: DefaultConfig()}
+	if err := env.Rebuild(context.Background(), "rebuild", true); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Rebuild() of a locked environment = %v, want it refused", err)
+	}
+	if env.State() != StateReady {
+		t.Errorf("State() = %s, want the refused rebuild to leave it ready", env.State())
+	}
+}
+
+func TestSetupScriptAllowsExitCodes(t *testing.T) {
+	requireShell(t)
+	allowed := map[string][]int{"exit 1": {1, 3}, "exit 1 # fine": {1}}
+	for _, tt := range []struct {
+		layer []string
+		want  int
+	}{
+		{[]string{"exit 1"}, 0},
+		{[]string{"true", "exit 1", "echo after"}, 0},
+		{[]string{"exit 2"}, 2},
+		{[]string{"exit 1", "exit 4"}, 4},
+		// A trailing comment doesn't swallow the wrapping.
+		{[]string{"exit 1 # fine", "exit 5"}, 5},
+	} {
+		err := exec.Command("sh", "-c", setupScript(tt.layer, allowed)).Run()
+		got := 0
+		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+			got = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("setupScript(%q) exited %d, want %d", tt.layer, got, tt.want)
+		}
+	}
+}
+
+func TestSetupScriptReportsExitCodes(t *testing.T) {
+	requireShell(t)
+	allowed := map[string][]int{"exit 1": {1}}
+	for _, tt := range []struct {
+		layer []string
+		want  map[int]int
+	}{
+		{[]string{"true", "echo oops >&2; exit 1", "echo after"}, map[int]int{1: 1}},
+		{[]string{"true", "echo oops >&2; exit 3", "echo never"}, map[int]int{1: 3}},
+		{[]string{"exit 1", "true"}, map[int]int{0: 1}},
+	} {
+		cmd := exec.Command("sh", "-c", reportingSetupScript(tt.layer, allowed))
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		_ = cmd.Run()
+		rest, statuses := parseSetupStatuses(stderr.String())
+		if !reflect.DeepEqual(statuses, tt.want) {
+			t.Errorf("statuses of %q = %v, want %v", tt.layer, statuses, tt.want)
+		}
+		if strings.Contains(rest, setupStatusPrefix) {
+			t.Errorf("stderr of %q kept the status lines: %q", tt.layer, rest)
+		}
+	}
+	// The exported script doesn't report anything.
+	if strings.Contains(setupScript([]string{"true", "false"}, nil), setupStatusPrefix) {
+		t.Error("setupScript() reports exit codes")
+	}
+}
+
+func TestValidateSetupExitCodes(t *testing.T) {
+	commands := []string{"grep -q x file"}
+	for _, tt := range []struct {
+		codes map[string][]int
+		ok    bool
+	}{
+		{nil, true},
+		{map[string][]int{"grep -q x file": {0, 1}}, true},
+		{map[string][]int{"grep -q x file": {255}}, true},
+		{map[string][]int{"grep -q x file": {256}}, false},
+		{map[string][]int{"grep -q x file": {-1}}, false},
+		{map[string][]int{"not a setup command": {1}}, false},
+	} {
+		if err := validateSetupExitCodes(tt.codes, commands); (err == nil) != tt.ok {
+			t.Errorf("validateSetupExitCodes(%v) = %v, want ok %v", tt.codes, err, tt.ok)
+		}
+	}
+}
+
+func TestSetupExitCodes(t *testing.T) {
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupLayering = SetupCombined
+	config.SetupCommands = []string{"true", "grep -q missing /etc/hostname"}
+	config.SetupExitCodes = map[string][]int{"grep -q missing /etc/hostname": {1}}
+	env := newEngineEnvironment(t, config)
+
+	// The allowed exit code is recorded, along with the commands rather than
+	// the script wrapping them.
+	results, err := env.SetupResults(env.History.LatestVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Command != "true && grep -q missing /etc/hostname" || results[0].ExitCode != 1 {
+		t.Errorf("setup results = %+v, want the commands with exit code 1", results)
+	}
+
+	config = env.Config.Copy()
+	config.SetupCommands = append(config.SetupCommands, "exit 2", "true")
+	env.Config = config
+	err = env.Rebuild(context.Background(), "unlisted exit code", false)
+	var setupErr *SetupError
+	if !errors.As(err, &setupErr) || setupErr.ExitCode != 2 || setupErr.Command != "exit 2" {
+		t.Fatalf("Rebuild() = %v, want a SetupError for exit 2", err)
+	}
+	if len(setupErr.Results) != 1 || setupErr.Results[0].Command != "exit 2" || setupErr.Results[0].ExitCode != 2 {
+		t.Errorf("results of the failed build = %+v, want the failing step with its exit code", setupErr.Results)
+	}
+}
+
+func TestSetupResultsRecordedOnRevision(t *testing.T) {
+	env := &Environment{Config: DefaultConfig()}
+	results := []SetupResult{
+		{Command: "apt-get update", Duration: Duration(2 * time.Second), Output: "done"},
+		{Command: "go mod download", Duration: Duration(time.Second), Cached: true},
+	}
+	env.mu.Lock()
+	env.setupResults = results
+	env.appendRevision(nil, "build", "", "", nil, "")
+	env.appendRevision(nil, "exec", "", "", nil, "")
+	env.mu.Unlock()
+
+	got, err := env.SetupResults(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, results) {
+		t.Errorf("SetupResults(1) = %+v, want %+v", got, results)
+	}
+	// Results belong to the build revision only.
+	if got, err := env.SetupResults(2); err != nil || len(got) != 0 {
+		t.Errorf("SetupResults(2) = %+v, %v, want none", got, err)
+	}
+	if _, err := env.SetupResults(3); err == nil {
+		t.Error("SetupResults() of an unknown version succeeded")
+	}
+
+	data, err := json.Marshal(env.History[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revision Revision
+	if err := json.Unmarshal(data, &revision); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(revision.SetupResults, results) {
+		t.Errorf("setup results after a JSON round trip = %+v, want %+v", revision.SetupResults, results)
+	}
+}
+
+func TestSetupResults(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupLayering = SetupPerCommand
+	config.SetupLogMode = SetupLogAlways
+	config.SetupCommands = []string{"echo one", "sleep 1; echo two", "echo three"}
+	env := newEngineEnvironment(t, config)
+
+	results, err := env.SetupResults(env.History.LatestVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(config.SetupCommands) {
+		t.Fatalf("setup results = %+v, want one per command", results)
+	}
+	for i, result := range results {
+		if result.Command != config.SetupCommands[i] || result.ExitCode != 0 {
+			t.Errorf("setup result %d = %+v, want %q to succeed", i, result, config.SetupCommands[i])
+		}
+	}
+	if strings.TrimSpace(results[1].Output) != "two" || time.Duration(results[1].Duration) < time.Second {
+		t.Errorf("setup result of %q = %+v, want its output and duration", results[1].Command, results[1])
+	}
+
+	if _, err := env.Run(ctx, "next", "true", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if results, _ := env.SetupResults(env.History.LatestVersion()); len(results) != 0 {
+		t.Errorf("setup results of a non-build revision = %+v", results)
+	}
+}
+
+func TestSetupLogModeValidate(t *testing.T) {
+	for _, mode := range []SetupLogMode{"", SetupLogOnFailure, SetupLogAlways, SetupLogNever} {
+		if err := mode.Validate(); err != nil {
+			t.Errorf("SetupLogMode(%q).Validate() = %v", mode, err)
+		}
+	}
+	if err := SetupLogMode("sometimes").Validate(); err == nil {
+		t.Error("Validate() accepted an unknown setup log mode")
+	}
+
+	config := DefaultConfig()
+	config.SetupLogMode = "sometimes"
+	if err := config.Validate(); err == nil {
+		t.Error("EnvironmentConfig.Validate() accepted an unknown setup log mode")
+	}
+}
+
+func TestTailOutput(t *testing.T) {
+	if got := tailOutput("short\n"); got != "short\n" {
+		t.Errorf("tailOutput() of a short output = %q", got)
+	}
+
+	// Lines short enough to survive truncateLines, ending with a multi-byte
+	// rune straddling the cut.
+	long := strings.Repeat(strings.Repeat("x", 99)+"\n", 100) + "é" + strings.Repeat("y", setupOutputBytes-1)
+	got := tailOutput(long)
+	if !strings.HasPrefix(got, "[") || !strings.HasSuffix(got, strings.Repeat("y", setupOutputBytes-1)) {
+		t.Errorf("tailOutput() = %q..., want the end of the output", got[:min(len(got), 40)])
+	}
+	if kept := got[strings.Index(got, "...")+3:]; len(kept) > setupOutputBytes || !utf8.ValidString(kept) {
+		t.Errorf("tailOutput() kept %d bytes, valid UTF-8 %v", len(kept), utf8.ValidString(kept))
+	}
+}
+
+func TestSetupLogMode(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		mode                   SetupLogMode
+		keepSuccess, keepError bool
+	}{
+		{"", false, true},
+		{SetupLogOnFailure, false, true},
+		{SetupLogAlways, true, true},
+		{SetupLogNever, false, false},
+	} {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			config := DefaultConfig()
+			config.BaseImage = alpineImage
+			config.SetupLogMode = tt.mode
+			config.SetupCommands = []string{"echo installed"}
+			env := newEngineEnvironment(t, config)
+
+			results, err := env.SetupResults(env.History.LatestVersion())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || (strings.TrimSpace(results[0].Output) == "installed") != tt.keepSuccess {
+				t.Errorf("setup results = %+v, want output kept %v", results, tt.keepSuccess)
+			}
+			if tt.mode == SetupLogAlways {
+				// Even when kept, output is capped.
+				config = env.Config.Copy()
+				config.SetupCommands = []string{"for i in $(seq 1000); do echo line $i; done"}
+				env.Config = config
+				if err := env.Rebuild(ctx, "verbose setup", false); err != nil {
+					t.Fatal(err)
+				}
+				results, _ := env.SetupResults(env.History.LatestVersion())
+				if len(results) != 1 || len(results[0].Output) > setupOutputBytes+64 || !strings.HasSuffix(results[0].Output, "line 1000\n") {
+					t.Errorf("verbose setup results = %+v, want the tail of the output", results)
+				}
+			}
+
+			config = env.Config.Copy()
+			config.SetupCommands = append(config.SetupCommands, "echo broken; exit 2")
+			env.Config = config
+			err = env.Rebuild(ctx, "failing setup", false)
+			var setupErr *SetupError
+			if !errors.As(err, &setupErr) {
+				t.Fatalf("Rebuild() = %v, want a SetupError", err)
+			}
+			if (strings.TrimSpace(setupErr.Stdout) == "broken") != tt.keepError {
+				t.Errorf("SetupError stdout = %q, want output kept %v", setupErr.Stdout, tt.keepError)
+			}
+		})
+	}
+}
+
+func TestEstimateBuildTime(t *testing.T) {
+	config := DefaultConfig()
+	config.SetupCommands = []string{"apt-get update", "go mod download", "make tools"}
+	env := &Environment{Config: config}
+	if got, want := env.EstimateBuildTime(), 3*defaultSetupEstimate; got != want {
+		t.Errorf("EstimateBuildTime() without history = %s, want %s", got, want)
+	}
+
+	env.mu.Lock()
+	env.setupResults = []SetupResult{
+		{Command: "apt-get update", Duration: Duration(time.Minute)},
+		{Command: "go mod download", Duration: Duration(20 * time.Second)},
+	}
+	env.appendRevision(nil, "build", "", "", nil, "")
+	// The latest run wins, and cached layers say nothing of the time to run
+	// them.
+	env.setupResults = []SetupResult{
+		{Command: "apt-get update", Duration: Duration(0), Cached: true},
+		{Command: "go mod download", Duration: Duration(40 * time.Second)},
+	}
+	env.appendRevision(nil, "rebuild", "", "", nil, "")
+	env.mu.Unlock()
+
+	if got, want := env.EstimateBuildTime(), time.Minute+40*time.Second+defaultSetupEstimate; got != want {
+		t.Errorf("EstimateBuildTime() = %s, want %s", got, want)
+	}
+
+	// Combining the commands makes a single, never run, layer.
+	env.Config.SetupLayering = SetupCombined
+	if got := env.EstimateBuildTime(); got != defaultSetupEstimate {
+		t.Errorf("EstimateBuildTime() of combined commands = %s, want %s", got, defaultSetupEstimate)
+	}
+}
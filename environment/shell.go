@@ -0,0 +1,86 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// shellCandidates are the shells probed, in order of preference, when the
+// config doesn't set Shell.
+var shellCandidates = [][]string{
+	{"/bin/bash"},
+	{"/bin/sh"},
+	{"/bin/ash"},
+	{"busybox", "sh"},
+}
+
+var ErrNoShell = errors.New("no shell found in the image: set shell in the config or use an image providing one of /bin/bash, /bin/sh, /bin/ash or busybox")
+
+var (
+	shellCacheMu sync.Mutex
+	// shellCache holds the probed shell of each base image reference.
+	shellCache = map[string][]string{}
+)
+
+// shellWorks runs a trivial script with shell in container. It is a variable
+// so it can be swapped out.
+var shellWorks = func(ctx context.Context, container *dagger.Container, shell []string) bool {
+	_, err := container.WithExec(append(shell, "-c", "true")).Sync(ctx)
+	return err == nil
+}
+
+// probeShell returns the first of shellCandidates working in container. When
+// image is set, the result is cached for that image.
+func probeShell(ctx context.Context, image string, container *dagger.Container) ([]string, error) {
+	if image != "" {
+		shellCacheMu.Lock()
+		shell, ok := shellCache[image]
+		shellCacheMu.Unlock()
+		if ok {
+			return shell, nil
+		}
+	}
+
+	for _, shell := range shellCandidates {
+		if !shellWorks(ctx, container, shell) {
+			continue
+		}
+		if image != "" {
+			shellCacheMu.Lock()
+			shellCache[image] = shell
+			shellCacheMu.Unlock()
+		}
+		return shell, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoShell
+}
+
+// resolveShell returns the shell of the environment: the one set in the config,
+// or else the one probed in container. It must not be called with env.mu
+// held, as probing runs execs.
+func (env *Environment) resolveShell(ctx context.Context, container *dagger.Container) ([]string, error) {
+	env.mu.Lock()
+	configured, shell, baseImage := env.Config.Shell, env.shell, env.Config.BaseImage
+	env.mu.Unlock()
+	if configured != "" {
+		return strings.Fields(configured), nil
+	}
+	if shell != nil {
+		return shell, nil
+	}
+	shell, err := probeShell(ctx, baseImage, container)
+	if err != nil {
+		return nil, err
+	}
+	env.mu.Lock()
+	env.shell = shell
+	env.mu.Unlock()
+	return shell, nil
+}
@@ -0,0 +1,78 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+// fakeShells makes shellWorks succeed only for the given shells and counts the
+// probes.
+func fakeShells(t *testing.T, available ...string) *int {
+	t.Helper()
+	probes := 0
+	orig := shellWorks
+	shellWorks = func(_ context.Context, _ *dagger.Container, shell []string) bool {
+		probes++
+		return slices.Contains(available, strings.Join(shell, " "))
+	}
+	t.Cleanup(func() { shellWorks = orig })
+	return &probes
+}
+
+func TestProbeShell(t *testing.T) {
+	ctx := context.Background()
+	probes := fakeShells(t, "busybox sh", "/bin/ash")
+
+	image := "test/busybox:" + t.Name()
+	for range 2 {
+		shell, err := probeShell(ctx, image, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(shell, []string{"/bin/ash"}) {
+			t.Errorf("probeShell() = %q, want the preferred available shell", shell)
+		}
+	}
+	if *probes != 3 {
+		t.Errorf("probed %d times, want /bin/bash, /bin/sh and /bin/ash once", *probes)
+	}
+}
+
+func TestProbeShellNoShell(t *testing.T) {
+	ctx := context.Background()
+	probes := fakeShells(t)
+
+	image := "test/distroless:" + t.Name()
+	if _, err := probeShell(ctx, image, nil); !errors.Is(err, ErrNoShell) {
+		t.Fatalf("probeShell() of a shell-less image = %v, want ErrNoShell", err)
+	}
+	if *probes != len(shellCandidates) {
+		t.Errorf("probed %d shells, want all %d", *probes, len(shellCandidates))
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := probeShell(canceled, image, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("probeShell() with a canceled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestResolveShellFromConfig(t *testing.T) {
+	probes := fakeShells(t)
+	config := DefaultConfig()
+	config.Shell = "/usr/bin/zsh -o pipefail"
+	env := &Environment{Config: config}
+
+	shell, err := env.resolveShell(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(shell, []string{"/usr/bin/zsh", "-o", "pipefail"}) || *probes != 0 {
+		t.Errorf("resolveShell() = %q after %d probes, want the configured shell unprobed", shell, *probes)
+	}
+}
@@ -0,0 +1,168 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownGrace = 30 * time.Second
+
+// ShutdownMode tells what shutdown does to the registered environments:
+// "close", the default, stops their services and unregisters them, while
+// "freeze" only stops them from accepting operations, leaving them registered
+// for whatever outlives the shutdown.
+type ShutdownMode string
+
+const (
+	ShutdownClose  ShutdownMode = "close"
+	ShutdownFreeze ShutdownMode = "freeze"
+)
+
+func (m ShutdownMode) Validate() error {
+	switch m {
+	case "", ShutdownClose, ShutdownFreeze:
+		return nil
+	default:
+		return fmt.Errorf("invalid shutdown mode %q, expected %s or %s", m, ShutdownClose, ShutdownFreeze)
+	}
+}
+
+// ShutdownPolicy controls what happens to the registered environments on
+// shutdown. The registry is saved to RegistryDir, if set, and the history of
+// every environment to the store, if one is set, before they are closed or
+// frozen according to Mode. Grace bounds the whole shutdown.
+type ShutdownPolicy struct {
+	RegistryDir string
+	Mode        ShutdownMode
+	Grace       time.Duration
+}
+
+var (
+	shutdownMu     sync.Mutex
+	shutdownPolicy = ShutdownPolicy{Grace: defaultShutdownGrace}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	shutdownHandlerOnce sync.Once
+	shutdownDone        = make(chan struct{})
+)
+
+func SetShutdownPolicy(policy ShutdownPolicy) error {
+	if err := policy.Mode.Validate(); err != nil {
+		return err
+	}
+	if policy.Grace <= 0 {
+		policy.Grace = defaultShutdownGrace
+	}
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownPolicy = policy
+	return nil
+}
+
+// InstallShutdownHandler shuts down the registered environments when the
+// process receives SIGTERM or SIGINT, or when ctx is done. The returned
+// function blocks until the shutdown has completed. Installing the handler
+// more than once has no effect.
+func InstallShutdownHandler(ctx context.Context) (wait func()) {
+	shutdownHandlerOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			defer close(shutdownDone)
+			select {
+			case sig := <-signals:
+				slog.Info("Shutting down", "signal", sig)
+			case <-ctx.Done():
+				slog.Info("Shutting down", "reason", ctx.Err())
+			}
+			signal.Stop(signals)
+			if err := Shutdown(context.WithoutCancel(ctx)); err != nil {
+				slog.Error("Shutdown failed", "error", err)
+			}
+		}()
+	})
+	return func() { <-shutdownDone }
+}
+
+// Shutdown applies the shutdown policy: it saves the registry and the history
+// of every registered environment, then closes or freezes them, giving up once the grace period has elapsed. Only
+// the first call does anything; later calls return its result.
+func Shutdown(ctx context.Context) error {
+	shutdownOnce.Do(func() {
+		shutdownMu.Lock()
+		policy := shutdownPolicy
+		shutdownMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(ctx, policy.Grace)
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() { done <- shutdown(ctx, policy) }()
+		select {
+		case shutdownErr = <-done:
+		case <-ctx.Done():
+			shutdownErr = fmt.Errorf("shutdown did not complete within %s: %w", policy.Grace, ctx.Err())
+		}
+	})
+	return shutdownErr
+}
+
+func shutdown(ctx context.Context, policy ShutdownPolicy) error {
+	var errs []error
+	if policy.RegistryDir != "" {
+		if err := SaveRegistry(policy.RegistryDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to save registry: %w", err))
+		}
+	}
+
+	environmentsMu.RLock()
+	envs := make([]*Environment, 0, len(environments))
+	for _, env := range environments {
+		envs = append(envs, env)
+	}
+	environmentsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, env := range envs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shutdownEnvironment(ctx, env, policy.Mode); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func shutdownEnvironment(ctx context.Context, env *Environment, mode ShutdownMode) error {
+	env.mu.Lock()
+	err := env.persistHistory()
+	env.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to persist the history of %s: %w", env.ID, err)
+	}
+	if mode == ShutdownFreeze {
+		if err := env.Freeze(ctx); err != nil {
+			return fmt.Errorf("failed to freeze %s: %w", env.ID, err)
+		}
+		return nil
+	}
+	if err := env.Close(ctx); err != nil {
+		return fmt.Errorf("failed to close %s: %w", env.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// resetShutdown lets a test shut down again, which the process only does once.
+func resetShutdown(t *testing.T) {
+	reset := func() {
+		shutdownOnce = sync.Once{}
+		shutdownErr = nil
+		shutdownHandlerOnce = sync.Once{}
+		shutdownDone = make(chan struct{})
+		SetShutdownPolicy(ShutdownPolicy{})
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func registerShutdownEnvironment(t *testing.T, id string) *Environment {
+	t.Helper()
+	env := &Environment{ID: id, Name: "shutdown", Config: DefaultConfig()}
+	env.mu.Lock()
+	env.appendRevision(nil, "create", "", "", nil, "")
+	env.mu.Unlock()
+	registerEnvironment(env)
+	t.Cleanup(func() { unregisterEnvironment(id) })
+	return env
+}
+
+func waitShutdown(t *testing.T, wait func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shutdown didn't complete")
+	}
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	resetShutdown(t)
+	dir := t.TempDir()
+	SetShutdownPolicy(ShutdownPolicy{RegistryDir: dir})
+	env := registerShutdownEnvironment(t, "shutdown/signal")
+
+	wait := InstallShutdownHandler(context.Background())
+	// Installing again doesn't register a second handler.
+	InstallShutdownHandler(context.Background())
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitShutdown(t, wait)
+
+	if _, err := os.Stat(filepath.Join(dir, url.PathEscape(env.ID)+".json")); err != nil {
+		t.Errorf("registry wasn't saved on shutdown: %v", err)
+	}
+	if env.State() != StateClosed || Get(env.ID) != nil {
+		t.Errorf("environment is %s after shutdown, want it closed and unregistered", env.State())
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown() = %v, want the result of the first", err)
+	}
+}
+
+func TestShutdownOnContext(t *testing.T) {
+	resetShutdown(t)
+	env := registerShutdownEnvironment(t, "shutdown/context")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := InstallShutdownHandler(ctx)
+	cancel()
+	waitShutdown(t, wait)
+	if env.State() != StateClosed {
+		t.Errorf("environment is %s after shutdown, want it closed", env.State())
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	resetShutdown(t)
+	SetShutdownPolicy(ShutdownPolicy{Grace: 50 * time.Millisecond})
+	env := registerShutdownEnvironment(t, "shutdown/stuck")
+
+	// Closing blocks for as long as the environment is busy.
+	env.mu.Lock()
+	err := Shutdown(context.Background())
+	env.mu.Unlock()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() of a stuck environment = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestShutdownFreezePersistsHistory(t *testing.T) {
+	resetShutdown(t)
+	store := NewMemoryStore()
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+	if err := SetShutdownPolicy(ShutdownPolicy{Mode: "pause"}); err == nil {
+		t.Error("SetShutdownPolicy() with an unknown mode succeeded")
+	}
+	if err := SetShutdownPolicy(ShutdownPolicy{Mode: ShutdownFreeze}); err != nil {
+		t.Fatal(err)
+	}
+	env := registerShutdownEnvironment(t, "shutdown/freeze")
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if env.State() != StateFrozen || Get(env.ID) == nil {
+		t.Errorf("environment is %s after shutdown, want it frozen and registered", env.State())
+	}
+	history, err := store.ReadHistory(env.ID)
+	if err != nil {
+		t.Fatalf("history wasn't persisted on shutdown: %v", err)
+	}
+	if len(history) != 1 || history[0].Name != "create" {
+		t.Errorf("persisted history = %+v, want the create revision", history)
+	}
+}
@@ -0,0 +1,66 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// RevisionSize estimates the bytes a revision adds over its parent.
+//
+// Dagger doesn't expose layer sizes, so this is the apparent size of the files
+// in the workdir that were added or modified by the revision, or of the whole
+// workdir for revisions without a parent. Changes outside the workdir, such as
+// installed packages, aren't counted, deleted files count as zero, and storage
+// savings from layer sharing and compression are ignored.
+func (env *Environment) RevisionSize(ctx context.Context, version Version) (int64, error) {
+	env.mu.Lock()
+	revision := env.revision(version)
+	if revision == nil || revision.container == nil {
+		env.mu.Unlock()
+		return 0, fmt.Errorf("version %d not found", version)
+	}
+	parent, workdir := env.revision(revision.Parent), env.Config.Workdir
+	env.mu.Unlock()
+
+	dir := revision.container.Directory(workdir)
+	if parent != nil && parent.container != nil {
+		dir = parent.container.Directory(workdir).Diff(dir)
+	}
+	return directorySize(ctx, dir)
+}
+
+// TotalSize estimates the storage used by the environment as the sum of the
+// sizes of all its revisions. See RevisionSize for the accuracy of the
+// estimate.
+func (env *Environment) TotalSize(ctx context.Context) (int64, error) {
+	env.mu.Lock()
+	history := slices.Clone(env.History)
+	env.mu.Unlock()
+
+	var total int64
+	for _, revision := range history {
+		size, err := env.RevisionSize(ctx, revision.Version)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func directorySize(ctx context.Context, dir *dagger.Directory) (int64, error) {
+	out, err := dag.Container().
+		From(alpineImage).
+		WithMountedDirectory("/size", dir).
+		WithExec([]string{"sh", "-c", `find /size -type f -exec stat -c %s {} + | awk '{ s += $1 } END { print s + 0 }'`}).
+		Stdout(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute size: %w", err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
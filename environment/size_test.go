@@ -0,0 +1,63 @@
+package environment
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestRevisionSizeMissingVersion(t *testing.T) {
+	env := &Environment{ID: "size/test", Config: DefaultConfig()}
+	if _, err := env.RevisionSize(context.Background(), 3); err == nil {
+		t.Error("RevisionSize() of a missing version succeeded")
+	}
+
+	// Revisions read back from storage have no container to measure.
+	env.mu.Lock()
+	env.appendRevision(nil, "imported", "", "", nil, "")
+	env.mu.Unlock()
+	if _, err := env.RevisionSize(context.Background(), 1); err == nil {
+		t.Error("RevisionSize() of a revision without a container succeeded")
+	}
+
+	// Sizes can be asked for while revisions are being committed.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			env.commitRevision(nil, "concurrent", "", "", nil, "")
+		}
+	}()
+	for version := range Version(100) {
+		env.RevisionSize(context.Background(), version+1)
+	}
+	wg.Wait()
+}
+
+func TestRevisionSize(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+
+	before, err := env.TotalSize(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Run(ctx, "write", "head -c 4096 /dev/zero > blob", "", false); err != nil {
+		t.Fatal(err)
+	}
+	size, err := env.RevisionSize(ctx, env.History.LatestVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4096 {
+		t.Errorf("RevisionSize() = %d, want the 4096 bytes written", size)
+	}
+	after, err := env.TotalSize(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after-before != 4096 {
+		t.Errorf("TotalSize() grew by %d, want 4096", after-before)
+	}
+}
@@ -0,0 +1,98 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DependsOn declares that the environment must only start once other is
+// ready. See StartInOrder.
+func (env *Environment) DependsOn(other *Environment) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if !slices.Contains(env.dependencies, other) {
+		env.dependencies = append(env.dependencies, other)
+	}
+}
+
+func (env *Environment) dependenciesSnapshot() []*Environment {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return slices.Clone(env.dependencies)
+}
+
+// StartInOrder waits for each environment to be ready, with WaitReady, after
+// the environments it depends on. Dependencies missing from envs are waited
+// for as well, but their own dependencies aren't. It fails without starting
+// anything if the dependencies form a cycle.
+func StartInOrder(ctx context.Context, envs ...*Environment) error {
+	order, err := startOrder(envs)
+	if err != nil {
+		return err
+	}
+	for _, env := range order {
+		for _, dep := range env.dependenciesSnapshot() {
+			if slices.Contains(envs, dep) {
+				continue
+			}
+			if err := dep.WaitReady(ctx); err != nil {
+				return fmt.Errorf("dependency %s of %s isn't ready: %w", dep.ID, env.ID, err)
+			}
+		}
+		if err := env.WaitReady(ctx); err != nil {
+			return fmt.Errorf("failed to start %s: %w", env.ID, err)
+		}
+	}
+	return nil
+}
+
+// startOrder sorts envs so that each one comes after its dependencies,
+// keeping the given order otherwise.
+func startOrder(envs []*Environment) ([]*Environment, error) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	marks := map[*Environment]int{}
+	order := make([]*Environment, 0, len(envs))
+	var path []*Environment
+
+	var visit func(env *Environment) error
+	visit = func(env *Environment) error {
+		switch marks[env] {
+		case done:
+			return nil
+		case visiting:
+			cycle := path[slices.Index(path, env):]
+			ids := make([]string, 0, len(cycle)+1)
+			for _, e := range cycle {
+				ids = append(ids, e.ID)
+			}
+			ids = append(ids, env.ID)
+			return fmt.Errorf("environment dependency cycle: %s", strings.Join(ids, " -> "))
+		}
+		marks[env] = visiting
+		path = append(path, env)
+		for _, dep := range env.dependenciesSnapshot() {
+			if !slices.Contains(envs, dep) {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[env] = done
+		order = append(order, env)
+		return nil
+	}
+
+	for _, env := range envs {
+		if err := visit(env); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,88 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startOrderEnvironment returns an environment recording "start <id>" when it
+// becomes ready.
+func startOrderEnvironment(id string) *Environment {
+	config := DefaultConfig()
+	config.OnStart = []string{"start " + id}
+	env := lifecycleEnvironment(config)
+	env.ID = id
+	return env
+}
+
+func TestStartInOrder(t *testing.T) {
+	ran := recordLifecycleCommands(t)
+	backend := startOrderEnvironment("backend")
+	api := startOrderEnvironment("api")
+	frontend := startOrderEnvironment("frontend")
+	frontend.DependsOn(api)
+	frontend.DependsOn(backend)
+	api.DependsOn(backend)
+	// Declaring a dependency twice is harmless.
+	api.DependsOn(backend)
+
+	if err := StartInOrder(context.Background(), frontend, api, backend); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"start backend", "start api", "start frontend"}; !slices.Equal(*ran, want) {
+		t.Errorf("started %q, want %q", *ran, want)
+	}
+}
+
+func TestStartInOrderWaitsForDependencies(t *testing.T) {
+	recordLifecycleCommands(t)
+	backend := startOrderEnvironment("backend")
+	api := startOrderEnvironment("api")
+	api.DependsOn(backend)
+	if err := backend.beginBuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dependency isn't in the list, but is waited for all the same.
+	done := make(chan error, 1)
+	go func() { done <- StartInOrder(context.Background(), api) }()
+	select {
+	case err := <-done:
+		t.Fatalf("StartInOrder() = %v before the dependency was built", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	backend.endBuild()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	backend.state = StateClosed
+	if err := StartInOrder(context.Background(), api); !errors.Is(err, ErrClosed) || !strings.Contains(err.Error(), "backend") {
+		t.Errorf("StartInOrder() with a closed dependency = %v, want ErrClosed naming it", err)
+	}
+}
+
+func TestStartInOrderCycle(t *testing.T) {
+	ran := recordLifecycleCommands(t)
+	a, b, c := startOrderEnvironment("a"), startOrderEnvironment("b"), startOrderEnvironment("c")
+	a.DependsOn(b)
+	b.DependsOn(c)
+	c.DependsOn(a)
+
+	err := StartInOrder(context.Background(), a, b, c)
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("StartInOrder() = %v, want the cycle named", err)
+	}
+	if len(*ran) != 0 {
+		t.Errorf("started %q despite the cycle", *ran)
+	}
+
+	// The cycle only matters among the environments started together.
+	if err := StartInOrder(context.Background(), a, b); err != nil {
+		t.Errorf("StartInOrder() without the environment closing the cycle = %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package environment
+
+import (
+	"context"
+	"errors"
+)
+
+type EnvironmentState string
+
+const (
+	StateReady    EnvironmentState = "ready"
+	StateBuilding EnvironmentState = "building"
+	StateFrozen   EnvironmentState = "frozen"
+	StateClosed   EnvironmentState = "closed"
+)
+
+var (
+	ErrBusy   = errors.New("environment is busy rebuilding, try again later")
+	ErrFrozen = errors.New("environment is frozen for maintenance")
+	ErrClosed = errors.New("environment is closed")
+	ErrMirror = errors.New("environment is a mirror, promote it before changing it")
+)
+
+// State returns the lifecycle state of the environment.
+func (env *Environment) State() EnvironmentState {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.stateLocked()
+}
+
+func (env *Environment) stateLocked() EnvironmentState {
+	if env.state == "" {
+		return StateReady
+	}
+	return env.state
+}
+
+// SetQueueDuringBuild controls what operations do while the environment is
+// being rebuilt: wait for the build to finish if queue is set, or fail with
+// ErrBusy otherwise, which is the default.
+func (env *Environment) SetQueueDuringBuild(queue bool) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.queueDuringBuild = queue
+}
+
+// Freeze puts the environment in maintenance: once the operation in flight,
+// if any, is over, operations and rebuilds fail with ErrFrozen until Thaw is
+// called. Reads keep working.
+func (env *Environment) Freeze(ctx context.Context) error {
+	_, done, err := env.beginOperation(ctx, "freeze")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	env.mu.Lock()
+	env.state = StateFrozen
+	env.mu.Unlock()
+	env.audit(ctx, "freeze", "")
+	return nil
+}
+
+// Thaw ends the maintenance started by Freeze.
+func (env *Environment) Thaw(ctx context.Context) {
+	env.mu.Lock()
+	frozen := env.state == StateFrozen
+	if frozen {
+		env.state = StateReady
+	}
+	env.mu.Unlock()
+	if frozen {
+		env.audit(ctx, "thaw", "")
+	}
+}
+
+// beginOperation must be called by operations that run commands or change the
+// container state. It fails if the environment is closed or frozen, and if it
+// is being rebuilt, either waits or fails with ErrBusy. Otherwise the
+// operation is tracked, and holds the operation lock of the environment, until
+// the returned function is called.
+//
+// The operation lock serializes the operations changing the environment:
+// runs, file changes, env and config updates and rebuilds. Reads don't take
+// it. It isn't reentrant, so an operation never calls another exported one:
+// both use an internal variant expecting the lock to be held instead.
+func (env *Environment) beginOperation(ctx context.Context, kind string) (context.Context, func(), error) {
+	if err := env.waitReady(ctx); err != nil {
+		return nil, nil, err
+	}
+	env.opMu.Lock()
+	// The environment may have been closed or rebuilt while waiting.
+	if err := env.waitReady(ctx); err != nil {
+		env.opMu.Unlock()
+		return nil, nil, err
+	}
+	ctx, done := env.trackOperation(ctx, kind)
+	return ctx, func() {
+		done()
+		env.opMu.Unlock()
+	}, nil
+}
+
+// WithLock runs fn while holding the operation lock of the environment, so
+// that compound operations, e.g. reading the state and changing it based on
+// what was read, aren't interleaved with other operations. fn changes the
+// environment through locked, whose methods run under the lock already held;
+// the methods of the environment itself would wait for fn to return. The
+// context given to fn is ctx, tracked as the operation in flight.
+func (env *Environment) WithLock(ctx context.Context, fn func(ctx context.Context, locked *LockedEnvironment) error) error {
+	ctx, done, err := env.beginOperation(ctx, "with_lock")
+	if err != nil {
+		return err
+	}
+	defer done()
+	return fn(ctx, &LockedEnvironment{env: env})
+}
+
+// LockedEnvironment changes an environment whose operation lock is held by
+// WithLock. It must not be used once the callback it was given to returned.
+type LockedEnvironment struct {
+	env *Environment
+}
+
+// Environment returns the environment, e.g. to read its state.
+func (l *LockedEnvironment) Environment() *Environment {
+	return l.env
+}
+
+func (l *LockedEnvironment) Exec(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (*ExecResult, error) {
+	return l.env.exec(ctx, explanation, command, shell, useEntrypoint)
+}
+
+func (l *LockedEnvironment) SetEnv(ctx context.Context, explanation string, envs []string) error {
+	return l.env.setEnv(ctx, explanation, envs)
+}
+
+func (l *LockedEnvironment) FileWrite(ctx context.Context, explanation, targetFile, contents string) error {
+	return l.env.fileWrite(ctx, explanation, targetFile, contents)
+}
+
+func (l *LockedEnvironment) FileDelete(ctx context.Context, explanation, targetFile string) error {
+	return l.env.fileDelete(ctx, explanation, targetFile)
+}
+
+func (l *LockedEnvironment) AddService(ctx context.Context, explanation string, cfg *ServiceConfig) (*Service, error) {
+	return l.env.addService(ctx, explanation, cfg)
+}
+
+func (l *LockedEnvironment) Rebuild(ctx context.Context, explanation string, resume bool) error {
+	return l.env.rebuildLocked(ctx, "rebuild", "Rebuild environment", explanation, l.env.Config, resume)
+}
+
+func (env *Environment) waitReady(ctx context.Context) error {
+	env.mu.Lock()
+	queue := env.queueDuringBuild
+	env.mu.Unlock()
+	return env.waitBuild(ctx, queue)
+}
+
+// waitBuild returns once the environment can be worked in. A build in progress
+// is waited for if queue is set, and fails with ErrBusy otherwise.
+func (env *Environment) waitBuild(ctx context.Context, queue bool) error {
+	for {
+		env.mu.Lock()
+		state, done := env.stateLocked(), env.buildDone
+		mirror := env.primary != nil
+		env.mu.Unlock()
+
+		switch {
+		case state == StateClosed:
+			return ErrClosed
+		case state == StateFrozen:
+			return ErrFrozen
+		case mirror:
+			return ErrMirror
+		case state == StateBuilding && !queue:
+			return ErrBusy
+		case state == StateBuilding:
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// beginBuild moves the environment to the building state. endBuild must be
+// called once the build is over.
+func (env *Environment) beginBuild() error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	switch env.stateLocked() {
+	case StateClosed:
+		return ErrClosed
+	case StateFrozen:
+		return ErrFrozen
+	case StateBuilding:
+		return ErrBusy
+	}
+	env.state = StateBuilding
+	env.buildDone = make(chan struct{})
+	return nil
+}
+
+func (env *Environment) endBuild() {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	if env.state == StateBuilding {
+		env.state = StateReady
+	}
+	close(env.buildDone)
+}
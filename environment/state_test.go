@@ -0,0 +1,284 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExecDuringBuildIsBusy(t *testing.T) {
+	env := &Environment{Config: DefaultConfig()}
+	if err := env.beginBuild(); err != nil {
+		t.Fatal(err)
+	}
+	if got := env.Status().State; got != StateBuilding {
+		t.Errorf("Status().State = %s, want %s", got, StateBuilding)
+	}
+
+	if _, err := env.Exec(context.Background(), "during build", "true", "sh", false); !errors.Is(err, ErrBusy) {
+		t.Errorf("Exec() during a build = %v, want ErrBusy", err)
+	}
+	if err := env.beginBuild(); !errors.Is(err, ErrBusy) {
+		t.Errorf("second beginBuild() = %v, want ErrBusy", err)
+	}
+
+	env.endBuild()
+	if got := env.Status().State; got != StateReady {
+		t.Errorf("Status().State after the build = %s, want %s", got, StateReady)
+	}
+}
+
+func TestQueueDuringBuild(t *testing.T) {
+	env := &Environment{}
+	env.SetQueueDuringBuild(true)
+	if err := env.beginBuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		_, done, err := env.beginOperation(context.Background(), "queued")
+		if err == nil {
+			done()
+		}
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		t.Fatalf("operation started during the build: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	env.endBuild()
+	if err := <-started; err != nil {
+		t.Errorf("queued operation = %v, want it run after the build", err)
+	}
+
+	// Queued operations still give up with their context.
+	if err := env.beginBuild(); err != nil {
+		t.Fatal(err)
+	}
+	defer env.endBuild()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := env.beginOperation(ctx, "queued"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("queued operation past its deadline = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestOperationsAreSerialized(t *testing.T) {
+	env := &Environment{}
+	_, done, err := env.beginOperation(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := make(chan struct{})
+	go func() {
+		_, done, err := env.beginOperation(context.Background(), "second")
+		if err == nil {
+			done()
+		}
+		close(second)
+	}()
+	select {
+	case <-second:
+		t.Fatal("second operation ran alongside the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	<-second
+}
+
+func TestFreeze(t *testing.T) {
+	env := &Environment{Config: DefaultConfig()}
+	_, done, err := env.beginOperation(context.Background(), "in flight")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frozen := make(chan error, 1)
+	go func() { frozen <- env.Freeze(context.Background()) }()
+	select {
+	case <-frozen:
+		t.Fatal("Freeze() returned while an operation was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	if err := <-frozen; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := env.Status().State; got != StateFrozen {
+		t.Errorf("Status().State = %s, want %s", got, StateFrozen)
+	}
+	if _, _, err := env.beginOperation(context.Background(), "run"); !errors.Is(err, ErrFrozen) {
+		t.Errorf("operation while frozen = %v, want ErrFrozen", err)
+	}
+	if err := env.beginBuild(); !errors.Is(err, ErrFrozen) {
+		t.Errorf("build while frozen = %v, want ErrFrozen", err)
+	}
+
+	env.Thaw(context.Background())
+	if _, done, err := env.beginOperation(context.Background(), "run"); err != nil {
+		t.Errorf("operation after Thaw() = %v", err)
+	} else {
+		done()
+	}
+}
+
+func TestWithLockSerializesCompoundOperations(t *testing.T) {
+	env := &Environment{ID: "with-lock/test", Config: DefaultConfig()}
+	const workers, steps = 8, 20
+
+	var inside atomic.Int32
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range steps {
+				err := env.WithLock(context.Background(), func(context.Context, *LockedEnvironment) error {
+					if n := inside.Add(1); n != 1 {
+						t.Errorf("%d callers inside WithLock", n)
+					}
+					defer inside.Add(-1)
+					// A compound operation: read the latest version, then
+					// record the next one on top of it.
+					env.mu.Lock()
+					latest := env.History.LatestVersion()
+					env.mu.Unlock()
+					time.Sleep(time.Microsecond)
+					env.mu.Lock()
+					revision := env.appendRevision(nil, fmt.Sprintf("worker %d step %d", w, s), "", "", nil, "")
+					env.mu.Unlock()
+					if revision.Version != latest+1 || revision.Parent != latest {
+						return fmt.Errorf("revision %d on top of %d, read %d", revision.Version, revision.Parent, latest)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	// Reads don't take the operation lock.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			_ = env.Status()
+			_ = env.HistoryStats()
+		}
+	}()
+	wg.Wait()
+
+	if got := env.History.LatestVersion(); got != workers*steps {
+		t.Errorf("latest version = %d, want %d", got, workers*steps)
+	}
+	for i, revision := range env.History {
+		if revision.Version != Version(i+1) || revision.Parent != Version(i) {
+			t.Fatalf("revision %d = version %d on top of %d, want a linear history", i, revision.Version, revision.Parent)
+		}
+	}
+
+	wantErr := errors.New("compound operation failed")
+	if err := env.WithLock(context.Background(), func(context.Context, *LockedEnvironment) error { return wantErr }); err != wantErr {
+		t.Errorf("WithLock() = %v, want the error of fn", err)
+	}
+	// The handle changes the environment under the lock already held rather
+	// than waiting for it.
+	err := env.WithLock(context.Background(), func(ctx context.Context, locked *LockedEnvironment) error {
+		return locked.SetEnv(ctx, "invalid", []string{"NO_VALUE"})
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid environment variable") {
+		t.Errorf("SetEnv() through WithLock() = %v, want the validation error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	env.state = StateBuilding
+	env.queueDuringBuild = true
+	env.buildDone = make(chan struct{})
+	if err := env.WithLock(ctx, func(context.Context, *LockedEnvironment) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("WithLock() waiting for a build with a canceled context = %v", err)
+	}
+
+	env.state = StateClosed
+	if err := env.WithLock(context.Background(), func(context.Context, *LockedEnvironment) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Errorf("WithLock() of a closed environment = %v, want ErrClosed", err)
+	}
+}
+
+func TestWithLockCompoundOperation(t *testing.T) {
+	env := newEngineEnvironment(t, nil)
+	err := env.WithLock(context.Background(), func(ctx context.Context, locked *LockedEnvironment) error {
+		if err := locked.SetEnv(ctx, "set", []string{"STEP=1"}); err != nil {
+			return err
+		}
+		result, err := locked.Exec(ctx, "record", `echo "$STEP" > step`, "sh", false)
+		if err != nil {
+			return err
+		}
+		if result.ExitCode != 0 {
+			return fmt.Errorf("exec failed: %+v", result)
+		}
+		return locked.FileWrite(ctx, "write", "/workdir/done", "yes")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := env.FileRead(context.Background(), "step", true, 0, 0); err != nil || out != "1\n" {
+		t.Errorf("step = %q, %v", out, err)
+	}
+}
+
+func TestConcurrentMutations(t *testing.T) {
+	ctx := context.Background()
+	env := newEngineEnvironment(t, nil)
+	before := env.History.LatestVersion()
+	const n = 4
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := env.SetEnv(ctx, "set", []string{fmt.Sprintf("VAR_%d=%d", i, i)}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := env.Run(ctx, "write", fmt.Sprintf("echo %d > file-%d", i, i), "", false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := env.History.LatestVersion(); got != before+2*n {
+		t.Errorf("latest version = %d, want %d", got, before+2*n)
+	}
+	for i, revision := range env.History[1:] {
+		if revision.Parent != env.History[i].Version {
+			t.Errorf("revision %d is on top of %d, want a linear history", revision.Version, revision.Parent)
+		}
+	}
+	// Every mutation landed on top of the others.
+	out, err := env.Run(ctx, "check", "cat file-*; env | grep -c '^VAR_'", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(out); len(got) != n+1 || got[n] != strconv.Itoa(n) {
+		t.Errorf("files and variables = %q, want all %d of each", out, n)
+	}
+}
@@ -0,0 +1,94 @@
+package environment
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// statusSchemaVersion is bumped whenever the JSON shape of Status changes in
+// a way consumers need to know about.
+const statusSchemaVersion = 1
+
+type ServiceState string
+
+const (
+	ServiceRunning ServiceState = "running"
+	ServiceFailed  ServiceState = "failed"
+	ServiceSkipped ServiceState = "skipped"
+)
+
+type ServiceStatus struct {
+	Name     string       `json:"name"`
+	State    ServiceState `json:"state"`
+	Optional bool         `json:"optional,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type Status struct {
+	ID       string           `json:"id"`
+	State    EnvironmentState `json:"state"`
+	Version  Version          `json:"version"`
+	Services []ServiceStatus  `json:"services,omitempty"`
+}
+
+// MarshalJSON encodes the status with a schema version. Services are listed
+// in config order, so the output is stable for a given environment.
+func (s *Status) MarshalJSON() ([]byte, error) {
+	type status Status
+	return json.Marshal(struct {
+		Schema int `json:"schema"`
+		*status
+	}{statusSchemaVersion, (*status)(s)})
+}
+
+func (s *Status) String() string {
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "%s (%s) at version %d", s.ID, s.State, s.Version)
+	for _, svc := range s.Services {
+		fmt.Fprintf(out, "\n  %s: %s", svc.Name, svc.State)
+		if svc.Optional {
+			out.WriteString(" (optional)")
+		}
+		if svc.Error != "" {
+			fmt.Fprintf(out, ": %s", svc.Error)
+		}
+	}
+	return out.String()
+}
+
+// Status reports the current state of the environment and its services, in
+// config order.
+func (env *Environment) Status() *Status {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.statusLocked()
+}
+
+func (env *Environment) statusLocked() *Status {
+	status := &Status{
+		ID:      env.ID,
+		State:   env.stateLocked(),
+		Version: env.History.LatestVersion(),
+	}
+	services, err := env.Config.Services.Expand()
+	if err != nil {
+		services = env.Config.Services
+	}
+	for _, cfg := range services.Active(env.profiles...) {
+		svcStatus := ServiceStatus{
+			Name:     cfg.Name,
+			State:    ServiceRunning,
+			Optional: cfg.Optional,
+		}
+		if failure := env.serviceFailures[cfg.Name]; failure != nil {
+			svcStatus.State = ServiceFailed
+			if failure.Skipped {
+				svcStatus.State = ServiceSkipped
+			}
+			svcStatus.Error = failure.Err.Error()
+		}
+		status.Services = append(status.Services, svcStatus)
+	}
+	return status
+}
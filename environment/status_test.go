@@ -0,0 +1,35 @@
+package environment
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStatusJSON(t *testing.T) {
+	config := DefaultConfig()
+	config.Services = ServiceConfigs{
+		{Name: "web", Image: "nginx"},
+		{Name: "db", Image: "postgres", Optional: true},
+		{Name: "cache", Image: "redis"},
+	}
+	env := &Environment{ID: "status/test", Config: config}
+
+	want := `{"schema":1,"id":"status/test","state":"ready","version":0,"services":[` +
+		`{"name":"web","state":"running"},` +
+		`{"name":"db","state":"running","optional":true},` +
+		`{"name":"cache","state":"running"}]}`
+	for range 20 {
+		data, err := json.Marshal(env.Status())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("json.Marshal(Status()) =\n%s\nwant\n%s", data, want)
+		}
+	}
+
+	wantString := "status/test (ready) at version 0\n  web: running\n  db: running (optional)\n  cache: running"
+	if got := env.Status().String(); got != wantString {
+		t.Errorf("String() = %q, want %q", got, wantString)
+	}
+}
@@ -0,0 +1,275 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store persists the config, history and lock state of environments, keyed by
+// environment ID, so that several servers can share them. Reads of missing
+// configs and histories return errors wrapping os.ErrNotExist; ReadLock
+// returns nil for unlocked environments and WriteLock(id, nil) unlocks.
+//
+// Without a store, which is the default, state lives in the worktree and git
+// notes of the source repository only. With one, every change propagated to
+// the worktree is also written to the store, and Open, Locked and LockInfo
+// read from it: Open restores the config, instructions and history it holds,
+// then rebuilds on top of them.
+type Store interface {
+	ReadConfig(id string) (*EnvironmentConfig, error)
+	WriteConfig(id string, config *EnvironmentConfig) error
+	ReadHistory(id string) (History, error)
+	WriteHistory(id string, history History) error
+	ReadLock(id string) (*LockMetadata, error)
+	WriteLock(id string, lock *LockMetadata) error
+}
+
+var (
+	storeMu sync.RWMutex
+	store   Store
+)
+
+// SetStore routes persistence through s. A nil store restores the default.
+func SetStore(s Store) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
+}
+
+func currentStore() Store {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return store
+}
+
+// saveConfig writes the config and instructions of the environment to the
+// worktree, where they are committed, and to the store, if one is set.
+func (env *Environment) saveConfig(worktreePath string) error {
+	if err := env.Config.Save(worktreePath); err != nil {
+		return err
+	}
+	if s := currentStore(); s != nil && !env.Ephemeral {
+		if err := s.WriteConfig(env.ID, env.Config); err != nil {
+			return fmt.Errorf("failed to store config: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the config and instructions of the environment from the
+// store, or from the worktree when there is no store or it doesn't have them.
+func (env *Environment) loadConfig(worktreePath string) (*EnvironmentConfig, error) {
+	if s := currentStore(); s != nil {
+		config, err := s.ReadConfig(env.ID)
+		if !errors.Is(err, os.ErrNotExist) {
+			return config, err
+		}
+	}
+	config := DefaultConfig()
+	if err := config.Load(worktreePath); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// persistHistory writes the history of the environment to the store, if one
+// is set.
+func (env *Environment) persistHistory() error {
+	s := currentStore()
+	if s == nil || env.Ephemeral {
+		return nil
+	}
+	if err := s.WriteHistory(env.ID, env.History); err != nil {
+		return fmt.Errorf("failed to store history: %w", err)
+	}
+	return nil
+}
+
+// loadHistory reads the history of the environment from the store. It
+// returns nil when there is no store or it doesn't have one.
+func (env *Environment) loadHistory() (History, error) {
+	s := currentStore()
+	if s == nil {
+		return nil, nil
+	}
+	history, err := s.ReadHistory(env.ID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := history.validate(); err != nil {
+		return nil, fmt.Errorf("invalid stored history: %w", err)
+	}
+	return history, nil
+}
+
+const historyFile = "history.json"
+
+// FileStore stores each environment in its own directory under Root, using
+// the same layout as a source directory: the config and instructions under
+// .container-use, next to the history and lock files.
+type FileStore struct {
+	Root string
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{Root: root}
+}
+
+func (s *FileStore) dir(id string) string {
+	return filepath.Join(s.Root, url.PathEscape(id))
+}
+
+func (s *FileStore) ReadConfig(id string) (*EnvironmentConfig, error) {
+	config := &EnvironmentConfig{}
+	if err := config.Load(s.dir(id)); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (s *FileStore) WriteConfig(id string, config *EnvironmentConfig) error {
+	return config.Save(s.dir(id))
+}
+
+func (s *FileStore) ReadHistory(id string) (History, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir(id), configDir, historyFile))
+	if err != nil {
+		return nil, err
+	}
+	var history History
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *FileStore) WriteHistory(id string, history History) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(filepath.Join(s.dir(id), configDir, historyFile), data)
+}
+
+func (s *FileStore) ReadLock(id string) (*LockMetadata, error) {
+	return (&EnvironmentConfig{}).LockInfo(s.dir(id))
+}
+
+func (s *FileStore) WriteLock(id string, lock *LockMetadata) error {
+	p := filepath.Join(s.dir(id), configDir, lockFile)
+	if lock == nil {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(p, data)
+}
+
+func writeStoreFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// MemoryStore keeps everything in memory. It's meant for tests and for
+// embedding container-use where persistence isn't wanted.
+type MemoryStore struct {
+	mu        sync.Mutex
+	configs   map[string]*EnvironmentConfig
+	histories map[string]History
+	locks     map[string]*LockMetadata
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		configs:   map[string]*EnvironmentConfig{},
+		histories: map[string]History{},
+		locks:     map[string]*LockMetadata{},
+	}
+}
+
+func (s *MemoryStore) ReadConfig(id string) (*EnvironmentConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, ok := s.configs[id]
+	if !ok {
+		return nil, fmt.Errorf("config of %s: %w", id, os.ErrNotExist)
+	}
+	return config.Copy(), nil
+}
+
+func (s *MemoryStore) WriteConfig(id string, config *EnvironmentConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configs[id] = config.Copy()
+	return nil
+}
+
+func (s *MemoryStore) ReadHistory(id string) (History, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.histories[id]
+	if !ok {
+		return nil, fmt.Errorf("history of %s: %w", id, os.ErrNotExist)
+	}
+	return copyHistory(history), nil
+}
+
+func (s *MemoryStore) WriteHistory(id string, history History) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.histories[id] = copyHistory(history)
+	return nil
+}
+
+func (s *MemoryStore) ReadLock(id string) (*LockMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.locks[id]
+	if !ok {
+		return nil, nil
+	}
+	lockCopy := *lock
+	return &lockCopy, nil
+}
+
+func (s *MemoryStore) WriteLock(id string, lock *LockMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lock == nil {
+		delete(s.locks, id)
+		return nil
+	}
+	lockCopy := *lock
+	s.locks[id] = &lockCopy
+	return nil
+}
+
+// copyHistory copies the revisions of history, keeping only what is
+// persisted: containers are reloaded from their state.
+func copyHistory(history History) History {
+	historyCopy := make(History, len(history))
+	for i, revision := range history {
+		revisionCopy := copyRevision(revision)
+		revisionCopy.container = nil
+		historyCopy[i] = revisionCopy
+	}
+	return historyCopy
+}
@@ -0,0 +1,162 @@
+package environment
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func storeTestConfig() *EnvironmentConfig {
+	config := DefaultConfig()
+	config.BaseImage = "golang:1.24"
+	config.Instructions = "Run make test."
+	config.Env = []string{"GOFLAGS=-mod=mod"}
+	config.Secrets = []string{"GITHUB_TOKEN=env://GITHUB_TOKEN"}
+	config.SetupCommands = []string{"go mod download"}
+	config.Services = ServiceConfigs{{Name: "db", Image: "postgres:16", ExposedPorts: []int{5432}}}
+	return config
+}
+
+func storeTestHistory() History {
+	created := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	return History{
+		{Version: 1, Name: "create", CreatedAt: created, State: "state-1",
+			SetupResults: []SetupResult{{Command: "go mod download", Duration: Duration(time.Second)}}},
+		{Version: 2, Parent: 1, Name: "test", Explanation: "run the tests", Output: "ok", CreatedAt: created.Add(time.Minute), State: "state-2",
+			Annotations: map[string]string{"ticket": "42"}},
+	}
+}
+
+// storeBehavior records what a store returns for a fixed sequence of
+// operations, so that stores can be compared.
+type storeBehavior struct {
+	MissingConfig, MissingHistory bool
+	MissingLock                   *LockMetadata
+	Config, MutatedConfig         *EnvironmentConfig
+	History, MutatedHistory       History
+	Lock, Unlocked                *LockMetadata
+	OtherConfig                   bool
+}
+
+func exerciseStore(t *testing.T, s Store) storeBehavior {
+	t.Helper()
+	var b storeBehavior
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := s.ReadConfig("env/a")
+	b.MissingConfig = errors.Is(err, os.ErrNotExist)
+	_, err = s.ReadHistory("env/a")
+	b.MissingHistory = errors.Is(err, os.ErrNotExist)
+	b.MissingLock, err = s.ReadLock("env/a")
+	must(err)
+
+	written := storeTestConfig()
+	must(s.WriteConfig("env/a", written))
+	// Changing what was written, even in place, doesn't change what is
+	// stored.
+	written.Env[0] = "LEAKED=1"
+	written.Services[0].ExposedPorts[0] = 1
+	b.Config, err = s.ReadConfig("env/a")
+	must(err)
+	// Nor does changing what was read.
+	read, err := s.ReadConfig("env/a")
+	must(err)
+	read.Env[0] = "LEAKED=2"
+	read.Secrets = append(read.Secrets, "LEAKED=env://LEAKED")
+	read.Services[0].Env = append(read.Services[0].Env, "LEAKED=3")
+	read.Services[0].ExposedPorts[0] = 2
+	b.MutatedConfig, err = s.ReadConfig("env/a")
+	must(err)
+	_, err = s.ReadConfig("env/b")
+	b.OtherConfig = err == nil
+
+	must(s.WriteHistory("env/a", storeTestHistory()))
+	b.History, err = s.ReadHistory("env/a")
+	must(err)
+	readHistory, err := s.ReadHistory("env/a")
+	must(err)
+	readHistory[1].Annotations["ticket"] = "leaked"
+	readHistory[0].SetupResults[0].Command = "leaked"
+	b.MutatedHistory, err = s.ReadHistory("env/a")
+	must(err)
+
+	must(s.WriteLock("env/a", &LockMetadata{Owner: "ci", Reason: "release", CreatedAt: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)}))
+	b.Lock, err = s.ReadLock("env/a")
+	must(err)
+	must(s.WriteLock("env/a", nil))
+	b.Unlocked, err = s.ReadLock("env/a")
+	must(err)
+	must(s.WriteLock("env/a", nil))
+	return b
+}
+
+func TestStoresBehaveIdentically(t *testing.T) {
+	file := exerciseStore(t, NewFileStore(t.TempDir()))
+	memory := exerciseStore(t, NewMemoryStore())
+	if !reflect.DeepEqual(file, memory) {
+		t.Errorf("file store:\n%+v\nmemory store:\n%+v", file, memory)
+	}
+
+	want := storeBehavior{
+		MissingConfig:  true,
+		MissingHistory: true,
+		Config:         storeTestConfig(),
+		MutatedConfig:  storeTestConfig(),
+		History:        storeTestHistory(),
+		MutatedHistory: storeTestHistory(),
+		Lock:           &LockMetadata{Owner: "ci", Reason: "release", CreatedAt: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(memory, want) {
+		t.Errorf("memory store:\n%+v\nwant:\n%+v", memory, want)
+	}
+}
+
+func TestEnvironmentPersistsThroughStore(t *testing.T) {
+	for name, s := range map[string]Store{"file": NewFileStore(t.TempDir()), "memory": NewMemoryStore()} {
+		t.Run(name, func(t *testing.T) {
+			SetStore(s)
+			t.Cleanup(func() { SetStore(nil) })
+			worktree := t.TempDir()
+
+			env := &Environment{ID: "env/" + name, Config: storeTestConfig(), History: storeTestHistory()}
+			// Without anything stored, the config comes from the worktree.
+			writeFiles(t, worktree, map[string]string{configDir + "/" + environmentFile: `{"base_image": "debian:12"}`})
+			if config, err := env.loadConfig(worktree); err != nil || config.BaseImage != "debian:12" {
+				t.Errorf("loadConfig() without a stored config = %+v, %v, want the worktree one", config, err)
+			}
+			if history, err := env.loadHistory(); history != nil || err != nil {
+				t.Errorf("loadHistory() without a stored history = %v, %v", history, err)
+			}
+
+			if err := env.saveConfig(worktree); err != nil {
+				t.Fatal(err)
+			}
+			if err := env.persistHistory(); err != nil {
+				t.Fatal(err)
+			}
+			config, err := env.loadConfig(t.TempDir())
+			if err != nil || !reflect.DeepEqual(config, env.Config) {
+				t.Errorf("loadConfig() = %+v, %v, want the stored config", config, err)
+			}
+			history, err := env.loadHistory()
+			if err != nil || !reflect.DeepEqual(history, env.History) {
+				t.Errorf("loadHistory() = %v, %v, want the stored history", history, err)
+			}
+
+			// Stored histories are validated like imported ones.
+			if err := s.WriteHistory(env.ID, History{{Version: 2, Parent: 5}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := env.loadHistory(); err == nil {
+				t.Error("loadHistory() accepted a dangling parent")
+			}
+		})
+	}
+}
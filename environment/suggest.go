@@ -0,0 +1,130 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// makeTargetPattern matches the explicit targets of a Makefile, skipping
+// special targets like .PHONY and pattern rules.
+var makeTargetPattern = regexp.MustCompile(`(?m)^([A-Za-z0-9][A-Za-z0-9_-]*)\s*:([^=]|$)`)
+
+// projectMarkers map files found at the root of the workdir to the commands
+// usually building and testing such projects.
+var projectMarkers = []struct {
+	file     string
+	kind     string
+	commands []string
+}{
+	{"go.mod", "Go module", []string{"go build ./...", "go test ./..."}},
+	{"Cargo.toml", "Rust crate", []string{"cargo build", "cargo test"}},
+	{"pyproject.toml", "Python project", []string{"pip install -e .", "pytest"}},
+	{"requirements.txt", "Python project", []string{"pip install -r requirements.txt", "pytest"}},
+}
+
+// SuggestInstructions drafts instructions for env, which runs this config,
+// from what it finds in the workdir (Makefile targets, package.json scripts,
+// common project files) and from the runtime and services of the config. The
+// draft only depends on those, so the same environment always gets the same
+// draft.
+func (c *EnvironmentConfig) SuggestInstructions(ctx context.Context, env *Environment) (string, error) {
+	workdir := env.container.Directory(c.Workdir)
+	entries, err := workdir.Entries(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %w", c.Workdir, err)
+	}
+	return c.draftInstructions(entries, func(name string) (string, bool) {
+		contents, err := workdir.File(name).Contents(ctx)
+		return contents, err == nil
+	}, env.Profiles()), nil
+}
+
+// draftInstructions drafts the instructions for a workdir holding entries,
+// reading the files it inspects with readFile.
+func (c *EnvironmentConfig) draftInstructions(entries []string, readFile func(name string) (string, bool), profiles []string) string {
+	entries = slices.Sorted(slices.Values(entries))
+	read := func(name string) (string, bool) {
+		if !slices.Contains(entries, name) {
+			return "", false
+		}
+		return readFile(name)
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "The project is in %s.", c.Workdir)
+	if c.Runtime != nil {
+		fmt.Fprintf(out, " Its main runtime is %s", c.Runtime.Name)
+		if c.Runtime.Version != "" {
+			fmt.Fprintf(out, " %s", c.Runtime.Version)
+		}
+		out.WriteString(".")
+	}
+	out.WriteString("\n")
+
+	var commands []string
+	if makefile, ok := read("Makefile"); ok {
+		targets := []string{}
+		for _, match := range makeTargetPattern.FindAllStringSubmatch(makefile, -1) {
+			if !slices.Contains(targets, match[1]) {
+				targets = append(targets, match[1])
+			}
+		}
+		for _, target := range targets {
+			commands = append(commands, "make "+target)
+		}
+		if len(targets) == 0 {
+			commands = append(commands, "make")
+		}
+	}
+	if packageJSON, ok := read("package.json"); ok {
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		if err := json.Unmarshal([]byte(packageJSON), &pkg); err == nil {
+			commands = append(commands, "npm install")
+			for _, script := range slices.Sorted(maps.Keys(pkg.Scripts)) {
+				commands = append(commands, "npm run "+script)
+			}
+		}
+	}
+	for _, marker := range projectMarkers {
+		if slices.Contains(entries, marker.file) {
+			fmt.Fprintf(out, "\nThis is a %s (%s).\n", marker.kind, marker.file)
+			commands = append(commands, marker.commands...)
+		}
+	}
+
+	if len(commands) > 0 {
+		out.WriteString("\nUseful commands:\n")
+		for _, command := range commands {
+			fmt.Fprintf(out, "- `%s`\n", command)
+		}
+	}
+
+	services := c.Services.Active(profiles...)
+	if len(services) > 0 {
+		out.WriteString("\nServices:\n")
+		for _, svc := range services {
+			fmt.Fprintf(out, "- %s (%s)", svc.Name, svc.Image)
+			if len(svc.ExposedPorts) > 0 {
+				endpoints := make([]string, len(svc.ExposedPorts))
+				for i, port := range svc.ExposedPorts {
+					endpoints[i] = fmt.Sprintf("%s:%d", svc.Name, port)
+				}
+				fmt.Fprintf(out, " at %s", strings.Join(endpoints, ", "))
+			}
+			out.WriteString("\n")
+		}
+	}
+
+	if c.ScratchDir != "" {
+		fmt.Fprintf(out, "\nUse %s for temporary files, it isn't part of the project.\n", path.Clean(c.ScratchDir))
+	}
+	return out.String()
+}
@@ -0,0 +1,90 @@
+package environment
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeWorkdir lists and reads files from a map, recording what was read.
+func fakeWorkdir(files map[string]string) ([]string, func(string) (string, bool), *[]string) {
+	var reads []string
+	return slices.Collect(maps.Keys(files)), func(name string) (string, bool) {
+		reads = append(reads, name)
+		contents, ok := files[name]
+		return contents, ok
+	}, &reads
+}
+
+func TestDraftInstructions(t *testing.T) {
+	config := DefaultConfig()
+	config.Runtime = &RuntimeConfig{Name: "go", Version: "1.24"}
+	config.ScratchDir = "/scratch/"
+	config.Services = ServiceConfigs{
+		{Name: "db", Image: "postgres:16", ExposedPorts: []int{5432}},
+		{Name: "debug", Image: "busybox", Profiles: []string{"debug"}},
+	}
+	entries, read, reads := fakeWorkdir(map[string]string{
+		"Makefile":     ".PHONY: build test\nbuild:\n\tgo build ./...\ntest: build\n\tgo test ./...\n%.o: %.c\nVAR := value\ntest:\n",
+		"package.json": `{"scripts": {"lint": "eslint .", "build": "tsc"}}`,
+		"go.mod":       "module example.com/project\n",
+		"README.md":    "# Project\n",
+	})
+
+	want := "The project is in /workdir. Its main runtime is go 1.24.\n" +
+		"\nThis is a Go module (go.mod).\n" +
+		"\nUseful commands:\n" +
+		"- `make build`\n- `make test`\n" +
+		"- `npm install`\n- `npm run build`\n- `npm run lint`\n" +
+		"- `go build ./...`\n- `go test ./...`\n" +
+		"\nServices:\n- db (postgres:16) at db:5432\n" +
+		"\nUse /scratch for temporary files, it isn't part of the project.\n"
+	got := config.draftInstructions(entries, read, nil)
+	if got != want {
+		t.Errorf("draftInstructions() =\n%s\nwant\n%s", got, want)
+	}
+	if !slices.Equal(*reads, []string{"Makefile", "package.json"}) {
+		t.Errorf("read %q, want only the Makefile and package.json", *reads)
+	}
+
+	// The order the workdir lists files in doesn't matter.
+	slices.Reverse(entries)
+	if again := config.draftInstructions(entries, read, nil); again != got {
+		t.Errorf("draftInstructions() isn't deterministic:\n%s\nthen\n%s", got, again)
+	}
+	if withDebug := config.draftInstructions(entries, read, []string{"debug"}); !strings.Contains(withDebug, "- debug (busybox)\n") {
+		t.Errorf("draftInstructions() with the debug profile doesn't list its service:\n%s", withDebug)
+	}
+}
+
+func TestDraftInstructionsMakefileWithoutTargets(t *testing.T) {
+	entries, read, _ := fakeWorkdir(map[string]string{"Makefile": "include common.mk\n"})
+	got := DefaultConfig().draftInstructions(entries, read, nil)
+	if !strings.Contains(got, "- `make`\n") {
+		t.Errorf("draftInstructions() = %q, want it to suggest make", got)
+	}
+
+	config := DefaultConfig()
+	config.ScratchDir = ""
+	entries, read, _ = fakeWorkdir(nil)
+	if got := config.draftInstructions(entries, read, nil); got != "The project is in /workdir.\n" {
+		t.Errorf("draftInstructions() of an empty workdir = %q", got)
+	}
+}
+
+func TestSuggestInstructions(t *testing.T) {
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.SetupCommands = []string{"mkdir -p /workdir && printf 'test:\\n\\ttrue\\n' > /workdir/Makefile"}
+	env := newEngineEnvironment(t, config)
+
+	got, err := env.Config.SuggestInstructions(context.Background(), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "`make test`") {
+		t.Errorf("SuggestInstructions() = %q, want it to mention make test", got)
+	}
+}
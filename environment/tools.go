@@ -0,0 +1,51 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+func validateTool(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("invalid required tool %q", name)
+	}
+	return nil
+}
+
+// CheckTools returns the required tools of the config that can't be found on
+// the PATH of the environment.
+func (env *Environment) CheckTools(ctx context.Context) ([]string, error) {
+	return env.missingTools(ctx, env.container)
+}
+
+func (env *Environment) missingTools(ctx context.Context, container *dagger.Container) ([]string, error) {
+	if len(env.Config.RequiredTools) == 0 {
+		return nil, nil
+	}
+	shell, err := env.resolveShell(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	script := `for tool in "$@"; do command -v "$tool" >/dev/null 2>&1 || echo "$tool"; done`
+	args := append(append(shell, "-c", script, "sh"), env.Config.RequiredTools...)
+	out, err := container.WithExec(args).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for required tools: %w", err)
+	}
+	return strings.Fields(out), nil
+}
+
+// checkRequiredTools fails when required tools are missing from container.
+func (env *Environment) checkRequiredTools(ctx context.Context, container *dagger.Container) error {
+	missing, err := env.missingTools(ctx, container)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required tools not found: %s (add them to packages or setup_commands)", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package environment
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateRequiredTools(t *testing.T) {
+	for tool, ok := range map[string]bool{
+		"git":         true,
+		"python3.12":  true,
+		"":            false,
+		"git make":    false,
+		"make\tcmake": false,
+		"curl\nwget":  false,
+	} {
+		config := DefaultConfig()
+		config.RequiredTools = []string{tool}
+		if err := config.Validate(); (err == nil) != ok {
+			t.Errorf("Validate() with required tool %q = %v, want ok %v", tool, err, ok)
+		}
+	}
+}
+
+func TestCheckToolsWithoutRequiredTools(t *testing.T) {
+	// Nothing to look for, so the container is never used.
+	env := &Environment{Config: DefaultConfig()}
+	if missing, err := env.CheckTools(context.Background()); missing != nil || err != nil {
+		t.Errorf("CheckTools() = %q, %v, want nothing missing", missing, err)
+	}
+}
+
+func TestRequiredTools(t *testing.T) {
+	ctx := context.Background()
+	requireEngine(t)
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.RequiredTools = []string{"sh", "make", "git"}
+	if _, err := CreateEphemeral(ctx, "", "test", config); err == nil || !strings.Contains(err.Error(), "make, git") {
+		t.Errorf("CreateEphemeral() from a base without make and git = %v, want them reported", err)
+	}
+
+	config.RequiredTools = []string{"sh", "ls"}
+	env := newEngineEnvironment(t, config)
+	env.Config.RequiredTools = append(env.Config.RequiredTools, "make")
+	missing, err := env.CheckTools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(missing, []string{"make"}) {
+		t.Errorf("CheckTools() = %q, want make", missing)
+	}
+}
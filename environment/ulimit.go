@@ -0,0 +1,72 @@
+package environment
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Ulimit is a resource limit, keyed in configs by its name (nofile, nproc...).
+//
+// Dagger has no API for container ulimits, so limits are applied with the
+// ulimit shell builtin before commands the environment runs through a shell:
+// setup commands, Run and RunBackground commands, and service commands. They
+// don't apply to commands run with the image entrypoint or to services
+// relying on the default command of their image. Raising a hard limit needs
+// root in the container, and nproc needs a shell supporting ulimit -u, like
+// bash or busybox.
+type Ulimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+var ulimitFlags = map[string]string{
+	"core":    "-c",
+	"cpu":     "-t",
+	"fsize":   "-f",
+	"memlock": "-l",
+	"nofile":  "-n",
+	"nproc":   "-u",
+	"stack":   "-s",
+}
+
+func validateUlimits(limits map[string]Ulimit) error {
+	for _, name := range slices.Sorted(maps.Keys(limits)) {
+		limit := limits[name]
+		if _, ok := ulimitFlags[name]; !ok {
+			return fmt.Errorf("unknown ulimit %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(ulimitFlags)), ", "))
+		}
+		if limit.Soft < 0 || limit.Hard < 0 {
+			return fmt.Errorf("ulimit %s cannot be negative", name)
+		}
+		if limit.Soft > limit.Hard {
+			return fmt.Errorf("ulimit %s: soft limit %d is greater than hard limit %d", name, limit.Soft, limit.Hard)
+		}
+	}
+	return nil
+}
+
+// withUlimits prefixes a shell script with the commands setting limits.
+func withUlimits(limits map[string]Ulimit, script string) string {
+	if len(limits) == 0 {
+		return script
+	}
+	prefix := &strings.Builder{}
+	for _, name := range slices.Sorted(maps.Keys(limits)) {
+		flag, limit := ulimitFlags[name], limits[name]
+		// Lowering the soft limit first lets the hard limit go below the
+		// current soft limit.
+		fmt.Fprintf(prefix, "ulimit -S %s %d 2>/dev/null; ulimit -H %s %d && ulimit -S %s %d || exit 1\n",
+			flag, limit.Soft, flag, limit.Hard, flag, limit.Soft)
+	}
+	return prefix.String() + script
+}
+
+// argsWithUlimits wraps args so that they run with limits applied, by shell.
+func argsWithUlimits(limits map[string]Ulimit, shell, args []string) []string {
+	if len(limits) == 0 || len(args) == 0 {
+		return args
+	}
+	return slices.Concat(shell, []string{"-c", withUlimits(limits, `exec "$@"`), "sh"}, args)
+}
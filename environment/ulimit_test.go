@@ -0,0 +1,47 @@
+package environment
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestValidateUlimits(t *testing.T) {
+	for _, tt := range []struct {
+		limits map[string]Ulimit
+		ok     bool
+	}{
+		{nil, true},
+		{map[string]Ulimit{"nofile": {Soft: 1024, Hard: 4096}, "nproc": {Soft: 64, Hard: 64}}, true},
+		{map[string]Ulimit{"nofile": {Soft: 4096, Hard: 1024}}, false},
+		{map[string]Ulimit{"nofile": {Soft: -1, Hard: 1024}}, false},
+		{map[string]Ulimit{"files": {Soft: 1, Hard: 1}}, false},
+	} {
+		if err := validateUlimits(tt.limits); (err == nil) != tt.ok {
+			t.Errorf("validateUlimits(%v) = %v, want ok %v", tt.limits, err, tt.ok)
+		}
+	}
+}
+
+func TestUlimitsApplied(t *testing.T) {
+	requireShell(t)
+	limits := map[string]Ulimit{"nofile": {Soft: 64, Hard: 128}}
+
+	out, err := exec.Command("sh", "-c", withUlimits(limits, "ulimit -Sn; ulimit -Hn")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(out)); len(got) != 2 || got[0] != "64" || got[1] != "128" {
+		t.Errorf("limits in the script = %q, want 64 and 128", out)
+	}
+
+	args := argsWithUlimits(limits, []string{"sh"}, []string{"sh", "-c", "ulimit -Sn"})
+	out, err = exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "64" {
+		t.Errorf("limit of the wrapped command = %q, want 64", got)
+	}
+
+}
@@ -0,0 +1,57 @@
+package environment
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+var userPattern = regexp.MustCompile(`^([a-z_][a-z0-9_-]*\$?|[0-9]+)(:([a-z_][a-z0-9_-]*|[0-9]+))?$`)
+
+// validateUser accepts user, uid, user:group and uid:gid.
+func validateUser(user string) error {
+	if user != "" && !userPattern.MatchString(user) {
+		return fmt.Errorf("invalid user %q, expected user, uid, user:group or uid:gid", user)
+	}
+	return nil
+}
+
+// validateSetupUsers checks that users are set for setup commands of the
+// config and are valid.
+func validateSetupUsers(users map[string]string, commands []string) error {
+	for _, command := range slices.Sorted(maps.Keys(users)) {
+		if !slices.Contains(commands, command) {
+			return fmt.Errorf("user for unknown setup command %q", command)
+		}
+		if users[command] == "" {
+			return fmt.Errorf("empty user for setup command %q", command)
+		}
+		if err := validateUser(users[command]); err != nil {
+			return fmt.Errorf("setup command %q: %w", command, err)
+		}
+	}
+	return nil
+}
+
+// withSetupUser switches container to root for setup when the config runs as
+// another user.
+func (env *Environment) withSetupUser(container *dagger.Container) *dagger.Container {
+	if env.Config.RunAsUser == "" {
+		return container
+	}
+	return container.WithUser("0")
+}
+
+// withRunAsUser hands the workdir over to the configured user and switches to
+// it.
+func (env *Environment) withRunAsUser(container *dagger.Container) *dagger.Container {
+	if env.Config.RunAsUser == "" {
+		return container
+	}
+	return container.
+		WithExec([]string{"chown", "-R", env.Config.RunAsUser, env.Config.Workdir}).
+		WithUser(env.Config.RunAsUser)
+}
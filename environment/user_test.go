@@ -0,0 +1,85 @@
+package environment
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateUser(t *testing.T) {
+	for user, ok := range map[string]bool{
+		"":             true,
+		"dev":          true,
+		"1000":         true,
+		"dev:staff":    true,
+		"1000:1000":    true,
+		"build-bot_2":  true,
+		"machine$":     true,
+		"Dev":          false,
+		"dev:":         false,
+		":staff":       false,
+		"dev user":     false,
+		"dev;id":       false,
+		"1000:1000:10": false,
+	} {
+		if err := validateUser(user); (err == nil) != ok {
+			t.Errorf("validateUser(%q) = %v, want ok %v", user, err, ok)
+		}
+	}
+}
+
+func TestValidateSetupUsers(t *testing.T) {
+	commands := []string{"apk add git", "npm ci"}
+	for _, tt := range []struct {
+		users map[string]string
+		ok    bool
+	}{
+		{nil, true},
+		{map[string]string{"npm ci": "node"}, true},
+		{map[string]string{"npm install": "node"}, false},
+		{map[string]string{"npm ci": ""}, false},
+		{map[string]string{"npm ci": "No Body"}, false},
+	} {
+		if err := validateSetupUsers(tt.users, commands); (err == nil) != tt.ok {
+			t.Errorf("validateSetupUsers(%v) = %v, want ok %v", tt.users, err, tt.ok)
+		}
+	}
+
+	config := DefaultConfig()
+	config.RunAsUser = "dev user"
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() accepted an invalid run_as_user")
+	}
+}
+
+func TestSetupLayersSplitOnUser(t *testing.T) {
+	commands := []string{"apk add git", "apk add make", "npm ci", "npm run build", "apk add curl"}
+	users := map[string]string{"npm ci": "node", "npm run build": "node"}
+	want := [][]string{
+		{"apk add git", "apk add make"},
+		{"npm ci", "npm run build"},
+		{"apk add curl"},
+	}
+	if got := setupLayers(commands, SetupCombined, users); !reflect.DeepEqual(got, want) {
+		t.Errorf("setupLayers() = %q, want %q", got, want)
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.BaseImage = alpineImage
+	config.RunAsUser = "guest"
+	config.SetupCommands = []string{"id -un > /tmp/setup-user", "id -un > /tmp/step-user"}
+	config.SetupUsers = map[string]string{"id -un > /tmp/step-user": "nobody"}
+	env := newEngineEnvironment(t, config)
+
+	out, err := env.Run(ctx, "check", "cat /tmp/setup-user /tmp/step-user; id -un; stat -c %U "+config.Workdir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(out), []string{"root", "nobody", "guest", "guest"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("users = %q, want setup as root, the step as its user and the environment as run_as_user owning the workdir", got)
+	}
+}
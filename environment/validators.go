@@ -0,0 +1,38 @@
+package environment
+
+import (
+	"errors"
+	"sync"
+)
+
+// ConfigValidator enforces a policy on configs, e.g. an approved registry for
+// base images, on top of the built-in checks.
+type ConfigValidator func(config *EnvironmentConfig) error
+
+var (
+	configValidatorsMu sync.RWMutex
+	configValidators   []ConfigValidator
+)
+
+// RegisterConfigValidator adds fn to the validators run by Validate once the
+// built-in checks pass. Validators run in registration order, and all of them
+// run: their errors are combined.
+func RegisterConfigValidator(fn ConfigValidator) {
+	configValidatorsMu.Lock()
+	defer configValidatorsMu.Unlock()
+	configValidators = append(configValidators, fn)
+}
+
+func runConfigValidators(config *EnvironmentConfig) error {
+	configValidatorsMu.RLock()
+	validators := configValidators
+	configValidatorsMu.RUnlock()
+
+	var errs []error
+	for _, validate := range validators {
+		if err := validate(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
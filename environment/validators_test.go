@@ -0,0 +1,70 @@
+package environment
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// registerConfigValidator registers fn for the duration of the test.
+func registerConfigValidator(t *testing.T, fn ConfigValidator) {
+	configValidatorsMu.Lock()
+	orig := slices.Clone(configValidators)
+	configValidatorsMu.Unlock()
+	t.Cleanup(func() {
+		configValidatorsMu.Lock()
+		configValidators = orig
+		configValidatorsMu.Unlock()
+	})
+	RegisterConfigValidator(fn)
+}
+
+func TestConfigValidators(t *testing.T) {
+	var ran []string
+	registerConfigValidator(t, func(config *EnvironmentConfig) error {
+		ran = append(ran, "registry")
+		if !strings.HasPrefix(config.BaseImage, "registry.example.com/") {
+			return errors.New("base image must come from registry.example.com")
+		}
+		return nil
+	})
+	registerConfigValidator(t, func(config *EnvironmentConfig) error {
+		ran = append(ran, "limits")
+		if len(config.Ulimits) == 0 {
+			return errors.New("resource limits are required")
+		}
+		return nil
+	})
+
+	config := DefaultConfig()
+	config.BaseImage = "registry.example.com/base:1"
+	config.Ulimits = map[string]Ulimit{"nofile": {Soft: 1024, Hard: 4096}}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() of an allowed config = %v", err)
+	}
+	if !slices.Equal(ran, []string{"registry", "limits"}) {
+		t.Errorf("validators ran in order %q, want registration order", ran)
+	}
+
+	ran = nil
+	config.BaseImage = "docker.io/library/alpine:3"
+	config.Ulimits = nil
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "registry.example.com") || !strings.Contains(err.Error(), "resource limits") {
+		t.Errorf("Validate() = %v, want both violations", err)
+	}
+	if !slices.Equal(ran, []string{"registry", "limits"}) {
+		t.Errorf("validators ran %q, want all of them", ran)
+	}
+
+	// Validators only see configs passing the built-in checks.
+	ran = nil
+	config.SetupLogMode = "sometimes"
+	if err := config.Validate(); err == nil || strings.Contains(err.Error(), "registry") {
+		t.Errorf("Validate() of an invalid config = %v, want only the built-in error", err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("validators ran %q on an invalid config", ran)
+	}
+}
@@ -0,0 +1,105 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// WorkdirPolicy controls what happens to the content the base image already
+// has in the workdir. "preserve", the default, keeps it. "clean" empties the
+// workdir before anything else runs. "error-on-conflict" keeps it but fails
+// the build if a provisioned file or a file of the source would overwrite a
+// file of the image.
+//
+// The source isn't mounted: it is copied over the workdir at the end of the
+// build, after setup, so with "preserve" it wins over the image file by file,
+// and image files it doesn't have are still there.
+type WorkdirPolicy string
+
+const (
+	WorkdirPreserve        WorkdirPolicy = "preserve"
+	WorkdirClean           WorkdirPolicy = "clean"
+	WorkdirErrorOnConflict WorkdirPolicy = "error-on-conflict"
+)
+
+func (p WorkdirPolicy) Validate() error {
+	switch p {
+	case "", WorkdirPreserve, WorkdirClean, WorkdirErrorOnConflict:
+		return nil
+	default:
+		return fmt.Errorf("invalid workdir policy %q, expected one of %s, %s or %s", p, WorkdirPreserve, WorkdirClean, WorkdirErrorOnConflict)
+	}
+}
+
+// withWorkdirPolicy applies the workdir policy to the base image container.
+func (env *Environment) withWorkdirPolicy(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	workdir := env.Config.Workdir
+	switch env.Config.WorkdirPolicy {
+	case WorkdirClean:
+		return container.
+			WithoutDirectory(workdir).
+			WithDirectory(workdir, dag.Directory()), nil
+	case WorkdirErrorOnConflict:
+		existing, err := container.Directory(workdir).Glob(ctx, "**")
+		if err != nil {
+			// The image has no workdir, so nothing to conflict with.
+			return container, nil
+		}
+		incoming, err := env.incomingWorkdirFiles()
+		if err != nil {
+			return nil, err
+		}
+		conflicts := []string{}
+		for _, p := range existing {
+			if p = strings.TrimSuffix(p, "/"); slices.Contains(incoming, p) {
+				conflicts = append(conflicts, path.Join(workdir, p))
+			}
+		}
+		if len(conflicts) > 0 {
+			slices.Sort(conflicts)
+			return nil, fmt.Errorf("workdir policy %s: the base image already has %s", WorkdirErrorOnConflict, strings.Join(conflicts, ", "))
+		}
+	}
+	return container, nil
+}
+
+// incomingWorkdirFiles returns the paths, relative to the workdir, of the
+// provisioned files and source files the build writes to the workdir.
+func (env *Environment) incomingWorkdirFiles() ([]string, error) {
+	files := []string{}
+	for _, f := range env.Config.Files {
+		if rel, ok := strings.CutPrefix(path.Clean(f.Path), path.Clean(env.Config.Workdir)+"/"); ok {
+			files = append(files, rel)
+		}
+	}
+	if env.Worktree == "" {
+		return files, nil
+	}
+	err := filepath.WalkDir(env.Worktree, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() {
+			rel, err := filepath.Rel(env.Worktree, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source files: %w", err)
+	}
+	return files, nil
+}
@@ -0,0 +1,101 @@
+package environment
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWorkdirPolicyValidate(t *testing.T) {
+	for _, policy := range []WorkdirPolicy{"", WorkdirPreserve, WorkdirClean, WorkdirErrorOnConflict} {
+		if err := policy.Validate(); err != nil {
+			t.Errorf("WorkdirPolicy(%q).Validate() = %v", policy, err)
+		}
+	}
+	config := DefaultConfig()
+	config.WorkdirPolicy = "merge"
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() accepted an unknown workdir policy")
+	}
+}
+
+func TestIncomingWorkdirFiles(t *testing.T) {
+	worktree := t.TempDir()
+	writeFiles(t, worktree, map[string]string{
+		"main.go":         "package main",
+		"cmd/tool/run.go": "package main",
+		".git/HEAD":       "ref: refs/heads/main",
+	})
+	config := DefaultConfig()
+	config.Files = []FileProvision{
+		{Path: "/workdir/.env", Content: "A=1"},
+		{Path: "/workdir/conf/../settings.json", Content: "{}"},
+		{Path: "/etc/app.conf", Content: ""},
+		{Path: "/workdirectory/other", Content: ""},
+	}
+	env := &Environment{Config: config, Worktree: worktree}
+
+	got, err := env.incomingWorkdirFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	if want := []string{".env", "cmd/tool/run.go", "main.go", "settings.json"}; !slices.Equal(got, want) {
+		t.Errorf("incomingWorkdirFiles() = %q, want %q", got, want)
+	}
+
+	env.Worktree = filepath.Join(worktree, "missing")
+	if _, err := env.incomingWorkdirFiles(); err == nil {
+		t.Error("incomingWorkdirFiles() of a missing worktree succeeded")
+	}
+}
+
+func TestWorkdirPolicy(t *testing.T) {
+	ctx := context.Background()
+	// The workdir of the base image already has arch and world.
+	newConfig := func(policy WorkdirPolicy) *EnvironmentConfig {
+		config := DefaultConfig()
+		config.BaseImage = alpineImage
+		config.Workdir = "/etc/apk"
+		config.WorkdirPolicy = policy
+		config.Files = []FileProvision{{Path: "/etc/apk/world", Content: "provisioned"}}
+		return config
+	}
+
+	for _, tt := range []struct {
+		policy WorkdirPolicy
+		want   string
+	}{
+		{"", "arch provisioned"},
+		{WorkdirPreserve, "arch provisioned"},
+		{WorkdirClean, "provisioned"},
+	} {
+		env := newEngineEnvironment(t, newConfig(tt.policy))
+		out, err := env.Run(ctx, "list", "if test -e arch; then echo arch; fi; cat world", "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(strings.Fields(out), " "); got != tt.want {
+			t.Errorf("workdir with policy %q = %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+
+	requireEngine(t)
+	env, err := CreateEphemeral(ctx, "", "test", newConfig(WorkdirErrorOnConflict))
+	if err == nil {
+		_ = env.Close(ctx)
+		t.Fatal("CreateEphemeral() overwrote a file of the image with policy error-on-conflict")
+	}
+	if !strings.Contains(err.Error(), "/etc/apk/world") {
+		t.Errorf("CreateEphemeral() = %v, want the conflicting file named", err)
+	}
+
+	config := newConfig(WorkdirErrorOnConflict)
+	config.Files[0].Path = "/etc/apk/new"
+	env = newEngineEnvironment(t, config)
+	if out, err := env.Run(ctx, "list", "cat arch >/dev/null && cat new", "", false); err != nil || out != "provisioned" {
+		t.Errorf("workdir without conflict = %q, %v, want the image files and the provisioned one", out, err)
+	}
+}
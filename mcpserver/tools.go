@@ -137,7 +137,7 @@ type EnvironmentResponse struct {
 func marshalEnvironment(env *environment.Environment) (string, error) {
 	resp := &EnvironmentResponse{
 		ID:               env.ID,
-		Instructions:     env.Config.Instructions,
+		Instructions:     env.Instructions(),
 		BaseImage:        env.Config.BaseImage,
 		SetupCommands:    env.Config.SetupCommands,
 		Workdir:          env.Config.Workdir,
@@ -269,6 +269,7 @@ Supported schemas are:
 			return nil, err
 		}
 		config.BaseImage = baseImage
+		config.BaseBuild = nil
 
 		setupCommands, err := request.RequireStringSlice("setup_commands")
 		if err != nil {
@@ -517,6 +518,9 @@ Background commands are unaffected by filesystem and any other kind of changes.
 		}
 
 		stdout, err := env.Run(ctx, request.GetString("explanation", ""), command, shell, request.GetBool("use_entrypoint", false))
+		if errors.Is(err, context.DeadlineExceeded) {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to run command: %s\n\n%s", err, stdout)), nil
+		}
 		if err != nil {
 			return mcp.NewToolResultErrorFromErr("failed to run command", err), nil
 		}
@@ -975,7 +979,11 @@ var EnvironmentAddServiceTool = &Tool{
 			mcp.Required(),
 		),
 		mcp.WithString("command",
-			mcp.Description("The command to start the service. If not provided the image default command will be used."),
+			mcp.Description("The command to start the service, interpreted by `sh`. If not provided the image default command will be used."),
+		),
+		mcp.WithArray("command_args",
+			mcp.Description("The command to start the service as an argument list, executed without a shell (e.g. `[\"redis-server\", \"--port\", \"6380\"]`). Cannot be combined with `command`."),
+			mcp.Items(map[string]any{"type": "string"}),
 		),
 		mcp.WithArray("ports",
 			mcp.Description("Ports to expose. For each port, returns the internal (for use by other environments) and external (for use by the user) address."),
@@ -1016,6 +1024,7 @@ Supported schemas are:
 			return nil, err
 		}
 		command := request.GetString("command", "")
+		commandArgs := request.GetStringSlice("command_args", []string{})
 		ports := []int{}
 		if portList, ok := request.GetArguments()["ports"].([]any); ok {
 			for _, port := range portList {
@@ -1030,6 +1039,7 @@ Supported schemas are:
 			Name:         serviceName,
 			Image:        image,
 			Command:      command,
+			CommandArgs:  commandArgs,
 			ExposedPorts: ports,
 			Env:          envs,
 			Secrets:      secrets,